@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/service"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+func admin(args []string) {
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, "usage: gophermart admin create-user|set-role|requeue-order|merge-users [flags]\n")
+		os.Exit(2)
+	}
+
+	command := "admin " + args[1]
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_URI"), "database connection string")
+
+	switch args[1] {
+	case "create-user":
+		login := fs.String("login", "", "user login")
+		merchant := fs.String("merchant", "", "merchant id, the default merchant if empty")
+		role := fs.String("role", storage.RoleUser, "user role: user, support or admin")
+		fs.Parse(args[2:])
+
+		merchantID := storage.DefaultMerchantID
+		if len(*merchant) != 0 {
+			var err error
+			if merchantID, err = uuid.Parse(*merchant); err != nil {
+				fail(command, err)
+			}
+		}
+		if len(*login) == 0 {
+			fail(command, fmt.Errorf("-login is required"))
+		}
+		if !storage.ValidRole(*role) {
+			fail(command, fmt.Errorf("unknown role %q", *role))
+		}
+
+		// The password is read from stdin so it doesn't end up in the
+		// shell history or the process list.
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(password) == 0 {
+			fail(command, fmt.Errorf("failed to read password from stdin: %w", err))
+		}
+
+		st := openStorage(command, *dsn)
+		users := service.NewUserService(st, validate.DefaultPasswordPolicy())
+		user, err := users.CreateUser(context.Background(), merchantID, *login, strings.TrimRight(password, "\r\n"), *role)
+		if err != nil {
+			fail(command, err)
+		}
+		fmt.Println(user.ID)
+	case "set-role":
+		user := fs.String("user", "", "user id")
+		role := fs.String("role", "", "user role: user, support or admin")
+		fs.Parse(args[2:])
+
+		userID, err := uuid.Parse(*user)
+		if err != nil {
+			fail(command, fmt.Errorf("-user must be a user id: %w", err))
+		}
+		if !storage.ValidRole(*role) {
+			fail(command, fmt.Errorf("unknown role %q", *role))
+		}
+
+		st := openStorage(command, *dsn)
+		if err := st.SetUserRole(context.Background(), userID, *role); err != nil {
+			fail(command, err)
+		}
+	case "requeue-order":
+		order := fs.String("order", "", "order number")
+		fs.Parse(args[2:])
+
+		if len(*order) == 0 {
+			fail(command, fmt.Errorf("-order is required"))
+		}
+
+		st := openStorage(command, *dsn)
+		if err := st.RequeueOrder(context.Background(), *order); err != nil {
+			fail(command, err)
+		}
+	case "merge-users":
+		source := fs.String("source", "", "id of the user to merge, deleted afterwards")
+		target := fs.String("target", "", "id of the user to merge into")
+		reason := fs.String("reason", "", "why the users are merged")
+		operator := fs.String("operator", os.Getenv("USER"), "who merges the users")
+		fs.Parse(args[2:])
+
+		sourceID, err := uuid.Parse(*source)
+		if err != nil {
+			fail(command, fmt.Errorf("-source must be a user id: %w", err))
+		}
+		targetID, err := uuid.Parse(*target)
+		if err != nil {
+			fail(command, fmt.Errorf("-target must be a user id: %w", err))
+		}
+		if len(*reason) == 0 || len(*operator) == 0 {
+			fail(command, fmt.Errorf("-reason and -operator are required"))
+		}
+
+		st := openStorage(command, *dsn)
+		merge, err := st.MergeUsers(context.Background(), storage.AccountMerge{
+			SourceUserID: sourceID,
+			TargetUserID: targetID,
+			Reason:       *reason,
+			Operator:     *operator,
+		})
+		if err != nil {
+			fail(command, err)
+		}
+		fmt.Printf("merge %s: %d orders, %d withdrawals, %d dropped idempotency keys, balance %s, withdrawn %s\n",
+			merge.ID, merge.Orders, merge.Withdrawals, merge.DroppedIdempotencyKeys, merge.Current, merge.Withdrawn)
+	default:
+		fail("admin", fmt.Errorf("unknown command %q", args[1]))
+	}
+}
+
+func openStorage(command, dsn string) storage.AppStorage {
+	ctx := context.Background()
+	if storage.IsSQLiteDSN(dsn) {
+		db, err := storage.OpenSQLite(ctx, dsn, zap.NewNop())
+		if err != nil {
+			fail(command, err)
+		}
+		st, err := storage.NewSQLiteStorage(ctx, db, zap.NewNop(), storage.Options{})
+		if err != nil {
+			fail(command, err)
+		}
+		return st
+	}
+
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		fail(command, err)
+	}
+
+	retryConfig, err := storage.ParseRetryConfig("")
+	if err != nil {
+		fail(command, err)
+	}
+
+	st, err := storage.NewDatabaseStorage(ctx, pool, zap.NewNop(), storage.Options{Retry: retryConfig})
+	if err != nil {
+		fail(command, err)
+	}
+	return st
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrualmock"
+	"github.com/real-splendid/gophermart-practicum/internal/e2e"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+// e2eStartTimeout bounds how long the local service may take to answer its
+// health check.
+const e2eStartTimeout = 30 * time.Second
+
+// runE2E walks a user through the journey. Without -url it starts the service
+// itself, on SQLite or the -d database, with a mock accrual system.
+func runE2E(args []string) {
+	fs := flag.NewFlagSet("e2e", flag.ExitOnError)
+	baseURL := fs.String("url", "", "gophermart base URL; empty starts a local service")
+	dsn := fs.String("d", "", "database for the local service, already migrated if Postgres; empty uses a temporary SQLite file")
+	timeout := fs.Duration("timeout", e2e.DefaultTimeout, "time limit for the journey")
+	poll := fs.Duration("poll-interval", e2e.DefaultPollInterval, "how often to check the order status")
+	withdrawal := fs.Float64("withdraw", e2e.DefaultWithdrawal.Float64(), "points to withdraw")
+	verbose := fs.Bool("v", false, "print the local service's output")
+	fs.Parse(args[1:])
+
+	stop := func() {}
+	if len(*baseURL) == 0 {
+		url, stopService, err := startLocalService(*dsn, *verbose)
+		if err != nil {
+			fail("e2e", err)
+		}
+		*baseURL, stop = url, stopService
+	}
+
+	report, err := e2e.Run(context.Background(), e2e.Config{
+		BaseURL:      *baseURL,
+		Timeout:      *timeout,
+		PollInterval: *poll,
+		Withdrawal:   money.FromFloat(*withdrawal),
+	})
+	stop()
+
+	fmt.Printf("user %s, order %s\n", report.Login, report.Order)
+	for _, s := range report.Steps {
+		fmt.Printf("ok   %-15s %s\n", s.Name, s.Duration.Round(time.Millisecond))
+	}
+	if err != nil {
+		fmt.Printf("FAIL %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// startLocalService runs the mock accrual system in-process and this binary's
+// serve command as a child, and waits until the service is healthy.
+func startLocalService(dsn string, verbose bool) (string, func(), error) {
+	mock, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	go http.Serve(mock, accrualmock.NewServer(accrualmock.Scenario{
+		ProcessingPolls: accrualmock.DefaultProcessingPolls,
+		Accrual:         accrualmock.DefaultAccrual,
+	}).Handler())
+
+	var tempDir string
+	if len(dsn) == 0 {
+		if tempDir, err = os.MkdirTemp("", "gophermart-e2e"); err != nil {
+			mock.Close()
+			return "", nil, err
+		}
+		dsn = "sqlite://" + filepath.Join(tempDir, "gophermart.db")
+	}
+	cleanup := func() {
+		mock.Close()
+		if len(tempDir) != 0 {
+			os.RemoveAll(tempDir)
+		}
+	}
+
+	addr, err := freeAddr()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	cmd := exec.Command(self, "serve",
+		"-a", addr,
+		"-d", dsn,
+		"-r", "http://"+mock.Addr().String(),
+		"-accrual-poll-interval", "100ms",
+	)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if verbose {
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	stop := func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		cmd.Wait()
+		cleanup()
+	}
+
+	url := "http://" + addr
+	if err := waitHealthy(url, e2eStartTimeout); err != nil {
+		stop()
+		io.Copy(os.Stderr, &output)
+		return "", nil, err
+	}
+	return url, stop, nil
+}
+
+// freeAddr returns a loopback address nothing is listening on right now.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func waitHealthy(url string, timeout time.Duration) error {
+	client := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := client.Get(url + "/api/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service at %s is not healthy after %s", url, timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
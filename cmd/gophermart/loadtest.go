@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/loadtest"
+)
+
+// runLoadTest runs register, upload, poll and withdraw scenarios against a
+// running service and prints the latency of each step.
+func runLoadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	cfg := loadtest.Config{}
+	fs.StringVar(&cfg.BaseURL, "url", "http://localhost:8080", "gophermart base URL")
+	fs.IntVar(&cfg.RPS, "rps", 10, "scenarios started per second")
+	fs.DurationVar(&cfg.Duration, "duration", 30*time.Second, "test duration")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 0, "max concurrent scenarios (defaults to rps)")
+	fs.Parse(args[1:])
+
+	report, err := loadtest.Run(context.Background(), cfg)
+	if err != nil {
+		fail("loadtest", err)
+	}
+
+	fmt.Printf("scenarios: %d\n", report.Scenarios)
+	fmt.Printf("%-10s %8s %8s %10s %10s %10s %10s\n", "step", "requests", "errors", "p50", "p90", "p99", "max")
+	for _, s := range report.Steps {
+		fmt.Printf("%-10s %8d %8d %10s %10s %10s %10s\n", s.Name, s.Requests, s.Errors, s.P50, s.P90, s.P99, s.Max)
+	}
+}
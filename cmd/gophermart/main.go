@@ -1,74 +1,82 @@
 package main
 
 import (
-	"context"
-	"flag"
 	"fmt"
 	"os"
+	"strings"
 
-	"github.com/jackc/pgx/v4/pgxpool"
-	"go.uber.org/zap"
-
-	"github.com/real-splendid/gophermart-practicum/internal/accrual"
-	"github.com/real-splendid/gophermart-practicum/internal/app"
-	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/internal/buildinfo"
 )
 
-type config struct {
-	ServerAddress            string
-	AccrualSystemAddress     string
-	DatabaseConnectionString string
-}
+const usage = `usage: gophermart [command] [flags]
+
+commands:
+  serve                  run the service (default)
+  migrate up|down|status apply or inspect database migrations
+  migrate plan|expand-target|contract-target
+                         plan a zero-downtime Postgres migration
+  admin create-user      create a user
+  admin set-role         change the role of a user
+  admin requeue-order    send an order back to accrual processing
+  mock-accrual           serve a scripted accrual system API
+  e2e                    run the user journey against a service
+  seed                   generate users, orders and withdrawals
+  loadtest               load a running service and report latencies
+  version, -version      print the build version
+`
 
 func main() {
-	cfg := config{
-		ServerAddress: ":8080",
-	}
-
-	flag.StringVar(&cfg.ServerAddress, "a", os.Getenv("RUN_ADDRESS"), "")
-	flag.StringVar(&cfg.AccrualSystemAddress, "r", os.Getenv("ACCRUAL_SYSTEM_ADDRESS"), "")
-	flag.StringVar(&cfg.DatabaseConnectionString, "d", os.Getenv("DATABASE_URI"), "")
-
-	flag.Parse()
-
-	logger, err := zap.NewProduction()
-	if err != nil {
-		fmt.Printf("failed to initialize logger: %+v", err)
-		os.Exit(1)
+	if len(os.Args) == 2 && (os.Args[1] == "-version" || os.Args[1] == "--version") {
+		printVersion()
+		return
 	}
-	defer logger.Sync()
 
-	if len(cfg.DatabaseConnectionString) == 0 {
-		logger.Fatal("Empty database connection string")
+	// Without a command, or with flags only, the service starts as before
+	// subcommands existed.
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		serve(os.Args)
+		return
 	}
 
-	dbConn, err := pgxpool.Connect(context.Background(), cfg.DatabaseConnectionString)
-	if err != nil {
-		logger.Fatal("Failed to connect to database", zap.Error(err))
+	command, args := os.Args[1], append([]string{os.Args[0]}, os.Args[2:]...)
+	switch command {
+	case "serve":
+		serve(args)
+	case "migrate":
+		migrate(args)
+	case "admin":
+		admin(args)
+	case "mock-accrual":
+		mockAccrual(args)
+	case "e2e":
+		runE2E(args)
+	case "seed":
+		seedData(args)
+	case "loadtest":
+		runLoadTest(args)
+	case "version":
+		printVersion()
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
-	defer dbConn.Close()
-
-	storageCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+}
 
-	storage, err := storage.NewDatabaseStorage(storageCtx, dbConn, logger)
-	if err != nil {
-		logger.Fatal("Failed to initialize storage", zap.Error(err))
+func printVersion() {
+	info := buildinfo.Get()
+	fmt.Println("gophermart", info.Version)
+	if info.Commit != "" {
+		fmt.Println("commit", info.Commit)
 	}
-
-	serverCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	updaterCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	accCfg := accrual.Config{
-		BaseAddr:   cfg.AccrualSystemAddress,
-		Logger:     logger,
-		AppStorage: storage,
+	if info.Date != "" {
+		fmt.Println("built", info.Date)
 	}
-	accrual := accrual.NewAccrual(updaterCtx, accCfg)
-	defer accrual.Stop()
+	fmt.Println("go", info.GoVersion)
+}
 
-	app.Run(serverCtx, cfg.ServerAddress, logger, storage)
+func fail(command string, err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+	os.Exit(1)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+
+	"github.com/real-splendid/gophermart-practicum/internal/schema"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+// migrate applies the goose migrations. For zero-downtime rollouts on
+// Postgres, plan, expand-target and contract-target pick the versions to
+// migrate up to before and after the new binaries are out.
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_URI"), "database connection string")
+	dir := fs.String("dir", "migrations", "migrations directory")
+	staleAfter := fs.Duration("stale-after", 2*time.Minute, "ignore instances not seen for this long in contract-target")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gophermart migrate [flags] up|down|status|plan|expand-target|contract-target")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch fs.Arg(0) {
+	case "plan", "expand-target", "contract-target":
+		if storage.IsSQLiteDSN(*dsn) {
+			fail("migrate", fmt.Errorf("%s needs Postgres: SQLite is migrated on startup", fs.Arg(0)))
+		}
+		planMigrations(fs.Arg(0), *dsn, *dir, *staleAfter)
+		return
+	}
+
+	driver, dialect := "pgx", "postgres"
+	if storage.IsSQLiteDSN(*dsn) {
+		// The SQLite schema has its own migrations, built into the binary.
+		driver, dialect = "sqlite", "sqlite3"
+		*dsn = storage.SQLiteDriverDSN(*dsn)
+		*dir = "."
+		goose.SetBaseFS(storage.SQLiteMigrations)
+	}
+
+	db, err := sql.Open(driver, *dsn)
+	if err != nil {
+		fail("migrate", err)
+	}
+	defer db.Close()
+
+	if err := goose.SetDialect(dialect); err != nil {
+		fail("migrate", err)
+	}
+
+	switch fs.Arg(0) {
+	case "up":
+		err = goose.Up(db, *dir)
+	case "down":
+		err = goose.Down(db, *dir)
+	case "status":
+		err = goose.Status(db, *dir)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail("migrate", err)
+	}
+}
+
+// planMigrations prints the pending migrations with their phase, or the
+// version the expand or contract step may migrate up to. contract-target
+// fails while an instance that can't run the contract migration is alive.
+func planMigrations(command, dsn, dir string, staleAfter time.Duration) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		fail("migrate", err)
+	}
+	defer pool.Close()
+
+	migrations, err := schema.LoadMigrations(dir)
+	if err != nil {
+		fail("migrate", err)
+	}
+
+	current, err := schema.CurrentVersion(ctx, pool)
+	if err != nil {
+		fail("migrate", err)
+	}
+
+	switch command {
+	case "plan":
+		for _, m := range migrations {
+			if m.Version > current {
+				fmt.Printf("%-9s %s\n", m.Phase, m.Name)
+			}
+		}
+	case "expand-target":
+		fmt.Println(schema.ExpandTarget(migrations, current))
+	case "contract-target":
+		target := current
+		for _, m := range migrations {
+			if m.Version <= current {
+				continue
+			}
+			if m.Phase == schema.PhaseContract {
+				if err := schema.CheckContract(ctx, pool, m.Version, staleAfter); err != nil {
+					fail("migrate", fmt.Errorf("%s is not safe to apply: %w", m.Name, err))
+				}
+			}
+			target = m.Version
+		}
+		fmt.Println(target)
+	}
+}
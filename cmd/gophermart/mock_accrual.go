@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrualmock"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+func mockAccrual(args []string) {
+	fs := flag.NewFlagSet("mock-accrual", flag.ExitOnError)
+	addr := fs.String("a", ":8081", "address to listen on")
+	delay := fs.Duration("delay", 0, "delay added to every response")
+	rateLimitEvery := fs.Int("rate-limit-every", 0, "answer every Nth request with 429, 0 to disable")
+	retryAfter := fs.Duration("retry-after", accrualmock.DefaultRetryAfter, "Retry-After sent with 429")
+	unregistered := fs.Float64("unregistered-ratio", 0, "share of orders answered with 204")
+	invalid := fs.Float64("invalid-ratio", 0, "share of orders that end up INVALID")
+	polls := fs.Int("processing-polls", accrualmock.DefaultProcessingPolls, "polls an order stays PROCESSING")
+	amount := fs.Float64("accrual", accrualmock.DefaultAccrual.Float64(), "points credited for a PROCESSED order")
+	fs.Parse(args[1:])
+
+	server := accrualmock.NewServer(accrualmock.Scenario{
+		Delay:             *delay,
+		RateLimitEvery:    *rateLimitEvery,
+		RetryAfter:        *retryAfter,
+		UnregisteredRatio: *unregistered,
+		InvalidRatio:      *invalid,
+		ProcessingPolls:   *polls,
+		Accrual:           money.FromFloat(*amount),
+	})
+
+	fmt.Fprintf(os.Stderr, "mock accrual system is listening on %s\n", *addr)
+	if err := http.ListenAndServe(*addr, server.Handler()); err != nil {
+		fail("mock-accrual", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/config"
+	"github.com/real-splendid/gophermart-practicum/internal/dbauth"
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+// connectPostgres opens the primary pool and, if configured, the replica
+// pool. The caller closes them.
+func connectPostgres(cfg *config.Config, logger *zap.Logger, tracer pgx.QueryTracer) (dbConn, replicaConn *pgxpool.Pool) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURI)
+	if err != nil {
+		logger.Fatal("Failed to parse database connection string", zap.Error(err))
+	}
+	poolConfig.MaxConns = int32(cfg.DBMaxConns)
+	poolConfig.MinConns = int32(cfg.DBMinConns)
+	poolConfig.MaxConnLifetime = cfg.DBMaxConnLifetime
+	poolConfig.MaxConnIdleTime = cfg.DBMaxConnIdleTime
+	poolConfig.HealthCheckPeriod = cfg.DBHealthCheck
+
+	poolConfig.ConnConfig.Tracer = tracer
+
+	var tokenSource dbauth.TokenSource
+	switch {
+	case len(cfg.DBAuthTokenCommand) != 0:
+		tokenSource = dbauth.CommandTokenSource{Command: cfg.DBAuthTokenCommand}
+	case len(cfg.DBAuthTokenFile) != 0:
+		tokenSource = dbauth.FileTokenSource{Path: cfg.DBAuthTokenFile}
+	}
+
+	if tokenSource != nil {
+		tokenSource = dbauth.NewCachedTokenSource(tokenSource, cfg.DBAuthTokenTTL)
+		dbauth.Configure(poolConfig, tokenSource, cfg.DBAuthTokenTTL, logger)
+	}
+
+	dbConn, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		logger.Fatal("Failed to connect to database", zap.Error(err))
+	}
+	if cfg.WaitForDB {
+		err = storage.WaitForDB(context.Background(), dbConn, cfg.DBStartupTimeout, logger)
+	} else {
+		err = dbConn.Ping(context.Background())
+	}
+	if err != nil {
+		logger.Fatal("Failed to connect to database", zap.Error(err))
+	}
+	metrics.PublishPool("db_pool", dbConn.Stat)
+
+	if len(cfg.DatabaseReplicaURI) != 0 {
+		replicaConfig, err := pgxpool.ParseConfig(cfg.DatabaseReplicaURI)
+		if err != nil {
+			logger.Fatal("Failed to parse replica connection string", zap.Error(err))
+		}
+		replicaConfig.MaxConns = poolConfig.MaxConns
+		replicaConfig.MinConns = poolConfig.MinConns
+		replicaConfig.MaxConnLifetime = poolConfig.MaxConnLifetime
+		replicaConfig.MaxConnIdleTime = poolConfig.MaxConnIdleTime
+		replicaConfig.HealthCheckPeriod = poolConfig.HealthCheckPeriod
+		replicaConfig.ConnConfig.Tracer = poolConfig.ConnConfig.Tracer
+		if tokenSource != nil {
+			dbauth.Configure(replicaConfig, tokenSource, cfg.DBAuthTokenTTL, logger)
+		}
+
+		// Unlike the primary, the replica is not pinged: one that is down at
+		// startup is not fatal, reads fall back to the primary until it
+		// comes up.
+		replicaConn, err = pgxpool.NewWithConfig(context.Background(), replicaConfig)
+		if err != nil {
+			logger.Fatal("Failed to configure replica connection", zap.Error(err))
+		}
+		metrics.PublishPool("db_replica_pool", replicaConn.Stat)
+	}
+
+	return dbConn, replicaConn
+}
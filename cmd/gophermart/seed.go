@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/seed"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+// seedData generates users, orders and withdrawals for performance work.
+func seedData(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_URI"), "database connection string")
+	users := fs.Int("users", 100, "users to create")
+	orders := fs.Int("orders", 20, "orders per user")
+	withdrawals := fs.Int("withdrawals", 3, "withdrawals per user, as far as the balance allows")
+	history := fs.Duration("history", seed.DefaultHistory, "how far back orders and withdrawals are spread")
+	password := fs.String("password", seed.DefaultPassword, "password of every seeded user")
+	merchant := fs.String("merchant", "", "merchant id, the default merchant if empty")
+	fs.Parse(args[1:])
+
+	merchantID := storage.DefaultMerchantID
+	if len(*merchant) != 0 {
+		var err error
+		if merchantID, err = uuid.Parse(*merchant); err != nil {
+			fail("seed", err)
+		}
+	}
+
+	st := openStorage("seed", *dsn)
+	start := time.Now()
+	report, err := seed.Run(context.Background(), st, seed.Config{
+		Users:       *users,
+		Orders:      *orders,
+		Withdrawals: *withdrawals,
+		History:     *history,
+		Password:    *password,
+		MerchantID:  merchantID,
+		Progress: func(done int) {
+			if done%100 == 0 {
+				fmt.Fprintf(os.Stderr, "%d/%d users\n", done, *users)
+			}
+		},
+	})
+	if report != nil {
+		fmt.Printf("users %d, orders %d (%d processed, %d unfinished), withdrawals %d in %s\n",
+			report.Users, report.Orders, report.Processed, report.Unfinished, report.Withdrawals, time.Since(start).Round(time.Millisecond))
+	}
+	if err != nil {
+		fail("seed", err)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/app"
+	"github.com/real-splendid/gophermart-practicum/internal/buildinfo"
+	"github.com/real-splendid/gophermart-practicum/internal/config"
+	"github.com/real-splendid/gophermart-practicum/internal/events"
+	"github.com/real-splendid/gophermart-practicum/internal/fiscal"
+	"github.com/real-splendid/gophermart-practicum/internal/live"
+	"github.com/real-splendid/gophermart-practicum/internal/logging"
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/notify"
+	"github.com/real-splendid/gophermart-practicum/internal/rates"
+	"github.com/real-splendid/gophermart-practicum/internal/reconcile"
+	"github.com/real-splendid/gophermart-practicum/internal/retention"
+	"github.com/real-splendid/gophermart-practicum/internal/schema"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+// serve runs the loyalty service. args are the process arguments without the
+// subcommand, so the config sees the same flags either way.
+func serve(args []string) {
+	cfg, err := config.Load(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logger, logLevel, err := logging.New(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fmt.Printf("failed to initialize logger: %+v", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	build := buildinfo.Get()
+	logger = logger.With(zap.String("version", build.Version), zap.String("commit", build.Commit))
+	metrics.PublishBuildInfo(build)
+
+	queryLogger := storage.QueryLogger{
+		Logger:        logger,
+		SlowThreshold: cfg.DBSlowQueryThreshold,
+		LogArgs:       cfg.DBLogQueryArgs,
+	}
+
+	if len(cfg.TracingEndpoint) != 0 {
+		tracer := tracing.Init(tracing.Config{
+			Endpoint:    cfg.TracingEndpoint,
+			SampleRatio: cfg.TracingSampleRatio,
+			Logger:      logger,
+		})
+		defer tracer.Shutdown()
+
+		queryLogger.Next = tracing.PgxTracer{}
+	}
+
+	accrualProviders, err := accrual.ParseProviders(cfg.AccrualProviders)
+	if err != nil {
+		logger.Fatal("Failed to parse accrual providers", zap.Error(err))
+	}
+
+	retentionRules, err := retention.ParseRules(cfg.RetentionRules)
+	if err != nil {
+		logger.Fatal("Failed to parse retention rules", zap.Error(err))
+	}
+
+	retryConfig, err := storage.ParseRetryConfig(cfg.DBRetryPolicies)
+	if err != nil {
+		logger.Fatal("Failed to parse database retry policies", zap.Error(err))
+	}
+
+	storageCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storageOptions := storage.Options{
+		Retry: retryConfig,
+		Timeouts: storage.Timeouts{
+			Read:  cfg.DBReadTimeout,
+			Write: cfg.DBWriteTimeout,
+			Batch: cfg.DBBatchTimeout,
+		},
+	}
+
+	var appStorage storage.AppStorage
+	var dbConn, replicaConn *pgxpool.Pool
+	if storage.IsSQLiteDSN(cfg.DatabaseURI) {
+		db, err := storage.OpenSQLite(storageCtx, cfg.DatabaseURI, logger)
+		if err != nil {
+			logger.Fatal("Failed to open SQLite database", zap.Error(err))
+		}
+		defer db.Close()
+
+		appStorage, err = storage.NewSQLiteStorage(storageCtx, db, logger, storageOptions)
+		if err != nil {
+			logger.Fatal("Failed to initialize storage", zap.Error(err))
+		}
+	} else {
+		dbConn, replicaConn = connectPostgres(cfg, logger, queryLogger)
+		defer dbConn.Close()
+		if replicaConn != nil {
+			defer replicaConn.Close()
+		}
+
+		if err := schema.Check(context.Background(), dbConn); err != nil {
+			logger.Fatal("Database schema check failed", zap.Error(err))
+		}
+		if err := schema.Register(storageCtx, dbConn, logger); err != nil {
+			logger.Error("Failed to register schema client", zap.Error(err))
+		}
+
+		storageOptions.Replica = replicaConn
+		appStorage, err = storage.NewDatabaseStorage(storageCtx, dbConn, logger, storageOptions)
+		if err != nil {
+			logger.Fatal("Failed to initialize storage", zap.Error(err))
+		}
+	}
+	appStorage = storage.NewCachedStorage(appStorage, storage.CacheConfig{Size: cfg.CacheSize, TTL: cfg.CacheTTL})
+
+	// serverCtx ends on SIGINT or SIGTERM. app.Run then stops taking
+	// requests and returns, and the deferred Stops below drain the background
+	// work before the storage is closed.
+	serverCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if dbConn != nil {
+		go storage.WatchPool(serverCtx, "db_pool", dbConn, logger)
+	}
+	if replicaConn != nil {
+		go storage.WatchPool(serverCtx, "db_replica_pool", replicaConn, logger)
+	}
+
+	updaterCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	senders := map[string]notify.Sender{}
+	if len(cfg.SMTPAddress) != 0 {
+		senders[notify.ChannelEmail] = notify.NewSMTPSender(cfg.SMTPAddress, cfg.SMTPFrom, cfg.SMTPUsername, cfg.SMTPPassword)
+	}
+	if cfg.NotifyWebhooks {
+		senders[notify.ChannelWebhook] = notify.NewWebhookSender()
+	}
+
+	var notifiers accrual.Notifiers
+	if len(senders) != 0 {
+		notifiers = append(notifiers, notify.NewNotifier(updaterCtx, notify.Config{
+			Senders:        senders,
+			MaxAttempts:    cfg.NotifyMaxAttempts,
+			RetryBaseDelay: cfg.NotifyRetryBaseDelay,
+			RetryMaxDelay:  cfg.NotifyRetryMaxDelay,
+			PollInterval:   cfg.NotifyPollInterval,
+			Logger:         logger,
+			AppStorage:     appStorage,
+		}))
+	}
+
+	var eventsSink events.Sink
+	switch cfg.EventsSink {
+	case events.SinkKafka:
+		eventsSink = events.NewKafkaSink(cfg.EventsKafkaRESTURL, cfg.EventsKafkaTopic)
+	case events.SinkNATS:
+		eventsSink, err = events.NewNATSSink(cfg.EventsNATSURL, cfg.EventsNATSSubject)
+		if err != nil {
+			logger.Fatal("Failed to configure NATS events sink", zap.Error(err))
+		}
+	}
+	if eventsSink != nil {
+		bus := events.NewBus(updaterCtx, events.Config{
+			Sink:      eventsSink,
+			QueueSize: cfg.EventsQueueSize,
+			Logger:    logger,
+		})
+		defer bus.Close()
+		notifiers = append(notifiers, bus)
+	}
+
+	liveHub := live.NewHub(appStorage, logger)
+	notifiers = append(notifiers, liveHub)
+
+	var notifier accrual.Notifier
+	if len(notifiers) != 0 {
+		notifier = notifiers
+	}
+
+	accCfg := accrual.Config{
+		Mode:            cfg.AccrualMode,
+		BaseAddr:        cfg.AccrualSystemAddress,
+		Providers:       accrualProviders,
+		Workers:         cfg.AccrualWorkers,
+		WorkerRateLimit: cfg.AccrualWorkerRateLimit,
+		PollInterval:    cfg.AccrualPollInterval,
+		DrainTimeout:    cfg.AccrualDrainTimeout,
+		MaxNotFound:     cfg.AccrualMaxNotFound,
+		MaxFailures:     cfg.AccrualMaxFailures,
+		ClaimLease:      cfg.AccrualClaimLease,
+		ClaimBatch:      cfg.AccrualClaimBatch,
+		RegisterOrders:  cfg.AccrualRegisterOrders,
+		ResultCacheTTL:  cfg.AccrualResultCacheTTL,
+
+		BacklogThreshold: cfg.AccrualBacklogThreshold,
+		BacklogInterval:  cfg.AccrualBacklogInterval,
+
+		StaleAfter:    cfg.AccrualStaleAfter,
+		SweepInterval: cfg.AccrualSweepInterval,
+
+		Retry: accrual.RetryPolicy{
+			MaxAttempts: cfg.AccrualRetryAttempts,
+			BaseDelay:   cfg.AccrualRetryBaseDelay,
+			MaxDelay:    cfg.AccrualRetryMaxDelay,
+			MaxElapsed:  cfg.AccrualRetryMaxElapsed,
+			OrderBudget: cfg.AccrualRetryBudget,
+		},
+		HTTP: accrual.HTTPConfig{
+			DialTimeout:         cfg.AccrualDialTimeout,
+			ResponseTimeout:     cfg.AccrualResponseTimeout,
+			RequestTimeout:      cfg.AccrualRequestTimeout,
+			KeepAlive:           cfg.AccrualKeepAlive,
+			IdleConnTimeout:     cfg.AccrualIdleConnTimeout,
+			MaxIdleConnsPerHost: cfg.AccrualMaxIdleConnsPerHost,
+		},
+		Notifier:   notifier,
+		Logger:     logger,
+		AppStorage: appStorage,
+	}
+	accrual := accrual.NewAccrual(updaterCtx, accCfg)
+	defer accrual.Stop()
+
+	retention.NewEngine(updaterCtx, retention.Config{
+		Rules:      retentionRules,
+		DryRun:     cfg.RetentionDryRun,
+		Logger:     logger,
+		AppStorage: appStorage,
+	})
+
+	if cfg.ReconcileInterval > 0 {
+		reconcile.NewEngine(updaterCtx, reconcile.Config{
+			Interval:    cfg.ReconcileInterval,
+			AutoCorrect: cfg.ReconcileAutoCorrect,
+			Logger:      logger,
+			AppStorage:  appStorage,
+		})
+	}
+
+	var ratesProvider rates.Provider
+	switch {
+	case len(cfg.ExchangeRateURL) != 0:
+		ratesProvider = rates.NewHTTPProvider(cfg.ExchangeRateURL)
+	case cfg.ExchangeRate != 0:
+		ratesProvider = rates.StaticProvider(cfg.ExchangeRate)
+	}
+
+	var converter *rates.Converter
+	if ratesProvider != nil {
+		converter = rates.NewConverter(serverCtx, rates.Config{
+			Currency: cfg.ExchangeCurrency,
+			Provider: ratesProvider,
+			Logger:   logger,
+		})
+	}
+
+	var fiscalValidator fiscal.Validator
+	if len(cfg.FiscalAddress) != 0 {
+		fiscalValidator = fiscal.NewHTTPValidator(cfg.FiscalAddress, cfg.FiscalToken)
+	}
+
+	jwtSecret := []byte(cfg.JWTSecret)
+	if len(cfg.JWTSecretFile) != 0 {
+		b, err := os.ReadFile(cfg.JWTSecretFile)
+		if err != nil {
+			logger.Fatal("Failed to read JWT secret file", zap.Error(err))
+		}
+		jwtSecret = bytes.TrimSpace(b)
+	}
+
+	var jwtPreviousSecrets [][]byte
+	for _, key := range strings.Split(cfg.JWTPreviousSecrets, ",") {
+		if key = strings.TrimSpace(key); len(key) != 0 {
+			jwtPreviousSecrets = append(jwtPreviousSecrets, []byte(key))
+		}
+	}
+
+	cookieSameSite, err := app.ParseSameSite(cfg.CookieSameSite)
+	if err != nil {
+		logger.Fatal("Failed to parse cookie SameSite mode", zap.Error(err))
+	}
+
+	passwordPolicy := validate.PasswordPolicy{MinLength: cfg.PasswordMinLength}
+	for _, class := range cfg.PasswordClasses() {
+		switch class {
+		case validate.RuleLower:
+			passwordPolicy.RequireLower = true
+		case validate.RuleUpper:
+			passwordPolicy.RequireUpper = true
+		case validate.RuleDigit:
+			passwordPolicy.RequireDigit = true
+		case validate.RuleSymbol:
+			passwordPolicy.RequireSymbol = true
+		}
+	}
+	if len(cfg.PasswordDenyListFile) != 0 {
+		b, err := os.ReadFile(cfg.PasswordDenyListFile)
+		if err != nil {
+			logger.Fatal("Failed to read password deny-list file", zap.Error(err))
+		}
+		passwordPolicy.DenyList = strings.Fields(string(b))
+	}
+
+	compressionEncodings, err := app.ParseEncodings(cfg.CompressionEncodings)
+	if err != nil {
+		logger.Fatal("Failed to parse compression encodings", zap.Error(err))
+	}
+
+	// Configured route timeouts are added to the default ones.
+	routeTimeouts, err := app.ParseRouteTimeouts(cfg.RequestRouteTimeouts)
+	if err != nil {
+		logger.Fatal("Failed to parse route timeouts", zap.Error(err))
+	}
+	for route, d := range app.DefaultTimeouts.Routes {
+		if _, ok := routeTimeouts[route]; !ok {
+			routeTimeouts[route] = d
+		}
+	}
+
+	app.Run(serverCtx, app.Config{
+		ServerAddress:  cfg.ServerAddress,
+		Logger:         logger,
+		LogLevel:       &logLevel,
+		Storage:        appStorage,
+		AccrualEnabled: accrual.Enabled(),
+		Rates:          converter,
+		Fiscal:         fiscalValidator,
+		ReportsAPIKey:  cfg.ReportsAPIKey,
+		AdminAPIKey:    cfg.AdminAPIKey,
+		DocsUI:         cfg.DocsUI,
+
+		StrictWithdrawals: cfg.StrictWithdrawals,
+
+		Compression: app.Compression{
+			Level:     cfg.CompressionLevel,
+			MinSize:   cfg.CompressionMinSize,
+			Encodings: compressionEncodings,
+		},
+
+		Accrual:               accrual,
+		AccrualCallbackAPIKey: cfg.AccrualCallbackAPIKey,
+		Live:                  liveHub,
+
+		RateLimit:      cfg.RateLimit,
+		RateLimitBurst: cfg.RateLimitBurst,
+
+		AccessLogSampleRatio: cfg.AccessLogSampleRatio,
+
+		DebugAddress: cfg.DebugAddress,
+
+		Timeouts: app.Timeouts{
+			Read:   cfg.RequestReadTimeout,
+			Write:  cfg.RequestWriteTimeout,
+			Routes: routeTimeouts,
+		},
+		HTTP: app.HTTPServer{
+			ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+			ReadTimeout:       cfg.HTTPReadTimeout,
+			WriteTimeout:      cfg.HTTPWriteTimeout,
+			IdleTimeout:       cfg.HTTPIdleTimeout,
+			MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+			H2C:               cfg.HTTPH2C,
+			ShutdownTimeout:   cfg.HTTPShutdownTimeout,
+		},
+		TLS: app.TLS{
+			CertFile:         cfg.TLSCert,
+			KeyFile:          cfg.TLSKey,
+			AutocertHosts:    cfg.AutocertHosts(),
+			AutocertCacheDir: cfg.TLSAutocertCacheDir,
+			RedirectAddress:  cfg.HTTPRedirectAddress,
+		},
+
+		JWTSecret:          jwtSecret,
+		JWTPreviousSecrets: jwtPreviousSecrets,
+		JWTTTL:             cfg.JWTTTL,
+		RefreshTokenTTL:    cfg.RefreshTokenTTL,
+
+		PasswordPolicy: passwordPolicy,
+		LoginLockout: app.LoginLockout{
+			MaxFailures:      cfg.LoginMaxFailures,
+			MaxFailuresPerIP: cfg.LoginMaxFailuresPerIP,
+			Cooldown:         cfg.LoginCooldown,
+			MaxCooldown:      cfg.LoginMaxCooldown,
+			Window:           cfg.LoginFailureWindow,
+		},
+		Cookies: app.Cookies{
+			Secure:   cfg.CookieSecure,
+			SameSite: cookieSameSite,
+			HTTPOnly: cfg.CookieHTTPOnly,
+			Domain:   cfg.CookieDomain,
+		},
+		CSRFMode: cfg.CSRFMode,
+	})
+}
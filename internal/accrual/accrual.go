@@ -2,17 +2,19 @@ package accrual
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
-	"strconv"
+	"os"
 	"sync"
 	"time"
 
-	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
 	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
 )
 
 const (
@@ -22,151 +24,660 @@ const (
 	StatusProcessed  = "PROCESSED"
 )
 
-type orderInfo struct {
-	Order   string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
+const (
+	DefaultWorkers      = 10
+	DefaultPollInterval = time.Second
+	DefaultDrainTimeout = 10 * time.Second
+	DefaultMaxNotFound  = 10
+	DefaultMaxFailures  = 20
+	DefaultClaimLease   = 5 * time.Minute
+	DefaultClaimBatch   = 1000
+)
+
+const (
+	ModePolling  = "polling"
+	ModeCallback = "callback"
+
+	CallbackProviderName = "callback"
+)
+
+// Notifier is told about order status transitions that have been committed.
+type Notifier interface {
+	OrdersUpdated(ctx context.Context, transitions []storage.OrderTransition)
+}
+
+// Notifiers passes updates on to every notifier in turn.
+type Notifiers []Notifier
+
+func (ns Notifiers) OrdersUpdated(ctx context.Context, transitions []storage.OrderTransition) {
+	for _, n := range ns {
+		n.OrdersUpdated(ctx, transitions)
+	}
 }
 
 type Config struct {
-	BaseAddr string
-	Logger   *zap.Logger
+	Mode            string
+	BaseAddr        string
+	Provider        Provider
+	Providers       []ProviderConfig
+	Workers         int
+	WorkerRateLimit int
+	PollInterval    time.Duration
+	DrainTimeout    time.Duration
+	MaxNotFound     int
+	MaxFailures     int
+	Retry           RetryPolicy
+	HTTP            HTTPConfig
+	// RegisterOrders registers every order with the accrual system before
+	// its status is polled, for systems that require it.
+	RegisterOrders bool
+	Notifier       Notifier
+	Logger         *zap.Logger
+
+	// BacklogThreshold is the number of unfinished orders above which a
+	// warning is raised; 0 disables the warning. The backlog is checked
+	// every BacklogInterval.
+	BacklogThreshold int
+	BacklogInterval  time.Duration
+
+	// InstanceID names this instance in order claims. Instances sharing a
+	// database must use different IDs.
+	InstanceID string
+	ClaimLease time.Duration
+	ClaimBatch int
+	// ResultCacheTTL is how long a final result is kept for an order whose
+	// update hasn't been committed yet.
+	ResultCacheTTL time.Duration
+
+	// StaleAfter splits the polling: orders that haven't changed for that
+	// long are left to a sweep every SweepInterval instead of being polled
+	// every PollInterval. 0 polls every order.
+	StaleAfter    time.Duration
+	SweepInterval time.Duration
+
 	storage.AppStorage
 }
 
 type Accrual struct {
-	ctx       context.Context
-	ctxCancel context.CancelFunc
-	client    *resty.Client
+	ctx            context.Context
+	ctxCancel      context.CancelFunc
+	providers      []*routedProvider
+	workerLimiters []*limiter
+	results        *resultCache
+
+	// stopping ends the poll loop after the current cycle; done is closed
+	// once the loop has exited.
+	stopping chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	loops    sync.WaitGroup
+
+	// pausedUntil is shared by all workers: a 429 from the provider stops
+	// the whole poller for the Retry-After window.
+	pauseMu     sync.Mutex
+	pausedUntil time.Time
+
 	Config
 }
 
 func NewAccrual(ctx context.Context, cfg Config) *Accrual {
 	ctx, cancel := context.WithCancel(ctx)
 
-	retryFn := resty.RetryAfterFunc(func(client *resty.Client, response *resty.Response) (time.Duration, error) {
-		if response.StatusCode() != http.StatusTooManyRequests {
-			return 0, nil
-		}
-
-		retryAfterValue := response.Header().Get("Retry-After")
-		if len(retryAfterValue) == 0 {
-			return 0, nil
-		}
+	cfg.Retry = cfg.Retry.withDefaults()
 
-		seconds, err := strconv.ParseInt(retryAfterValue, 10, 64)
+	providers := make([]*routedProvider, 0, len(cfg.Providers)+1)
+	defaultCfg := ProviderConfig{Name: DefaultProviderName, BaseAddr: cfg.BaseAddr, HTTP: cfg.HTTP}
+	switch {
+	case cfg.Provider != nil:
+		providers = append(providers, newRoutedProvider(defaultCfg, cfg.Provider, cfg.Retry))
+	case len(cfg.BaseAddr) != 0:
+		providers = append(providers, newRoutedProvider(defaultCfg, NewHTTPProvider(cfg.BaseAddr, "", cfg.HTTP), cfg.Retry))
+	}
+	for _, pc := range cfg.Providers {
+		pc.HTTP = cfg.HTTP
+		p, err := NewProvider(pc)
 		if err != nil {
-			return 0, err
+			cfg.Logger.Error("Skipping accrual provider", zap.Error(err))
+			continue
 		}
+		providers = append(providers, newRoutedProvider(pc, p, cfg.Retry))
+	}
 
-		return time.Duration(seconds) * time.Second, nil
-	})
+	if len(cfg.Mode) == 0 {
+		cfg.Mode = ModePolling
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = DefaultDrainTimeout
+	}
+
+	if cfg.MaxNotFound <= 0 {
+		cfg.MaxNotFound = DefaultMaxNotFound
+	}
+
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = DefaultMaxFailures
+	}
+
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultWorkers
+	}
+
+	if len(cfg.InstanceID) == 0 {
+		hostname, _ := os.Hostname()
+		cfg.InstanceID = hostname + "-" + uuid.NewString()
+	}
+
+	if cfg.ClaimLease <= 0 {
+		cfg.ClaimLease = DefaultClaimLease
+	}
 
-	client := resty.New().SetRetryAfter(retryFn).SetRetryCount(3)
+	if cfg.ClaimBatch <= 0 {
+		cfg.ClaimBatch = DefaultClaimBatch
+	}
+
+	if cfg.BacklogInterval <= 0 {
+		cfg.BacklogInterval = DefaultBacklogInterval
+	}
+
+	if cfg.ResultCacheTTL <= 0 {
+		cfg.ResultCacheTTL = DefaultResultCacheTTL
+	}
+
+	if cfg.SweepInterval <= 0 {
+		cfg.SweepInterval = DefaultSweepInterval
+	}
+
+	workerLimiters := make([]*limiter, cfg.Workers)
+	for i := range workerLimiters {
+		workerLimiters[i] = newLimiter(cfg.WorkerRateLimit)
+	}
 
 	updater := &Accrual{
-		ctx:       ctx,
-		ctxCancel: cancel,
-		client:    client,
-		Config:    cfg,
+		ctx:            ctx,
+		ctxCancel:      cancel,
+		providers:      providers,
+		workerLimiters: workerLimiters,
+		results:        newResultCache(cfg.ResultCacheTTL),
+		stopping:       make(chan struct{}),
+		done:           make(chan struct{}),
+		Config:         cfg,
+	}
+
+	if !updater.Enabled() {
+		updater.Logger.Warn("Accrual system address is not configured, running in degraded mode: orders will stay NEW")
+		metrics.AccrualEnabled.Set(0)
+		close(updater.done)
+		return updater
 	}
 
+	metrics.AccrualEnabled.Set(1)
+	go updater.watchBacklog()
+	if cfg.Mode == ModeCallback {
+		updater.Logger.Info("Accrual system pushes results via callback, polling is disabled")
+		close(updater.done)
+		return updater
+	}
+	updater.loops.Add(1)
 	go updater.updateOrders()
+	if cfg.StaleAfter > 0 {
+		updater.loops.Add(1)
+		go updater.sweepOrders()
+	}
+	go func() {
+		updater.loops.Wait()
+		close(updater.done)
+	}()
 
 	return updater
 }
 
+func (u *Accrual) Enabled() bool {
+	return u.Mode == ModeCallback || len(u.providers) != 0
+}
+
+// Apply stores an order result pushed by the accrual system.
+func (u *Accrual) Apply(ctx context.Context, info OrderInfo) error {
+	if err := info.validate(info.Order); err != nil {
+		return err
+	}
+
+	order, err := u.GetOrder(ctx, info.Order)
+	if err != nil {
+		return err
+	}
+
+	entry := newJournalEntry(info.Order, CallbackProviderName, &info, nil)
+	if err := u.AddAccrualJournalEntries(ctx, []storage.AccrualJournalEntry{entry}); err != nil {
+		requestid.Logger(ctx, u.Logger).Error("can't write accrual journal", zap.Error(err))
+	}
+
+	from := order.Status
+	if !applyOrderInfo(order, &info) {
+		return nil
+	}
+	t, ok := u.transition(ctx, *order, from)
+	if !ok {
+		return nil
+	}
+	if err := u.UpdateBalanceFromOrders(ctx, []storage.OrderTransition{t}); err != nil {
+		return err
+	}
+	u.notify(ctx, []storage.OrderTransition{t})
+	return nil
+}
+
+// Stop lets the current poll cycle commit its results and cancels it only if
+// that takes longer than DrainTimeout.
 func (u *Accrual) Stop() {
-	u.ctxCancel()
+	u.stopOnce.Do(func() {
+		close(u.stopping)
+
+		timer := time.NewTimer(u.DrainTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-u.done:
+		case <-timer.C:
+			u.Logger.Warn("accrual poller did not drain in time, cancelling in-flight updates", zap.Duration("timeout", u.DrainTimeout))
+		}
+		u.ctxCancel()
+		<-u.done
+
+		if u.Enabled() && u.Mode == ModePolling {
+			ctx, cancel := context.WithTimeout(context.Background(), u.DrainTimeout)
+			defer cancel()
+			owners := []string{u.InstanceID}
+			if u.StaleAfter > 0 {
+				owners = append(owners, u.sweepOwner())
+			}
+			for _, owner := range owners {
+				if err := u.ReleaseOrderClaims(ctx, owner); err != nil {
+					u.Logger.Error("can't release order claims", zap.String("owner", owner), zap.Error(err))
+				}
+			}
+		}
+	})
 }
 
 func (u *Accrual) updateOrders() {
-	ticker := time.NewTicker(time.Second)
+	defer u.loops.Done()
+
+	ticker := time.NewTicker(u.PollInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
+			if u.pauseRemaining() > 0 {
+				continue
+			}
 			u.update()
+		case <-u.stopping:
+			return
 		case <-u.ctx.Done():
 			return
-
 		}
 	}
 }
 
 func (u *Accrual) update() {
-	orders, err := u.GetUnfinishedOrders(u.ctx)
+	ctx, span := tracing.Start(requestid.NewContext(u.ctx, "accrual-"), "accrual.update", tracing.KindInternal)
+	defer span.End()
+	logger := requestid.Logger(ctx, u.Logger)
+
+	filter := storage.ClaimFilter{}
+	if u.StaleAfter > 0 {
+		filter.UpdatedSince = time.Now().Add(-u.StaleAfter)
+	}
+	orders, err := u.ClaimUnfinishedOrders(ctx, u.InstanceID, u.ClaimLease, filter, u.ClaimBatch)
 	if err != nil {
+		logger.Error("can't claim unfinished orders", zap.Error(err))
 		return
 	}
+	u.process(ctx, orders)
+}
+
+// process looks up the claimed orders and commits the results.
+func (u *Accrual) process(ctx context.Context, orders []storage.Order) {
 	if len(orders) == 0 {
 		return
 	}
+	logger := requestid.Logger(ctx, u.Logger)
 
 	var wg sync.WaitGroup
-	ordersInfo := make([]*orderInfo, len(orders))
-
-	ordersWithBalanceUpdate := make([]storage.Order, 0)
-	for i, o := range orders {
+	ordersInfo := make([]*OrderInfo, len(orders))
+	notFound := make([]bool, len(orders))
+	failures := make([]error, len(orders))
+	answered := make([]bool, len(orders))
+	journal := make([]storage.AccrualJournalEntry, len(orders))
+
+	transitions := make([]storage.OrderTransition, 0)
+
+	// The jobs channel is bounded by the pool size, so the producer blocks
+	// instead of queueing every pending order at once.
+	jobs := make(chan int, u.Workers)
+	for _, l := range u.workerLimiters {
 		wg.Add(1)
-		go func(index int, o storage.Order) {
+		go func(l *limiter) {
 			defer wg.Done()
-			info, err := u.getOrderStatus(o.OrderNumber)
-			if err != nil {
-				return
+			for index := range jobs {
+				if err := u.waitPause(); err != nil {
+					continue
+				}
+				if err := l.wait(u.ctx); err != nil {
+					continue
+				}
+				orderID := orders[index].OrderNumber
+				if info, _, ok := u.results.get(orderID); ok {
+					metrics.AccrualResultCacheHits.Add(1)
+					ordersInfo[index] = info
+					continue
+				}
+				ctx := withRetryBudget(ctx, u.Retry.OrderBudget)
+				if u.RegisterOrders && !orders[index].Registered {
+					if providerName, err := u.registerOrder(ctx, orderID); err != nil {
+						journal[index] = newJournalEntry(orderID, providerName, nil, err)
+						var rateLimitErr *RateLimitError
+						if errors.As(err, &rateLimitErr) {
+							u.pause(rateLimitErr.RetryAfter)
+						}
+						if isLookupFailure(err) {
+							failures[index] = err
+						}
+						continue
+					}
+				}
+				info, providerName, err := u.getOrderStatus(ctx, orderID)
+				journal[index] = newJournalEntry(orderID, providerName, info, err)
+				answered[index] = err == nil || errors.Is(err, ErrOrderNotFound) || errors.Is(err, ErrOrderNotRegistered)
+				if err != nil {
+					var rateLimitErr *RateLimitError
+					if errors.As(err, &rateLimitErr) {
+						u.pause(rateLimitErr.RetryAfter)
+					}
+					notFound[index] = errors.Is(err, ErrOrderNotFound)
+					if isLookupFailure(err) {
+						failures[index] = err
+					}
+					continue
+				}
+				u.results.put(orderID, providerName, info)
+				ordersInfo[index] = info
 			}
-			ordersInfo[index] = info
-		}(i, o)
+		}(l)
+	}
+
+	// On shutdown no further orders are fetched; the results already
+	// received are still written below.
+enqueue:
+	for i := range orders {
+		select {
+		case jobs <- i:
+		case <-u.stopping:
+			break enqueue
+		}
 	}
+	close(jobs)
 
 	wg.Wait()
 
-	for i, info := range ordersInfo {
-		if info == nil {
+	if err := u.AddAccrualJournalEntries(ctx, journal); err != nil {
+		logger.Error("can't write accrual journal", zap.Error(err))
+	}
+
+	// An outage fails every lookup alike and says nothing about the orders,
+	// so such failures only count against an order while its provider
+	// answers about others.
+	up := make(map[string]bool)
+	for i, ok := range answered {
+		if ok {
+			up[journal[i].Provider] = true
+		}
+	}
+	skipped := 0
+	for i, err := range failures {
+		if err == nil {
 			continue
 		}
-
-		switch info.Status {
-		case StatusRegistered, StatusProcessing:
-			orders[i].Status = storage.StatusProcessing
-		case StatusInvalid:
-			orders[i].Status = storage.StatusInvalid
-		case StatusProcessed:
-			orders[i].Status = storage.StatusProcessed
-			orders[i].Accrual = info.Accrual
+		if isOutage(err) && !up[journal[i].Provider] {
+			skipped++
+			continue
 		}
+		u.recordFailure(ctx, orders[i].OrderNumber, err)
+	}
+	if skipped != 0 {
+		logger.Warn("accrual system is not answering, lookup failures are not counted", zap.Int("orders", skipped))
+	}
 
-		if info.Status == storage.StatusProcessed {
-			ordersWithBalanceUpdate = append(ordersWithBalanceUpdate, orders[i])
+	for i, info := range ordersInfo {
+		from := orders[i].Status
+		switch {
+		case notFound[i] && u.giveUp(ctx, &orders[i]):
+		case info != nil && applyOrderInfo(&orders[i], info):
+		default:
+			continue
 		}
 
-		if err := u.UpdateOrder(u.ctx, orders[i]); err != nil {
-			u.Logger.Error("can't update order", zap.Error(err))
+		if t, ok := u.transition(ctx, orders[i], from); ok {
+			transitions = append(transitions, t)
 		}
 	}
 
-	if err := u.UpdateBalanceFromOrders(u.ctx, ordersWithBalanceUpdate); err != nil {
-		u.Logger.Error("can't update balance", zap.Error(err))
+	// Order statuses and balance credits are committed together. Cached
+	// results are kept for the next cycle until that succeeds.
+	if err := u.UpdateBalanceFromOrders(ctx, transitions); err != nil {
+		logger.Error("can't update orders and balance", zap.Error(err))
+		return
+	}
+	u.results.forget(orderNumbers(orders))
+	u.notify(ctx, transitions)
+}
+
+func orderNumbers(orders []storage.Order) []string {
+	numbers := make([]string, len(orders))
+	for i, o := range orders {
+		numbers[i] = o.OrderNumber
+	}
+	return numbers
+}
+
+// transition checks a status change against the order state machine. A
+// change it doesn't allow, e.g. a result for an order that is already
+// final, is logged and dropped.
+func (u *Accrual) transition(ctx context.Context, order storage.Order, from string) (storage.OrderTransition, bool) {
+	t := storage.OrderTransition{Order: order, From: from}
+	if err := t.Check(); err != nil {
+		requestid.Logger(ctx, u.Logger).Warn("ignoring accrual result", zap.String("order_id", order.OrderNumber), zap.Error(err))
+		return storage.OrderTransition{}, false
 	}
+	return t, true
 }
 
-func (u *Accrual) getOrderStatus(orderID string) (*orderInfo, error) {
-	request := u.client.R().SetContext(u.ctx)
+func (u *Accrual) notify(ctx context.Context, transitions []storage.OrderTransition) {
+	if u.Notifier != nil && len(transitions) != 0 {
+		u.Notifier.OrdersUpdated(ctx, transitions)
+	}
+}
 
-	url := fmt.Sprintf("%s/api/orders/%s", u.BaseAddr, orderID)
-	response, err := request.Get(url)
+// giveUp counts a "not found" answer for the order and marks it INVALID once
+// the accrual system has given MaxNotFound of them.
+func (u *Accrual) giveUp(ctx context.Context, order *storage.Order) bool {
+	count, err := u.RecordAccrualNotFound(ctx, order.OrderNumber)
 	if err != nil {
-		return nil, err
+		requestid.Logger(ctx, u.Logger).Error("can't record accrual miss", zap.String("order_id", order.OrderNumber), zap.Error(err))
+		return false
+	}
+	if count < u.MaxNotFound {
+		return false
+	}
+
+	requestid.Logger(ctx, u.Logger).Warn("order is unknown to the accrual system, marking invalid", zap.String("order_id", order.OrderNumber), zap.Int("attempts", count))
+	order.Status = storage.StatusInvalid
+	return true
+}
+
+// isLookupFailure reports whether err counts towards dead-lettering an order.
+// Throttling, shutdown and answers the poller handles itself don't.
+func isLookupFailure(err error) bool {
+	var rateLimitErr *RateLimitError
+	return !errors.As(err, &rateLimitErr) &&
+		!errors.Is(err, ErrOrderNotRegistered) &&
+		!errors.Is(err, ErrOrderNotFound) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// isOutage reports whether err comes from the accrual system being
+// unreachable or failing as a whole rather than from the order: a transport
+// error, a timeout or a server error.
+func isOutage(err error) bool {
+	var rateLimitErr *RateLimitError
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.Code >= 500
+	case errors.As(err, &rateLimitErr),
+		errors.Is(err, ErrOrderNotRegistered), errors.Is(err, ErrOrderNotFound),
+		errors.Is(err, ErrBadResponse), errors.Is(err, ErrNoProvider):
+		return false
 	}
+	return true
+}
+
+// recordFailure moves the order to the dead-letter queue once its lookups
+// have failed MaxFailures times.
+func (u *Accrual) recordFailure(ctx context.Context, orderID string, lookupErr error) {
+	logger := requestid.Logger(ctx, u.Logger)
 
-	if response.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", response.StatusCode())
+	count, err := u.RecordAccrualFailure(ctx, orderID)
+	if err != nil {
+		logger.Error("can't record accrual failure", zap.String("order_id", orderID), zap.Error(err))
+		return
+	}
+	if count < u.MaxFailures {
+		return
 	}
 
-	var info orderInfo
-	if err := json.Unmarshal(response.Body(), &info); err != nil {
-		return nil, err
+	err = u.DeadLetterOrder(ctx, storage.DeadLetter{OrderNumber: orderID, Failures: count, LastError: lookupErr.Error()})
+	if err != nil {
+		logger.Error("can't dead-letter order", zap.String("order_id", orderID), zap.Error(err))
+		return
+	}
+	metrics.AccrualDeadLetters.Add(1)
+	logger.Warn("accrual lookups keep failing, order moved to dead-letter queue", zap.String("order_id", orderID), zap.Int("failures", count), zap.Error(lookupErr))
+}
+
+// applyOrderInfo maps the accrual system status onto the order and reports
+// whether the order has changed.
+func applyOrderInfo(order *storage.Order, info *OrderInfo) bool {
+	status := order.Status
+	switch info.Status {
+	case StatusRegistered, StatusProcessing:
+		order.Status = storage.StatusProcessing
+	case StatusInvalid:
+		order.Status = storage.StatusInvalid
+	case StatusProcessed:
+		order.Status = storage.StatusProcessed
+		order.Accrual = info.Accrual
+	}
+
+	return order.Status != status
+}
+
+func (u *Accrual) pause(d time.Duration) {
+	u.pauseMu.Lock()
+	defer u.pauseMu.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(u.pausedUntil) {
+		u.pausedUntil = until
+		metrics.AccrualThrottled.Add(1)
+		u.Logger.Warn("accrual system is throttling requests, pausing poller", zap.Duration("retry_after", d))
+	}
+}
+
+func (u *Accrual) pauseRemaining() time.Duration {
+	u.pauseMu.Lock()
+	defer u.pauseMu.Unlock()
+
+	return time.Until(u.pausedUntil)
+}
+
+// ThrottledUntil returns when this instance resumes polling after the accrual
+// system throttled it, or the zero time while it isn't throttled.
+func (u *Accrual) ThrottledUntil() time.Time {
+	u.pauseMu.Lock()
+	defer u.pauseMu.Unlock()
+
+	if time.Now().Before(u.pausedUntil) {
+		return u.pausedUntil
+	}
+	return time.Time{}
+}
+
+func (u *Accrual) waitPause() error {
+	d := u.pauseRemaining()
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-u.ctx.Done():
+		return u.ctx.Err()
+	}
+}
+
+// registerOrder registers the order with its provider and records the
+// outcome on the order. A failed registration is retried on the next cycle.
+func (u *Accrual) registerOrder(ctx context.Context, orderID string) (string, error) {
+	p := route(u.providers, orderID)
+	if p == nil {
+		return "", fmt.Errorf("%w %s", ErrNoProvider, orderID)
+	}
+
+	if err := p.RegisterOrder(ctx, orderID); err != nil {
+		err = fmt.Errorf("%w: %w", ErrRegistrationFailed, err)
+		if err := u.SetOrderRegistrationError(ctx, orderID, err.Error()); err != nil {
+			requestid.Logger(ctx, u.Logger).Error("can't record registration error", zap.String("order_id", orderID), zap.Error(err))
+		}
+		return p.Name, err
+	}
+
+	if err := u.MarkOrderRegistered(ctx, orderID); err != nil {
+		requestid.Logger(ctx, u.Logger).Error("can't mark order registered", zap.String("order_id", orderID), zap.Error(err))
+	}
+	return p.Name, nil
+}
+
+func (u *Accrual) getOrderStatus(ctx context.Context, orderID string) (*OrderInfo, string, error) {
+	p := route(u.providers, orderID)
+	if p == nil {
+		return nil, "", fmt.Errorf("%w %s", ErrNoProvider, orderID)
+	}
+
+	info, err := p.GetOrderStatus(ctx, orderID)
+	return info, p.Name, err
+}
+
+func newJournalEntry(orderID, providerName string, info *OrderInfo, err error) storage.AccrualJournalEntry {
+	entry := storage.AccrualJournalEntry{
+		OrderNumber: orderID,
+		Provider:    providerName,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
 	}
 
-	return &info, nil
+	entry.Status = info.Status
+	entry.Accrual = info.Accrual
+	return entry
 }
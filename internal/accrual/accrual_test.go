@@ -0,0 +1,100 @@
+package accrual
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+type providerStub map[string]error
+
+func (p providerStub) GetOrderStatus(_ context.Context, orderID string) (*OrderInfo, error) {
+	if err := p[orderID]; err != nil {
+		return nil, err
+	}
+	return &OrderInfo{Order: orderID, Status: StatusProcessing}, nil
+}
+
+func (p providerStub) RegisterOrder(context.Context, string) error {
+	return nil
+}
+
+// failuresStub counts the failures recorded per order. Other AppStorage
+// methods are not used by process and panic.
+type failuresStub struct {
+	storage.AppStorage
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func (s *failuresStub) RecordAccrualFailure(_ context.Context, orderNumber string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[orderNumber]++
+	return s.failures[orderNumber], nil
+}
+
+func (s *failuresStub) AddAccrualJournalEntries(context.Context, []storage.AccrualJournalEntry) error {
+	return nil
+}
+
+func (s *failuresStub) UpdateBalanceFromOrders(context.Context, []storage.OrderTransition) error {
+	return nil
+}
+
+func TestProcessCountsFailures(t *testing.T) {
+	unavailable := &StatusError{Code: 503}
+
+	tests := []struct {
+		name     string
+		provider providerStub
+		want     map[string]int
+	}{
+		{
+			name:     "outage is not counted",
+			provider: providerStub{"1": unavailable, "2": unavailable},
+			want:     map[string]int{},
+		},
+		{
+			name:     "server error for one order is counted while others are answered",
+			provider: providerStub{"1": unavailable},
+			want:     map[string]int{"1": 1},
+		},
+		{
+			name:     "malformed response is counted during an outage",
+			provider: providerStub{"1": ErrBadResponse, "2": unavailable},
+			want:     map[string]int{"1": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &failuresStub{failures: map[string]int{}}
+			u := NewAccrual(context.Background(), Config{
+				Mode:       ModeCallback,
+				Provider:   tt.provider,
+				Retry:      RetryPolicy{MaxAttempts: 1},
+				Logger:     zap.NewNop(),
+				AppStorage: st,
+			})
+			defer u.Stop()
+
+			u.process(context.Background(), []storage.Order{
+				{OrderNumber: "1", Status: storage.StatusNew},
+				{OrderNumber: "2", Status: storage.StatusNew},
+			})
+
+			if len(st.failures) != len(tt.want) {
+				t.Fatalf("failures = %v, want %v", st.failures, tt.want)
+			}
+			for order, n := range tt.want {
+				if st.failures[order] != n {
+					t.Errorf("failures = %v, want %v", st.failures, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package accrual
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const DefaultBacklogInterval = 30 * time.Second
+
+// BacklogNotifier is implemented by notifiers that want to know when the
+// number of unfinished orders grows past Config.BacklogThreshold, e.g. to
+// scale out workers. They are told once each time the threshold is crossed.
+type BacklogNotifier interface {
+	BacklogExceeded(ctx context.Context, backlog storage.AccrualBacklog, threshold int)
+}
+
+func (ns Notifiers) BacklogExceeded(ctx context.Context, backlog storage.AccrualBacklog, threshold int) {
+	for _, n := range ns {
+		if bn, ok := n.(BacklogNotifier); ok {
+			bn.BacklogExceeded(ctx, backlog, threshold)
+		}
+	}
+}
+
+// Status describes the accrual processing for operators.
+type Status struct {
+	Mode             string     `json:"mode"`
+	Enabled          bool       `json:"enabled"`
+	UnfinishedOrders int        `json:"unfinished_orders"`
+	OldestUploadedAt *time.Time `json:"oldest_uploaded_at,omitempty"`
+	OldestAgeSeconds float64    `json:"oldest_age_seconds"`
+	BacklogThreshold int        `json:"backlog_threshold,omitempty"`
+	BacklogExceeded  bool       `json:"backlog_exceeded"`
+	ThrottledUntil   *time.Time `json:"throttled_until,omitempty"`
+}
+
+// Status reads the current backlog and updates its metrics.
+func (u *Accrual) Status(ctx context.Context) (*Status, error) {
+	backlog, err := u.backlog(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{
+		Mode:             u.Mode,
+		Enabled:          u.Enabled(),
+		UnfinishedOrders: backlog.Orders,
+		OldestAgeSeconds: backlog.Age(time.Now()).Seconds(),
+		BacklogThreshold: u.BacklogThreshold,
+		BacklogExceeded:  u.backlogExceeded(backlog),
+	}
+	if backlog.Orders != 0 {
+		status.OldestUploadedAt = &backlog.OldestUploadedAt
+	}
+	if until := u.ThrottledUntil(); !until.IsZero() {
+		status.ThrottledUntil = &until
+	}
+	return status, nil
+}
+
+func (u *Accrual) backlog(ctx context.Context) (storage.AccrualBacklog, error) {
+	backlog, err := u.GetAccrualBacklog(ctx)
+	if err != nil {
+		return storage.AccrualBacklog{}, err
+	}
+
+	metrics.AccrualBacklog.Set(int64(backlog.Orders))
+	metrics.AccrualBacklogAge.Set(backlog.Age(time.Now()).Seconds())
+	return *backlog, nil
+}
+
+func (u *Accrual) backlogExceeded(backlog storage.AccrualBacklog) bool {
+	return u.BacklogThreshold > 0 && backlog.Orders > u.BacklogThreshold
+}
+
+// watchBacklog keeps the backlog metrics current and warns when the backlog
+// exceeds the threshold.
+func (u *Accrual) watchBacklog() {
+	ticker := time.NewTicker(u.BacklogInterval)
+	defer ticker.Stop()
+
+	exceeded := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-u.ctx.Done():
+			return
+		}
+
+		ctx := requestid.NewContext(u.ctx, "backlog-")
+		logger := requestid.Logger(ctx, u.Logger)
+
+		backlog, err := u.backlog(ctx)
+		if err != nil {
+			logger.Error("can't get accrual backlog", zap.Error(err))
+			continue
+		}
+
+		wasExceeded := exceeded
+		exceeded = u.backlogExceeded(backlog)
+		if !exceeded || wasExceeded {
+			continue
+		}
+
+		logger.Warn("accrual backlog exceeds threshold",
+			zap.Int("orders", backlog.Orders),
+			zap.Int("threshold", u.BacklogThreshold),
+			zap.Duration("oldest_age", backlog.Age(time.Now())),
+		)
+		if bn, ok := u.Notifier.(BacklogNotifier); ok {
+			bn.BacklogExceeded(ctx, backlog, u.BacklogThreshold)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+)
+
+type registerOrderRequest struct {
+	Order string `json:"order"`
+}
+
+const defaultRetryAfter = 60 * time.Second
+
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+func newRateLimitError(retryAfterValue string) *RateLimitError {
+	seconds, err := strconv.ParseInt(retryAfterValue, 10, 64)
+	if err != nil || seconds <= 0 {
+		return &RateLimitError{RetryAfter: defaultRetryAfter}
+	}
+
+	return &RateLimitError{RetryAfter: time.Duration(seconds) * time.Second}
+}
+
+// DefaultHTTPConfig bounds every request so that a hung accrual system can't
+// hold a worker for longer than ten seconds.
+var DefaultHTTPConfig = HTTPConfig{
+	DialTimeout:         3 * time.Second,
+	ResponseTimeout:     5 * time.Second,
+	RequestTimeout:      10 * time.Second,
+	KeepAlive:           30 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConnsPerHost: DefaultWorkers,
+}
+
+// HTTPConfig tunes the connections of HTTP providers. ResponseTimeout limits
+// the wait for response headers and RequestTimeout the whole request,
+// including reading the body. MaxIdleConnsPerHost should be about the number
+// of workers, so that connections are reused rather than redialed.
+type HTTPConfig struct {
+	DialTimeout         time.Duration
+	ResponseTimeout     time.Duration
+	RequestTimeout      time.Duration
+	KeepAlive           time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+}
+
+func (c HTTPConfig) withDefaults() HTTPConfig {
+	if c == (HTTPConfig{}) {
+		return DefaultHTTPConfig
+	}
+	return c
+}
+
+func (c HTTPConfig) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}).DialContext
+	transport.ResponseHeaderTimeout = c.ResponseTimeout
+	transport.IdleConnTimeout = c.IdleConnTimeout
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	return transport
+}
+
+type HTTPProvider struct {
+	baseAddr string
+	client   *resty.Client
+}
+
+func NewHTTPProvider(baseAddr, token string, cfg HTTPConfig) *HTTPProvider {
+	cfg = cfg.withDefaults()
+
+	// Retries are up to the RetryPolicy of the provider's route.
+	client := resty.New().
+		SetTransport(cfg.transport()).
+		SetTimeout(cfg.RequestTimeout).
+		OnBeforeRequest(requestid.Propagate)
+	client = tracing.InstrumentClient(client)
+	if len(token) != 0 {
+		client.SetAuthToken(token)
+	}
+
+	return &HTTPProvider{
+		baseAddr: baseAddr,
+		client:   client,
+	}
+}
+
+func (p *HTTPProvider) GetOrderStatus(ctx context.Context, orderID string) (*OrderInfo, error) {
+	url := fmt.Sprintf("%s/api/orders/%s", p.baseAddr, orderID)
+	response, err := p.client.R().SetContext(ctx).Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, ErrOrderNotRegistered
+	case http.StatusNotFound:
+		return nil, ErrOrderNotFound
+	case http.StatusTooManyRequests:
+		return nil, newRateLimitError(response.Header().Get("Retry-After"))
+	default:
+		return nil, &StatusError{Code: response.StatusCode()}
+	}
+
+	var info OrderInfo
+	if err := json.Unmarshal(response.Body(), &info); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadResponse, err)
+	}
+	if err := info.validate(orderID); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (p *HTTPProvider) RegisterOrder(ctx context.Context, orderID string) error {
+	url := fmt.Sprintf("%s/api/orders", p.baseAddr)
+	response, err := p.client.R().SetContext(ctx).SetBody(registerOrderRequest{Order: orderID}).Post(url)
+	if err != nil {
+		return err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK, http.StatusAccepted, http.StatusConflict:
+		return nil
+	default:
+		return &StatusError{Code: response.StatusCode()}
+	}
+}
@@ -0,0 +1,273 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+const (
+	DefaultProviderName = "default"
+	ProviderTypeHTTP    = "http"
+)
+
+type OrderInfo struct {
+	Order   string       `json:"order"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual"`
+}
+
+var (
+	// ErrOrderNotRegistered means the accrual system doesn't know the order
+	// yet; it is asked again on the next cycle.
+	ErrOrderNotRegistered = errors.New("order is not registered in the accrual system")
+	// ErrOrderNotFound is counted per order; see Config.MaxNotFound.
+	ErrOrderNotFound = errors.New("order is not found in the accrual system")
+	ErrBadResponse   = errors.New("malformed accrual system response")
+	// ErrNoProvider means no provider route matches the order.
+	ErrNoProvider = errors.New("no accrual provider for order")
+	// ErrRegistrationFailed counts towards dead-lettering like a failed
+	// lookup.
+	ErrRegistrationFailed = errors.New("registering the order with the accrual system failed")
+)
+
+// validate checks an accrual response against the API contract.
+func (info *OrderInfo) validate(orderID string) error {
+	if len(info.Order) != 0 && info.Order != orderID {
+		return fmt.Errorf("%w: got order %q, asked for %q", ErrBadResponse, info.Order, orderID)
+	}
+
+	switch info.Status {
+	case StatusRegistered, StatusInvalid, StatusProcessing:
+		if info.Accrual != 0 {
+			return fmt.Errorf("%w: accrual %s for status %s", ErrBadResponse, info.Accrual, info.Status)
+		}
+	case StatusProcessed:
+		if info.Accrual < 0 {
+			return fmt.Errorf("%w: negative accrual %s", ErrBadResponse, info.Accrual)
+		}
+	default:
+		return fmt.Errorf("%w: unknown status %q", ErrBadResponse, info.Status)
+	}
+
+	return nil
+}
+
+// Provider is an accrual system. GetOrderStatus reports an order the system
+// doesn't know yet as ErrOrderNotRegistered and throttling as a
+// *RateLimitError.
+type Provider interface {
+	GetOrderStatus(ctx context.Context, orderID string) (*OrderInfo, error)
+	RegisterOrder(ctx context.Context, orderID string) error
+}
+
+// ProviderConfig configures a provider. Type selects the implementation and
+// defaults to http.
+type ProviderConfig struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Prefix    string `json:"prefix"`
+	BaseAddr  string `json:"base_addr"`
+	Token     string `json:"token"`
+	RateLimit int    `json:"rate_limit"`
+
+	// HTTP is set from Config.HTTP.
+	HTTP HTTPConfig `json:"-"`
+}
+
+// ProviderFactory creates a provider of a registered type.
+type ProviderFactory func(cfg ProviderConfig) (Provider, error)
+
+var (
+	providerTypesMu sync.RWMutex
+	providerTypes   = map[string]ProviderFactory{
+		ProviderTypeHTTP: func(cfg ProviderConfig) (Provider, error) {
+			if len(cfg.BaseAddr) == 0 {
+				return nil, errors.New("base_addr is required")
+			}
+			return NewHTTPProvider(cfg.BaseAddr, cfg.Token, cfg.HTTP), nil
+		},
+	}
+)
+
+// RegisterProviderType makes an implementation available as a provider type
+// in ProviderConfig. It is meant to be called from init functions, like
+// database/sql drivers.
+func RegisterProviderType(name string, factory ProviderFactory) {
+	providerTypesMu.Lock()
+	defer providerTypesMu.Unlock()
+
+	if _, ok := providerTypes[name]; ok {
+		panic("accrual: provider type " + name + " registered twice")
+	}
+	providerTypes[name] = factory
+}
+
+// NewProvider creates the provider cfg describes.
+func NewProvider(cfg ProviderConfig) (Provider, error) {
+	typ := cfg.Type
+	if len(typ) == 0 {
+		typ = ProviderTypeHTTP
+	}
+
+	providerTypesMu.RLock()
+	factory, ok := providerTypes[typ]
+	providerTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("accrual provider %s: unknown type %q", cfg.Name, typ)
+	}
+
+	p, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("accrual provider %s: %w", cfg.Name, err)
+	}
+	return p, nil
+}
+
+type routedProvider struct {
+	ProviderConfig
+	Provider
+	limiter *limiter
+	retry   RetryPolicy
+}
+
+func ParseProviders(value string) ([]ProviderConfig, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var providers []ProviderConfig
+	if err := json.Unmarshal([]byte(value), &providers); err != nil {
+		return nil, fmt.Errorf("failed to parse accrual providers: %w", err)
+	}
+
+	for i, p := range providers {
+		if len(p.Name) == 0 {
+			return nil, fmt.Errorf("accrual provider #%d: name is required", i)
+		}
+		// Creating the provider checks its type and settings; NewAccrual
+		// creates the one that is used.
+		if _, err := NewProvider(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return providers, nil
+}
+
+func newRoutedProvider(cfg ProviderConfig, p Provider, retry RetryPolicy) *routedProvider {
+	return &routedProvider{
+		ProviderConfig: cfg,
+		Provider:       p,
+		limiter:        newLimiter(cfg.RateLimit),
+		retry:          retry,
+	}
+}
+
+// GetOrderStatus asks the provider with rate limiting and retries. Every
+// attempt counts against the rate limit.
+func (p *routedProvider) GetOrderStatus(ctx context.Context, orderID string) (*OrderInfo, error) {
+	var info *OrderInfo
+	err := p.retry.do(ctx, func() error {
+		if err := p.limiter.wait(ctx); err != nil {
+			return err
+		}
+
+		metrics.AccrualRequests.Add(p.Name, 1)
+
+		var err error
+		info, err = p.Provider.GetOrderStatus(ctx, orderID)
+		if err != nil && !errors.Is(err, ErrOrderNotRegistered) {
+			metrics.AccrualErrors.Add(p.Name, 1)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (p *routedProvider) RegisterOrder(ctx context.Context, orderID string) error {
+	return p.retry.do(ctx, func() error {
+		if err := p.limiter.wait(ctx); err != nil {
+			return err
+		}
+
+		metrics.AccrualRequests.Add(p.Name, 1)
+
+		err := p.Provider.RegisterOrder(ctx, orderID)
+		if err != nil {
+			metrics.AccrualErrors.Add(p.Name, 1)
+		}
+		return err
+	})
+}
+
+// route picks the provider with the longest matching prefix; providers
+// without a prefix act as a fallback.
+func route(providers []*routedProvider, orderID string) *routedProvider {
+	var matched *routedProvider
+	for _, p := range providers {
+		if !strings.HasPrefix(orderID, p.Prefix) {
+			continue
+		}
+		if matched == nil || len(p.Prefix) > len(matched.Prefix) {
+			matched = p
+		}
+	}
+
+	return matched
+}
+
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newLimiter(rps int) *limiter {
+	l := &limiter{}
+	if rps > 0 {
+		l.interval = time.Second / time.Duration(rps)
+	}
+
+	return l
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
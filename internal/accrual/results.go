@@ -0,0 +1,69 @@
+package accrual
+
+import (
+	"sync"
+	"time"
+)
+
+const DefaultResultCacheTTL = time.Hour
+
+// resultCache keeps final accrual results until they are committed, so an
+// order whose update failed is retried from the cache instead of asking the
+// provider again for an answer that can't change.
+type resultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]cachedResult
+}
+
+type cachedResult struct {
+	info     OrderInfo
+	provider string
+	expires  time.Time
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		entries: make(map[string]cachedResult),
+	}
+}
+
+func (c *resultCache) get(orderID string) (*OrderInfo, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[orderID]
+	if !ok || time.Now().After(e.expires) {
+		return nil, "", false
+	}
+	info := e.info
+	return &info, e.provider, true
+}
+
+// put remembers info if it is final; other statuses must be polled again.
+func (c *resultCache) put(orderID, provider string, info *OrderInfo) {
+	if info.Status != StatusProcessed && info.Status != StatusInvalid {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for id, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[orderID] = cachedResult{info: *info, provider: provider, expires: now.Add(c.ttl)}
+}
+
+func (c *resultCache) forget(orderIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range orderIDs {
+		delete(c.entries, id)
+	}
+}
@@ -0,0 +1,125 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRetryPolicy retries a failed request up to three times, within five
+// seconds, sharing six retries between all requests for an order in a cycle.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	MaxElapsed:  5 * time.Second,
+	OrderBudget: 6,
+}
+
+// RetryPolicy spaces out retries of failed accrual requests with exponential
+// backoff and full jitter, so workers that failed together don't retry
+// together. No retry is started once MaxElapsed has passed since the first
+// attempt, and OrderBudget, unless zero, caps the retries of all requests
+// made for one order in a poll cycle.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxElapsed  time.Duration
+	OrderBudget int
+}
+
+// StatusError is an unexpected HTTP status from the accrual system.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad status code: %d", e.Code)
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		return DefaultRetryPolicy
+	}
+	return rp
+}
+
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.BaseDelay << attempt
+	if d <= 0 || (rp.MaxDelay > 0 && d > rp.MaxDelay) {
+		d = rp.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// do calls fn until it succeeds, fails with an error not worth retrying or
+// the policy is exhausted.
+func (rp RetryPolicy) do(ctx context.Context, fn func() error) error {
+	start := time.Now()
+	budget, _ := ctx.Value(retryBudgetCtxKey{}).(*atomic.Int64)
+
+	var err error
+	for attempt := 0; attempt < rp.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if budget != nil && budget.Add(-1) < 0 {
+				return err
+			}
+
+			delay := rp.backoff(attempt - 1)
+			if rp.MaxElapsed > 0 && time.Since(start)+delay > rp.MaxElapsed {
+				return err
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+		}
+
+		err = fn()
+		if err == nil || !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+type retryBudgetCtxKey struct{}
+
+// withRetryBudget gives the requests made with ctx a shared number of
+// retries.
+func withRetryBudget(ctx context.Context, retries int) context.Context {
+	if retries <= 0 {
+		return ctx
+	}
+	budget := &atomic.Int64{}
+	budget.Store(int64(retries))
+	return context.WithValue(ctx, retryBudgetCtxKey{}, budget)
+}
+
+// retryable reports whether err may go away on a retry: transport errors and
+// server errors do, answers about the order and throttling don't.
+func retryable(err error) bool {
+	var rateLimitErr *RateLimitError
+	var statusErr *StatusError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, ErrOrderNotRegistered), errors.Is(err, ErrOrderNotFound),
+		errors.Is(err, ErrBadResponse), errors.As(err, &rateLimitErr):
+		return false
+	case errors.As(err, &statusErr):
+		return statusErr.Code >= 500
+	}
+	return true
+}
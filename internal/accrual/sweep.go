@@ -0,0 +1,82 @@
+package accrual
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+)
+
+const DefaultSweepInterval = 24 * time.Hour
+
+// sweepOwner claims the orders of the sweep, so the fast poller of the same
+// instance doesn't take them while they are looked up.
+func (u *Accrual) sweepOwner() string {
+	return u.InstanceID + "-sweep"
+}
+
+// sweepOrders catches up on the orders the fast poller no longer looks at,
+// e.g. those stuck after an outage of the accrual system.
+func (u *Accrual) sweepOrders() {
+	defer u.loops.Done()
+
+	ticker := time.NewTicker(u.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.sweep()
+		case <-u.stopping:
+			return
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep pages through every unfinished order that hasn't changed for
+// StaleAfter, one claim batch at a time.
+func (u *Accrual) sweep() {
+	ctx, span := tracing.Start(requestid.NewContext(u.ctx, "accrual-sweep-"), "accrual.sweep", tracing.KindInternal)
+	defer span.End()
+	logger := requestid.Logger(ctx, u.Logger)
+
+	started := time.Now()
+	filter := storage.ClaimFilter{UpdatedBefore: started.Add(-u.StaleAfter), ByNumber: true}
+	swept := 0
+	for {
+		select {
+		case <-u.stopping:
+			return
+		default:
+		}
+		if err := u.waitPause(); err != nil {
+			return
+		}
+
+		orders, err := u.ClaimUnfinishedOrders(ctx, u.sweepOwner(), u.ClaimLease, filter, u.ClaimBatch)
+		if err != nil {
+			logger.Error("can't claim stale orders", zap.Error(err))
+			return
+		}
+		if len(orders) == 0 {
+			break
+		}
+
+		u.process(ctx, orders)
+		swept += len(orders)
+		metrics.AccrualSweptOrders.Add(int64(len(orders)))
+		filter.AfterNumber = orders[len(orders)-1].OrderNumber
+	}
+
+	if err := u.ReleaseOrderClaims(ctx, u.sweepOwner()); err != nil {
+		logger.Error("can't release order claims", zap.String("owner", u.sweepOwner()), zap.Error(err))
+	}
+	if swept != 0 {
+		logger.Info("accrual sweep finished", zap.Int("orders", swept), zap.Duration("took", time.Since(started)))
+	}
+}
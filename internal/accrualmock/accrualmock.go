@@ -0,0 +1,177 @@
+// Package accrualmock serves the accrual system API with scripted behaviour,
+// for local development and end-to-end tests without the real accrual binary.
+package accrualmock
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+const (
+	DefaultProcessingPolls = 1
+	DefaultAccrual         = money.Amount(50000)
+	DefaultRetryAfter      = time.Second
+)
+
+// Scenario describes how the mock answers. Per-order outcomes are derived
+// from the order number, so the same order always ends the same way.
+type Scenario struct {
+	// Delay is added to every response.
+	Delay time.Duration
+	// RateLimitEvery answers every Nth request with 429; zero disables it.
+	RateLimitEvery int
+	RetryAfter     time.Duration
+	// UnregisteredRatio of orders are answered with 204 forever, and
+	// InvalidRatio of orders end up INVALID.
+	UnregisteredRatio float64
+	InvalidRatio      float64
+	// ProcessingPolls is the number of polls an order stays PROCESSING
+	// before it gets its final status.
+	ProcessingPolls int
+	// Accrual is credited for every PROCESSED order.
+	Accrual money.Amount
+}
+
+type Server struct {
+	scenario Scenario
+
+	mu       sync.Mutex
+	requests int
+	polls    map[string]int
+}
+
+func NewServer(scenario Scenario) *Server {
+	if scenario.ProcessingPolls < 0 {
+		scenario.ProcessingPolls = DefaultProcessingPolls
+	}
+	if scenario.RetryAfter <= 0 {
+		scenario.RetryAfter = DefaultRetryAfter
+	}
+
+	return &Server{
+		scenario: scenario,
+		polls:    make(map[string]int),
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.delay)
+	r.Use(s.rateLimit)
+	r.Get("/api/orders/{number}", s.apiGetOrder)
+	r.Post("/api/orders", s.apiRegisterOrder)
+	return r
+}
+
+func (s *Server) delay(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.scenario.Delay > 0 {
+			select {
+			case <-time.After(s.scenario.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.throttled() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.scenario.RetryAfter.Seconds())))
+			http.Error(w, "No more than N requests per minute allowed", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) throttled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	return s.scenario.RateLimitEvery > 0 && s.requests%s.scenario.RateLimitEvery == 0
+}
+
+// poll answers a status request for the order; false means the order is
+// unregistered.
+func (s *Server) poll(number string) (accrual.OrderInfo, bool) {
+	if fraction(number, "unregistered") < s.scenario.UnregisteredRatio {
+		return accrual.OrderInfo{}, false
+	}
+
+	s.mu.Lock()
+	s.polls[number]++
+	polls := s.polls[number]
+	s.mu.Unlock()
+
+	info := accrual.OrderInfo{Order: number, Status: accrual.StatusProcessing}
+	if polls > s.scenario.ProcessingPolls {
+		if fraction(number, "invalid") < s.scenario.InvalidRatio {
+			info.Status = accrual.StatusInvalid
+		} else {
+			info.Status = accrual.StatusProcessed
+			info.Accrual = s.scenario.Accrual
+		}
+	}
+	return info, true
+}
+
+// register adds the order and reports false if it is already known.
+func (s *Server) register(number string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.polls[number]; ok {
+		return false
+	}
+	s.polls[number] = 0
+	return true
+}
+
+func (s *Server) apiGetOrder(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.poll(chi.URLParam(r, "number"))
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (s *Server) apiRegisterOrder(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Order string `json:"order"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Order) == 0 {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if !s.register(req.Order) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// fraction maps the order number to [0, 1). The salt makes the outcomes of
+// different ratios independent of each other.
+func fraction(number, salt string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(salt))
+	h.Write([]byte(number))
+	return float64(h.Sum32()) / (1 << 32)
+}
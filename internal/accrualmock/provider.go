@@ -0,0 +1,58 @@
+package accrualmock
+
+import (
+	"context"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+)
+
+// ProviderType is the accrual provider type of the in-process mock.
+const ProviderType = "mock"
+
+func init() {
+	accrual.RegisterProviderType(ProviderType, func(accrual.ProviderConfig) (accrual.Provider, error) {
+		return NewProvider(Scenario{
+			ProcessingPolls: DefaultProcessingPolls,
+			Accrual:         DefaultAccrual,
+		}), nil
+	})
+}
+
+// Provider answers like Server without the HTTP round-trip, for running the
+// service with no accrual system at all.
+type Provider struct {
+	server *Server
+}
+
+func NewProvider(scenario Scenario) *Provider {
+	return &Provider{server: NewServer(scenario)}
+}
+
+func (p *Provider) GetOrderStatus(ctx context.Context, orderID string) (*accrual.OrderInfo, error) {
+	s := p.server
+	if s.scenario.Delay > 0 {
+		timer := time.NewTimer(s.scenario.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if s.throttled() {
+		return nil, &accrual.RateLimitError{RetryAfter: s.scenario.RetryAfter}
+	}
+
+	info, ok := s.poll(orderID)
+	if !ok {
+		return nil, accrual.ErrOrderNotRegistered
+	}
+	return &info, nil
+}
+
+func (p *Provider) RegisterOrder(_ context.Context, orderID string) error {
+	p.server.register(orderID)
+	return nil
+}
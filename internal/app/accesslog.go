@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+)
+
+var accessLogCtxKey = &contextKey{"AccessLog"}
+
+type accessLogEntry struct {
+	userID uuid.UUID
+}
+
+// setAccessLogUser records the authenticated user for the access log line of
+// the current request.
+func setAccessLogUser(ctx context.Context, userID uuid.UUID) {
+	if entry, ok := ctx.Value(accessLogCtxKey).(*accessLogEntry); ok {
+		entry.userID = userID
+	}
+}
+
+// AccessLog logs one line per request. Successful requests are logged with
+// the given probability; failed ones (status 400 and above) are always logged.
+func AccessLog(logger *zap.Logger, sampleRatio float64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			entry := &accessLogEntry{}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessLogCtxKey, entry)))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status < http.StatusBadRequest && sampleRatio < 1 && rand.Float64() >= sampleRatio {
+				return
+			}
+
+			fields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Int("status", status),
+				zap.Duration("latency", time.Since(start)),
+				zap.Int("bytes", ww.BytesWritten()),
+			}
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				if pattern := rctx.RoutePattern(); len(pattern) != 0 {
+					fields = append(fields, zap.String("route", pattern))
+				}
+			}
+			if entry.userID != uuid.Nil {
+				fields = append(fields, zap.String("user_id", entry.userID.String()))
+			}
+
+			requestid.Logger(r.Context(), logger).Info("request", fields...)
+		})
+	}
+}
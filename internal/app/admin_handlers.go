@@ -0,0 +1,676 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const OperatorHeader = "X-Operator"
+
+type AdminServer struct {
+	ctx            context.Context
+	logger         *zap.Logger
+	storageService storage.AppStorage
+	accrual        *accrual.Accrual
+}
+
+type accrualLogResponse struct {
+	Order     string                        `json:"order"`
+	Attempts  int                           `json:"attempts"`
+	LastError string                        `json:"last_error,omitempty"`
+	Entries   []storage.AccrualJournalEntry `json:"entries"`
+}
+
+type adminUserResponse struct {
+	ID         uuid.UUID            `json:"id"`
+	MerchantID uuid.UUID            `json:"merchant_id"`
+	Login      string               `json:"login"`
+	Role       string               `json:"role"`
+	CreatedAt  time.Time            `json:"created_at"`
+	Balance    *storage.BalanceInfo `json:"balance"`
+}
+
+type merchantRequest struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+}
+
+type merchantResponse struct {
+	*storage.Merchant
+	APIKey string `json:"api_key"`
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+type balanceAdjustmentRequest struct {
+	Amount     money.Amount `json:"amount"`
+	ReasonCode string       `json:"reason_code"`
+	Reason     string       `json:"reason"`
+}
+
+type mergeRequest struct {
+	Source uuid.UUID `json:"source"`
+	Reason string    `json:"reason"`
+}
+
+func NewAdminServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage, accrual *accrual.Accrual) (*AdminServer, error) {
+	server := &AdminServer{
+		ctx:            ctx,
+		logger:         logger,
+		storageService: storage,
+		accrual:        accrual,
+	}
+
+	return server, nil
+}
+
+// operator names who made an admin request: the staff user when authorized
+// by token, otherwise the X-Operator header sent along with the API key.
+func operator(r *http.Request) string {
+	if userData, ok := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization); ok {
+		return userData.Login
+	}
+	return r.Header.Get(OperatorHeader)
+}
+
+// staffMerchant returns the merchant of the staff user who made the request,
+// the only one whose users they may see or change. It reports false for the
+// API key, which reaches every merchant.
+func staffMerchant(r *http.Request) (uuid.UUID, bool) {
+	if userData, ok := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization); ok {
+		return userData.MerchantID, true
+	}
+	return uuid.Nil, false
+}
+
+// checkStaffMerchant writes 404 and reports false when a staff user asks for
+// a user of another merchant, as if the user didn't exist.
+func (s *AdminServer) checkStaffMerchant(w http.ResponseWriter, r *http.Request, userID uuid.UUID) bool {
+	merchantID, scoped := staffMerchant(r)
+	if !scoped {
+		return true
+	}
+
+	user, err := s.storageService.GetUserAuthInfoByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			http.Error(w, "", http.StatusNotFound)
+			return false
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to get user", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return false
+	}
+	if user.MerchantID != merchantID {
+		http.Error(w, "", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (s *AdminServer) apiGetOrderAccrualLog(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "number")
+
+	entries, err := s.storageService.GetAccrualJournal(r.Context(), orderID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get accrual journal", zap.String("order_id", orderID), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	if len(entries) == 0 {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	resp := accrualLogResponse{
+		Order:    orderID,
+		Attempts: len(entries),
+		Entries:  entries,
+	}
+	for _, e := range entries {
+		if len(e.Error) != 0 {
+			resp.LastError = e.Error
+		}
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, resp)
+}
+
+// apiAddMerchant creates a merchant. Its API key is only returned here; the
+// database keeps a hash.
+func (s *AdminServer) apiAddMerchant(w http.ResponseWriter, r *http.Request) {
+	req := merchantRequest{}
+	if err := decodeJSON(r, &req); err != nil || len(req.Name) == 0 {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	apiKey, err := newRandomToken()
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	merchant := &storage.Merchant{Name: req.Name, Host: req.Host}
+	if err := s.storageService.AddMerchant(r.Context(), merchant, hashMerchantKey(apiKey)); err != nil {
+		if errors.Is(err, storage.ErrDuplicateMerchant) {
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to add merchant", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("merchant added",
+		zap.String("merchant_id", merchant.ID.String()),
+		zap.String("operator", operator(r)),
+	)
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusCreated, merchantResponse{Merchant: merchant, APIKey: apiKey})
+}
+
+func (s *AdminServer) apiFindUser(w http.ResponseWriter, r *http.Request) {
+	login := r.URL.Query().Get("login")
+	if len(login) == 0 {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	merchantID := storage.DefaultMerchantID
+	staffMerchantID, scoped := staffMerchant(r)
+	if scoped {
+		merchantID = staffMerchantID
+	}
+	if merchant := r.URL.Query().Get("merchant"); len(merchant) != 0 {
+		var err error
+		if merchantID, err = uuid.Parse(merchant); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if scoped && merchantID != staffMerchantID {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+	}
+
+	user, err := s.storageService.GetUserAuthInfo(r.Context(), merchantID, login)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to find user", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	balance, err := s.storageService.GetBalance(r.Context(), user.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get balance", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, adminUserResponse{
+		ID:         user.ID,
+		MerchantID: user.MerchantID,
+		Login:      user.Login,
+		Role:       user.Role,
+		CreatedAt:  user.CreatedAt,
+		Balance:    balance,
+	})
+}
+
+// apiAddPlacedOrder registers an order on behalf of a merchant, e.g. the
+// default one, which has no API key.
+func (s *AdminServer) apiAddPlacedOrder(w http.ResponseWriter, r *http.Request) {
+	merchantID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if staffMerchantID, scoped := staffMerchant(r); scoped && merchantID != staffMerchantID {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	addPlacedOrder(w, r, s.logger, s.storageService, merchantID)
+}
+
+func (s *AdminServer) apiSetUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if !s.checkStaffMerchant(w, r, userID) {
+		return
+	}
+
+	req := roleRequest{}
+	if err := decodeJSON(r, &req); err != nil || !storage.ValidRole(req.Role) {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if err := s.storageService.SetUserRole(r.Context(), userID, req.Role); err != nil {
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to set user role", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("user role changed",
+		zap.String("user_id", userID.String()),
+		zap.String("role", req.Role),
+		zap.String("operator", operator(r)),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) apiGetUserOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if !s.checkStaffMerchant(w, r, userID) {
+		return
+	}
+
+	orders, err := s.storageService.GetOrders(r.Context(), userID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get orders", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, orders)
+}
+
+func (s *AdminServer) apiGetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if !s.checkStaffMerchant(w, r, userID) {
+		return
+	}
+
+	ws, err := s.storageService.GetWithdrawals(r.Context(), userID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get withdrawals", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, ws)
+}
+
+func (s *AdminServer) apiRequeueOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "number")
+
+	if err := s.storageService.RequeueOrder(r.Context(), orderID); err != nil {
+		if errors.Is(err, storage.ErrNoSuchOrder) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to requeue order", zap.String("order_id", orderID), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("order requeued",
+		zap.String("order_id", orderID),
+		zap.String("operator", operator(r)),
+	)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *AdminServer) apiGetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := s.storageService.GetDeadLetters(r.Context())
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get dead letters", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, letters)
+}
+
+// apiGetNotificationDeliveries lists outbox deliveries, newest first,
+// optionally only those of ?user= or with ?status= pending, sent or failed.
+func (s *AdminServer) apiGetNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	filter := storage.NotificationDeliveryFilter{Status: query.Get("status"), Limit: limit}
+	filter.MerchantID.UUID, filter.MerchantID.Valid = staffMerchant(r)
+	switch filter.Status {
+	case "", storage.DeliveryPending, storage.DeliverySent, storage.DeliveryFailed:
+	default:
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if user := query.Get("user"); len(user) != 0 {
+		if filter.UserID, err = uuid.Parse(user); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	deliveries, err := s.storageService.GetNotificationDeliveries(r.Context(), filter)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get notification deliveries", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, deliveries)
+}
+
+func (s *AdminServer) apiGetAccrualStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.accrual.Status(r.Context())
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get accrual status", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, status)
+}
+
+func (s *AdminServer) apiRedriveOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := chi.URLParam(r, "number")
+
+	if err := s.storageService.RedriveOrder(r.Context(), orderID); err != nil {
+		if errors.Is(err, storage.ErrNoSuchOrder) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to redrive order", zap.String("order_id", orderID), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("order redriven",
+		zap.String("order_id", orderID),
+		zap.String("operator", operator(r)),
+	)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *AdminServer) apiUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.storageService.GetUserAuthInfoByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to get user", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+	if merchantID, scoped := staffMerchant(r); scoped && user.MerchantID != merchantID {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	if err := s.storageService.ResetLoginFailures(r.Context(), loginLockKey(user.MerchantID, user.Login)); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to unlock user", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("user unlocked",
+		zap.String("user_id", userID.String()),
+		zap.String("operator", operator(r)),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiUnlockIP lifts the lock on a client address and clears its failures.
+func (s *AdminServer) apiUnlockIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(chi.URLParam(r, "ip"))
+	if ip == nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storageService.ResetLoginFailures(r.Context(), ipLockKey(ip.String())); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to unlock IP", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("IP unlocked",
+		zap.String("ip", ip.String()),
+		zap.String("operator", operator(r)),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) apiAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if !s.checkStaffMerchant(w, r, userID) {
+		return
+	}
+
+	operator := operator(r)
+	if len(operator) == 0 {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	req := balanceAdjustmentRequest{}
+	if err := decodeJSON(r, &req); err != nil || req.Amount == 0 || len(req.Reason) == 0 {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+	if !storage.ValidAdjustmentReason(req.ReasonCode) {
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		return
+	}
+
+	balance, err := s.storageService.AdjustBalance(r.Context(), storage.BalanceAdjustment{
+		UserID:     userID,
+		Amount:     req.Amount,
+		ReasonCode: req.ReasonCode,
+		Reason:     req.Reason,
+		Operator:   operator,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotEnoughBalance) {
+			http.Error(w, "", http.StatusPaymentRequired)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to adjust balance", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("balance adjusted",
+		zap.String("user_id", userID.String()),
+		zap.Stringer("amount", req.Amount),
+		zap.String("reason_code", req.ReasonCode),
+		zap.String("operator", operator),
+	)
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, balance)
+}
+
+// apiMergeUser merges the account given as source into the one in the path,
+// for users who registered twice. The source account is deleted.
+func (s *AdminServer) apiMergeUser(w http.ResponseWriter, r *http.Request) {
+	targetID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if !s.checkStaffMerchant(w, r, targetID) {
+		return
+	}
+
+	operator := operator(r)
+	if len(operator) == 0 {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	req := mergeRequest{}
+	if err := decodeJSON(r, &req); err != nil || req.Source == uuid.Nil || len(req.Reason) == 0 {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+	if req.Source == targetID {
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		return
+	}
+	if !s.checkStaffMerchant(w, r, req.Source) {
+		return
+	}
+
+	merge, err := s.storageService.MergeUsers(r.Context(), storage.AccountMerge{
+		SourceUserID: req.Source,
+		TargetUserID: targetID,
+		Reason:       req.Reason,
+		Operator:     operator,
+	})
+	if err != nil {
+		if !errors.Is(err, storage.ErrNoSuchUser) && !errors.Is(err, storage.ErrDifferentMerchants) {
+			requestid.Logger(r.Context(), s.logger).Error("failed to merge users", zap.Error(err))
+		}
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	requestid.Logger(r.Context(), s.logger).Info("users merged",
+		zap.String("merge_id", merge.ID.String()),
+		zap.String("source_user_id", merge.SourceUserID.String()),
+		zap.String("target_user_id", merge.TargetUserID.String()),
+		zap.Int("orders", merge.Orders),
+		zap.Int("withdrawals", merge.Withdrawals),
+		zap.Int("dropped_idempotency_keys", merge.DroppedIdempotencyKeys),
+		zap.String("operator", operator),
+	)
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, merge)
+}
+
+// apiGetBalanceAudit lists balance changes, newest first, for dispute
+// resolution. It can be narrowed to a user, an order or adjustment, and a
+// time range.
+func (s *AdminServer) apiGetBalanceAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	filter := storage.BalanceAuditFilter{Reference: query.Get("reference"), Limit: limit}
+	filter.MerchantID.UUID, filter.MerchantID.Valid = staffMerchant(r)
+	if user := query.Get("user"); len(user) != 0 {
+		if filter.UserID, err = uuid.Parse(user); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+	for param, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if !query.Has(param) {
+			continue
+		}
+		if *value, err = time.Parse(time.RFC3339, query.Get(param)); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := s.storageService.GetBalanceAudit(r.Context(), filter)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get balance audit", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, entries)
+}
+
+// apiGetBalanceDrift lists what balance reconciliation found, newest first.
+func (s *AdminServer) apiGetBalanceDrift(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	filter := storage.BalanceDriftFilter{Limit: limit}
+	filter.MerchantID.UUID, filter.MerchantID.Valid = staffMerchant(r)
+	if user := query.Get("user"); len(user) != 0 {
+		if filter.UserID, err = uuid.Parse(user); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+	}
+
+	drifts, err := s.storageService.GetBalanceDrift(r.Context(), filter)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get balance drift", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, drifts)
+}
+
+// logLevelHandler changes the level of the running logger, e.g. to debug an
+// incident, and records who changed it. The body is {"level": "debug"}.
+func (s *AdminServer) logLevelHandler(level zap.AtomicLevel) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		previous := level.Level()
+		level.ServeHTTP(w, r)
+
+		if current := level.Level(); current != previous {
+			requestid.Logger(r.Context(), s.logger).Warn("log level changed",
+				zap.Stringer("from", previous),
+				zap.Stringer("to", current),
+				zap.String("operator", operator(r)),
+			)
+		}
+	}
+}
@@ -1,40 +1,80 @@
 package app
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"io"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/jwtauth"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/service"
 	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
 )
 
-const AuthCookieName = "jwt"
+const (
+	AuthCookieName         = "jwt"
+	RefreshCookieName      = "refresh_token"
+	DefaultTokenTTL        = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+	randomTokenSize = 32
+)
 
 type userAuthRequest struct {
 	Login    string
 	Password string
 }
 
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type AuthServer struct {
 	ctx         context.Context
 	logger      *zap.Logger
 	userStorage storage.AppStorage
 	authorizer  *jwtauth.JWTAuth
+	tokenTTL    time.Duration
+	refreshTTL  time.Duration
+	users       *service.UserService
+	balances    *service.BalanceService
+	lockout     LoginLockout
+	cookies     Cookies
 }
 
-func NewAuthServer(ctx context.Context, logger *zap.Logger, userStorage storage.AppStorage, authorizer *jwtauth.JWTAuth) (*AuthServer, error) {
+func NewAuthServer(ctx context.Context, logger *zap.Logger, userStorage storage.AppStorage, users *service.UserService, balances *service.BalanceService, authorizer *jwtauth.JWTAuth, tokenTTL, refreshTTL time.Duration, lockout LoginLockout, cookies Cookies) (*AuthServer, error) {
+	if tokenTTL <= 0 {
+		tokenTTL = DefaultTokenTTL
+	}
+	if refreshTTL <= 0 {
+		refreshTTL = DefaultRefreshTokenTTL
+	}
+
 	server := &AuthServer{
 		ctx:         ctx,
 		logger:      logger,
 		userStorage: userStorage,
 		authorizer:  authorizer,
+		tokenTTL:    tokenTTL,
+		refreshTTL:  refreshTTL,
+		users:       users,
+		balances:    balances,
+		lockout:     lockout,
+		cookies:     cookies,
 	}
 
 	return server, nil
@@ -43,95 +83,269 @@ func NewAuthServer(ctx context.Context, logger *zap.Logger, userStorage storage.
 func (s *AuthServer) registerUser(w http.ResponseWriter, r *http.Request) {
 	authData := userAuthRequest{}
 	if err := s.parseRequest(r, &authData); err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
-	if err := s.userStorage.AddUser(r.Context(), &storage.UserAuthorization{
-		Login:    authData.Login,
-		Password: []byte(authData.Password),
-	}); err != nil {
+	userData, err := s.users.Register(r.Context(), merchantFromContext(r.Context()), authData.Login, authData.Password)
+	if err != nil {
+		var passwordErr *validate.PasswordError
+		if errors.As(err, &passwordErr) {
+			writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusBadRequest, passwordErr)
+			return
+		}
 		if errors.Is(err, storage.ErrDuplicateUser) {
 			http.Error(w, "", http.StatusConflict)
 			return
 		}
-		http.Error(w, "", http.StatusInternalServerError)
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	s.issueToken(w, r, userData, uuid.Nil)
+}
+
+func (s *AuthServer) login(w http.ResponseWriter, r *http.Request) {
+	authData := userAuthRequest{}
+	if err := s.parseRequest(r, &authData); err != nil {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if !s.checkLoginLock(w, r, authData.Login) {
 		return
 	}
 
-	userData, err := s.userStorage.GetUserAuthInfo(r.Context(), authData.Login)
+	dbUserData, err := s.users.Authenticate(r.Context(), merchantFromContext(r.Context()), authData.Login, authData.Password)
 	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		if errors.Is(err, service.ErrInvalidCredentials) {
+			s.recordLoginFailure(r.Context(), r, authData.Login)
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("Failed to get user info from DB", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
 
-	_, value, err := s.authorizer.Encode(map[string]interface{}{"id": userData.ID, "ts": time.Now().Unix()})
+	s.resetLoginFailures(r.Context(), r, authData.Login)
+	s.issueToken(w, r, dbUserData, uuid.Nil)
+}
+
+// issueToken returns the JWT both as a cookie and, for clients that can't
+// manage cookies, in the Authorization header and response body.
+func (s *AuthServer) issueToken(w http.ResponseWriter, r *http.Request, user *storage.UserAuthorization, sessionID uuid.UUID) {
+	tokens, ok := s.setTokens(w, r, user, sessionID)
+	if !ok {
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, tokens)
+}
+
+// setTokens issues a token pair to the session, or to a new one if sessionID
+// is uuid.Nil, and sets the cookies and Authorization header for it. On
+// failure it writes the error response and returns false.
+func (s *AuthServer) setTokens(w http.ResponseWriter, r *http.Request, user *storage.UserAuthorization, sessionID uuid.UUID) (tokenResponse, bool) {
+	userID := user.ID
+	now := time.Now()
+	jti := uuid.New()
+
+	sessionID, err := s.saveSession(r, userID, sessionID, jti, now.Add(s.refreshTTL))
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchSession) {
+			http.Error(w, "", http.StatusUnauthorized)
+			return tokenResponse{}, false
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to save session", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return tokenResponse{}, false
+	}
+
+	claims := map[string]interface{}{
+		"id":   userID,
+		"ts":   now.Unix(),
+		"jti":  jti.String(),
+		"sid":  sessionID.String(),
+		"role": user.Role,
+		"exp":  now.Add(s.tokenTTL).Unix(),
+	}
+	_, value, err := s.authorizer.Encode(claims)
 	if err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
-		return
+		return tokenResponse{}, false
+	}
+
+	refreshToken, err := newRandomToken()
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return tokenResponse{}, false
+	}
+	csrfToken, err := newRandomToken()
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return tokenResponse{}, false
 	}
 
-	cookie := http.Cookie{
-		Name:  AuthCookieName,
-		Value: value,
-		Path:  "/",
+	if err := s.userStorage.AddRefreshToken(r.Context(), hashRefreshToken(refreshToken), userID, sessionID, now.Add(s.refreshTTL)); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to store refresh token", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return tokenResponse{}, false
 	}
-	http.SetCookie(w, &cookie)
 
-	w.WriteHeader(http.StatusOK)
+	// The access token cookie lives as long as the token, so the browser
+	// drops it when the session needs a refresh.
+	http.SetCookie(w, s.cookies.cookie(r, AuthCookieName, value, "/", s.tokenTTL, s.cookies.HTTPOnly))
+	http.SetCookie(w, s.cookies.cookie(r, RefreshCookieName, refreshToken, "/api/user", s.refreshTTL, true))
+	// Scripts read the CSRF cookie to echo it in CSRFHeader.
+	http.SetCookie(w, s.cookies.cookie(r, CSRFCookieName, csrfToken, "/", s.refreshTTL, false))
+	w.Header().Set("Authorization", "Bearer "+value)
+
+	return tokenResponse{Token: value, RefreshToken: refreshToken}, true
 }
 
-func (s *AuthServer) login(w http.ResponseWriter, r *http.Request) {
-	authData := userAuthRequest{}
-	if err := s.parseRequest(r, &authData); err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+// refresh exchanges a refresh token for a new token pair. Refresh tokens are
+// single-use: the presented one is consumed even if issuing fails.
+func (s *AuthServer) refresh(w http.ResponseWriter, r *http.Request) {
+	refreshToken := ""
+	if cookie, err := r.Cookie(RefreshCookieName); err == nil {
+		refreshToken = cookie.Value
+	}
+	if len(refreshToken) == 0 {
+		req := refreshRequest{}
+		if err := s.parseRequest(r, &req); err != nil {
+			http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+			return
+		}
+		refreshToken = req.RefreshToken
+	}
+
+	userID, sessionID, err := s.userStorage.ConsumeRefreshToken(r.Context(), hashRefreshToken(refreshToken))
+	if err != nil {
+		if !errors.Is(err, storage.ErrNoSuchToken) {
+			requestid.Logger(r.Context(), s.logger).Error("failed to consume refresh token", zap.Error(err))
+		}
+		http.Error(w, "", http.StatusUnauthorized)
 		return
 	}
 
-	dbUserData, err := s.userStorage.GetUserAuthInfo(r.Context(), authData.Login)
+	// Reload the user so the new token carries the current role.
+	user, err := s.userStorage.GetUserAuthInfoByID(r.Context(), userID)
 	if err != nil {
-		s.logger.Error("Failed to get user info from DB", zap.Error(err))
+		if !errors.Is(err, storage.ErrNoSuchUser) {
+			requestid.Logger(r.Context(), s.logger).Error("failed to get user data", zap.Error(err))
+		}
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	// Like access tokens, a refresh token is only valid at the merchant that
+	// issued it.
+	if user.MerchantID != merchantFromContext(r.Context()) {
+		requestid.Logger(r.Context(), s.logger).Info("refresh token presented to another merchant", zap.String("user_id", userID.String()))
 		http.Error(w, "", http.StatusUnauthorized)
 		return
 	}
 
-	if !bytes.Equal(dbUserData.Password, []byte(authData.Password)) {
+	s.issueToken(w, r, user, sessionID)
+}
+
+func newRandomToken() (string, error) {
+	b := make([]byte, randomTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *AuthServer) logout(w http.ResponseWriter, r *http.Request) {
+	token, _, err := jwtauth.FromContext(r.Context())
+	if err != nil || token == nil {
 		http.Error(w, "", http.StatusUnauthorized)
 		return
 	}
 
-	_, value, err := s.authorizer.Encode(map[string]interface{}{"id": dbUserData.ID, "ts": time.Now().Unix()})
+	jti, err := uuid.Parse(token.JwtID())
 	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		requestid.Logger(r.Context(), s.logger).Info("token without jti can't be revoked")
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.userStorage.RevokeToken(r.Context(), jti, token.Expiration()); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to revoke token", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
 
-	cookie := http.Cookie{
-		Name:  AuthCookieName,
-		Value: value,
-		Path:  "/",
+	if cookie, err := r.Cookie(RefreshCookieName); err == nil {
+		if _, _, err := s.userStorage.ConsumeRefreshToken(r.Context(), hashRefreshToken(cookie.Value)); err != nil && !errors.Is(err, storage.ErrNoSuchToken) {
+			requestid.Logger(r.Context(), s.logger).Error("failed to revoke refresh token", zap.Error(err))
+		}
+	}
+
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+	if sessionID := tokenSessionID(r.Context()); sessionID != uuid.Nil {
+		if err := s.userStorage.RevokeSession(r.Context(), userData.ID, sessionID); err != nil && !errors.Is(err, storage.ErrNoSuchSession) {
+			requestid.Logger(r.Context(), s.logger).Error("failed to revoke session", zap.Error(err))
+		}
 	}
-	http.SetCookie(w, &cookie)
 
+	s.clearAuthCookies(w, r)
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *AuthServer) parseRequest(r *http.Request, body interface{}) error {
-	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
-		return ErrBadContentType
+// deleteUser soft-deletes the caller's account. Deleted users fail
+// authorization, so tokens issued before are useless; the current one is
+// revoked as well.
+func (s *AuthServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	if err := s.users.Delete(r.Context(), userData.ID); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to delete user", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
 	}
 
-	b, err := io.ReadAll(r.Body)
+	s.revokeCurrentToken(r)
+
+	requestid.Logger(r.Context(), s.logger).Info("user deleted", zap.String("user_id", userData.ID.String()))
+	s.clearAuthCookies(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AuthServer) exportUser(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	export, err := s.users.Export(r.Context(), userData.ID)
 	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		return err
+		requestid.Logger(r.Context(), s.logger).Error("failed to export user data", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
 	}
 
-	if err = json.Unmarshal(b, &body); err != nil {
-		s.logger.Error("failed to unmarshal request json", zap.Error(err))
-		return ErrBodyUnmarshal
-	}
+	w.Header().Set("Content-Disposition", `attachment; filename="gophermart-export.json"`)
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, export)
+}
+
+// clearAuthCookies deletes the cookies with the attributes they were set
+// with, as browsers only match a deletion to a cookie with the same domain
+// and path.
+func (s *AuthServer) clearAuthCookies(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, s.cookies.cookie(r, AuthCookieName, "", "/", -1, s.cookies.HTTPOnly))
+	http.SetCookie(w, s.cookies.cookie(r, RefreshCookieName, "", "/api/user", -1, true))
+	http.SetCookie(w, s.cookies.cookie(r, CSRFCookieName, "", "/", -1, false))
+}
 
-	return nil
+func (s *AuthServer) parseRequest(r *http.Request, body interface{}) error {
+	err := decodeJSON(r, body)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Info("bad request body", zap.String("content_type", r.Header.Get("Content-Type")), zap.Error(err))
+	}
+	return err
 }
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxOrderBodySize = 512
+	maxJSONBodySize  = 4 << 10
+)
+
+// LimitBody caps the request body at n bytes. Reading past the limit fails
+// with an error that bodyErrorStatus reports as 413.
+func LimitBody(n int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasContentType reports whether the request body is of mediaType. Parameters
+// are allowed as long as the charset, if given, is UTF-8.
+func hasContentType(r *http.Request, mediaType string) bool {
+	t, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || t != mediaType {
+		return false
+	}
+	charset, ok := params["charset"]
+	return !ok || strings.EqualFold(charset, "utf-8")
+}
+
+func readBody(r *http.Request, mediaType string) ([]byte, error) {
+	if !hasContentType(r, mediaType) {
+		return nil, ErrBadContentType
+	}
+
+	b, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return nil, ErrBodyTooLarge
+	}
+	return b, err
+}
+
+func decodeJSON(r *http.Request, body interface{}) error {
+	b, err := readBody(r, "application/json")
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(b, body); err != nil {
+		return ErrBodyUnmarshal
+	}
+	return nil
+}
+
+// bodyErrorStatus maps an error from reading the request body to an HTTP
+// status, or returns fallback for malformed bodies.
+func bodyErrorStatus(err error, fallback int) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, ErrBodyTooLarge), errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrBadContentType):
+		return http.StatusUnsupportedMediaType
+	}
+	return fallback
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+type CallbackServer struct {
+	logger  *zap.Logger
+	accrual *accrual.Accrual
+}
+
+func NewCallbackServer(logger *zap.Logger, accrual *accrual.Accrual) *CallbackServer {
+	return &CallbackServer{
+		logger:  logger,
+		accrual: accrual,
+	}
+}
+
+func (s *CallbackServer) apiAccrualCallback(w http.ResponseWriter, r *http.Request) {
+	info := accrual.OrderInfo{}
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	if !validate.OrderNumber(info.Order) {
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := s.accrual.Apply(r.Context(), info); err != nil {
+		if errors.Is(err, accrual.ErrBadResponse) {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storage.ErrNoSuchOrder) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to apply accrual callback", zap.String("order_id", info.Order), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
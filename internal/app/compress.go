@@ -0,0 +1,304 @@
+package app
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+
+	DefaultCompressionLevel   = 5
+	DefaultCompressionMinSize = 1024
+	DefaultEncodings          = EncodingZstd + "," + EncodingBrotli + "," + EncodingGzip
+
+	// bulkCompressionLevel is used for large, rarely requested responses
+	// where the smaller transfer is worth the extra CPU.
+	bulkCompressionLevel = 9
+)
+
+var ErrUnknownEncoding = errors.New("unknown content encoding")
+
+// Compression configures response compression. Level is on the gzip scale of
+// 1 to 9 and is mapped to the nearest setting of the other encoders; 0
+// disables compression. Responses shorter than MinSize are sent as is.
+// Encodings lists the supported encodings in order of preference.
+type Compression struct {
+	Level     int
+	MinSize   int
+	Encodings []string
+}
+
+// ParseEncodings parses a comma-separated list of content encodings.
+func ParseEncodings(s string) ([]string, error) {
+	var encodings []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch e {
+		case "":
+			continue
+		case EncodingZstd, EncodingBrotli, EncodingGzip:
+			encodings = append(encodings, e)
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUnknownEncoding, e)
+		}
+	}
+	return encodings, nil
+}
+
+type compressionCtxKey struct{}
+
+// Compress encodes responses with the best encoding both the client and cfg
+// accept. Only text-like content is compressed.
+func Compress(cfg Compression) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), cfg.Encodings)
+			if len(encoding) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       encoding,
+				level:          cfg.Level,
+				minSize:        cfg.MinSize,
+				status:         http.StatusOK,
+			}
+			defer cw.Close()
+
+			next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), compressionCtxKey{}, cw)))
+		})
+	}
+}
+
+// RouteCompression overrides the level and minimum size of Compress for the
+// routes it is applied to. Level 0 disables compression.
+func RouteCompression(level, minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cw, ok := r.Context().Value(compressionCtxKey{}).(*compressWriter); ok {
+				cw.level = level
+				cw.minSize = minSize
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// negotiateEncoding picks the first of preferred with the highest weight in
+// the Accept-Encoding header, or "" when none is acceptable.
+func negotiateEncoding(accept string, preferred []string) string {
+	if len(accept) == 0 {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = q
+			}
+		}
+		weights[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+
+	best, bestWeight := "", 0.0
+	for _, e := range preferred {
+		weight, ok := weights[e]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = e, weight
+		}
+	}
+	return best
+}
+
+func isCompressible(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch {
+	case strings.HasPrefix(contentType, "text/"),
+		strings.HasSuffix(contentType, "/json"),
+		strings.HasSuffix(contentType, "+json"),
+		strings.HasSuffix(contentType, "/yaml"),
+		strings.HasSuffix(contentType, "/xml"),
+		strings.HasSuffix(contentType, "/javascript"):
+		return true
+	}
+	return false
+}
+
+// compressWriter holds the response back until MinSize bytes are written or
+// the handler flushes, then decides whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.minSize {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+
+	h := cw.Header()
+	if len(h.Get("Content-Type")) == 0 && len(cw.buf) != 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	compress = compress && cw.level > 0 &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		len(h.Get("Content-Encoding")) == 0 && isCompressible(h.Get("Content-Type"))
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		cw.enc = getEncoder(cw.encoding, cw.level, cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if !cw.wroteHeader {
+			return nil
+		}
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+
+	err := cw.enc.Close()
+	putEncoder(cw.encoding, cw.level, cw.enc)
+	cw.enc = nil
+	return err
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type encoderKey struct {
+	encoding string
+	level    int
+}
+
+var encoderPools sync.Map
+
+func getEncoder(encoding string, level int, w io.Writer) encoder {
+	if pool, ok := encoderPools.Load(encoderKey{encoding, level}); ok {
+		if enc, ok := pool.(*sync.Pool).Get().(encoder); ok {
+			enc.Reset(w)
+			return enc
+		}
+	}
+	return newEncoder(encoding, level, w)
+}
+
+func putEncoder(encoding string, level int, enc encoder) {
+	pool, _ := encoderPools.LoadOrStore(encoderKey{encoding, level}, &sync.Pool{})
+	pool.(*sync.Pool).Put(enc)
+}
+
+func newEncoder(encoding string, level int, w io.Writer) encoder {
+	if level > gzip.BestCompression {
+		level = gzip.BestCompression
+	}
+
+	switch encoding {
+	case EncodingZstd:
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+		return enc
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(w, level)
+	}
+	enc, _ := gzip.NewWriterLevel(w, level)
+	return enc
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cookie Secure modes. In CookieSecureAuto mode cookies are Secure on
+// requests that arrived over TLS; behind a proxy that terminates TLS use
+// CookieSecureAlways.
+const (
+	CookieSecureAuto   = "auto"
+	CookieSecureAlways = "always"
+	CookieSecureNever  = "never"
+)
+
+// Cookies are the attributes of the auth cookies. HTTPOnly applies to the
+// access token cookie; the refresh token cookie is always HttpOnly.
+type Cookies struct {
+	Secure   string
+	SameSite http.SameSite
+	HTTPOnly bool
+	Domain   string
+}
+
+func DefaultCookies() Cookies {
+	return Cookies{
+		Secure:   CookieSecureAuto,
+		SameSite: http.SameSiteLaxMode,
+		HTTPOnly: true,
+	}
+}
+
+// ParseSameSite maps lax, strict or none to its SameSite mode.
+func ParseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown SameSite mode %q", value)
+}
+
+func (c Cookies) secure(r *http.Request) bool {
+	switch c.Secure {
+	case CookieSecureAlways:
+		return true
+	case CookieSecureNever:
+		return false
+	}
+	return r.TLS != nil
+}
+
+// cookie expires after ttl; a negative ttl deletes it.
+func (c Cookies) cookie(r *http.Request, name, value, path string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.Domain,
+		Secure:   c.secure(r),
+		HttpOnly: httpOnly,
+		SameSite: c.SameSite,
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+		return cookie
+	}
+	cookie.MaxAge = int(ttl.Seconds())
+	cookie.Expires = time.Now().Add(ttl)
+	return cookie
+}
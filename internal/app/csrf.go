@@ -0,0 +1,72 @@
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/go-chi/jwtauth"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+)
+
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeader     = "X-CSRF-Token"
+)
+
+// CSRF modes. CSRFDoubleSubmit wants CSRFHeader to repeat the CSRFCookieName
+// cookie set at sign in; CSRFHeaderOnly only wants the header to be present,
+// which a cross-site form can't add, and suits deployments with SameSite
+// strict cookies.
+const (
+	CSRFDoubleSubmit = "double-submit"
+	CSRFHeaderOnly   = "header"
+	CSRFOff          = "off"
+)
+
+// CSRF rejects unsafe requests authenticated by the auth cookie that don't
+// carry the CSRF header. Requests with a bearer token are not checked, as a
+// browser doesn't send one on its own.
+func CSRF(mode string, logger *zap.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if mode == CSRFOff {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(jwtauth.TokenFromHeader(r)) != 0 || len(jwtauth.TokenFromCookie(r)) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !csrfTokenValid(r, mode) {
+				requestid.Logger(r.Context(), logger).Info("CSRF check failed", zap.String("method", r.Method), zap.String("path", r.URL.Path))
+				http.Error(w, "", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func csrfTokenValid(r *http.Request, mode string) bool {
+	header := r.Header.Get(CSRFHeader)
+	if len(header) == 0 {
+		return false
+	}
+	if mode == CSRFHeaderOnly {
+		return true
+	}
+
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil || len(cookie.Value) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1
+}
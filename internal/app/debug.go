@@ -0,0 +1,25 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+// runDebugServer serves pprof and runtime vars on their own listener so
+// profiling is never reachable through the public API address.
+func runDebugServer(addr string, logger *zap.Logger) {
+	r := chi.NewRouter()
+	r.Mount("/debug", middleware.Profiler())
+
+	logger.Info("Debug server is listening", zap.String("address", addr))
+	go func() {
+		server := &http.Server{Addr: addr, Handler: r}
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Debug server failed", zap.Error(err))
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+package app
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed docs/openapi.yaml
+var openAPISpec []byte
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Gophermart API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/api/docs", dom_id: "#swagger-ui"});</script>
+</body>
+</html>`
+
+func apiDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+func apiDocsUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// EnvelopeMediaType is the Accept value that asks list endpoints for
+// envelopeResponse instead of a bare JSON array.
+const EnvelopeMediaType = "application/vnd.gophermart.envelope+json"
+
+type pageInfo struct {
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type envelopeResponse struct {
+	Data      interface{}      `json:"data"`
+	Page      pageInfo         `json:"page"`
+	RateLimit *rateLimitStatus `json:"rate_limit,omitempty"`
+}
+
+// wantsEnvelope reports whether the client accepts EnvelopeMediaType at all;
+// its quality against application/json doesn't matter.
+func wantsEnvelope(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err == nil && mediaType == EnvelopeMediaType && params["q"] != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeList answers a list request with data, wrapped with page when the
+// client asked for the envelope. An empty list without the envelope is 204
+// where emptyNoContent is set, as those endpoints always answered.
+func writeList(logger *zap.Logger, w http.ResponseWriter, r *http.Request, data interface{}, page pageInfo, emptyNoContent bool) {
+	w.Header().Add("Vary", "Accept")
+
+	if !wantsEnvelope(r) {
+		if emptyNoContent && page.Total == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(logger, w, http.StatusOK, data)
+		return
+	}
+
+	resp := envelopeResponse{Data: data, Page: page}
+	if status, ok := r.Context().Value(rateLimitCtxKey).(rateLimitStatus); ok {
+		resp.RateLimit = &status
+	}
+	writeJSONAs(logger, w, http.StatusOK, EnvelopeMediaType, resp)
+}
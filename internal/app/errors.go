@@ -1,10 +1,32 @@
 package app
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
 
 var (
 	ErrBadContentType  = errors.New("bad content type in request")
 	ErrBodyUnmarshal   = errors.New("failed to unmarshal request body")
+	ErrBodyTooLarge    = errors.New("request body is too large")
 	ErrMissedJWTKey    = errors.New("failed to get data from JWT")
 	ErrJWTKeyBadFormat = errors.New("JWT key data has unexpected type")
+	ErrBadPageLimit    = errors.New("bad page limit")
+	ErrBadOrdersFilter = errors.New("bad orders filter")
 )
+
+// storageErrorStatus maps a storage error that the handler has no specific
+// response for to an HTTP status by its class.
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
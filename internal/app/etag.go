@@ -0,0 +1,54 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/real-splendid/gophermart-practicum/internal/service"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func ordersETagVersion(v storage.OrdersVersion) string {
+	return strconv.FormatInt(v.UpdatedAt.UnixMicro(), 36) + "-" + strconv.Itoa(v.Count)
+}
+
+// balanceETagVersion also covers the converted value, which changes with the
+// exchange rate.
+func balanceETagVersion(b *service.Balance) string {
+	version := strconv.FormatInt(b.UpdatedAt.UnixMicro(), 36)
+	if len(b.Currency) != 0 {
+		version += "-" + b.Value.String() + b.Currency
+	}
+	return version
+}
+
+// checkETag sets a weak ETag for version on the response and, if the client
+// already holds it, answers 304 Not Modified. It reports whether the
+// response is complete.
+func checkETag(w http.ResponseWriter, r *http.Request, version string) bool {
+	etag := `W/"` + version + `"`
+	w.Header().Set("ETag", etag)
+	// Let clients store the response so they can revalidate it.
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches compares If-None-Match against etag with the weak comparison
+// of RFC 9110.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -4,100 +4,223 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/service"
 	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+const (
+	TotalCountHeader = "X-Total-Count"
+	NextCursorHeader = "X-Next-Cursor"
+
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// AccrualThrottledHeader carries, while the accrual system throttles
+	// order processing, the time it is expected to resume.
+	AccrualThrottledHeader = "X-Accrual-Throttled-Until"
+
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+
+	// orderNotPlacedCode tells a strict-mode withdrawal against an unknown
+	// order apart from other 422 answers.
+	orderNotPlacedCode = "order_not_placed"
 )
 
 type HandlersServer struct {
-	ctx            context.Context
-	logger         *zap.Logger
-	storageService storage.AppStorage
+	ctx      context.Context
+	logger   *zap.Logger
+	orders   *service.OrderService
+	balances *service.BalanceService
+	accrual  *accrual.Accrual
 }
 
 type orderResponse struct {
-	Number     string    `json:"number"`
-	Status     string    `json:"status"`
-	Accrual    float64   `json:"accrual,omitempty"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	Number     string       `json:"number"`
+	Status     string       `json:"status"`
+	Accrual    money.Amount `json:"accrual,omitempty"`
+	UploadedAt time.Time    `json:"uploaded_at"`
+}
+
+type orderDetailsResponse struct {
+	orderResponse
+	UpdatedAt         time.Time `json:"updated_at"`
+	RegistrationError string    `json:"registration_error,omitempty"`
+	// AccrualThrottledUntil is set on unfinished orders while the accrual
+	// system throttles their processing.
+	AccrualThrottledUntil *time.Time `json:"accrual_throttled_until,omitempty"`
 }
 
 type withdrawalsResponse struct {
-	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	Order       string       `json:"order"`
+	Sum         money.Amount `json:"sum"`
+	ProcessedAt time.Time    `json:"processed_at"`
+}
+
+type userStatsResponse struct {
+	TotalAccrued    money.Amount   `json:"total_accrued"`
+	TotalWithdrawn  money.Amount   `json:"total_withdrawn"`
+	OrdersByStatus  map[string]int `json:"orders_by_status"`
+	EarnedThisMonth money.Amount   `json:"earned_this_month"`
+}
+
+type balanceResponse struct {
+	*storage.BalanceInfo
+	Value    money.Amount `json:"value,omitempty"`
+	Currency string       `json:"currency,omitempty"`
 }
 
 type balanceWithdrawRequest struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order string       `json:"order"`
+	Sum   money.Amount `json:"sum"`
 }
 
-func NewHandlersServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage) (*HandlersServer, error) {
+func NewHandlersServer(ctx context.Context, logger *zap.Logger, orders *service.OrderService, balances *service.BalanceService, accrual *accrual.Accrual) (*HandlersServer, error) {
 	server := &HandlersServer{
-		ctx:            ctx,
-		logger:         logger,
-		storageService: storage,
+		ctx:      ctx,
+		logger:   logger,
+		orders:   orders,
+		balances: balances,
+		accrual:  accrual,
 	}
 
 	return server, nil
 }
 
-func (s *HandlersServer) apiAddUserOrder(w http.ResponseWriter, r *http.Request) {
-	if contentType := r.Header.Get("Content-Type"); contentType != "text/plain" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
-		http.Error(w, "", http.StatusBadRequest)
-		return
+// reportAccrualThrottle sets AccrualThrottledHeader while the accrual system
+// throttles order processing, and Retry-After as a hint when to look for
+// results if retryAfter is set. It returns the time sent, or the zero time.
+func (s *HandlersServer) reportAccrualThrottle(w http.ResponseWriter, retryAfter bool) time.Time {
+	if s.accrual == nil {
+		return time.Time{}
+	}
+	until := s.accrual.ThrottledUntil()
+	if until.IsZero() {
+		return until
 	}
 
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
-		return
+	w.Header().Set(AccrualThrottledHeader, until.UTC().Format(time.RFC3339))
+	if retryAfter {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
 	}
+	return until
+}
 
-	if !isCorrectOrderNum(string(b)) {
-		s.logger.Info("bad order id", zap.String("order_id", string(b)))
-		http.Error(w, "", http.StatusUnprocessableEntity)
+func (s *HandlersServer) apiAddUserOrder(w http.ResponseWriter, r *http.Request) {
+	b, err := readBody(r, "text/plain")
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Info("bad request body", zap.String("content_type", r.Header.Get("Content-Type")), zap.Error(err))
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
 		return
 	}
 
 	orderID := string(b)
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
-	if err := s.storageService.AddOrder(r.Context(), userData.ID, orderID); err != nil {
+	if err := s.orders.Upload(r.Context(), userData.MerchantID, userData.ID, orderID); err != nil {
+		if errors.Is(err, service.ErrInvalidOrderNumber) {
+			logger := requestid.Logger(r.Context(), s.logger)
+			logger.Info("bad order id", zap.String("order_id", orderID), zap.Error(err))
+			writeOrderNumberError(logger, w, err)
+			return
+		}
+		if errors.Is(err, service.ErrReceiptRejected) {
+			http.Error(w, "", http.StatusUnprocessableEntity)
+			return
+		}
 		if errors.Is(err, storage.ErrDuplicateOrder) {
-			s.logger.Error("duplicate order id", zap.String("order_id", orderID))
+			requestid.Logger(r.Context(), s.logger).Error("duplicate order id", zap.String("order_id", orderID))
 			http.Error(w, "", http.StatusConflict)
 			return
 		}
 		if errors.Is(err, storage.ErrOrderAlreadyPlaced) {
-			s.logger.Info("order already placed", zap.String("order_id", orderID))
+			requestid.Logger(r.Context(), s.logger).Info("order already placed", zap.String("order_id", orderID))
+			s.reportAccrualThrottle(w, true)
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		s.logger.Error("failed to add order", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+		requestid.Logger(r.Context(), s.logger).Error("failed to add order", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
 
+	s.reportAccrualThrottle(w, true)
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (s *HandlersServer) apiGetUserOrders(w http.ResponseWriter, r *http.Request) {
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
-	orders, err := s.storageService.GetOrders(r.Context(), userData.ID)
+	version, err := s.orders.Version(r.Context(), userData.ID)
 	if err != nil {
-		s.logger.Error("get orders failed", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		requestid.Logger(r.Context(), s.logger).Error("get orders version failed", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
+	s.reportAccrualThrottle(w, false)
+	etagVersion := ordersETagVersion(version)
+	if wantsEnvelope(r) {
+		etagVersion += "-envelope"
+	}
+	if checkETag(w, r, etagVersion) {
+		return
+	}
+
+	var orders []storage.Order
+	var page pageInfo
+	query := r.URL.Query()
+	if isPageQuery(query) {
+		limit, err := parseLimit(query.Get("limit"))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseOrdersFilter(query)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		ordersPage, err := s.orders.ListPage(r.Context(), userData.ID, filter, query.Get("cursor"), limit)
+		if err != nil {
+			if errors.Is(err, storage.ErrBadCursor) || errors.Is(err, service.ErrInvalidFilter) {
+				http.Error(w, "", http.StatusBadRequest)
+				return
+			}
+			requestid.Logger(r.Context(), s.logger).Error("get orders page failed", zap.Error(err))
+			http.Error(w, "", storageErrorStatus(err))
+			return
+		}
+
+		w.Header().Set(TotalCountHeader, strconv.Itoa(ordersPage.Total))
+		if len(ordersPage.NextCursor) != 0 {
+			w.Header().Set(NextCursorHeader, ordersPage.NextCursor)
+		}
+		orders = ordersPage.Orders
+		page = pageInfo{Total: ordersPage.Total, NextCursor: ordersPage.NextCursor}
+	} else {
+		orders, err = s.orders.List(r.Context(), userData.ID)
+		if err != nil {
+			requestid.Logger(r.Context(), s.logger).Error("get orders failed", zap.Error(err))
+			http.Error(w, "", storageErrorStatus(err))
+			return
+		}
+		page.Total = len(orders)
+	}
 
 	respData := make([]orderResponse, len(orders))
 	for i, e := range orders {
@@ -109,21 +232,78 @@ func (s *HandlersServer) apiGetUserOrders(w http.ResponseWriter, r *http.Request
 		}
 	}
 
-	s.apiWriteResponse(w, http.StatusOK, respData)
+	writeList(s.logger, w, r, respData, page, false)
 }
 
-func (s *HandlersServer) apiGetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+func (s *HandlersServer) apiGetUserOrder(w http.ResponseWriter, r *http.Request) {
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+	orderID := chi.URLParam(r, "number")
 
-	ws, err := s.storageService.GetWithdrawals(r.Context(), userData.ID)
+	order, err := s.orders.Get(r.Context(), userData.ID, orderID)
 	if err != nil {
-		s.logger.Error("failed to get withdrawals", zap.String("user_id", userData.ID.String()), zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrNoSuchOrder) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("get order failed", zap.String("order_id", orderID), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
 
-	if len(ws) == 0 {
-		w.WriteHeader(http.StatusNoContent)
+	resp := orderDetailsResponse{
+		orderResponse: orderResponse{
+			Number:     order.OrderNumber,
+			Status:     order.Status,
+			Accrual:    order.Accrual,
+			UploadedAt: order.UploadedAt,
+		},
+		UpdatedAt:         order.UpdatedAt,
+		RegistrationError: order.RegistrationError,
+	}
+	if until := s.reportAccrualThrottle(w, false); !until.IsZero() && !storage.IsFinalStatus(order.Status) {
+		resp.AccrualThrottledUntil = &until
+	}
+	s.apiWriteResponse(w, http.StatusOK, resp)
+}
+
+func (s *HandlersServer) apiGetUserBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	entries, err := s.balances.History(r.Context(), userData.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get balance history", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeList(s.logger, w, r, entries, pageInfo{Total: len(entries)}, true)
+}
+
+func (s *HandlersServer) apiGetUserStats(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	stats, err := s.balances.Stats(r.Context(), userData.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get stats", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	s.apiWriteResponse(w, http.StatusOK, userStatsResponse{
+		TotalAccrued:    stats.TotalAccrued,
+		TotalWithdrawn:  stats.TotalWithdrawn,
+		OrdersByStatus:  stats.OrdersByStatus,
+		EarnedThisMonth: stats.EarnedSince,
+	})
+}
+
+func (s *HandlersServer) apiGetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	ws, err := s.balances.Withdrawals(r.Context(), userData.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get withdrawals", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
 
@@ -136,21 +316,27 @@ func (s *HandlersServer) apiGetUserWithdrawals(w http.ResponseWriter, r *http.Re
 		}
 	}
 
-	s.apiWriteResponse(w, http.StatusOK, responseData)
+	writeList(s.logger, w, r, responseData, pageInfo{Total: len(responseData)}, true)
 }
 
 func (s *HandlersServer) apiGetUserBalance(w http.ResponseWriter, r *http.Request) {
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
-	balance, err := s.storageService.GetBalance(r.Context(), userData.ID)
-	s.logger.Info("got balance", zap.String("user_id", userData.ID.String()), zap.Any("balance", balance))
+	balance, err := s.balances.Balance(r.Context(), userData.ID)
 	if err != nil {
-		s.logger.Error("failed to get balance", zap.String("user_id", userData.ID.String()), zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		requestid.Logger(r.Context(), s.logger).Error("failed to get balance", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+	if checkETag(w, r, balanceETagVersion(balance)) {
 		return
 	}
 
-	s.apiWriteResponse(w, http.StatusOK, balance)
+	s.apiWriteResponse(w, http.StatusOK, balanceResponse{
+		BalanceInfo: balance.BalanceInfo,
+		Value:       balance.Value,
+		Currency:    balance.Currency,
+	})
 }
 
 func (s *HandlersServer) apiBalanceWithdraw(w http.ResponseWriter, r *http.Request) {
@@ -158,83 +344,137 @@ func (s *HandlersServer) apiBalanceWithdraw(w http.ResponseWriter, r *http.Reque
 
 	withdrawRequest := balanceWithdrawRequest{}
 	if err := s.apiParseRequest(r, &withdrawRequest); err != nil {
-		s.logger.Error("failed to withdraw balance", zap.String("user_id", userData.ID.String()), zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
-		return
-	}
-
-	if !isCorrectOrderNum(withdrawRequest.Order) {
-		s.logger.Error("bad order id", zap.String("order_id", withdrawRequest.Order))
-		http.Error(w, "", http.StatusUnprocessableEntity)
+		requestid.Logger(r.Context(), s.logger).Error("failed to withdraw balance", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", bodyErrorStatus(err, http.StatusInternalServerError))
 		return
 	}
 
-	orderID := string(withdrawRequest.Order)
-	err := s.storageService.Withdraw(r.Context(), userData.ID, orderID, withdrawRequest.Sum)
+	err := s.balances.Withdraw(r.Context(), userData.ID, withdrawRequest.Order, withdrawRequest.Sum, r.Header.Get(IdempotencyKeyHeader))
 	if err != nil {
-		if err == storage.ErrNotEnoughBalance {
+		if errors.Is(err, service.ErrInvalidOrderNumber) || errors.Is(err, service.ErrInvalidAmount) {
+			logger := requestid.Logger(r.Context(), s.logger)
+			logger.Info("bad withdrawal request", zap.String("order_id", withdrawRequest.Order), zap.Stringer("sum", withdrawRequest.Sum), zap.Error(err))
+			writeOrderNumberError(logger, w, err)
+			return
+		}
+		if errors.Is(err, service.ErrInvalidIdempotencyKey) {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, service.ErrOrderNotPlaced) {
+			writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusUnprocessableEntity, errorResponse{
+				Error:     err.Error(),
+				Code:      orderNotPlacedCode,
+				RequestID: requestid.FromContext(r.Context()),
+			})
+			return
+		}
+		if errors.Is(err, storage.ErrNotEnoughBalance) {
 			http.Error(w, "", http.StatusPaymentRequired)
 			return
 		}
-		s.logger.Error("failed to withdraw", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		if errors.Is(err, storage.ErrIdempotencyKeyUsed) {
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, storage.ErrDuplicateOrder) {
+			http.Error(w, "", http.StatusUnprocessableEntity)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to withdraw", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *HandlersServer) apiParseRequest(r *http.Request, body interface{}) error {
-	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
-		return ErrBadContentType
+	err := decodeJSON(r, body)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Info("bad request body", zap.String("content_type", r.Header.Get("Content-Type")), zap.Error(err))
 	}
+	return err
+}
 
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		return err
+func (s *HandlersServer) apiWriteResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+	writeJSON(s.logger, w, statusCode, response)
+}
+
+// isPageQuery reports whether the orders list is requested page by page.
+// Filtering and sorting are only supported on pages.
+func isPageQuery(query url.Values) bool {
+	for _, param := range []string{"limit", "cursor", "status", "from", "to", "sort"} {
+		if query.Has(param) {
+			return true
+		}
 	}
+	return false
+}
 
-	if err = json.Unmarshal(b, &body); err != nil {
-		s.logger.Error("failed to unmarshal request json", zap.Error(err))
-		return ErrBodyUnmarshal
+func parseOrdersFilter(query url.Values) (storage.OrdersFilter, error) {
+	filter := storage.OrdersFilter{Sort: query.Get("sort")}
+
+	if statuses := query.Get("status"); len(statuses) != 0 {
+		filter.Statuses = strings.Split(statuses, ",")
 	}
 
-	return nil
+	for param, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if !query.Has(param) {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			return storage.OrdersFilter{}, ErrBadOrdersFilter
+		}
+		*value = t
+	}
+
+	return filter, nil
 }
 
-func (s *HandlersServer) apiWriteResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+func parseLimit(value string) (int, error) {
+	if len(value) == 0 {
+		return defaultPageLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, ErrBadPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	return limit, nil
+}
+
+func writeJSON(logger *zap.Logger, w http.ResponseWriter, statusCode int, response interface{}) {
+	writeJSONAs(logger, w, statusCode, "application/json", response)
+}
+
+func writeJSONAs(logger *zap.Logger, w http.ResponseWriter, statusCode int, contentType string, response interface{}) {
 	dst, err := json.Marshal(response)
 	if err != nil {
-		s.logger.Error("failed to marshal response", zap.Error(err))
+		logger.Error("failed to marshal response", zap.Error(err))
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(statusCode)
 
 	if _, err := w.Write(dst); err != nil {
-		s.logger.Error("failed to write response body", zap.Error(err))
+		logger.Error("failed to write response body", zap.Error(err))
 	}
 }
 
-func isCorrectOrderNum(number string) bool {
-	digitsCount := len(number)
-	isSecond := false
-	sum := 0
-
-	for i := digitsCount - 1; i >= 0; i-- {
-		d := number[i] - '0'
-		if isSecond {
-			d = d * 2
-		}
-
-		sum += int(d) / 10
-		sum += int(d) % 10
-
-		isSecond = !isSecond
+// writeOrderNumberError answers 422, with the violated rule in the body when
+// err carries one.
+func writeOrderNumberError(logger *zap.Logger, w http.ResponseWriter, err error) {
+	var numberErr *validate.OrderNumberError
+	if errors.As(err, &numberErr) {
+		writeJSON(logger, w, http.StatusUnprocessableEntity, numberErr)
+		return
 	}
-
-	return sum%10 == 0
+	http.Error(w, "", http.StatusUnprocessableEntity)
 }
@@ -0,0 +1,574 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/fiscal"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/rates"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+var testJWTSecret = []byte("handler-tests-secret")
+
+func testConfig(st storage.AppStorage) Config {
+	return Config{
+		Logger:    zap.NewNop(),
+		Storage:   st,
+		JWTSecret: testJWTSecret,
+		Timeouts:  DefaultTimeouts,
+		CSRFMode:  CSRFOff,
+
+		PasswordPolicy: validate.DefaultPasswordPolicy(),
+	}
+}
+
+func newTestHandler(t *testing.T, cfg Config) http.Handler {
+	t.Helper()
+
+	handler, err := NewHandler(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	return handler
+}
+
+// tokenFor signs a token for user with secret, as the auth handlers would
+// for a user signed in before sessions were tracked.
+func tokenFor(t testing.TB, secret []byte, userID, jti uuid.UUID) string {
+	t.Helper()
+
+	now := time.Now()
+	_, token, err := jwtauth.New(jwtAlgorithm, secret, nil).Encode(map[string]interface{}{
+		"id":  userID.String(),
+		"ts":  now.Unix(),
+		"jti": jti.String(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("can't sign a token: %v", err)
+	}
+	return token
+}
+
+// serve sends a request with body, if any, and the token, if any.
+func serve(handler http.Handler, method, target, contentType, body, token string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if len(body) != 0 {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	if len(contentType) != 0 {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if len(token) != 0 {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestUnauthorized(t *testing.T) {
+	st := newStorageMock()
+	user := st.addUser("alice", "password")
+	revoked := uuid.New()
+	st.revoked[revoked] = true
+	handler := newTestHandler(t, testConfig(st))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"no token", ""},
+		{"malformed token", "not-a-jwt"},
+		{"token signed with another key", tokenFor(t, []byte("another secret"), user.ID, uuid.New())},
+		{"revoked token", tokenFor(t, testJWTSecret, user.ID, revoked)},
+		{"token of an unknown user", tokenFor(t, testJWTSecret, uuid.New(), uuid.New())},
+	}
+	for _, tt := range tests {
+		for _, route := range []struct{ method, target, contentType, body string }{
+			{http.MethodGet, "/api/user/orders", "", ""},
+			{http.MethodPost, "/api/user/orders", "text/plain", "79927398713"},
+			{http.MethodGet, "/api/user/balance", "", ""},
+			{http.MethodPost, "/api/user/balance/withdraw", "application/json", `{"order":"79927398713","sum":1}`},
+		} {
+			w := serve(handler, route.method, route.target, route.contentType, route.body, tt.token)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with %s = %d, want %d", route.method, route.target, tt.name, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+
+	w := serve(handler, http.MethodPost, "/api/user/login", "application/json", `{"login":"alice","password":"wrong"}`, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = serve(handler, http.MethodPost, "/api/user/login", "application/json", `{"login":"bob","password":"password"}`, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("login of an unknown user = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	st := newStorageMock()
+	handler := newTestHandler(t, testConfig(st))
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		want   int
+	}{
+		{"register", "/api/user/register", `{"login":"alice","password":"correct horse"}`, http.StatusOK},
+		{"register a taken login", "/api/user/register", `{"login":"alice","password":"battery staple"}`, http.StatusConflict},
+		{"register with a weak password", "/api/user/register", `{"login":"bob","password":"short"}`, http.StatusBadRequest},
+		{"register without JSON", "/api/user/register", `login=alice`, http.StatusUnsupportedMediaType},
+		{"login", "/api/user/login", `{"login":"alice","password":"correct horse"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		contentType := "application/json"
+		if !strings.HasPrefix(tt.body, "{") {
+			contentType = "application/x-www-form-urlencoded"
+		}
+		w := serve(handler, http.MethodPost, tt.target, contentType, tt.body, "")
+		if w.Code != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+
+		tokens := tokenResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || len(tokens.Token) == 0 {
+			t.Errorf("%s returned %q, %v, want a token", tt.name, w.Body.String(), err)
+			continue
+		}
+		if w := serve(handler, http.MethodGet, "/api/user/balance/history", "", "", tokens.Token); w.Code == http.StatusUnauthorized {
+			t.Errorf("the token from %s is not accepted", tt.name)
+		}
+	}
+}
+
+func TestRefreshAtAnotherMerchant(t *testing.T) {
+	st := newStorageMock()
+	handler := newTestHandler(t, testConfig(st))
+	user := st.addUser("alice", "password")
+	other := st.addUser("bob", "password")
+	other.MerchantID = uuid.New()
+
+	tests := []struct {
+		name string
+		user *storage.UserAuthorization
+		want int
+	}{
+		{"user of the merchant", user, http.StatusOK},
+		{"user of another merchant", other, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		token := tt.user.Login + "-refresh"
+		st.AddRefreshToken(context.Background(), hashRefreshToken(token), tt.user.ID, uuid.New(), time.Now().Add(time.Hour))
+
+		w := serve(handler, http.MethodPost, "/api/user/refresh", "application/json", `{"refresh_token":"`+token+`"}`, "")
+		if w.Code != tt.want {
+			t.Errorf("refresh by %s = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestUploadOrder(t *testing.T) {
+	st := newStorageMock()
+	user := st.addUser("alice", "password")
+	token := tokenFor(t, testJWTSecret, user.ID, uuid.New())
+
+	tests := []struct {
+		name     string
+		body     string
+		addErr   error
+		validity *fiscal.Result
+		want     int
+		wantRule string
+	}{
+		{name: "new order", body: "79927398713", want: http.StatusAccepted},
+		{name: "own order again", body: "79927398713", addErr: storage.ErrOrderAlreadyPlaced, want: http.StatusOK},
+		{name: "another user's order", body: "79927398713", addErr: storage.ErrDuplicateOrder, want: http.StatusConflict},
+		{name: "checksum", body: "79927398710", want: http.StatusUnprocessableEntity, wantRule: validate.RuleOrderChecksum},
+		{name: "letters", body: "7992739871a", want: http.StatusUnprocessableEntity, wantRule: validate.RuleOrderDigits},
+		{name: "all zeros", body: "0000", want: http.StatusUnprocessableEntity, wantRule: validate.RuleOrderZero},
+		{name: "too short", body: "0", want: http.StatusUnprocessableEntity, wantRule: validate.RuleOrderLength},
+		{name: "rejected receipt", body: "79927398713", validity: &fiscal.Result{Reason: "unknown receipt"}, want: http.StatusUnprocessableEntity},
+		{name: "storage down", body: "79927398713", addErr: &storage.Error{Op: "AddOrder", Kind: storage.ErrUnavailable, Err: context.DeadlineExceeded}, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(st)
+			if tt.validity != nil {
+				cfg.Fiscal = fiscalStub{result: tt.validity}
+			}
+			handler := newTestHandler(t, cfg)
+
+			var added []string
+			st.addOrder = func(userID uuid.UUID, orderNumber string) error {
+				if userID != user.ID {
+					t.Errorf("order added for %s, want %s", userID, user.ID)
+				}
+				added = append(added, orderNumber)
+				return tt.addErr
+			}
+
+			w := serve(handler, http.MethodPost, "/api/user/orders", "text/plain", tt.body, token)
+			if w.Code != tt.want {
+				t.Fatalf("POST /api/user/orders = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnprocessableEntity && len(added) != 0 {
+				t.Errorf("rejected order %v reached storage", added)
+			}
+			if len(tt.wantRule) != 0 {
+				numberErr := validate.OrderNumberError{}
+				if err := json.NewDecoder(w.Body).Decode(&numberErr); err != nil || numberErr.Rule != tt.wantRule {
+					t.Errorf("422 body rule = %q, %v, want %q", numberErr.Rule, err, tt.wantRule)
+				}
+			}
+		})
+	}
+
+	handler := newTestHandler(t, testConfig(st))
+	if w := serve(handler, http.MethodPost, "/api/user/orders", "application/json", `"79927398713"`, token); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("POST /api/user/orders as JSON = %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	st := newStorageMock()
+	user := st.addUser("alice", "password")
+	token := tokenFor(t, testJWTSecret, user.ID, uuid.New())
+	handler := newTestHandler(t, testConfig(st))
+
+	tests := []struct {
+		name       string
+		body       string
+		withdraw   error
+		want       int
+		wantStored bool
+	}{
+		{name: "enough balance", body: `{"order":"2377225624","sum":751}`, want: http.StatusOK, wantStored: true},
+		{name: "not enough balance", body: `{"order":"2377225624","sum":751}`, withdraw: storage.ErrNotEnoughBalance, want: http.StatusPaymentRequired, wantStored: true},
+		{name: "idempotency key reused", body: `{"order":"2377225624","sum":751}`, withdraw: storage.ErrIdempotencyKeyUsed, want: http.StatusConflict, wantStored: true},
+		{name: "order already used", body: `{"order":"2377225624","sum":751}`, withdraw: storage.ErrDuplicateOrder, want: http.StatusUnprocessableEntity, wantStored: true},
+		{name: "bad order number", body: `{"order":"2377225625","sum":751}`, want: http.StatusUnprocessableEntity},
+		{name: "zero sum", body: `{"order":"2377225624","sum":0}`, want: http.StatusUnprocessableEntity},
+		{name: "negative sum", body: `{"order":"2377225624","sum":-5}`, want: http.StatusUnprocessableEntity},
+		{name: "not JSON", body: `order=2377225624`, want: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := false
+			st.withdraw = func(userID uuid.UUID, orderNumber string, sum money.Amount, _ string) error {
+				stored = true
+				if orderNumber != "2377225624" || sum != 75100 {
+					t.Errorf("Withdraw(%s, %s), want 2377225624 and 751", orderNumber, sum)
+				}
+				return tt.withdraw
+			}
+
+			contentType := "application/json"
+			if !strings.HasPrefix(tt.body, "{") {
+				contentType = "application/x-www-form-urlencoded"
+			}
+			w := serve(handler, http.MethodPost, "/api/user/balance/withdraw", contentType, tt.body, token)
+			if w.Code != tt.want {
+				t.Errorf("POST /api/user/balance/withdraw = %d, want %d", w.Code, tt.want)
+			}
+			if stored != tt.wantStored {
+				t.Errorf("withdrawal reached storage = %t, want %t", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestBalanceValue(t *testing.T) {
+	st := newStorageMock()
+	user := st.addUser("alice", "password")
+	st.balances[user.ID] = 1001
+	token := tokenFor(t, testJWTSecret, user.ID, uuid.New())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := testConfig(st)
+	cfg.Rates = rates.NewConverter(ctx, rates.Config{Currency: "RUB", Provider: rates.StaticProvider(1.5), Logger: zap.NewNop()})
+	handler := newTestHandler(t, cfg)
+
+	for _, target := range []string{"/api/user/balance", "/api/user/profile"} {
+		w := serve(handler, http.MethodGet, target, "", "", token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d, want %d", target, w.Code, http.StatusOK)
+		}
+		var resp struct {
+			Value    money.Amount `json:"value"`
+			Currency string       `json:"currency"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("GET %s body %q: %v", target, w.Body, err)
+		}
+		// 10.01 points at 1.5 are 15.015, rounded to the nearest hundredth.
+		if resp.Value != 1502 || resp.Currency != "RUB" {
+			t.Errorf("GET %s value = %s %s, want 15.02 RUB", target, resp.Value, resp.Currency)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	st := newStorageMock()
+	alice := st.addUser("alice", "password")
+	bob := st.addUser("bob", "password")
+	cfg := testConfig(st)
+	cfg.RateLimit = 0.001
+	cfg.RateLimitBurst = 2
+	handler := newTestHandler(t, cfg)
+
+	aliceToken := tokenFor(t, testJWTSecret, alice.ID, uuid.New())
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		w := serve(handler, http.MethodPost, "/api/user/orders", "text/plain", "79927398713", aliceToken)
+		if w.Code != want {
+			t.Errorf("upload #%d = %d, want %d", i+1, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && len(w.Header().Get("Retry-After")) == 0 {
+			t.Errorf("429 without Retry-After")
+		}
+	}
+
+	// Every user has a bucket of their own.
+	bobToken := tokenFor(t, testJWTSecret, bob.ID, uuid.New())
+	if w := serve(handler, http.MethodPost, "/api/user/orders", "text/plain", "79927398713", bobToken); w.Code != http.StatusAccepted {
+		t.Errorf("another user's upload = %d, want %d", w.Code, http.StatusAccepted)
+	}
+	// Reads are not limited.
+	if w := serve(handler, http.MethodGet, "/api/user/balance/history", "", "", aliceToken); w.Code == http.StatusTooManyRequests {
+		t.Errorf("GET /api/user/balance/history was rate limited")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	st := newStorageMock()
+	st.addUser("alice", "password")
+	cfg := testConfig(st)
+	cfg.LoginLockout = LoginLockout{MaxFailures: 2, MaxFailuresPerIP: 3, Cooldown: time.Minute, MaxCooldown: time.Hour}
+	handler := newTestHandler(t, cfg)
+
+	login := func(login, password string) *httptest.ResponseRecorder {
+		return serve(handler, http.MethodPost, "/api/user/login", "application/json", `{"login":"`+login+`","password":"`+password+`"}`, "")
+	}
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusLocked} {
+		if w := login("alice", "wrong"); w.Code != want {
+			t.Errorf("failed login #%d = %d, want %d", i+1, w.Code, want)
+		}
+	}
+	// The third failure from the address, for another login, locks it out.
+	if w := login("bob", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("failed login of another user = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := login("bob", "wrong")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("login from a locked address = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if len(w.Header().Get("Retry-After")) == 0 {
+		t.Errorf("429 without Retry-After")
+	}
+}
+
+// A successful login forgives the address, so that the typos of the users
+// behind one proxy don't add up to a lock.
+func TestLoginClearsAddressFailures(t *testing.T) {
+	st := newStorageMock()
+	st.addUser("alice", "password")
+	cfg := testConfig(st)
+	cfg.AdminAPIKey = "admin-key"
+	cfg.LoginLockout = LoginLockout{MaxFailures: 5, MaxFailuresPerIP: 3, Cooldown: time.Minute, MaxCooldown: time.Hour}
+	handler := newTestHandler(t, cfg)
+
+	login := func(login, password string) int {
+		return serve(handler, http.MethodPost, "/api/user/login", "application/json", `{"login":"`+login+`","password":"`+password+`"}`, "").Code
+	}
+
+	for _, attempt := range []struct {
+		login, password string
+		want            int
+	}{
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "wrong", http.StatusUnauthorized},
+		{"alice", "password", http.StatusOK},
+		{"carol", "wrong", http.StatusUnauthorized},
+		{"dave", "wrong", http.StatusUnauthorized},
+		{"alice", "password", http.StatusOK},
+	} {
+		if got := login(attempt.login, attempt.password); got != attempt.want {
+			t.Errorf("login of %s with %s = %d, want %d", attempt.login, attempt.password, got, attempt.want)
+		}
+	}
+
+	for _, who := range []string{"bob", "carol", "dave"} {
+		login(who, "wrong")
+	}
+	if got := login("alice", "password"); got != http.StatusTooManyRequests {
+		t.Fatalf("login from a locked address = %d, want %d", got, http.StatusTooManyRequests)
+	}
+
+	// httptest requests come from 192.0.2.1.
+	for target, want := range map[string]int{
+		"/api/admin/ips/not-an-ip/unlock": http.StatusBadRequest,
+		"/api/admin/ips/192.0.2.1/unlock": http.StatusNoContent,
+	} {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		r.Header.Set(APIKeyHeader, "admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("POST %s = %d, want %d", target, w.Code, want)
+		}
+	}
+	if got := login("alice", "password"); got != http.StatusOK {
+		t.Errorf("login from an unlocked address = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestStaffMerchant(t *testing.T) {
+	st := newStorageMock()
+	admin := st.addUser("admin", "password")
+	admin.Role = storage.RoleAdmin
+	own := st.addUser("alice", "password")
+	other := st.addUser("bob", "password")
+	other.MerchantID = uuid.New()
+	cfg := testConfig(st)
+	cfg.AdminAPIKey = "admin-key"
+	handler := newTestHandler(t, cfg)
+	token := tokenFor(t, testJWTSecret, admin.ID, uuid.New())
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		apiKey bool
+		want   int
+	}{
+		{"own user's orders", http.MethodGet, "/api/admin/users/" + own.ID.String() + "/orders", false, http.StatusOK},
+		{"other merchant's user's orders", http.MethodGet, "/api/admin/users/" + other.ID.String() + "/orders", false, http.StatusNotFound},
+		{"other merchant's user's withdrawals", http.MethodGet, "/api/admin/users/" + other.ID.String() + "/withdrawals", false, http.StatusNotFound},
+		{"unlock other merchant's user", http.MethodPost, "/api/admin/users/" + other.ID.String() + "/unlock", false, http.StatusNotFound},
+		{"find in another merchant", http.MethodGet, "/api/admin/users?login=bob&merchant=" + other.MerchantID.String(), false, http.StatusForbidden},
+		{"place orders for another merchant", http.MethodPost, "/api/admin/merchants/" + other.MerchantID.String() + "/placed-orders", false, http.StatusForbidden},
+		{"platform route", http.MethodGet, "/api/admin/dead-letters", false, http.StatusUnauthorized},
+		{"other merchant's user's orders by API key", http.MethodGet, "/api/admin/users/" + other.ID.String() + "/orders", true, http.StatusOK},
+		{"unlock other merchant's user by API key", http.MethodPost, "/api/admin/users/" + other.ID.String() + "/unlock", true, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.apiKey {
+			r.Header.Set(APIKeyHeader, "admin-key")
+		} else {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminRequestBody(t *testing.T) {
+	st := newStorageMock()
+	user := st.addUser("alice", "password")
+	cfg := testConfig(st)
+	cfg.AdminAPIKey = "admin-key"
+	handler := newTestHandler(t, cfg)
+	target := "/api/admin/users/" + user.ID.String() + "/role"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"JSON", "application/json", `{"role":"support"}`, http.StatusNoContent},
+		{"unknown field", "application/json", `{"role":"support","note":"x"}`, http.StatusNoContent},
+		{"not JSON", "application/x-www-form-urlencoded", `role=support`, http.StatusUnsupportedMediaType},
+		{"malformed JSON", "application/json", `{"role":`, http.StatusBadRequest},
+		{"too large", "application/json", `{"role":"support","note":"` + strings.Repeat("x", maxJSONBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPut, target, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		r.Header.Set(APIKeyHeader, "admin-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: PUT %s = %d, want %d", tt.name, target, w.Code, tt.want)
+		}
+	}
+}
+
+func FuzzUploadOrder(f *testing.F) {
+	for _, seed := range []string{
+		"79927398713", "79927398710", "0079927398713", "0000", "0",
+		" 79927398713", "79927398713\r\n", "7992 7398 713", "+79927398713",
+		"７９９２７３９８７１３", "7992739871\u200b3", "\xff\xfe", "",
+		strings.Repeat("0", maxOrderBodySize) + "79927398713",
+		strings.Repeat("1", 1<<20),
+	} {
+		f.Add(seed)
+	}
+
+	st := newStorageMock()
+	user := st.addUser("alice", "password")
+	handler, err := NewHandler(context.Background(), testConfig(st))
+	if err != nil {
+		f.Fatalf("NewHandler() error = %v", err)
+	}
+	token := tokenFor(f, testJWTSecret, user.ID, uuid.New())
+
+	f.Fuzz(func(t *testing.T, body string) {
+		var added []string
+		st.addOrder = func(_ uuid.UUID, orderNumber string) error {
+			added = append(added, orderNumber)
+			return nil
+		}
+
+		w := serve(handler, http.MethodPost, "/api/user/orders", "text/plain", body, token)
+		valid := validate.OrderNumber(body)
+		switch {
+		case len(body) > maxOrderBodySize:
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("upload of %d bytes = %d, want %d", len(body), w.Code, http.StatusRequestEntityTooLarge)
+			}
+		case valid:
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("upload of %q = %d, want %d", body, w.Code, http.StatusAccepted)
+			}
+		default:
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("upload of %q = %d, want %d", body, w.Code, http.StatusUnprocessableEntity)
+			}
+			numberErr := validate.OrderNumberError{}
+			if err := json.NewDecoder(w.Body).Decode(&numberErr); err != nil || len(numberErr.Rule) == 0 {
+				t.Fatalf("422 body of %q = %q, %v, want a rule", body, w.Body.String(), err)
+			}
+		}
+		if len(added) != 0 && (!valid || added[0] != body) {
+			t.Fatalf("upload of %q added %q", body, added)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/buildinfo"
+)
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+)
+
+type healthResponse struct {
+	Status  string `json:"status"`
+	Accrual string `json:"accrual"`
+}
+
+type HealthServer struct {
+	logger         *zap.Logger
+	accrualEnabled bool
+}
+
+func NewHealthServer(logger *zap.Logger, accrualEnabled bool) *HealthServer {
+	return &HealthServer{
+		logger:         logger,
+		accrualEnabled: accrualEnabled,
+	}
+}
+
+func (s *HealthServer) apiHealth(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status:  healthStatusOK,
+		Accrual: "enabled",
+	}
+	if !s.accrualEnabled {
+		resp.Status = healthStatusDegraded
+		resp.Accrual = "disabled"
+	}
+
+	writeJSON(s.logger, w, http.StatusOK, resp)
+}
+
+func (s *HealthServer) apiVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(s.logger, w, http.StatusOK, buildinfo.Get())
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// DefaultHTTPServer drops clients that are slow to send their headers or
+// body, which is what slowloris attacks rely on. WriteTimeout must outlast
+// the longest of the Timeouts.
+var DefaultHTTPServer = HTTPServer{
+	ReadHeaderTimeout: 5 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	WriteTimeout:      3 * time.Minute,
+	IdleTimeout:       120 * time.Second,
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	ShutdownTimeout:   30 * time.Second,
+}
+
+// HTTPServer tunes the API server's connections. A zero timeout means no
+// timeout. H2C serves HTTP/2 without TLS, for proxies that speak it to the
+// backend; over TLS HTTP/2 is always negotiated. ShutdownTimeout bounds how
+// long requests in flight may take to finish once the server is stopping.
+type HTTPServer struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	H2C               bool
+	ShutdownTimeout   time.Duration
+}
+
+func newHTTPServer(addr string, handler http.Handler, cfg HTTPServer) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	server.Handler = handler
+	return server
+}
+
+// clearDeadlines lifts the server timeouts for a connection that outlives
+// the request, like a websocket.
+func clearDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+}
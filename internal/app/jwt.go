@@ -0,0 +1,65 @@
+package app
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/jwtauth"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+const jwtAlgorithm = "HS256"
+
+// newAuthorizers returns the signing authorizer first, followed by
+// verify-only authorizers for previous keys still accepted during rotation.
+func newAuthorizers(secret []byte, previous [][]byte) ([]*jwtauth.JWTAuth, error) {
+	if len(secret) == 0 {
+		secret = make([]byte, privateKeySize)
+		readBytes, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		if readBytes != privateKeySize {
+			return nil, errors.New("failed to generate private key")
+		}
+	}
+
+	authorizers := []*jwtauth.JWTAuth{jwtauth.New(jwtAlgorithm, secret, nil)}
+	for _, key := range previous {
+		authorizers = append(authorizers, jwtauth.New(jwtAlgorithm, key, nil))
+	}
+
+	return authorizers, nil
+}
+
+func MultiKeyVerifier(authorizers ...*jwtauth.JWTAuth) func(http.Handler) http.Handler {
+	return verifier(authorizers, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie)
+}
+
+// WebSocketVerifier is MultiKeyVerifier that also accepts the token in the
+// "jwt" query parameter, since browsers cannot set headers on WebSocket
+// handshakes.
+func WebSocketVerifier(authorizers ...*jwtauth.JWTAuth) func(http.Handler) http.Handler {
+	return verifier(authorizers, jwtauth.TokenFromHeader, jwtauth.TokenFromCookie, jwtauth.TokenFromQuery)
+}
+
+func verifier(authorizers []*jwtauth.JWTAuth, findTokenFns ...func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				token jwt.Token
+				err   error
+			)
+			for _, ja := range authorizers {
+				token, err = jwtauth.VerifyRequest(ja, r, findTokenFns...)
+				if err == nil || errors.Is(err, jwtauth.ErrNoTokenFound) {
+					break
+				}
+			}
+
+			ctx := jwtauth.NewContext(r.Context(), token, err)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/jwtauth"
+	"go.uber.org/zap"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+
+	"github.com/real-splendid/gophermart-practicum/internal/live"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const (
+	livePingInterval = 30 * time.Second
+	liveWriteTimeout = 10 * time.Second
+)
+
+type LiveServer struct {
+	logger  *zap.Logger
+	storage storage.AppStorage
+	hub     *live.Hub
+}
+
+func NewLiveServer(logger *zap.Logger, st storage.AppStorage, hub *live.Hub) *LiveServer {
+	return &LiveServer{
+		logger:  logger,
+		storage: st,
+		hub:     hub,
+	}
+}
+
+// apiUserWebSocket streams the user's order and balance updates. The current
+// balance is sent first. The connection is closed when the token it was
+// opened with expires, so clients reconnect with a fresh one.
+func (s *LiveServer) apiUserWebSocket(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+	logger := requestid.Logger(r.Context(), s.logger).With(zap.String("user_id", userData.ID.String()))
+
+	balance, err := s.storage.GetBalance(r.Context(), userData.ID)
+	if err != nil {
+		logger.Error("failed to get balance", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	clearDeadlines(w)
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		logger.Info("websocket handshake failed", zap.Error(err))
+		return
+	}
+	defer conn.CloseNow()
+
+	sub := s.hub.Subscribe(userData.ID)
+	defer s.hub.Unsubscribe(sub)
+
+	// Clients only listen; reading is left to the library so that it answers
+	// pings and notices when the client goes away.
+	ctx := conn.CloseRead(r.Context())
+
+	expires := time.NewTimer(time.Until(tokenExpiration(r.Context())))
+	defer expires.Stop()
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+
+	err = s.write(ctx, conn, live.Update{
+		Type:    live.UpdateBalance,
+		Balance: &live.BalanceUpdate{Current: balance.Current, Withdrawn: balance.Withdrawn},
+	})
+	if err != nil {
+		logger.Debug("websocket write failed", zap.Error(err))
+		return
+	}
+
+	for {
+		select {
+		case update, ok := <-sub.C:
+			if !ok {
+				conn.Close(websocket.StatusPolicyViolation, "client is too slow")
+				return
+			}
+			if err := s.write(ctx, conn, update); err != nil {
+				logger.Debug("websocket write failed", zap.Error(err))
+				return
+			}
+		case <-ping.C:
+			pingCtx, cancel := context.WithTimeout(ctx, liveWriteTimeout)
+			err := conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				logger.Debug("websocket ping failed", zap.Error(err))
+				return
+			}
+		case <-expires.C:
+			conn.Close(websocket.StatusPolicyViolation, "token expired")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *LiveServer) write(ctx context.Context, conn *websocket.Conn, update live.Update) error {
+	ctx, cancel := context.WithTimeout(ctx, liveWriteTimeout)
+	defer cancel()
+
+	return wsjson.Write(ctx, conn, update)
+}
+
+func tokenExpiration(ctx context.Context) time.Time {
+	token, _, err := jwtauth.FromContext(ctx)
+	if err != nil || token == nil || token.Expiration().IsZero() {
+		return time.Now().Add(DefaultTokenTTL)
+	}
+	return token.Expiration()
+}
+
+// isWebSocketUpgrade reports whether r opens a WebSocket connection.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// unlessWebSocket applies mw to every request but WebSocket upgrades, which
+// outlive request timeouts and must not have their response compressed.
+func unlessWebSocket(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		wrapped := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+)
+
+const (
+	DefaultLoginMaxFailures      = 5
+	DefaultLoginMaxFailuresPerIP = 20
+	DefaultLoginCooldown         = time.Minute
+	DefaultLoginMaxCooldown      = time.Hour
+	DefaultLoginFailureWindow    = 15 * time.Minute
+)
+
+// LoginLockout locks a login, or a client IP, once it reaches its failure
+// limit within Window. Every further failure doubles the cooldown up to
+// MaxCooldown; a quiet Window starts the count over. A zero MaxFailures
+// disables lockouts.
+type LoginLockout struct {
+	MaxFailures      int
+	MaxFailuresPerIP int
+	Cooldown         time.Duration
+	MaxCooldown      time.Duration
+	Window           time.Duration
+}
+
+// loginLockKey is scoped by merchant: the same login at two merchants belongs
+// to two different users.
+func loginLockKey(merchantID uuid.UUID, login string) string {
+	return "login:" + merchantID.String() + ":" + login
+}
+
+func ipLockKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (l LoginLockout) enabled() bool {
+	return l.MaxFailures > 0
+}
+
+func (l LoginLockout) window() time.Duration {
+	if l.Window <= 0 {
+		return DefaultLoginFailureWindow
+	}
+	return l.Window
+}
+
+func (l LoginLockout) cooldown(failures, limit int) time.Duration {
+	shift := failures - limit
+	if shift > 30 {
+		return l.MaxCooldown
+	}
+	d := l.Cooldown << shift
+	if d <= 0 || d > l.MaxCooldown {
+		return l.MaxCooldown
+	}
+	return d
+}
+
+// checkLoginLock writes 423 for a locked login or 429 for a locked client IP
+// and reports whether the request may proceed.
+func (s *AuthServer) checkLoginLock(w http.ResponseWriter, r *http.Request, login string) bool {
+	if !s.lockout.enabled() {
+		return true
+	}
+
+	for _, lock := range []struct {
+		key    string
+		status int
+	}{
+		{loginLockKey(merchantFromContext(r.Context()), login), http.StatusLocked},
+		{ipLockKey(clientIP(r)), http.StatusTooManyRequests},
+	} {
+		until, err := s.userStorage.GetLoginLock(r.Context(), lock.key)
+		if err != nil {
+			requestid.Logger(r.Context(), s.logger).Error("failed to check login lock", zap.Error(err))
+			http.Error(w, "", storageErrorStatus(err))
+			return false
+		}
+		if !until.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+			http.Error(w, "", lock.status)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *AuthServer) recordLoginFailure(ctx context.Context, r *http.Request, login string) {
+	if !s.lockout.enabled() {
+		return
+	}
+
+	logger := requestid.Logger(ctx, s.logger)
+	for key, limit := range map[string]int{
+		loginLockKey(merchantFromContext(ctx), login): s.lockout.MaxFailures,
+		ipLockKey(clientIP(r)):                        s.lockout.MaxFailuresPerIP,
+	} {
+		if limit <= 0 {
+			continue
+		}
+		failures, err := s.userStorage.RecordLoginFailure(ctx, key, time.Now().Add(-s.lockout.window()))
+		if err != nil {
+			logger.Error("failed to record login failure", zap.Error(err))
+			continue
+		}
+		if failures < limit {
+			continue
+		}
+
+		until := time.Now().Add(s.lockout.cooldown(failures, limit))
+		if err := s.userStorage.LockLogin(ctx, key, until); err != nil {
+			logger.Error("failed to lock login", zap.Error(err))
+			continue
+		}
+		logger.Warn("login locked after repeated failures", zap.String("key", key), zap.Int("failures", failures), zap.Time("until", until))
+	}
+}
+
+// resetLoginFailures clears the failures of the login and of the client IP,
+// so that the mistakes of the users behind a shared address don't add up to
+// a lock.
+func (s *AuthServer) resetLoginFailures(ctx context.Context, r *http.Request, login string) {
+	if !s.lockout.enabled() {
+		return
+	}
+
+	for _, key := range []string{loginLockKey(merchantFromContext(ctx), login), ipLockKey(clientIP(r))} {
+		if err := s.userStorage.ResetLoginFailures(ctx, key); err != nil {
+			requestid.Logger(ctx, s.logger).Error("failed to reset login failures", zap.Error(err))
+		}
+	}
+}
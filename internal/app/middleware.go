@@ -3,15 +3,23 @@ package app
 import (
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"runtime/debug"
+	"slices"
 
 	"github.com/go-chi/jwtauth"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
 	"github.com/real-splendid/gophermart-practicum/internal/storage"
 )
 
+const APIKeyHeader = "X-API-Key"
+
 var UserAuthDataCtxKey = &contextKey{"UserAuthData"}
 
 type gzipBodyReader struct {
@@ -44,44 +52,215 @@ func DecompressGzip(next http.Handler) http.Handler {
 	})
 }
 
+// NoCache keeps clients and proxies from caching responses. Unlike
+// middleware.NoCache it leaves conditional request headers in place, so that
+// handlers can answer If-None-Match.
+func NoCache(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "no-cache, no-store, no-transform, must-revalidate, private, max-age=0")
+		h.Set("Expires", "Thu, 01 Jan 1970 00:00:00 GMT")
+		h.Set("Pragma", "no-cache")
+		h.Set("X-Accel-Expires", "0")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ResponseRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := requestid.FromContext(r.Context()); len(id) != 0 {
+			w.Header().Set(requestid.Header, id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type errorResponse struct {
+	Error     string `json:"error"`
+	Code      string `json:"code,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Recover turns a panic in a handler into a logged 500 response instead of a
+// dropped connection.
+func Recover(logger *zap.Logger) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				metrics.HTTPPanics.Add(1)
+				requestid.Logger(r.Context(), logger).Error("handler panicked",
+					zap.Any("panic", rec),
+					zap.String("method", r.Method),
+					zap.String("path", r.URL.Path),
+					zap.ByteString("stack", debug.Stack()),
+				)
+
+				writeJSON(logger, w, http.StatusInternalServerError, errorResponse{
+					Error:     http.StatusText(http.StatusInternalServerError),
+					RequestID: requestid.FromContext(r.Context()),
+				})
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func RequireAPIKey(key string) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(APIKeyHeader)), []byte(key)) != 1 {
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func AuthorizationVerifier(st storage.AppStorage, logger *zap.Logger) func(handler http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
-			_, claims, err := jwtauth.FromContext(ctx)
+			token, claims, err := jwtauth.FromContext(ctx)
 			if err != nil {
-				logger.Error("failed to get claims", zap.Error(err))
+				requestid.Logger(ctx, logger).Error("failed to get claims", zap.Error(err))
 				http.Error(w, "", http.StatusUnauthorized)
 				return
 			}
 
 			id, exists := claims["id"]
 			if !exists {
-				logger.Error("failed to get user id", zap.Error(err))
+				requestid.Logger(ctx, logger).Error("failed to get user id", zap.Error(err))
 				http.Error(w, "", http.StatusUnauthorized)
 				return
 			}
 
 			userID, err := uuid.Parse(id.(string))
 			if err != nil {
-				logger.Error("failed to parse user id", zap.Error(err))
+				requestid.Logger(ctx, logger).Error("failed to parse user id", zap.Error(err))
 				http.Error(w, "", http.StatusUnauthorized)
 				return
 			}
 
+			if jti, err := uuid.Parse(token.JwtID()); err == nil {
+				revoked, err := st.IsTokenRevoked(ctx, jti)
+				if err != nil {
+					requestid.Logger(ctx, logger).Error("failed to check token revocation", zap.Error(err))
+					http.Error(w, "", storageErrorStatus(err))
+					return
+				}
+				if revoked {
+					http.Error(w, "", http.StatusUnauthorized)
+					return
+				}
+			}
+
 			userData, err := st.GetUserAuthInfoByID(ctx, userID)
 			if err != nil {
-				logger.Error("failed to get user data", zap.Error(err))
+				requestid.Logger(ctx, logger).Error("failed to get user data", zap.Error(err))
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+
+			// A token is only valid at the merchant that issued it.
+			if userData.MerchantID != merchantFromContext(ctx) {
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+
+			// Changing the password invalidates the tokens issued before.
+			if issued, ok := claims["ts"].(float64); ok && int64(issued) < userData.PasswordChangedAt.Unix() {
 				http.Error(w, "", http.StatusUnauthorized)
 				return
 			}
 
+			if sessionID := tokenSessionID(ctx); sessionID != uuid.Nil {
+				if err := st.TouchSession(ctx, userID, sessionID); err != nil {
+					if errors.Is(err, storage.ErrNoSuchSession) {
+						http.Error(w, "", http.StatusUnauthorized)
+						return
+					}
+					requestid.Logger(ctx, logger).Error("failed to check session", zap.Error(err))
+					http.Error(w, "", storageErrorStatus(err))
+					return
+				}
+			}
+
+			setAccessLogUser(ctx, userData.ID)
 			ctx = context.WithValue(ctx, UserAuthDataCtxKey, userData)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// RequireRole lets through users authorized by AuthorizationVerifier whose
+// role is one of roles. The role is checked against the database, not the
+// token, so a demotion takes effect immediately.
+func RequireRole(roles ...string) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userData, ok := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+			if !ok {
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+			if !slices.Contains(roles, userData.Role) {
+				http.Error(w, "", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StaffAuth accepts either the API key, which grants full access, or a user
+// token passing tokenAuth whose role is one of roles. Staff users only reach
+// the users of their own merchant, see staffMerchant. An empty key disables
+// API key access.
+func StaffAuth(key string, tokenAuth func(http.Handler) http.Handler, roles ...string) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		byToken := tokenAuth(RequireRole(roles...)(next))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if apiKey := r.Header.Get(APIKeyHeader); len(apiKey) != 0 {
+				if !validAPIKey(key, apiKey) {
+					http.Error(w, "", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			byToken.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIKeyAuth accepts only the API key. It guards the routes that act across
+// merchants, which are beyond any staff user.
+func APIKeyAuth(key string) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !validAPIKey(key, r.Header.Get(APIKeyHeader)) {
+				http.Error(w, "", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func validAPIKey(key, apiKey string) bool {
+	return len(key) != 0 && subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1
+}
+
 func (k *contextKey) String() string {
 	return "marketappauth context value " + k.name
 }
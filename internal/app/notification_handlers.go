@@ -0,0 +1,73 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/service"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+type NotificationServer struct {
+	logger        *zap.Logger
+	notifications *service.NotificationService
+}
+
+func NewNotificationServer(logger *zap.Logger, notifications *service.NotificationService) *NotificationServer {
+	return &NotificationServer{
+		logger:        logger,
+		notifications: notifications,
+	}
+}
+
+func (s *NotificationServer) apiGetPreferences(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	prefs, err := s.notifications.Preferences(r.Context(), userData.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get notification preferences", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, prefs)
+}
+
+func (s *NotificationServer) apiSetPreferences(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	prefs := storage.NotificationPreferences{}
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+	prefs.UserID = userData.ID
+
+	if err := s.notifications.SetPreferences(r.Context(), prefs); err != nil {
+		if errors.Is(err, service.ErrInvalidEmail) || errors.Is(err, service.ErrInvalidWebhookURL) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to set notification preferences", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, prefs)
+}
+
+func (s *NotificationServer) apiDeletePreferences(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	if err := s.notifications.DeletePreferences(r.Context(), userData.ID); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to delete notification preferences", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+type placedOrderRequest struct {
+	Order string `json:"order"`
+}
+
+// PartnerServer serves the API merchants call with their API key.
+type PartnerServer struct {
+	logger  *zap.Logger
+	storage storage.AppStorage
+}
+
+func NewPartnerServer(logger *zap.Logger, storage storage.AppStorage) *PartnerServer {
+	return &PartnerServer{
+		logger:  logger,
+		storage: storage,
+	}
+}
+
+// RequireMerchantKey rejects requests without a merchant API key; Tenant
+// checks the key itself.
+func RequireMerchantKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get(MerchantKeyHeader)) == 0 {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiAddPlacedOrder registers an order the merchant is placing, so users can
+// withdraw points against it when withdrawals are strict.
+func (s *PartnerServer) apiAddPlacedOrder(w http.ResponseWriter, r *http.Request) {
+	addPlacedOrder(w, r, s.logger, s.storage, merchantFromContext(r.Context()))
+}
+
+func addPlacedOrder(w http.ResponseWriter, r *http.Request, logger *zap.Logger, st storage.AppStorage, merchantID uuid.UUID) {
+	logger = requestid.Logger(r.Context(), logger)
+
+	req := placedOrderRequest{}
+	if err := decodeJSON(r, &req); err != nil {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+	if !validate.OrderNumber(req.Order) {
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := st.AddPlacedOrder(r.Context(), merchantID, req.Order); err != nil {
+		if errors.Is(err, storage.ErrNoSuchMerchant) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		logger.Error("failed to add placed order", zap.String("order_id", req.Order), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	logger.Info("placed order added", zap.String("merchant_id", merchantID.String()), zap.String("order_id", req.Order))
+	w.WriteHeader(http.StatusCreated)
+}
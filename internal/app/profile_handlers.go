@@ -0,0 +1,126 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/jwtauth"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/service"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+type profileUpdateRequest struct {
+	DisplayName     *string `json:"display_name"`
+	Email           *string `json:"email"`
+	CurrentPassword string  `json:"current_password"`
+	NewPassword     string  `json:"new_password"`
+}
+
+// profileResponse carries a new token pair when the password was changed,
+// since the tokens issued before are no longer accepted. Value is the
+// monetary equivalent of the balance, as in the balance response.
+type profileResponse struct {
+	*storage.UserProfile
+	Value        money.Amount `json:"value,omitempty"`
+	Currency     string       `json:"currency,omitempty"`
+	Token        string       `json:"token,omitempty"`
+	RefreshToken string       `json:"refresh_token,omitempty"`
+}
+
+// newProfileResponse adds the balance value when exchange rates are
+// configured. The profile is still returned if the balance can't be read.
+func (s *AuthServer) newProfileResponse(r *http.Request, userID uuid.UUID, profile *storage.UserProfile) profileResponse {
+	resp := profileResponse{UserProfile: profile}
+	if s.balances == nil || !s.balances.Converts() {
+		return resp
+	}
+
+	balance, err := s.balances.Balance(r.Context(), userID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get balance", zap.String("user_id", userID.String()), zap.Error(err))
+		return resp
+	}
+	resp.Value, resp.Currency = balance.Value, balance.Currency
+	return resp
+}
+
+func (s *AuthServer) apiGetProfile(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	profile, err := s.users.Profile(r.Context(), userData.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get profile", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	writeJSON(requestid.Logger(r.Context(), s.logger), w, http.StatusOK, s.newProfileResponse(r, userData.ID, profile))
+}
+
+func (s *AuthServer) apiUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+	logger := requestid.Logger(r.Context(), s.logger)
+
+	req := profileUpdateRequest{}
+	if err := s.parseRequest(r, &req); err != nil {
+		http.Error(w, "", bodyErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	profile, err := s.users.UpdateProfile(r.Context(), userData.ID, service.ProfileUpdate{
+		DisplayName:     req.DisplayName,
+		Email:           req.Email,
+		CurrentPassword: req.CurrentPassword,
+		NewPassword:     req.NewPassword,
+	})
+	if err != nil {
+		var passwordErr *validate.PasswordError
+		switch {
+		case errors.As(err, &passwordErr):
+			writeJSON(logger, w, http.StatusBadRequest, passwordErr)
+		case errors.Is(err, service.ErrInvalidCredentials):
+			http.Error(w, "", http.StatusForbidden)
+		case errors.Is(err, service.ErrInvalidDisplayName), errors.Is(err, service.ErrInvalidEmail):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			logger.Error("failed to update profile", zap.String("user_id", userData.ID.String()), zap.Error(err))
+			http.Error(w, "", storageErrorStatus(err))
+		}
+		return
+	}
+
+	resp := s.newProfileResponse(r, userData.ID, profile)
+	if len(req.NewPassword) != 0 {
+		logger.Info("password changed", zap.String("user_id", userData.ID.String()))
+		s.revokeCurrentToken(r)
+
+		tokens, ok := s.setTokens(w, r, userData, uuid.Nil)
+		if !ok {
+			return
+		}
+		resp.Token = tokens.Token
+		resp.RefreshToken = tokens.RefreshToken
+	}
+
+	writeJSON(logger, w, http.StatusOK, resp)
+}
+
+func (s *AuthServer) revokeCurrentToken(r *http.Request) {
+	token, _, err := jwtauth.FromContext(r.Context())
+	if err != nil || token == nil {
+		return
+	}
+	jti, err := uuid.Parse(token.JwtID())
+	if err != nil {
+		return
+	}
+	if err := s.userStorage.RevokeToken(r.Context(), jti, token.Expiration()); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to revoke token", zap.Error(err))
+	}
+}
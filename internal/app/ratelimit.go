@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const rateLimitBucketTTL = 10 * time.Minute
+
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+)
+
+var rateLimitCtxKey = &contextKey{"RateLimit"}
+
+type bucket struct {
+	tokens float64
+	seen   time.Time
+}
+
+// rateLimitStatus is what a client has left of its bucket, reported in list
+// envelopes.
+type rateLimitStatus struct {
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+}
+
+// RateLimiter is a token bucket per client: each bucket holds up to burst
+// tokens and refills at rate tokens per second.
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token for key and otherwise reports how long to wait for one.
+// It also returns what is left of the bucket.
+func (l *RateLimiter) allow(key string) (bool, rateLimitStatus, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.seen).Seconds()*l.rate)
+	}
+	b.seen = now
+
+	status := rateLimitStatus{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		status.Remaining = int(b.tokens)
+		return true, status, 0
+	}
+
+	return false, status, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// status reports the bucket of key without taking a token.
+func (l *RateLimiter) status(key string) rateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tokens := l.burst
+	if b, ok := l.buckets[key]; ok {
+		tokens = math.Min(l.burst, b.tokens+time.Since(b.seen).Seconds()*l.rate)
+	}
+
+	return rateLimitStatus{Limit: int(l.burst), Remaining: int(tokens)}
+}
+
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitBucketTTL {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.seen) > rateLimitBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// RateLimit keys requests by the authenticated user, falling back to the
+// client IP for anonymous requests. Every response reports the bucket in the
+// X-RateLimit headers.
+func RateLimit(l *RateLimiter) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok, status, retryAfter := l.allow(rateLimitKey(r))
+			w.Header().Set(RateLimitLimitHeader, strconv.Itoa(status.Limit))
+			w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(status.Remaining))
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				http.Error(w, "", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimitStatus puts the client's bucket into the request context for
+// responses that report it, without limiting the request itself.
+func RateLimitStatus(l *RateLimiter) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), rateLimitCtxKey, l.status(rateLimitKey(r)))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func rateLimitKey(r *http.Request) string {
+	if userData, ok := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization); ok {
+		return userData.ID.String()
+	}
+	return clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/reporting"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+)
+
+const reportDateLayout = "2006-01-02"
+
+type ReportsServer struct {
+	logger   *zap.Logger
+	exporter *reporting.Exporter
+}
+
+func NewReportsServer(logger *zap.Logger, exporter *reporting.Exporter) *ReportsServer {
+	return &ReportsServer{
+		logger:   logger,
+		exporter: exporter,
+	}
+}
+
+func (s *ReportsServer) apiAccountingExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	from, err := time.Parse(reportDateLayout, query.Get("from"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	to, err := time.Parse(reportDateLayout, query.Get("to"))
+	if err != nil || !to.After(from) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = reporting.FormatCSV
+	}
+
+	var buf bytes.Buffer
+	period := reporting.Period{From: from, To: to}
+	if err := s.exporter.Export(r.Context(), &buf, period, format); err != nil {
+		if errors.Is(err, reporting.ErrUnknownFormat) {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to export accounting report", zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", s.exporter.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=accounting-"+from.Format(reportDateLayout)+"."+format)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to write response body", zap.Error(err))
+	}
+}
@@ -2,7 +2,7 @@ package app
 
 import (
 	"context"
-	"crypto/rand"
+	"errors"
 	"net/http"
 	"time"
 
@@ -11,69 +11,318 @@ import (
 	"github.com/go-chi/jwtauth"
 	"go.uber.org/zap"
 
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/fiscal"
+	"github.com/real-splendid/gophermart-practicum/internal/live"
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/rates"
+	"github.com/real-splendid/gophermart-practicum/internal/reporting"
+	"github.com/real-splendid/gophermart-practicum/internal/service"
 	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
 )
 
-const (
-	privateKeySize           = 32
-	compressionLevel         = 7
-	requestProcessingTimeout = 60 * time.Second
-)
+const privateKeySize = 32
+
+type Config struct {
+	ServerAddress  string
+	Logger         *zap.Logger
+	LogLevel       *zap.AtomicLevel
+	Storage        storage.AppStorage
+	AccrualEnabled bool
+	Rates          *rates.Converter
+	Fiscal         fiscal.Validator
+	ReportsAPIKey  string
+	AdminAPIKey    string
+	DocsUI         bool
+
+	// StrictWithdrawals only allows withdrawals against orders registered
+	// through the partner API.
+	StrictWithdrawals bool
+
+	Compression Compression
+
+	Accrual               *accrual.Accrual
+	AccrualCallbackAPIKey string
+
+	Live *live.Hub
+
+	RateLimit      float64
+	RateLimitBurst int
+
+	DebugAddress string
+
+	HTTP     HTTPServer
+	Timeouts Timeouts
+	TLS      TLS
+
+	AccessLogSampleRatio float64
+
+	JWTSecret          []byte
+	JWTPreviousSecrets [][]byte
+	JWTTTL             time.Duration
+	RefreshTokenTTL    time.Duration
+
+	PasswordPolicy validate.PasswordPolicy
+	LoginLockout   LoginLockout
+	Cookies        Cookies
+	CSRFMode       string
+}
+
+func Run(ctx context.Context, cfg Config) {
+	logger := cfg.Logger
+
+	if len(cfg.JWTSecret) == 0 {
+		logger.Warn("JWT secret is not configured, issued tokens will not survive a restart")
+	}
+
+	handler, err := NewHandler(ctx, cfg)
+	if err != nil {
+		logger.Fatal("Failed to initialize HTTP handlers", zap.Error(err))
+	}
+
+	if len(cfg.DebugAddress) != 0 {
+		runDebugServer(cfg.DebugAddress, logger)
+	}
+
+	server := newHTTPServer(cfg.ServerAddress, handler, cfg.HTTP)
+	served := make(chan error, 1)
+	go func() {
+		if cfg.TLS.enabled() {
+			served <- serveTLS(ctx, server, cfg.TLS, logger)
+			return
+		}
+		served <- server.ListenAndServe()
+	}()
 
-func Run(ctx context.Context, serverAddress string, logger *zap.Logger, st storage.AppStorage) {
-	privateKey := make([]byte, privateKeySize)
-	readBytes, err := rand.Read(privateKey)
-	if err != nil || readBytes != privateKeySize {
-		logger.Fatal("Failed to generate private key", zap.Error(err), zap.Int("generated_len", readBytes))
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed", zap.Error(err))
+		}
+		return
+	case <-ctx.Done():
 	}
 
-	authorizer := jwtauth.New("HS256", privateKey, nil)
+	// Shutdown waits for the requests in flight; hijacked connections like
+	// websockets are not waited for.
+	logger.Info("Shutting down HTTP server", zap.Duration("timeout", cfg.HTTP.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	if cfg.HTTP.ShutdownTimeout > 0 {
+		shutdownCtx, cancel = context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	}
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("HTTP server did not shut down in time", zap.Error(err))
+	}
+}
+
+// NewHandler builds the routes of the API with their middleware.
+func NewHandler(ctx context.Context, cfg Config) (http.Handler, error) {
+	logger := cfg.Logger
+	st := cfg.Storage
 
-	authServer, err := NewAuthServer(ctx, logger, st, authorizer)
+	authorizers, err := newAuthorizers(cfg.JWTSecret, cfg.JWTPreviousSecrets)
 	if err != nil {
-		logger.Fatal("Failed to initialize auth server", zap.Error(err))
+		return nil, err
 	}
+	authorizer := authorizers[0]
 
-	martServer, err := NewHandlersServer(ctx, logger, st)
+	balances := service.NewBalanceService(st, cfg.Rates, cfg.StrictWithdrawals)
+	authServer, err := NewAuthServer(ctx, logger, st, service.NewUserService(st, cfg.PasswordPolicy), balances, authorizer, cfg.JWTTTL, cfg.RefreshTokenTTL, cfg.LoginLockout, cfg.Cookies)
 	if err != nil {
-		logger.Fatal("Failed to initialize app server", zap.Error(err))
+		return nil, err
+	}
+
+	martServer, err := NewHandlersServer(ctx, logger, service.NewOrderService(logger, st, cfg.Fiscal), balances, cfg.Accrual)
+	if err != nil {
+		return nil, err
+	}
+
+	notificationServer := NewNotificationServer(logger, service.NewNotificationService(st))
+
+	healthServer := NewHealthServer(logger, cfg.AccrualEnabled)
+
+	rateLimit := func(next http.Handler) http.Handler { return next }
+	reportRateLimit := rateLimit
+	if cfg.RateLimit > 0 {
+		limiter := NewRateLimiter(cfg.RateLimit, cfg.RateLimitBurst)
+		rateLimit = RateLimit(limiter)
+		reportRateLimit = RateLimitStatus(limiter)
 	}
 
 	r := chi.NewRouter()
-	r.Use(middleware.NoCache)
-	r.Use(middleware.Compress(compressionLevel))
+	r.Use(middleware.RequestID)
+	r.Use(ResponseRequestID)
+	r.Use(tracing.Middleware)
+	r.Use(AccessLog(logger, cfg.AccessLogSampleRatio))
+	r.Use(Recover(logger))
+	r.Use(NoCache)
+	r.Use(unlessWebSocket(Compress(cfg.Compression)))
 	r.Use(DecompressGzip)
-	r.Use(middleware.Timeout(requestProcessingTimeout))
+	r.Use(unlessWebSocket(Timeout(r, cfg.Timeouts)))
 
 	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", http.StatusBadRequest)
 	})
 
+	r.Get("/api/health", healthServer.apiHealth)
+	r.Get("/api/version", healthServer.apiVersion)
+	r.Handle("/metrics", metrics.Handler())
+	r.With(RouteCompression(bulkCompressionLevel, 0)).Get("/api/docs", apiDocs)
+	if cfg.DocsUI {
+		r.Get("/api/docs/ui", apiDocsUI)
+	}
+
 	r.Group(func(r chi.Router) {
+		r.Use(Tenant(st, logger))
+		r.Use(LimitBody(maxJSONBodySize))
 		r.Post("/api/user/register", authServer.registerUser)
 		r.Post("/api/user/login", authServer.login)
+		r.Post("/api/user/refresh", authServer.refresh)
 	})
 
 	r.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(authorizer))
+		r.Use(Tenant(st, logger))
+		r.Use(MultiKeyVerifier(authorizers...))
 		r.Use(jwtauth.Authenticator)
 		r.Use(AuthorizationVerifier(st, logger))
+		r.Use(CSRF(cfg.CSRFMode, logger))
+		r.Use(reportRateLimit)
+
+		r.Post("/api/user/logout", authServer.logout)
+		r.Delete("/api/user", authServer.deleteUser)
+		r.With(RouteCompression(bulkCompressionLevel, 0)).Get("/api/user/export", authServer.exportUser)
+		r.Get("/api/user/profile", authServer.apiGetProfile)
+		r.Get("/api/user/sessions", authServer.apiGetSessions)
+		r.Delete("/api/user/sessions/{id}", authServer.apiRevokeSession)
+		r.With(rateLimit, LimitBody(maxJSONBodySize)).Patch("/api/user/profile", authServer.apiUpdateProfile)
 
 		r.Route("/api/user/orders", func(r chi.Router) {
 			r.Get("/", martServer.apiGetUserOrders)
-			r.Post("/", martServer.apiAddUserOrder)
+			r.With(rateLimit, LimitBody(maxOrderBodySize)).Post("/", martServer.apiAddUserOrder)
+			r.Get("/{number}", martServer.apiGetUserOrder)
 		})
 
 		r.Route("/api/user/balance", func(r chi.Router) {
 			r.Get("/", martServer.apiGetUserBalance)
-			r.Post("/withdraw", martServer.apiBalanceWithdraw)
+			r.Get("/history", martServer.apiGetUserBalanceHistory)
+			r.With(rateLimit, LimitBody(maxJSONBodySize)).Post("/withdraw", martServer.apiBalanceWithdraw)
 		})
 
+		r.Get("/api/user/stats", martServer.apiGetUserStats)
+
 		r.Route("/api/user/withdrawals", func(r chi.Router) {
 			r.Get("/", martServer.apiGetUserWithdrawals)
 		})
+
+		r.Route("/api/user/notifications", func(r chi.Router) {
+			r.Get("/", notificationServer.apiGetPreferences)
+			r.With(LimitBody(maxJSONBodySize)).Put("/", notificationServer.apiSetPreferences)
+			r.Delete("/", notificationServer.apiDeletePreferences)
+		})
+	})
+
+	if cfg.Live != nil {
+		liveServer := NewLiveServer(logger, st, cfg.Live)
+
+		r.Group(func(r chi.Router) {
+			r.Use(Tenant(st, logger))
+			r.Use(WebSocketVerifier(authorizers...))
+			r.Use(jwtauth.Authenticator)
+			r.Use(AuthorizationVerifier(st, logger))
+			r.Get("/api/user/ws", liveServer.apiUserWebSocket)
+		})
+	}
+
+	adminServer, err := NewAdminServer(ctx, logger, st, cfg.Accrual)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenAuth := chi.Chain(
+		Tenant(st, logger),
+		MultiKeyVerifier(authorizers...),
+		jwtauth.Authenticator,
+		AuthorizationVerifier(st, logger),
+	).Handler
+
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(LimitBody(maxJSONBodySize))
+		r.Use(CSRF(cfg.CSRFMode, logger))
+
+		// Support staff may look, only admins may change anything.
+		r.Group(func(r chi.Router) {
+			r.Use(StaffAuth(cfg.AdminAPIKey, tokenAuth, storage.RoleSupport, storage.RoleAdmin))
+			r.Get("/users", adminServer.apiFindUser)
+			r.Get("/users/{id}/orders", adminServer.apiGetUserOrders)
+			r.Get("/users/{id}/withdrawals", adminServer.apiGetUserWithdrawals)
+			r.Get("/balance-audit", adminServer.apiGetBalanceAudit)
+			r.Get("/balance-drift", adminServer.apiGetBalanceDrift)
+			r.Get("/notifications", adminServer.apiGetNotificationDeliveries)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(StaffAuth(cfg.AdminAPIKey, tokenAuth, storage.RoleAdmin))
+			r.Post("/merchants/{id}/placed-orders", adminServer.apiAddPlacedOrder)
+			r.Put("/users/{id}/role", adminServer.apiSetUserRole)
+			r.Post("/users/{id}/balance-adjustments", adminServer.apiAdjustBalance)
+			r.Post("/users/{id}/unlock", adminServer.apiUnlockUser)
+			r.Post("/users/{id}/merge", adminServer.apiMergeUser)
+		})
+
+		// The accrual pipeline, merchants, client addresses and the logger
+		// are shared by all merchants.
+		r.Group(func(r chi.Router) {
+			r.Use(APIKeyAuth(cfg.AdminAPIKey))
+			r.Post("/merchants", adminServer.apiAddMerchant)
+			r.Get("/orders/{number}/accrual-log", adminServer.apiGetOrderAccrualLog)
+			r.Post("/orders/{number}/requeue", adminServer.apiRequeueOrder)
+			r.Get("/dead-letters", adminServer.apiGetDeadLetters)
+			r.Post("/dead-letters/{number}/redrive", adminServer.apiRedriveOrder)
+			r.Post("/ips/{ip}/unlock", adminServer.apiUnlockIP)
+			if cfg.Accrual != nil {
+				r.Get("/accrual/status", adminServer.apiGetAccrualStatus)
+			}
+			if cfg.LogLevel != nil {
+				r.Method(http.MethodGet, "/log-level", cfg.LogLevel)
+				r.Method(http.MethodPut, "/log-level", adminServer.logLevelHandler(*cfg.LogLevel))
+			}
+		})
 	})
 
-	server := &http.Server{Addr: serverAddress, Handler: r}
-	server.ListenAndServe()
+	partnerServer := NewPartnerServer(logger, st)
+
+	r.Group(func(r chi.Router) {
+		r.Use(RequireMerchantKey)
+		r.Use(Tenant(st, logger))
+		r.Use(LimitBody(maxJSONBodySize))
+		r.Post("/api/partner/placed-orders", partnerServer.apiAddPlacedOrder)
+	})
+
+	if cfg.Accrual != nil && cfg.Accrual.Mode == accrual.ModeCallback {
+		if len(cfg.AccrualCallbackAPIKey) == 0 {
+			return nil, errors.New("accrual callback API key is required in callback mode")
+		}
+
+		callbackServer := NewCallbackServer(logger, cfg.Accrual)
+
+		r.Group(func(r chi.Router) {
+			r.Use(RequireAPIKey(cfg.AccrualCallbackAPIKey))
+			r.Use(LimitBody(maxJSONBodySize))
+			r.Post("/api/internal/accrual/callback", callbackServer.apiAccrualCallback)
+		})
+	}
+
+	if len(cfg.ReportsAPIKey) != 0 {
+		reportsServer := NewReportsServer(logger, reporting.NewExporter(st))
+
+		r.Group(func(r chi.Router) {
+			r.Use(RequireAPIKey(cfg.ReportsAPIKey))
+			r.With(RouteCompression(bulkCompressionLevel, 0)).Get("/api/reports/accounting", reportsServer.apiAccountingExport)
+		})
+	}
+
+	return r, nil
 }
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/jwtauth"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const maxUserAgentLength = 512
+
+type sessionResponse struct {
+	storage.Session
+	Current bool `json:"current"`
+}
+
+// tokenSessionID returns the session the request's token was issued to, or
+// uuid.Nil for tokens issued before sessions were tracked.
+func tokenSessionID(ctx context.Context) uuid.UUID {
+	_, claims, err := jwtauth.FromContext(ctx)
+	if err != nil {
+		return uuid.Nil
+	}
+	sid, _ := claims["sid"].(string)
+	sessionID, err := uuid.Parse(sid)
+	if err != nil {
+		return uuid.Nil
+	}
+	return sessionID
+}
+
+// saveSession starts a session for a newly issued token pair, or records
+// the new pair on an existing session, and returns the session ID.
+func (s *AuthServer) saveSession(r *http.Request, userID, sessionID, jti uuid.UUID, expiresAt time.Time) (uuid.UUID, error) {
+	if sessionID != uuid.Nil {
+		return sessionID, s.userStorage.RenewSession(r.Context(), sessionID, jti, expiresAt)
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	session := &storage.Session{
+		ID:        uuid.New(),
+		UserID:    userID,
+		JTI:       jti,
+		UserAgent: userAgent,
+		IP:        clientIP(r),
+		ExpiresAt: expiresAt,
+	}
+	if err := s.userStorage.StartSession(r.Context(), session); err != nil {
+		return uuid.Nil, err
+	}
+	return session.ID, nil
+}
+
+func (s *AuthServer) apiGetSessions(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	sessions, err := s.userStorage.GetSessions(r.Context(), userData.ID)
+	if err != nil {
+		requestid.Logger(r.Context(), s.logger).Error("failed to get sessions", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	current := tokenSessionID(r.Context())
+	resp := make([]sessionResponse, len(sessions))
+	for i, session := range sessions {
+		resp[i] = sessionResponse{Session: session, Current: session.ID == current}
+	}
+
+	writeList(requestid.Logger(r.Context(), s.logger), w, r, resp, pageInfo{Total: len(resp)}, false)
+}
+
+// apiRevokeSession signs the user out on one device. Its refresh token stops
+// working at once and its access token on the next request.
+func (s *AuthServer) apiRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	sessionID, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.userStorage.RevokeSession(r.Context(), userData.ID, sessionID); err != nil {
+		if errors.Is(err, storage.ErrNoSuchSession) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		requestid.Logger(r.Context(), s.logger).Error("failed to revoke session", zap.String("user_id", userData.ID.String()), zap.Error(err))
+		http.Error(w, "", storageErrorStatus(err))
+		return
+	}
+
+	if sessionID == tokenSessionID(r.Context()) {
+		s.clearAuthCookies(w, r)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,240 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/fiscal"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+// storageMock is the storage of handler tests. It keeps users, balances,
+// revoked tokens and login locks in memory for the auth middleware and handlers;
+// orders and withdrawals go to the func fields and succeed if those are nil.
+// Any other AppStorage method panics on the nil embedded interface.
+type storageMock struct {
+	storage.AppStorage
+
+	mu            sync.Mutex
+	users         map[uuid.UUID]*storage.UserAuthorization
+	balances      map[uuid.UUID]money.Amount
+	revoked       map[uuid.UUID]bool
+	refreshTokens map[string]mockRefreshToken
+	loginLocks    map[string]time.Time
+	failures      map[string]int
+	failedAt      map[string]time.Time
+
+	addOrder func(userID uuid.UUID, orderNumber string) error
+	withdraw func(userID uuid.UUID, orderNumber string, sum money.Amount, idempotencyKey string) error
+}
+
+type mockRefreshToken struct {
+	userID, sessionID uuid.UUID
+}
+
+func newStorageMock() *storageMock {
+	return &storageMock{
+		users:         make(map[uuid.UUID]*storage.UserAuthorization),
+		balances:      make(map[uuid.UUID]money.Amount),
+		revoked:       make(map[uuid.UUID]bool),
+		refreshTokens: make(map[string]mockRefreshToken),
+		loginLocks:    make(map[string]time.Time),
+		failures:      make(map[string]int),
+		failedAt:      make(map[string]time.Time),
+	}
+}
+
+// addUser adds a user of the default merchant and returns it.
+func (m *storageMock) addUser(login, password string) *storage.UserAuthorization {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user := &storage.UserAuthorization{
+		ID:         uuid.New(),
+		MerchantID: storage.DefaultMerchantID,
+		Login:      login,
+		Password:   []byte(password),
+		Role:       storage.RoleUser,
+	}
+	m.users[user.ID] = user
+	return user
+}
+
+func (m *storageMock) GetMerchantByHost(context.Context, string) (*storage.Merchant, error) {
+	return nil, storage.ErrNoSuchMerchant
+}
+
+func (m *storageMock) GetMerchantByAPIKey(context.Context, string) (*storage.Merchant, error) {
+	return nil, storage.ErrNoSuchMerchant
+}
+
+func (m *storageMock) AddUser(_ context.Context, auth *storage.UserAuthorization) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.MerchantID == auth.MerchantID && u.Login == auth.Login {
+			return storage.ErrDuplicateUser
+		}
+	}
+	user := *auth
+	user.ID = uuid.New()
+	user.Role = storage.RoleUser
+	m.users[user.ID] = &user
+	return nil
+}
+
+func (m *storageMock) GetUserAuthInfo(_ context.Context, merchantID uuid.UUID, login string) (*storage.UserAuthorization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.MerchantID == merchantID && u.Login == login {
+			return u, nil
+		}
+	}
+	return nil, storage.ErrNoSuchUser
+}
+
+func (m *storageMock) GetUserAuthInfoByID(_ context.Context, userID uuid.UUID) (*storage.UserAuthorization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u, ok := m.users[userID]; ok {
+		return u, nil
+	}
+	return nil, storage.ErrNoSuchUser
+}
+
+func (m *storageMock) SetUserRole(_ context.Context, userID uuid.UUID, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return storage.ErrNoSuchUser
+	}
+	user.Role = role
+	return nil
+}
+
+func (m *storageMock) IsTokenRevoked(_ context.Context, jti uuid.UUID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.revoked[jti], nil
+}
+
+func (m *storageMock) StartSession(context.Context, *storage.Session) error {
+	return nil
+}
+
+func (m *storageMock) RenewSession(context.Context, uuid.UUID, uuid.UUID, time.Time) error {
+	return nil
+}
+
+func (m *storageMock) AddRefreshToken(_ context.Context, tokenHash string, userID, sessionID uuid.UUID, _ time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refreshTokens[tokenHash] = mockRefreshToken{userID: userID, sessionID: sessionID}
+	return nil
+}
+
+func (m *storageMock) ConsumeRefreshToken(_ context.Context, tokenHash string) (uuid.UUID, uuid.UUID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.refreshTokens[tokenHash]
+	if !ok {
+		return uuid.Nil, uuid.Nil, storage.ErrNoSuchToken
+	}
+	delete(m.refreshTokens, tokenHash)
+	return token.userID, token.sessionID, nil
+}
+
+func (m *storageMock) GetLoginLock(_ context.Context, key string) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.loginLocks[key], nil
+}
+
+func (m *storageMock) RecordLoginFailure(_ context.Context, key string, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failedAt[key].Before(since) {
+		m.failures[key] = 0
+	}
+	m.failures[key]++
+	m.failedAt[key] = time.Now()
+	return m.failures[key], nil
+}
+
+func (m *storageMock) LockLogin(_ context.Context, key string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loginLocks[key] = until
+	return nil
+}
+
+func (m *storageMock) ResetLoginFailures(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, key)
+	delete(m.failedAt, key)
+	delete(m.loginLocks, key)
+	return nil
+}
+
+func (m *storageMock) GetUserProfile(_ context.Context, userID uuid.UUID) (*storage.UserProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, storage.ErrNoSuchUser
+	}
+	return &storage.UserProfile{Login: user.Login}, nil
+}
+
+func (m *storageMock) GetBalance(_ context.Context, userID uuid.UUID) (*storage.BalanceInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &storage.BalanceInfo{Current: m.balances[userID]}, nil
+}
+
+func (m *storageMock) GetOrders(context.Context, uuid.UUID) ([]storage.Order, error) {
+	return make([]storage.Order, 0), nil
+}
+
+func (m *storageMock) AddOrder(_ context.Context, _, userID uuid.UUID, orderNumber string) error {
+	if m.addOrder == nil {
+		return nil
+	}
+	return m.addOrder(userID, orderNumber)
+}
+
+func (m *storageMock) Withdraw(_ context.Context, userID uuid.UUID, orderNumber string, sum money.Amount, idempotencyKey string) error {
+	if m.withdraw == nil {
+		return nil
+	}
+	return m.withdraw(userID, orderNumber, sum, idempotencyKey)
+}
+
+// fiscalStub answers every receipt check with result.
+type fiscalStub struct {
+	result *fiscal.Result
+}
+
+func (f fiscalStub) Validate(context.Context, string) (*fiscal.Result, error) {
+	return f.result, nil
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const MerchantKeyHeader = "X-Merchant-Key"
+
+var merchantCtxKey = &contextKey{"Merchant"}
+
+// Tenant selects the merchant of the request: by the merchant API key if the
+// client sends one, otherwise by the request host. Requests that match no
+// merchant host belong to the default merchant; an unknown API key is
+// rejected.
+func Tenant(st storage.AppStorage, logger *zap.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			var (
+				merchant *storage.Merchant
+				err      error
+			)
+			if key := r.Header.Get(MerchantKeyHeader); len(key) != 0 {
+				merchant, err = st.GetMerchantByAPIKey(ctx, hashMerchantKey(key))
+				if errors.Is(err, storage.ErrNoSuchMerchant) {
+					http.Error(w, "", http.StatusUnauthorized)
+					return
+				}
+			} else {
+				merchant, err = st.GetMerchantByHost(ctx, requestHost(r))
+				if errors.Is(err, storage.ErrNoSuchMerchant) {
+					merchant, err = &storage.Merchant{ID: storage.DefaultMerchantID}, nil
+				}
+			}
+			if err != nil {
+				requestid.Logger(ctx, logger).Error("failed to resolve merchant", zap.Error(err))
+				http.Error(w, "", storageErrorStatus(err))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, merchantCtxKey, merchant.ID)))
+		})
+	}
+}
+
+func merchantFromContext(ctx context.Context) uuid.UUID {
+	if id, ok := ctx.Value(merchantCtxKey).(uuid.UUID); ok {
+		return id
+	}
+	return storage.DefaultMerchantID
+}
+
+func hashMerchantKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
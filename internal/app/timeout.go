@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+)
+
+// DefaultTimeouts keeps reads short and gives the bulk exports room.
+var DefaultTimeouts = Timeouts{
+	Read:  10 * time.Second,
+	Write: 30 * time.Second,
+	Routes: map[string]time.Duration{
+		"POST /api/user/orders":       5 * time.Second,
+		"GET /api/user/export":        120 * time.Second,
+		"GET /api/reports/accounting": 120 * time.Second,
+	},
+}
+
+var ErrBadRouteTimeout = errors.New("bad route timeout")
+
+// Timeouts limits how long a request may be processed. Routes are keyed by
+// method and route pattern, like "POST /api/user/orders"; other GET and HEAD
+// requests get Read and the rest Write.
+type Timeouts struct {
+	Read   time.Duration
+	Write  time.Duration
+	Routes map[string]time.Duration
+}
+
+// ParseRouteTimeouts parses a comma-separated list of route=duration pairs,
+// e.g. "GET /api/user/export=2m".
+func ParseRouteTimeouts(s string) (map[string]time.Duration, error) {
+	routes := make(map[string]time.Duration)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+
+		route, value, ok := strings.Cut(part, "=")
+		method, pattern, hasPattern := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !hasPattern || !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("%w: %q", ErrBadRouteTimeout, part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrBadRouteTimeout, part)
+		}
+		routes[strings.ToUpper(method)+" "+strings.TrimSpace(pattern)] = d
+	}
+	return routes, nil
+}
+
+func (t Timeouts) forRequest(routes chi.Routes, r *http.Request) (time.Duration, string) {
+	// Unknown paths share one metric key.
+	rctx := chi.NewRouteContext()
+	pattern := "*"
+	if routes.Match(rctx, r.Method, r.URL.Path) {
+		pattern = rctx.RoutePattern()
+	}
+
+	route := r.Method + " " + pattern
+	if d, ok := t.Routes[route]; ok {
+		return d, route
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return t.Read, route
+	}
+	return t.Write, route
+}
+
+// Timeout cancels the request context once the timeout of the route is up
+// and answers 504 if the handler gave up because of it. The route is matched
+// against routes up front, since a deadline can only be shortened once set.
+func Timeout(routes chi.Routes, t Timeouts) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d, route := t.forRequest(routes, r)
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer func() {
+				cancel()
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					metrics.HTTPTimeouts.Add(route, 1)
+					w.WriteHeader(http.StatusGatewayTimeout)
+				}
+			}()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
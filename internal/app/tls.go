@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const DefaultAutocertCacheDir = "autocert-cache"
+
+// TLS configures HTTPS. Either CertFile and KeyFile or AutocertHosts must be
+// set to enable it.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+
+	// AutocertHosts are the host names to get Let's Encrypt certificates
+	// for. Issued certificates are kept in AutocertCacheDir.
+	AutocertHosts    []string
+	AutocertCacheDir string
+
+	// RedirectAddress, if set, serves plain HTTP redirects to HTTPS. With
+	// autocert it also answers ACME HTTP-01 challenges.
+	RedirectAddress string
+}
+
+func (t TLS) enabled() bool {
+	return len(t.CertFile) != 0 || len(t.AutocertHosts) != 0
+}
+
+// certReloader serves the certificate from CertFile and KeyFile and reloads
+// them on SIGHUP. Handshakes after the reload use the new certificate; open
+// connections are not affected. A certificate that fails to load is logged
+// and the previous one stays in use.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(ctx context.Context, certFile, keyFile string, logger *zap.Logger) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := c.reload(); err != nil {
+					c.logger.Error("Failed to reload TLS certificate, keeping the previous one", zap.Error(err))
+					continue
+				}
+				c.logger.Info("TLS certificate reloaded")
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// serveTLS runs server over HTTPS and, if configured, the HTTP redirect
+// listener next to it.
+func serveTLS(ctx context.Context, server *http.Server, cfg TLS, logger *zap.Logger) error {
+	var redirect http.Handler = http.HandlerFunc(redirectToHTTPS)
+
+	if len(cfg.AutocertHosts) != 0 {
+		if len(cfg.AutocertCacheDir) == 0 {
+			cfg.AutocertCacheDir = DefaultAutocertCacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertHosts...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		redirect = manager.HTTPHandler(redirect)
+	} else {
+		reloader, err := newCertReloader(ctx, cfg.CertFile, cfg.KeyFile, logger)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+		}
+	}
+
+	if len(cfg.RedirectAddress) != 0 {
+		logger.Info("HTTP redirect server is listening", zap.String("address", cfg.RedirectAddress))
+		go func() {
+			redirectServer := &http.Server{Addr: cfg.RedirectAddress, Handler: redirect}
+			go func() {
+				<-ctx.Done()
+				redirectServer.Close()
+			}()
+			if err := redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("HTTP redirect server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	return server.ListenAndServeTLS("", "")
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,712 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/accrual"
+	"github.com/real-splendid/gophermart-practicum/internal/app"
+	"github.com/real-splendid/gophermart-practicum/internal/dbauth"
+	"github.com/real-splendid/gophermart-practicum/internal/events"
+	"github.com/real-splendid/gophermart-practicum/internal/logging"
+	"github.com/real-splendid/gophermart-practicum/internal/notify"
+	"github.com/real-splendid/gophermart-practicum/internal/reconcile"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+const (
+	ConfigFlag = "config"
+	ConfigEnv  = "CONFIG"
+)
+
+// Config is filled from defaults, then the -config JSON file, then environment
+// variables and finally command line flags. Every field is described by its
+// json key, env variable and flag name.
+type Config struct {
+	ServerAddress string `json:"run_address" env:"RUN_ADDRESS" flag:"a"`
+
+	TLSCert             string `json:"tls_cert" env:"TLS_CERT" flag:"tls-cert"`
+	TLSKey              string `json:"tls_key" env:"TLS_KEY" flag:"tls-key"`
+	TLSAutocertHosts    string `json:"tls_autocert_hosts" env:"TLS_AUTOCERT_HOSTS" flag:"tls-autocert-hosts"`
+	TLSAutocertCacheDir string `json:"tls_autocert_cache_dir" env:"TLS_AUTOCERT_CACHE_DIR" flag:"tls-autocert-cache-dir"`
+	HTTPRedirectAddress string `json:"http_redirect_address" env:"HTTP_REDIRECT_ADDRESS" flag:"http-redirect-address"`
+
+	HTTPReadHeaderTimeout time.Duration `json:"http_read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT" flag:"http-read-header-timeout"`
+	HTTPReadTimeout       time.Duration `json:"http_read_timeout" env:"HTTP_READ_TIMEOUT" flag:"http-read-timeout"`
+	HTTPWriteTimeout      time.Duration `json:"http_write_timeout" env:"HTTP_WRITE_TIMEOUT" flag:"http-write-timeout"`
+	HTTPIdleTimeout       time.Duration `json:"http_idle_timeout" env:"HTTP_IDLE_TIMEOUT" flag:"http-idle-timeout"`
+	HTTPMaxHeaderBytes    int           `json:"http_max_header_bytes" env:"HTTP_MAX_HEADER_BYTES" flag:"http-max-header-bytes"`
+	HTTPH2C               bool          `json:"http_h2c" env:"HTTP_H2C" flag:"http-h2c"`
+	HTTPShutdownTimeout   time.Duration `json:"http_shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT" flag:"http-shutdown-timeout"`
+
+	AccrualSystemAddress   string        `json:"accrual_system_address" env:"ACCRUAL_SYSTEM_ADDRESS" flag:"r"`
+	AccrualProviders       string        `json:"accrual_providers" env:"ACCRUAL_PROVIDERS" flag:"accrual-providers"`
+	AccrualMode            string        `json:"accrual_mode" env:"ACCRUAL_MODE" flag:"accrual-mode"`
+	AccrualCallbackAPIKey  string        `json:"accrual_callback_api_key" env:"ACCRUAL_CALLBACK_API_KEY" flag:"accrual-callback-api-key"`
+	AccrualWorkers         int           `json:"accrual_workers" env:"ACCRUAL_WORKERS" flag:"accrual-workers"`
+	AccrualWorkerRateLimit int           `json:"accrual_worker_rate_limit" env:"ACCRUAL_WORKER_RATE_LIMIT" flag:"accrual-worker-rate-limit"`
+	AccrualPollInterval    time.Duration `json:"accrual_poll_interval" env:"ACCRUAL_POLL_INTERVAL" flag:"accrual-poll-interval"`
+	AccrualDrainTimeout    time.Duration `json:"accrual_drain_timeout" env:"ACCRUAL_DRAIN_TIMEOUT" flag:"accrual-drain-timeout"`
+	AccrualMaxNotFound     int           `json:"accrual_max_not_found" env:"ACCRUAL_MAX_NOT_FOUND" flag:"accrual-max-not-found"`
+	AccrualMaxFailures     int           `json:"accrual_max_failures" env:"ACCRUAL_MAX_FAILURES" flag:"accrual-max-failures"`
+	AccrualClaimLease      time.Duration `json:"accrual_claim_lease" env:"ACCRUAL_CLAIM_LEASE" flag:"accrual-claim-lease"`
+	AccrualClaimBatch      int           `json:"accrual_claim_batch" env:"ACCRUAL_CLAIM_BATCH" flag:"accrual-claim-batch"`
+	AccrualRegisterOrders  bool          `json:"accrual_register_orders" env:"ACCRUAL_REGISTER_ORDERS" flag:"accrual-register-orders"`
+	AccrualResultCacheTTL  time.Duration `json:"accrual_result_cache_ttl" env:"ACCRUAL_RESULT_CACHE_TTL" flag:"accrual-result-cache-ttl"`
+
+	AccrualBacklogThreshold int           `json:"accrual_backlog_threshold" env:"ACCRUAL_BACKLOG_THRESHOLD" flag:"accrual-backlog-threshold"`
+	AccrualBacklogInterval  time.Duration `json:"accrual_backlog_interval" env:"ACCRUAL_BACKLOG_INTERVAL" flag:"accrual-backlog-interval"`
+	AccrualRetryAttempts    int           `json:"accrual_retry_attempts" env:"ACCRUAL_RETRY_ATTEMPTS" flag:"accrual-retry-attempts"`
+	AccrualRetryBaseDelay   time.Duration `json:"accrual_retry_base_delay" env:"ACCRUAL_RETRY_BASE_DELAY" flag:"accrual-retry-base-delay"`
+	AccrualRetryMaxDelay    time.Duration `json:"accrual_retry_max_delay" env:"ACCRUAL_RETRY_MAX_DELAY" flag:"accrual-retry-max-delay"`
+	AccrualRetryMaxElapsed  time.Duration `json:"accrual_retry_max_elapsed" env:"ACCRUAL_RETRY_MAX_ELAPSED" flag:"accrual-retry-max-elapsed"`
+	AccrualRetryBudget      int           `json:"accrual_retry_budget" env:"ACCRUAL_RETRY_BUDGET" flag:"accrual-retry-budget"`
+
+	// AccrualStaleAfter leaves orders unchanged for that long to a sweep
+	// every AccrualSweepInterval; 0 polls all of them.
+	AccrualStaleAfter    time.Duration `json:"accrual_stale_after" env:"ACCRUAL_STALE_AFTER" flag:"accrual-stale-after"`
+	AccrualSweepInterval time.Duration `json:"accrual_sweep_interval" env:"ACCRUAL_SWEEP_INTERVAL" flag:"accrual-sweep-interval"`
+
+	AccrualDialTimeout         time.Duration `json:"accrual_dial_timeout" env:"ACCRUAL_DIAL_TIMEOUT" flag:"accrual-dial-timeout"`
+	AccrualResponseTimeout     time.Duration `json:"accrual_response_timeout" env:"ACCRUAL_RESPONSE_TIMEOUT" flag:"accrual-response-timeout"`
+	AccrualRequestTimeout      time.Duration `json:"accrual_request_timeout" env:"ACCRUAL_REQUEST_TIMEOUT" flag:"accrual-request-timeout"`
+	AccrualKeepAlive           time.Duration `json:"accrual_keep_alive" env:"ACCRUAL_KEEP_ALIVE" flag:"accrual-keep-alive"`
+	AccrualIdleConnTimeout     time.Duration `json:"accrual_idle_conn_timeout" env:"ACCRUAL_IDLE_CONN_TIMEOUT" flag:"accrual-idle-conn-timeout"`
+	AccrualMaxIdleConnsPerHost int           `json:"accrual_max_idle_conns_per_host" env:"ACCRUAL_MAX_IDLE_CONNS_PER_HOST" flag:"accrual-max-idle-conns-per-host"`
+
+	DatabaseURI        string        `json:"database_uri" env:"DATABASE_URI" flag:"d"`
+	DatabaseReplicaURI string        `json:"database_replica_uri" env:"DATABASE_REPLICA_URI" flag:"database-replica-uri"`
+	DBMaxConns         int           `json:"db_max_conns" env:"DB_MAX_CONNS" flag:"db-max-conns"`
+	DBMinConns         int           `json:"db_min_conns" env:"DB_MIN_CONNS" flag:"db-min-conns"`
+	DBMaxConnLifetime  time.Duration `json:"db_max_conn_lifetime" env:"DB_MAX_CONN_LIFETIME" flag:"db-max-conn-lifetime"`
+	DBMaxConnIdleTime  time.Duration `json:"db_max_conn_idle_time" env:"DB_MAX_CONN_IDLE_TIME" flag:"db-max-conn-idle-time"`
+	DBHealthCheck      time.Duration `json:"db_health_check_period" env:"DB_HEALTH_CHECK_PERIOD" flag:"db-health-check-period"`
+	WaitForDB          bool          `json:"wait_for_db" env:"WAIT_FOR_DB" flag:"wait-for-db"`
+	DBStartupTimeout   time.Duration `json:"db_startup_timeout" env:"DB_STARTUP_TIMEOUT" flag:"db-startup-timeout"`
+	DBRetryPolicies    string        `json:"db_retry_policies" env:"DB_RETRY_POLICIES" flag:"db-retry-policies"`
+	DBAuthTokenCommand string        `json:"db_auth_token_command" env:"DB_AUTH_TOKEN_COMMAND" flag:"db-auth-token-command"`
+	DBAuthTokenFile    string        `json:"db_auth_token_file" env:"DB_AUTH_TOKEN_FILE" flag:"db-auth-token-file"`
+	DBAuthTokenTTL     time.Duration `json:"db_auth_token_ttl" env:"DB_AUTH_TOKEN_TTL" flag:"db-auth-token-ttl"`
+
+	DBReadTimeout  time.Duration `json:"db_read_timeout" env:"DB_READ_TIMEOUT" flag:"db-read-timeout"`
+	DBWriteTimeout time.Duration `json:"db_write_timeout" env:"DB_WRITE_TIMEOUT" flag:"db-write-timeout"`
+	DBBatchTimeout time.Duration `json:"db_batch_timeout" env:"DB_BATCH_TIMEOUT" flag:"db-batch-timeout"`
+
+	DBSlowQueryThreshold time.Duration `json:"db_slow_query_threshold" env:"DB_SLOW_QUERY_THRESHOLD" flag:"db-slow-query-threshold"`
+	DBLogQueryArgs       bool          `json:"db_log_query_args" env:"DB_LOG_QUERY_ARGS" flag:"db-log-query-args"`
+
+	CacheSize int           `json:"cache_size" env:"CACHE_SIZE" flag:"cache-size"`
+	CacheTTL  time.Duration `json:"cache_ttl" env:"CACHE_TTL" flag:"cache-ttl"`
+
+	ExchangeRate     float64 `json:"exchange_rate" env:"EXCHANGE_RATE" flag:"exchange-rate"`
+	ExchangeRateURL  string  `json:"exchange_rate_url" env:"EXCHANGE_RATE_URL" flag:"exchange-rate-url"`
+	ExchangeCurrency string  `json:"exchange_currency" env:"EXCHANGE_CURRENCY" flag:"exchange-currency"`
+
+	FiscalAddress string `json:"fiscal_address" env:"FISCAL_ADDRESS" flag:"fiscal-address"`
+	FiscalToken   string `json:"fiscal_token" env:"FISCAL_TOKEN" flag:"fiscal-token"`
+
+	StrictWithdrawals bool `json:"strict_withdrawals" env:"STRICT_WITHDRAWALS" flag:"strict-withdrawals"`
+
+	SMTPAddress    string `json:"smtp_address" env:"SMTP_ADDRESS" flag:"smtp-address"`
+	SMTPFrom       string `json:"smtp_from" env:"SMTP_FROM" flag:"smtp-from"`
+	SMTPUsername   string `json:"smtp_username" env:"SMTP_USERNAME" flag:"smtp-username"`
+	SMTPPassword   string `json:"smtp_password" env:"SMTP_PASSWORD" flag:"smtp-password"`
+	NotifyWebhooks bool   `json:"notify_webhooks" env:"NOTIFY_WEBHOOKS" flag:"notify-webhooks"`
+
+	NotifyMaxAttempts    int           `json:"notify_max_attempts" env:"NOTIFY_MAX_ATTEMPTS" flag:"notify-max-attempts"`
+	NotifyRetryBaseDelay time.Duration `json:"notify_retry_base_delay" env:"NOTIFY_RETRY_BASE_DELAY" flag:"notify-retry-base-delay"`
+	NotifyRetryMaxDelay  time.Duration `json:"notify_retry_max_delay" env:"NOTIFY_RETRY_MAX_DELAY" flag:"notify-retry-max-delay"`
+	NotifyPollInterval   time.Duration `json:"notify_poll_interval" env:"NOTIFY_POLL_INTERVAL" flag:"notify-poll-interval"`
+
+	LogLevel  string `json:"log_level" env:"LOG_LEVEL" flag:"log-level"`
+	LogFormat string `json:"log_format" env:"LOG_FORMAT" flag:"log-format"`
+
+	EventsSink         string `json:"events_sink" env:"EVENTS_SINK" flag:"events-sink"`
+	EventsKafkaRESTURL string `json:"events_kafka_rest_url" env:"EVENTS_KAFKA_REST_URL" flag:"events-kafka-rest-url"`
+	EventsKafkaTopic   string `json:"events_kafka_topic" env:"EVENTS_KAFKA_TOPIC" flag:"events-kafka-topic"`
+	EventsNATSURL      string `json:"events_nats_url" env:"EVENTS_NATS_URL" flag:"events-nats-url"`
+	EventsNATSSubject  string `json:"events_nats_subject" env:"EVENTS_NATS_SUBJECT" flag:"events-nats-subject"`
+	EventsQueueSize    int    `json:"events_queue_size" env:"EVENTS_QUEUE_SIZE" flag:"events-queue-size"`
+
+	ReportsAPIKey string `json:"reports_api_key" env:"REPORTS_API_KEY" flag:"reports-api-key"`
+	AdminAPIKey   string `json:"admin_api_key" env:"ADMIN_API_KEY" flag:"admin-api-key"`
+	DocsUI        bool   `json:"docs_ui" env:"DOCS_UI" flag:"docs-ui"`
+	DebugAddress  string `json:"debug_address" env:"DEBUG_ADDRESS" flag:"debug-address"`
+
+	TracingEndpoint    string  `json:"tracing_endpoint" env:"TRACING_ENDPOINT" flag:"tracing-endpoint"`
+	TracingSampleRatio float64 `json:"tracing_sample_ratio" env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio"`
+
+	AccessLogSampleRatio float64 `json:"access_log_sample_ratio" env:"ACCESS_LOG_SAMPLE_RATIO" flag:"access-log-sample-ratio"`
+
+	CompressionLevel     int    `json:"compression_level" env:"COMPRESSION_LEVEL" flag:"compression-level"`
+	CompressionMinSize   int    `json:"compression_min_size" env:"COMPRESSION_MIN_SIZE" flag:"compression-min-size"`
+	CompressionEncodings string `json:"compression_encodings" env:"COMPRESSION_ENCODINGS" flag:"compression-encodings"`
+
+	RequestReadTimeout   time.Duration `json:"request_read_timeout" env:"REQUEST_READ_TIMEOUT" flag:"request-read-timeout"`
+	RequestWriteTimeout  time.Duration `json:"request_write_timeout" env:"REQUEST_WRITE_TIMEOUT" flag:"request-write-timeout"`
+	RequestRouteTimeouts string        `json:"request_route_timeouts" env:"REQUEST_ROUTE_TIMEOUTS" flag:"request-route-timeouts"`
+
+	RateLimit      float64 `json:"rate_limit" env:"RATE_LIMIT" flag:"rate-limit"`
+	RateLimitBurst int     `json:"rate_limit_burst" env:"RATE_LIMIT_BURST" flag:"rate-limit-burst"`
+
+	RetentionRules  string `json:"retention_rules" env:"RETENTION_RULES" flag:"retention-rules"`
+	RetentionDryRun bool   `json:"retention_dry_run" env:"RETENTION_DRY_RUN" flag:"retention-dry-run"`
+
+	// ReconcileInterval of zero turns balance reconciliation off.
+	ReconcileInterval    time.Duration `json:"reconcile_interval" env:"RECONCILE_INTERVAL" flag:"reconcile-interval"`
+	ReconcileAutoCorrect bool          `json:"reconcile_auto_correct" env:"RECONCILE_AUTO_CORRECT" flag:"reconcile-auto-correct"`
+
+	JWTSecret          string        `json:"jwt_secret" env:"JWT_SECRET" flag:"jwt-secret"`
+	JWTSecretFile      string        `json:"jwt_secret_file" env:"JWT_SECRET_FILE" flag:"jwt-secret-file"`
+	JWTPreviousSecrets string        `json:"jwt_previous_secrets" env:"JWT_PREVIOUS_SECRETS" flag:"jwt-previous-secrets"`
+	JWTTTL             time.Duration `json:"jwt_ttl" env:"JWT_TTL" flag:"jwt-ttl"`
+	RefreshTokenTTL    time.Duration `json:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL" flag:"refresh-token-ttl"`
+
+	PasswordMinLength    int    `json:"password_min_length" env:"PASSWORD_MIN_LENGTH" flag:"password-min-length"`
+	PasswordRequire      string `json:"password_require" env:"PASSWORD_REQUIRE" flag:"password-require"`
+	PasswordDenyListFile string `json:"password_deny_list_file" env:"PASSWORD_DENY_LIST_FILE" flag:"password-deny-list-file"`
+
+	LoginMaxFailures      int           `json:"login_max_failures" env:"LOGIN_MAX_FAILURES" flag:"login-max-failures"`
+	LoginMaxFailuresPerIP int           `json:"login_max_failures_per_ip" env:"LOGIN_MAX_FAILURES_PER_IP" flag:"login-max-failures-per-ip"`
+	LoginCooldown         time.Duration `json:"login_cooldown" env:"LOGIN_COOLDOWN" flag:"login-cooldown"`
+	LoginMaxCooldown      time.Duration `json:"login_max_cooldown" env:"LOGIN_MAX_COOLDOWN" flag:"login-max-cooldown"`
+	LoginFailureWindow    time.Duration `json:"login_failure_window" env:"LOGIN_FAILURE_WINDOW" flag:"login-failure-window"`
+
+	// CookieSecure is auto, always or never; auto marks cookies Secure on
+	// requests that came over TLS.
+	CookieSecure   string `json:"cookie_secure" env:"COOKIE_SECURE" flag:"cookie-secure"`
+	CookieSameSite string `json:"cookie_same_site" env:"COOKIE_SAME_SITE" flag:"cookie-same-site"`
+	CookieHTTPOnly bool   `json:"cookie_http_only" env:"COOKIE_HTTP_ONLY" flag:"cookie-http-only"`
+	CookieDomain   string `json:"cookie_domain" env:"COOKIE_DOMAIN" flag:"cookie-domain"`
+
+	// CSRFMode is double-submit, header or off. Requests with a bearer token
+	// are never checked.
+	CSRFMode string `json:"csrf_mode" env:"CSRF_MODE" flag:"csrf-mode"`
+}
+
+func Default() Config {
+	return Config{
+		ServerAddress:       ":8080",
+		AccrualMode:         accrual.ModePolling,
+		AccrualWorkers:      accrual.DefaultWorkers,
+		AccrualPollInterval: accrual.DefaultPollInterval,
+		AccrualDrainTimeout: accrual.DefaultDrainTimeout,
+		AccrualMaxNotFound:  accrual.DefaultMaxNotFound,
+		AccrualMaxFailures:  accrual.DefaultMaxFailures,
+		AccrualClaimLease:   accrual.DefaultClaimLease,
+		AccrualClaimBatch:   accrual.DefaultClaimBatch,
+
+		AccrualResultCacheTTL: accrual.DefaultResultCacheTTL,
+
+		AccrualBacklogInterval: accrual.DefaultBacklogInterval,
+
+		AccrualSweepInterval: accrual.DefaultSweepInterval,
+
+		AccrualRetryAttempts:   accrual.DefaultRetryPolicy.MaxAttempts,
+		AccrualRetryBaseDelay:  accrual.DefaultRetryPolicy.BaseDelay,
+		AccrualRetryMaxDelay:   accrual.DefaultRetryPolicy.MaxDelay,
+		AccrualRetryMaxElapsed: accrual.DefaultRetryPolicy.MaxElapsed,
+		AccrualRetryBudget:     accrual.DefaultRetryPolicy.OrderBudget,
+
+		AccrualDialTimeout:         accrual.DefaultHTTPConfig.DialTimeout,
+		AccrualResponseTimeout:     accrual.DefaultHTTPConfig.ResponseTimeout,
+		AccrualRequestTimeout:      accrual.DefaultHTTPConfig.RequestTimeout,
+		AccrualKeepAlive:           accrual.DefaultHTTPConfig.KeepAlive,
+		AccrualIdleConnTimeout:     accrual.DefaultHTTPConfig.IdleConnTimeout,
+		AccrualMaxIdleConnsPerHost: accrual.DefaultHTTPConfig.MaxIdleConnsPerHost,
+
+		DBMaxConns:         10,
+		DBMaxConnLifetime:  time.Hour,
+		DBMaxConnIdleTime:  30 * time.Minute,
+		DBHealthCheck:      time.Minute,
+		DBStartupTimeout:   time.Minute,
+		DBAuthTokenTTL:     dbauth.DefaultTokenTTL,
+		CacheTTL:           storage.DefaultCacheTTL,
+		ExchangeCurrency:   "RUB",
+		RateLimitBurst:     5,
+		TracingSampleRatio: 1,
+		PasswordMinLength:  validate.DefaultPasswordPolicy().MinLength,
+
+		AccessLogSampleRatio: 1,
+
+		CompressionLevel:     app.DefaultCompressionLevel,
+		CompressionMinSize:   app.DefaultCompressionMinSize,
+		CompressionEncodings: app.DefaultEncodings,
+
+		RequestReadTimeout:  app.DefaultTimeouts.Read,
+		RequestWriteTimeout: app.DefaultTimeouts.Write,
+
+		LogLevel:  logging.DefaultLevel,
+		LogFormat: logging.DefaultFormat,
+
+		NotifyMaxAttempts:    notify.DefaultMaxAttempts,
+		NotifyRetryBaseDelay: notify.DefaultRetryBaseDelay,
+		NotifyRetryMaxDelay:  notify.DefaultRetryMaxDelay,
+		NotifyPollInterval:   notify.DefaultPollInterval,
+
+		ReconcileInterval: reconcile.DefaultInterval,
+
+		EventsSink:        events.SinkNone,
+		EventsKafkaTopic:  "gophermart-events",
+		EventsNATSSubject: "gophermart",
+		EventsQueueSize:   events.DefaultQueueSize,
+
+		TLSAutocertCacheDir: app.DefaultAutocertCacheDir,
+
+		HTTPReadHeaderTimeout: app.DefaultHTTPServer.ReadHeaderTimeout,
+		HTTPReadTimeout:       app.DefaultHTTPServer.ReadTimeout,
+		HTTPWriteTimeout:      app.DefaultHTTPServer.WriteTimeout,
+		HTTPIdleTimeout:       app.DefaultHTTPServer.IdleTimeout,
+		HTTPMaxHeaderBytes:    app.DefaultHTTPServer.MaxHeaderBytes,
+		HTTPShutdownTimeout:   app.DefaultHTTPServer.ShutdownTimeout,
+
+		DBReadTimeout:  storage.DatabaseOperationTimeout,
+		DBWriteTimeout: storage.DatabaseOperationTimeout,
+		DBBatchTimeout: storage.DatabaseOperationTimeout,
+
+		DBSlowQueryThreshold: storage.DefaultSlowQueryThreshold,
+
+		LoginMaxFailures:      app.DefaultLoginMaxFailures,
+		LoginMaxFailuresPerIP: app.DefaultLoginMaxFailuresPerIP,
+		LoginCooldown:         app.DefaultLoginCooldown,
+		LoginMaxCooldown:      app.DefaultLoginMaxCooldown,
+		LoginFailureWindow:    app.DefaultLoginFailureWindow,
+		JWTTTL:                app.DefaultTokenTTL,
+		RefreshTokenTTL:       app.DefaultRefreshTokenTTL,
+
+		CookieSecure:   app.DefaultCookies().Secure,
+		CookieSameSite: "lax",
+		CookieHTTPOnly: app.DefaultCookies().HTTPOnly,
+
+		CSRFMode: app.CSRFDoubleSubmit,
+	}
+}
+
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	path := os.Getenv(ConfigEnv)
+	if p, ok := lookupFlag(args, ConfigFlag); ok {
+		path = p
+	}
+	if len(path) != 0 {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadFlags(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if len(c.ServerAddress) == 0 {
+		errs = append(errs, errors.New("run_address (RUN_ADDRESS, -a) must not be empty"))
+	}
+	if len(c.DatabaseURI) == 0 {
+		errs = append(errs, errors.New("database_uri (DATABASE_URI, -d) is required"))
+	}
+	if storage.IsSQLiteDSN(c.DatabaseURI) && len(c.DatabaseReplicaURI) != 0 {
+		errs = append(errs, errors.New("database_replica_uri (DATABASE_REPLICA_URI) is not supported with SQLite"))
+	}
+	if c.AccrualMode != accrual.ModePolling && c.AccrualMode != accrual.ModeCallback {
+		errs = append(errs, fmt.Errorf("accrual_mode (ACCRUAL_MODE) must be polling or callback, got %q", c.AccrualMode))
+	}
+	if c.AccrualMode == accrual.ModeCallback && len(c.AccrualCallbackAPIKey) == 0 {
+		errs = append(errs, errors.New("accrual_callback_api_key (ACCRUAL_CALLBACK_API_KEY) is required in callback mode"))
+	}
+	if c.AccrualWorkers <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_workers (ACCRUAL_WORKERS) must be positive, got %d", c.AccrualWorkers))
+	}
+	if c.AccrualMaxNotFound <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_max_not_found (ACCRUAL_MAX_NOT_FOUND) must be positive, got %d", c.AccrualMaxNotFound))
+	}
+	if c.AccrualMaxFailures <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_max_failures (ACCRUAL_MAX_FAILURES) must be positive, got %d", c.AccrualMaxFailures))
+	}
+	if c.AccrualClaimBatch <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_claim_batch (ACCRUAL_CLAIM_BATCH) must be positive, got %d", c.AccrualClaimBatch))
+	}
+	if c.AccrualResultCacheTTL <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_result_cache_ttl (ACCRUAL_RESULT_CACHE_TTL) must be positive, got %s", c.AccrualResultCacheTTL))
+	}
+	if c.AccrualRetryAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_retry_attempts (ACCRUAL_RETRY_ATTEMPTS) must be positive, got %d", c.AccrualRetryAttempts))
+	}
+	if c.AccrualMaxIdleConnsPerHost <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_max_idle_conns_per_host (ACCRUAL_MAX_IDLE_CONNS_PER_HOST) must be positive, got %d", c.AccrualMaxIdleConnsPerHost))
+	}
+	if c.AccrualBacklogThreshold < 0 {
+		errs = append(errs, fmt.Errorf("accrual_backlog_threshold (ACCRUAL_BACKLOG_THRESHOLD) must not be negative, got %d", c.AccrualBacklogThreshold))
+	}
+	if c.AccrualRetryBudget < 0 {
+		errs = append(errs, fmt.Errorf("accrual_retry_budget (ACCRUAL_RETRY_BUDGET) must not be negative, got %d", c.AccrualRetryBudget))
+	}
+	if c.AccrualWorkerRateLimit < 0 {
+		errs = append(errs, fmt.Errorf("accrual_worker_rate_limit (ACCRUAL_WORKER_RATE_LIMIT) must not be negative, got %d", c.AccrualWorkerRateLimit))
+	}
+	if c.AccrualStaleAfter < 0 {
+		errs = append(errs, fmt.Errorf("accrual_stale_after (ACCRUAL_STALE_AFTER) must not be negative, got %s", c.AccrualStaleAfter))
+	}
+	if c.AccrualStaleAfter > 0 && c.AccrualSweepInterval <= 0 {
+		errs = append(errs, fmt.Errorf("accrual_sweep_interval (ACCRUAL_SWEEP_INTERVAL) must be positive, got %s", c.AccrualSweepInterval))
+	}
+	if len(c.SMTPAddress) != 0 && len(c.SMTPFrom) == 0 {
+		errs = append(errs, errors.New("smtp_from (SMTP_FROM) is required when smtp_address (SMTP_ADDRESS) is set"))
+	}
+	if c.NotifyMaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("notify_max_attempts (NOTIFY_MAX_ATTEMPTS) must be positive, got %d", c.NotifyMaxAttempts))
+	}
+	if c.NotifyRetryBaseDelay <= 0 || c.NotifyRetryMaxDelay < c.NotifyRetryBaseDelay {
+		errs = append(errs, fmt.Errorf("notify_retry_base_delay (NOTIFY_RETRY_BASE_DELAY) must be positive and at most notify_retry_max_delay (NOTIFY_RETRY_MAX_DELAY), got %s and %s", c.NotifyRetryBaseDelay, c.NotifyRetryMaxDelay))
+	}
+	if c.NotifyPollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("notify_poll_interval (NOTIFY_POLL_INTERVAL) must be positive, got %s", c.NotifyPollInterval))
+	}
+	if c.ReconcileInterval < 0 {
+		errs = append(errs, fmt.Errorf("reconcile_interval (RECONCILE_INTERVAL) must not be negative, got %s", c.ReconcileInterval))
+	}
+	switch c.EventsSink {
+	case events.SinkNone:
+	case events.SinkKafka:
+		if len(c.EventsKafkaRESTURL) == 0 || len(c.EventsKafkaTopic) == 0 {
+			errs = append(errs, errors.New("events_kafka_rest_url (EVENTS_KAFKA_REST_URL) and events_kafka_topic (EVENTS_KAFKA_TOPIC) are required for the kafka events sink"))
+		}
+	case events.SinkNATS:
+		if len(c.EventsNATSURL) == 0 || len(c.EventsNATSSubject) == 0 {
+			errs = append(errs, errors.New("events_nats_url (EVENTS_NATS_URL) and events_nats_subject (EVENTS_NATS_SUBJECT) are required for the nats events sink"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("events_sink (EVENTS_SINK) must be none, kafka or nats, got %q", c.EventsSink))
+	}
+	if c.EventsQueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("events_queue_size (EVENTS_QUEUE_SIZE) must be positive, got %d", c.EventsQueueSize))
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("cache_size (CACHE_SIZE) must not be negative, got %d", c.CacheSize))
+	}
+	if c.DBMaxConns <= 0 {
+		errs = append(errs, fmt.Errorf("db_max_conns (DB_MAX_CONNS) must be positive, got %d", c.DBMaxConns))
+	}
+	if c.DBMinConns < 0 || c.DBMinConns > c.DBMaxConns {
+		errs = append(errs, fmt.Errorf("db_min_conns (DB_MIN_CONNS) must be between 0 and db_max_conns, got %d", c.DBMinConns))
+	}
+	if c.ExchangeRate < 0 {
+		errs = append(errs, fmt.Errorf("exchange_rate (EXCHANGE_RATE) must not be negative, got %v", c.ExchangeRate))
+	}
+	if !logging.ValidLevel(c.LogLevel) {
+		errs = append(errs, fmt.Errorf("log_level (LOG_LEVEL) must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	if c.LogFormat != logging.FormatJSON && c.LogFormat != logging.FormatConsole {
+		errs = append(errs, fmt.Errorf("log_format (LOG_FORMAT) must be json or console, got %q", c.LogFormat))
+	}
+	if c.DBSlowQueryThreshold < 0 {
+		errs = append(errs, fmt.Errorf("db_slow_query_threshold (DB_SLOW_QUERY_THRESHOLD) must not be negative, got %s", c.DBSlowQueryThreshold))
+	}
+	if c.AccessLogSampleRatio < 0 || c.AccessLogSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("access_log_sample_ratio (ACCESS_LOG_SAMPLE_RATIO) must be between 0 and 1, got %v", c.AccessLogSampleRatio))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("rate_limit (RATE_LIMIT) must not be negative, got %v", c.RateLimit))
+	}
+	if c.CompressionLevel < 0 || c.CompressionLevel > 9 {
+		errs = append(errs, fmt.Errorf("compression_level (COMPRESSION_LEVEL) must be between 0 and 9, got %d", c.CompressionLevel))
+	}
+	if c.CompressionMinSize < 0 {
+		errs = append(errs, fmt.Errorf("compression_min_size (COMPRESSION_MIN_SIZE) must not be negative, got %d", c.CompressionMinSize))
+	}
+	if _, err := app.ParseEncodings(c.CompressionEncodings); err != nil {
+		errs = append(errs, fmt.Errorf("compression_encodings (COMPRESSION_ENCODINGS): %w", err))
+	}
+	if _, err := app.ParseRouteTimeouts(c.RequestRouteTimeouts); err != nil {
+		errs = append(errs, fmt.Errorf("request_route_timeouts (REQUEST_ROUTE_TIMEOUTS): %w", err))
+	}
+	if c.RateLimitBurst <= 0 {
+		errs = append(errs, fmt.Errorf("rate_limit_burst (RATE_LIMIT_BURST) must be positive, got %d", c.RateLimitBurst))
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing_sample_ratio (TRACING_SAMPLE_RATIO) must be between 0 and 1, got %v", c.TracingSampleRatio))
+	}
+	if c.LoginMaxFailures < 0 || c.LoginMaxFailuresPerIP < 0 {
+		errs = append(errs, errors.New("login_max_failures (LOGIN_MAX_FAILURES) and login_max_failures_per_ip (LOGIN_MAX_FAILURES_PER_IP) must not be negative"))
+	}
+	if c.LoginMaxCooldown < c.LoginCooldown {
+		errs = append(errs, fmt.Errorf("login_max_cooldown (LOGIN_MAX_COOLDOWN) must not be shorter than login_cooldown (LOGIN_COOLDOWN)"))
+	}
+	switch c.CookieSecure {
+	case app.CookieSecureAuto, app.CookieSecureAlways, app.CookieSecureNever:
+	default:
+		errs = append(errs, fmt.Errorf("cookie_secure (COOKIE_SECURE) must be auto, always or never, got %q", c.CookieSecure))
+	}
+	if _, err := app.ParseSameSite(c.CookieSameSite); err != nil {
+		errs = append(errs, fmt.Errorf("cookie_same_site (COOKIE_SAME_SITE) must be lax, strict or none, got %q", c.CookieSameSite))
+	} else if strings.EqualFold(c.CookieSameSite, "none") && c.CookieSecure == app.CookieSecureNever {
+		errs = append(errs, errors.New("cookie_same_site (COOKIE_SAME_SITE) none requires Secure cookies, cookie_secure (COOKIE_SECURE) must not be never"))
+	}
+	switch c.CSRFMode {
+	case app.CSRFDoubleSubmit, app.CSRFHeaderOnly, app.CSRFOff:
+	default:
+		errs = append(errs, fmt.Errorf("csrf_mode (CSRF_MODE) must be double-submit, header or off, got %q", c.CSRFMode))
+	}
+	if c.PasswordMinLength < 1 {
+		errs = append(errs, fmt.Errorf("password_min_length (PASSWORD_MIN_LENGTH) must be positive, got %d", c.PasswordMinLength))
+	}
+	for _, class := range c.PasswordClasses() {
+		switch class {
+		case validate.RuleLower, validate.RuleUpper, validate.RuleDigit, validate.RuleSymbol:
+		default:
+			errs = append(errs, fmt.Errorf("password_require (PASSWORD_REQUIRE) has unknown class %q, expected lowercase, uppercase, digit or symbol", class))
+		}
+	}
+	if len(c.JWTSecret) != 0 && len(c.JWTSecretFile) != 0 {
+		errs = append(errs, errors.New("jwt_secret (JWT_SECRET) and jwt_secret_file (JWT_SECRET_FILE) are mutually exclusive"))
+	}
+	if c.HTTPMaxHeaderBytes <= 0 {
+		errs = append(errs, fmt.Errorf("http_max_header_bytes (HTTP_MAX_HEADER_BYTES) must be positive, got %d", c.HTTPMaxHeaderBytes))
+	}
+	if c.HTTPShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("http_shutdown_timeout (HTTP_SHUTDOWN_TIMEOUT) must be positive, got %s", c.HTTPShutdownTimeout))
+	}
+	if c.HTTPH2C && (len(c.TLSCert) != 0 || len(c.AutocertHosts()) != 0) {
+		errs = append(errs, errors.New("http_h2c (HTTP_H2C) only applies without TLS"))
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		errs = append(errs, errors.New("tls_cert (TLS_CERT) and tls_key (TLS_KEY) must be set together"))
+	}
+	if len(c.TLSCert) != 0 && len(c.AutocertHosts()) != 0 {
+		errs = append(errs, errors.New("tls_cert (TLS_CERT) and tls_autocert_hosts (TLS_AUTOCERT_HOSTS) are mutually exclusive"))
+	}
+	if len(c.HTTPRedirectAddress) != 0 && len(c.TLSCert) == 0 && len(c.AutocertHosts()) == 0 {
+		errs = append(errs, errors.New("http_redirect_address (HTTP_REDIRECT_ADDRESS) requires tls_cert (TLS_CERT) or tls_autocert_hosts (TLS_AUTOCERT_HOSTS)"))
+	}
+	if len(c.DBAuthTokenCommand) != 0 && len(c.DBAuthTokenFile) != 0 {
+		errs = append(errs, errors.New("db_auth_token_command (DB_AUTH_TOKEN_COMMAND) and db_auth_token_file (DB_AUTH_TOKEN_FILE) are mutually exclusive"))
+	}
+
+	durations := map[string]time.Duration{
+		"accrual_poll_interval (ACCRUAL_POLL_INTERVAL)":         c.AccrualPollInterval,
+		"accrual_drain_timeout (ACCRUAL_DRAIN_TIMEOUT)":         c.AccrualDrainTimeout,
+		"accrual_backlog_interval (ACCRUAL_BACKLOG_INTERVAL)":   c.AccrualBacklogInterval,
+		"accrual_claim_lease (ACCRUAL_CLAIM_LEASE)":             c.AccrualClaimLease,
+		"accrual_retry_base_delay (ACCRUAL_RETRY_BASE_DELAY)":   c.AccrualRetryBaseDelay,
+		"accrual_retry_max_delay (ACCRUAL_RETRY_MAX_DELAY)":     c.AccrualRetryMaxDelay,
+		"accrual_retry_max_elapsed (ACCRUAL_RETRY_MAX_ELAPSED)": c.AccrualRetryMaxElapsed,
+		"accrual_dial_timeout (ACCRUAL_DIAL_TIMEOUT)":           c.AccrualDialTimeout,
+		"accrual_response_timeout (ACCRUAL_RESPONSE_TIMEOUT)":   c.AccrualResponseTimeout,
+		"accrual_request_timeout (ACCRUAL_REQUEST_TIMEOUT)":     c.AccrualRequestTimeout,
+		"accrual_keep_alive (ACCRUAL_KEEP_ALIVE)":               c.AccrualKeepAlive,
+		"accrual_idle_conn_timeout (ACCRUAL_IDLE_CONN_TIMEOUT)": c.AccrualIdleConnTimeout,
+		"db_max_conn_lifetime (DB_MAX_CONN_LIFETIME)":           c.DBMaxConnLifetime,
+		"db_max_conn_idle_time (DB_MAX_CONN_IDLE_TIME)":         c.DBMaxConnIdleTime,
+		"db_health_check_period (DB_HEALTH_CHECK_PERIOD)":       c.DBHealthCheck,
+		"db_startup_timeout (DB_STARTUP_TIMEOUT)":               c.DBStartupTimeout,
+		"db_auth_token_ttl (DB_AUTH_TOKEN_TTL)":                 c.DBAuthTokenTTL,
+		"cache_ttl (CACHE_TTL)":                                 c.CacheTTL,
+		"db_read_timeout (DB_READ_TIMEOUT)":                     c.DBReadTimeout,
+		"db_write_timeout (DB_WRITE_TIMEOUT)":                   c.DBWriteTimeout,
+		"db_batch_timeout (DB_BATCH_TIMEOUT)":                   c.DBBatchTimeout,
+		"request_read_timeout (REQUEST_READ_TIMEOUT)":           c.RequestReadTimeout,
+		"request_write_timeout (REQUEST_WRITE_TIMEOUT)":         c.RequestWriteTimeout,
+		"jwt_ttl (JWT_TTL)":                                     c.JWTTTL,
+		"refresh_token_ttl (REFRESH_TOKEN_TTL)":                 c.RefreshTokenTTL,
+		"login_cooldown (LOGIN_COOLDOWN)":                       c.LoginCooldown,
+		"login_failure_window (LOGIN_FAILURE_WINDOW)":           c.LoginFailureWindow,
+	}
+	for name, d := range durations {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", name, d))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// PasswordClasses lists the character classes from the comma-separated
+// password_require setting.
+func (c *Config) PasswordClasses() []string {
+	var classes []string
+	for _, class := range strings.Split(c.PasswordRequire, ",") {
+		if class = strings.TrimSpace(class); len(class) != 0 {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
+
+// AutocertHosts lists the host names from the comma-separated
+// tls_autocert_hosts setting.
+func (c *Config) AutocertHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(c.TLSAutocertHosts, ",") {
+		if host = strings.TrimSpace(host); len(host) != 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	fields := c.fields()
+	for key, raw := range values {
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+
+		value := string(bytes.TrimSpace(raw))
+		if s, err := strconv.Unquote(value); err == nil {
+			value = s
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("config file %s: %s: %w", path, key, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if !ok || len(value) == 0 {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) loadFlags(args []string) error {
+	fs := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	fs.String(ConfigFlag, "", "path to a JSON config file")
+
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Tag.Get("flag")
+		usage := fmt.Sprintf("%s (env %s)", f.Tag.Get("json"), f.Tag.Get("env"))
+
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(p, name, *p, usage)
+		case *int:
+			fs.IntVar(p, name, *p, usage)
+		case *bool:
+			fs.BoolVar(p, name, *p, usage)
+		case *float64:
+			fs.Float64Var(p, name, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, name, *p, usage)
+		}
+	}
+
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	return fs.Parse(args)
+}
+
+func (c *Config) fields() map[string]reflect.Value {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	fields := make(map[string]reflect.Value, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("json")] = v.Field(i)
+	}
+	return fields
+}
+
+func setField(field reflect.Value, value string) error {
+	switch p := field.Addr().Interface().(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		*p = b
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		*p = f
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s or 15m, got %q", value)
+		}
+		*p = d
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// lookupFlag finds a flag value before the flag set is parsed, so the config
+// file can be loaded first and overridden by the remaining flags.
+func lookupFlag(args []string, name string) (string, bool) {
+	for i := 1; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		arg := strings.TrimLeft(args[i], "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"="), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,118 @@
+package dbauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const DefaultTokenTTL = 15 * time.Minute
+
+var ErrEmptyToken = errors.New("token source returned an empty token")
+
+// TokenSource issues short-lived database passwords such as AWS RDS IAM or
+// GCP Cloud SQL login tokens.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// CommandTokenSource runs an external command (e.g. `aws rds
+// generate-db-auth-token ...`) and uses its stdout as the token.
+type CommandTokenSource struct {
+	Command string
+}
+
+func (s CommandTokenSource) Token(ctx context.Context) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.Command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// FileTokenSource reads the token from a file kept fresh by a sidecar.
+type FileTokenSource struct {
+	Path string
+}
+
+func (s FileTokenSource) Token(context.Context) (string, error) {
+	b, err := os.ReadFile(s.Path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+type cachedTokenSource struct {
+	mu        sync.Mutex
+	source    TokenSource
+	ttl       time.Duration
+	token     string
+	expiresAt time.Time
+}
+
+// NewCachedTokenSource reuses a token until 80% of its TTL has passed.
+func NewCachedTokenSource(source TokenSource, ttl time.Duration) TokenSource {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	return &cachedTokenSource{source: source, ttl: ttl}
+}
+
+func (s *cachedTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.token) != 0 && time.Now().Before(s.expiresAt) {
+		return s.token, nil
+	}
+
+	token, err := s.source.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(token) == 0 {
+		return "", ErrEmptyToken
+	}
+
+	s.token = token
+	s.expiresAt = time.Now().Add(s.ttl * 4 / 5)
+	return token, nil
+}
+
+// Configure makes every new pool connection authenticate with a fresh token
+// and recycles connections before the token they were opened with expires.
+func Configure(cfg *pgxpool.Config, source TokenSource, ttl time.Duration, logger *zap.Logger) {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+
+	cfg.BeforeConnect = func(ctx context.Context, cc *pgx.ConnConfig) error {
+		token, err := source.Token(ctx)
+		if err != nil {
+			logger.Error("failed to get database auth token", zap.Error(err))
+			return err
+		}
+		cc.Password = token
+		return nil
+	}
+
+	if cfg.MaxConnLifetime == 0 || cfg.MaxConnLifetime > ttl {
+		cfg.MaxConnLifetime = ttl
+	}
+}
@@ -0,0 +1,256 @@
+// Package e2e walks one user through the whole loyalty journey against a
+// running service: register, upload an order, wait for its accrual, check the
+// balance, withdraw and list the withdrawals.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/loadtest"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+const (
+	StepRegister        = "register"
+	StepUpload          = "upload"
+	StepWaitProcessed   = "wait processed"
+	StepBalance         = "balance"
+	StepWithdraw        = "withdraw"
+	StepWithdrawals     = "withdrawals"
+	DefaultTimeout      = time.Minute
+	DefaultPollInterval = 500 * time.Millisecond
+	DefaultWithdrawal   = money.Amount(100)
+)
+
+var ErrOrderNotProcessed = errors.New("order did not reach PROCESSED")
+
+type Config struct {
+	BaseURL string
+	// Timeout bounds the whole journey, PollInterval the wait for the order.
+	Timeout      time.Duration
+	PollInterval time.Duration
+	// Withdrawal is spent from the accrual; it must not exceed it.
+	Withdrawal money.Amount
+}
+
+type StepReport struct {
+	Name     string
+	Duration time.Duration
+}
+
+type Report struct {
+	Login   string
+	Order   string
+	Accrual money.Amount
+	Steps   []StepReport
+}
+
+type orderResponse struct {
+	Number  string       `json:"number"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual"`
+}
+
+type balanceResponse struct {
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
+}
+
+type withdrawal struct {
+	Order string       `json:"order"`
+	Sum   money.Amount `json:"sum"`
+}
+
+type journey struct {
+	cfg    Config
+	client *http.Client
+	report *Report
+}
+
+// Run performs the journey with a fresh user and returns the steps it
+// completed. The error names the step that failed.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.Withdrawal <= 0 {
+		cfg.Withdrawal = DefaultWithdrawal
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	jar, _ := cookiejar.New(nil)
+	j := &journey{
+		cfg:    cfg,
+		client: &http.Client{Jar: jar},
+		report: &Report{
+			Login: "e2e-" + strconv.FormatInt(rand.Int63(), 36),
+			Order: loadtest.GenerateOrderNumber(16),
+		},
+	}
+
+	steps := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{StepRegister, j.register},
+		{StepUpload, j.upload},
+		{StepWaitProcessed, j.waitProcessed},
+		{StepBalance, j.checkBalance},
+		{StepWithdraw, j.withdraw},
+		{StepWithdrawals, j.checkWithdrawals},
+	}
+	for _, step := range steps {
+		start := time.Now()
+		if err := step.run(ctx); err != nil {
+			return j.report, fmt.Errorf("%s: %w", step.name, err)
+		}
+		j.report.Steps = append(j.report.Steps, StepReport{Name: step.name, Duration: time.Since(start)})
+	}
+
+	return j.report, nil
+}
+
+func (j *journey) register(ctx context.Context) error {
+	body := fmt.Sprintf(`{"login":%q,"password":%q}`, j.report.Login, "e2e-"+strconv.FormatInt(rand.Int63(), 36))
+	_, err := j.do(ctx, http.MethodPost, "/api/user/register", "application/json", body, http.StatusOK)
+	return err
+}
+
+func (j *journey) upload(ctx context.Context) error {
+	_, err := j.do(ctx, http.MethodPost, "/api/user/orders", "text/plain", j.report.Order, http.StatusAccepted)
+	return err
+}
+
+func (j *journey) waitProcessed(ctx context.Context) error {
+	ticker := time.NewTicker(j.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		b, err := j.do(ctx, http.MethodGet, "/api/user/orders/"+j.report.Order, "", "", http.StatusOK)
+		if err != nil {
+			return err
+		}
+
+		var order orderResponse
+		if err := json.Unmarshal(b, &order); err != nil {
+			return err
+		}
+		switch order.Status {
+		case "PROCESSED":
+			if order.Accrual < j.cfg.Withdrawal {
+				return fmt.Errorf("accrual %s is less than the withdrawal %s", order.Accrual, j.cfg.Withdrawal)
+			}
+			j.report.Accrual = order.Accrual
+			return nil
+		case "INVALID":
+			return fmt.Errorf("%w: order is INVALID", ErrOrderNotProcessed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: still %s", ErrOrderNotProcessed, order.Status)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *journey) checkBalance(ctx context.Context) error {
+	balance, err := j.balance(ctx)
+	if err != nil {
+		return err
+	}
+	if balance.Current != j.report.Accrual || balance.Withdrawn != 0 {
+		return fmt.Errorf("balance is %s/%s, want %s/0", balance.Current, balance.Withdrawn, j.report.Accrual)
+	}
+	return nil
+}
+
+func (j *journey) withdraw(ctx context.Context) error {
+	body, err := json.Marshal(withdrawal{Order: loadtest.GenerateOrderNumber(16), Sum: j.cfg.Withdrawal})
+	if err != nil {
+		return err
+	}
+	if _, err := j.do(ctx, http.MethodPost, "/api/user/balance/withdraw", "application/json", string(body), http.StatusOK); err != nil {
+		return err
+	}
+
+	balance, err := j.balance(ctx)
+	if err != nil {
+		return err
+	}
+	if want := j.report.Accrual - j.cfg.Withdrawal; balance.Current != want || balance.Withdrawn != j.cfg.Withdrawal {
+		return fmt.Errorf("balance after withdrawal is %s/%s, want %s/%s", balance.Current, balance.Withdrawn, want, j.cfg.Withdrawal)
+	}
+	return nil
+}
+
+func (j *journey) checkWithdrawals(ctx context.Context) error {
+	b, err := j.do(ctx, http.MethodGet, "/api/user/withdrawals", "", "", http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	var withdrawals []withdrawal
+	if err := json.Unmarshal(b, &withdrawals); err != nil {
+		return err
+	}
+	if len(withdrawals) != 1 || withdrawals[0].Sum != j.cfg.Withdrawal {
+		return fmt.Errorf("got %d withdrawals, want one of %s", len(withdrawals), j.cfg.Withdrawal)
+	}
+	return nil
+}
+
+func (j *journey) balance(ctx context.Context) (*balanceResponse, error) {
+	b, err := j.do(ctx, http.MethodGet, "/api/user/balance", "", "", http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	var balance balanceResponse
+	if err := json.Unmarshal(b, &balance); err != nil {
+		return nil, err
+	}
+	return &balance, nil
+}
+
+// do sends a request and returns the body if the status is want.
+func (j *journey) do(ctx context.Context, method, path, contentType, body string, want int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, j.cfg.BaseURL+path, bytes.NewBufferString(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) != 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	loadtest.SetCSRFHeader(j.client, req)
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != want {
+		return nil, fmt.Errorf("%s %s: got %d, want %d: %s", method, path, resp.StatusCode, want, bytes.TrimSpace(b))
+	}
+	return b, nil
+}
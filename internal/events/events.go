@@ -0,0 +1,224 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const (
+	TypeOrderStatusChanged = "order.status_changed"
+	TypeOrderProcessed     = "order.processed"
+	TypeBalanceCredited    = "balance.credited"
+	TypeAccrualBacklog     = "accrual.backlog_exceeded"
+)
+
+const (
+	SinkNone  = "none"
+	SinkKafka = "kafka"
+	SinkNATS  = "nats"
+)
+
+const (
+	DefaultQueueSize      = 1000
+	DefaultBatchSize      = 100
+	DefaultPublishTimeout = 10 * time.Second
+	DefaultRetries        = 3
+	DefaultRetryDelay     = time.Second
+)
+
+var ErrQueueFull = errors.New("event queue is full")
+
+// Event is the message published for downstream consumers. Consumers should
+// deduplicate by ID: an event may be delivered more than once. PreviousStatus
+// is only set on order.status_changed events and Backlog and
+// BacklogThreshold only on accrual.backlog_exceeded events.
+type Event struct {
+	ID             uuid.UUID    `json:"id"`
+	Type           string       `json:"type"`
+	OccurredAt     time.Time    `json:"occurred_at"`
+	UserID         uuid.UUID    `json:"user_id"`
+	OrderNumber    string       `json:"order"`
+	Status         string       `json:"status,omitempty"`
+	PreviousStatus string       `json:"previous_status,omitempty"`
+	Accrual        money.Amount `json:"accrual,omitempty"`
+
+	Backlog          *storage.AccrualBacklog `json:"backlog,omitempty"`
+	BacklogThreshold int                     `json:"backlog_threshold,omitempty"`
+}
+
+// Sink delivers events to a message bus.
+type Sink interface {
+	Publish(ctx context.Context, events []Event) error
+	Close() error
+}
+
+type NoopSink struct{}
+
+func (NoopSink) Publish(context.Context, []Event) error { return nil }
+func (NoopSink) Close() error                           { return nil }
+
+type Config struct {
+	Sink      Sink
+	QueueSize int
+	Logger    *zap.Logger
+}
+
+// Bus publishes loyalty activity in the background. Like notifications,
+// events are queued so a slow or unavailable broker never holds up accrual
+// processing; events that don't fit in the queue, or can't be published
+// after DefaultRetries attempts, are dropped.
+type Bus struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan Event
+	done   chan struct{}
+
+	Config
+}
+
+func NewBus(ctx context.Context, cfg Config) *Bus {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.Sink == nil {
+		cfg.Sink = NoopSink{}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	b := &Bus{
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  make(chan Event, cfg.QueueSize),
+		done:   make(chan struct{}),
+		Config: cfg,
+	}
+	go b.run()
+
+	return b
+}
+
+// OrdersUpdated queues an order.status_changed event for every transition,
+// an order.processed event for every PROCESSED order and a balance.credited
+// event for every one with a non-zero accrual.
+func (b *Bus) OrdersUpdated(ctx context.Context, orders []storage.OrderTransition) {
+	now := time.Now()
+	for _, o := range orders {
+		b.enqueue(ctx, Event{
+			ID:             uuid.New(),
+			Type:           TypeOrderStatusChanged,
+			OccurredAt:     now,
+			UserID:         o.UserID,
+			OrderNumber:    o.OrderNumber,
+			Status:         o.Status,
+			PreviousStatus: o.From,
+		})
+
+		if o.Status != storage.StatusProcessed {
+			continue
+		}
+
+		b.enqueue(ctx, Event{
+			ID:          uuid.New(),
+			Type:        TypeOrderProcessed,
+			OccurredAt:  now,
+			UserID:      o.UserID,
+			OrderNumber: o.OrderNumber,
+			Status:      o.Status,
+			Accrual:     o.Accrual,
+		})
+		if o.Accrual != 0 {
+			b.enqueue(ctx, Event{
+				ID:          uuid.New(),
+				Type:        TypeBalanceCredited,
+				OccurredAt:  now,
+				UserID:      o.UserID,
+				OrderNumber: o.OrderNumber,
+				Accrual:     o.Accrual,
+			})
+		}
+	}
+}
+
+// BacklogExceeded queues an accrual.backlog_exceeded event.
+func (b *Bus) BacklogExceeded(ctx context.Context, backlog storage.AccrualBacklog, threshold int) {
+	b.enqueue(ctx, Event{
+		ID:               uuid.New(),
+		Type:             TypeAccrualBacklog,
+		OccurredAt:       time.Now(),
+		Backlog:          &backlog,
+		BacklogThreshold: threshold,
+	})
+}
+
+func (b *Bus) enqueue(ctx context.Context, event Event) {
+	select {
+	case b.queue <- event:
+	default:
+		metrics.EventErrors.Add("queue", 1)
+		requestid.Logger(ctx, b.Logger).Warn("dropping event",
+			zap.String("type", event.Type),
+			zap.String("order_id", event.OrderNumber),
+			zap.Error(ErrQueueFull),
+		)
+	}
+}
+
+// Close stops the worker and closes the sink. Events still queued are
+// dropped.
+func (b *Bus) Close() error {
+	b.cancel()
+	<-b.done
+	return b.Sink.Close()
+}
+
+func (b *Bus) run() {
+	defer close(b.done)
+
+	for {
+		select {
+		case event := <-b.queue:
+			batch := []Event{event}
+			for len(batch) < DefaultBatchSize && len(b.queue) != 0 {
+				batch = append(batch, <-b.queue)
+			}
+			b.publish(batch)
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Bus) publish(batch []Event) {
+	ctx := requestid.NewContext(b.ctx, "events-")
+	logger := requestid.Logger(ctx, b.Logger)
+
+	var err error
+	for attempt := 1; attempt <= DefaultRetries; attempt++ {
+		publishCtx, cancel := context.WithTimeout(ctx, DefaultPublishTimeout)
+		err = b.Sink.Publish(publishCtx, batch)
+		cancel()
+		if err == nil {
+			metrics.EventsPublished.Add(int64(len(batch)))
+			return
+		}
+
+		logger.Warn("failed to publish events", zap.Int("attempt", attempt), zap.Error(err))
+		select {
+		case <-time.After(DefaultRetryDelay * time.Duration(attempt)):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+
+	metrics.EventErrors.Add("publish", int64(len(batch)))
+	logger.Error("dropping events", zap.Int("count", len(batch)), zap.Error(err))
+}
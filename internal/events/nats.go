@@ -0,0 +1,184 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDefaultPort = "4222"
+
+var ErrNATSRejected = errors.New("NATS server rejected the request")
+
+// NATSSink publishes every event to <subject>.<type>, e.g.
+// gophermart.order.processed. It speaks the plain-text NATS client protocol
+// over a single connection, redialled after an error; TLS is not supported.
+type NATSSink struct {
+	mu      sync.Mutex
+	addr    string
+	connect []byte
+	subject string
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// NewNATSSink takes a nats://[user:pass@|token@]host[:port] URL.
+func NewNATSSink(serverURL, subject string) (*NATSSink, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("bad NATS URL %q, expected nats://host:port", serverURL)
+	}
+
+	port := u.Port()
+	if len(port) == 0 {
+		port = natsDefaultPort
+	}
+
+	connect := natsConnect{Name: "gophermart"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), pass
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	b, err := json.Marshal(connect)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NATSSink{
+		addr:    net.JoinHostPort(u.Hostname(), port),
+		connect: b,
+		subject: subject,
+	}, nil
+}
+
+func (s *NATSSink) Publish(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.publish(ctx, events); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *NATSSink) publish(ctx context.Context, events []Event) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultPublishTimeout)
+	}
+	if err := s.conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(s.conn)
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "PUB %s.%s %d\r\n", s.subject, e.Type, len(payload))
+		w.Write(payload)
+		w.WriteString("\r\n")
+	}
+	// The server answers PING only after it has processed everything sent
+	// before it, so PONG confirms the batch.
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return s.waitPong()
+}
+
+func (s *NATSSink) dial(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The server greets with INFO before accepting CONNECT.
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", s.connect); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *NATSSink) waitPong() error {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%w: %s", ErrNATSRejected, strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (s *NATSSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.reader = nil
+	}
+}
+
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.close()
+	return nil
+}
@@ -0,0 +1,74 @@
+package fiscal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+)
+
+const (
+	StatusValid    = "VALID"
+	StatusRejected = "REJECTED"
+)
+
+type Result struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"`
+}
+
+func (r *Result) Status() string {
+	if r.Valid {
+		return StatusValid
+	}
+	return StatusRejected
+}
+
+type Validator interface {
+	Validate(ctx context.Context, orderNumber string) (*Result, error)
+}
+
+type HTTPValidator struct {
+	baseAddr string
+	client   *resty.Client
+}
+
+func NewHTTPValidator(baseAddr, token string) *HTTPValidator {
+	client := tracing.InstrumentClient(resty.New().SetRetryCount(2).OnBeforeRequest(requestid.Propagate))
+	if len(token) != 0 {
+		client.SetAuthToken(token)
+	}
+
+	return &HTTPValidator{
+		baseAddr: baseAddr,
+		client:   client,
+	}
+}
+
+func (v *HTTPValidator) Validate(ctx context.Context, orderNumber string) (*Result, error) {
+	url := fmt.Sprintf("%s/api/receipts/%s", v.baseAddr, orderNumber)
+	response, err := v.client.R().SetContext(ctx).Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &Result{Valid: false, Reason: "receipt not found"}, nil
+	default:
+		return nil, fmt.Errorf("bad status code: %d", response.StatusCode())
+	}
+
+	var result Result
+	if err := json.Unmarshal(response.Body(), &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
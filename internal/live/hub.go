@@ -0,0 +1,159 @@
+package live
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const (
+	UpdateOrder   = "order"
+	UpdateBalance = "balance"
+)
+
+// SubscriptionBuffer is how many updates may wait for a slow client before
+// its subscription is dropped.
+const SubscriptionBuffer = 64
+
+type OrderUpdate struct {
+	Number  string       `json:"number"`
+	Status  string       `json:"status"`
+	Accrual money.Amount `json:"accrual,omitempty"`
+}
+
+type BalanceUpdate struct {
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
+}
+
+// Update is one message sent to a subscribed client.
+type Update struct {
+	Type    string         `json:"type"`
+	Order   *OrderUpdate   `json:"order,omitempty"`
+	Balance *BalanceUpdate `json:"balance,omitempty"`
+}
+
+// Subscription receives the updates of one user. C is closed when the hub
+// drops the subscription because the client fell behind.
+type Subscription struct {
+	C      <-chan Update
+	c      chan Update
+	userID uuid.UUID
+}
+
+// Hub fans out order and balance changes from the accrual pipeline to the
+// connected clients of each user.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[*Subscription]struct{}
+
+	storage storage.AppStorage
+	logger  *zap.Logger
+}
+
+func NewHub(st storage.AppStorage, logger *zap.Logger) *Hub {
+	return &Hub{
+		subs:    make(map[uuid.UUID]map[*Subscription]struct{}),
+		storage: st,
+		logger:  logger,
+	}
+}
+
+func (h *Hub) Subscribe(userID uuid.UUID) *Subscription {
+	c := make(chan Update, SubscriptionBuffer)
+	sub := &Subscription{C: c, c: c, userID: userID}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][sub] = struct{}{}
+	metrics.LiveSubscriptions.Add(1)
+
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(sub)
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	subs, ok := h.subs[sub.userID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, sub.userID)
+	}
+	close(sub.c)
+	metrics.LiveSubscriptions.Add(-1)
+}
+
+func (h *Hub) subscribed(userID uuid.UUID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs[userID]) != 0
+}
+
+func (h *Hub) Publish(userID uuid.UUID, update Update) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs[userID] {
+		select {
+		case sub.c <- update:
+		default:
+			h.remove(sub)
+		}
+	}
+}
+
+// OrdersUpdated publishes the new status of every order and, for users who
+// were credited, their new balance. Nothing is read from storage for users
+// without subscribers.
+func (h *Hub) OrdersUpdated(ctx context.Context, orders []storage.OrderTransition) {
+	credited := make(map[uuid.UUID]bool)
+	for _, o := range orders {
+		if !h.subscribed(o.UserID) {
+			continue
+		}
+
+		h.Publish(o.UserID, Update{
+			Type:  UpdateOrder,
+			Order: &OrderUpdate{Number: o.OrderNumber, Status: o.Status, Accrual: o.Accrual},
+		})
+		if o.Status == storage.StatusProcessed && o.Accrual != 0 {
+			credited[o.UserID] = true
+		}
+	}
+
+	for userID := range credited {
+		balance, err := h.storage.GetBalance(ctx, userID)
+		if err != nil {
+			requestid.Logger(ctx, h.logger).Error("failed to get balance for live update", zap.String("user_id", userID.String()), zap.Error(err))
+			continue
+		}
+		h.Publish(userID, Update{
+			Type:    UpdateBalance,
+			Balance: &BalanceUpdate{Current: balance.Current, Withdrawn: balance.Withdrawn},
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+const (
+	StepRegister = "register"
+	StepUpload   = "upload"
+	StepPoll     = "poll"
+	StepWithdraw = "withdraw"
+)
+
+type Config struct {
+	BaseURL     string
+	RPS         int
+	Duration    time.Duration
+	Concurrency int
+}
+
+type StepReport struct {
+	Name     string
+	Requests int
+	Errors   int
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+type Report struct {
+	Scenarios int
+	Steps     []StepReport
+}
+
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.RPS <= 0 || cfg.Duration <= 0 {
+		return nil, fmt.Errorf("rps and duration must be positive")
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = cfg.RPS
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	rec := &recorder{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(cfg.RPS))
+	defer ticker.Stop()
+
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	scenarios := 0
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			select {
+			case sem <- struct{}{}:
+			default:
+				continue
+			}
+			scenarios++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				runScenario(cfg.BaseURL, rec)
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	return rec.report(scenarios), nil
+}
+
+// runScenario walks a single user through register -> upload -> poll -> withdraw.
+func runScenario(baseURL string, rec *recorder) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 30 * time.Second}
+
+	login := "load-" + strconv.FormatInt(rand.Int63(), 36)
+	body := fmt.Sprintf(`{"login":%q,"password":"password"}`, login)
+	if !rec.do(client, StepRegister, http.MethodPost, baseURL+"/api/user/register", "application/json", body) {
+		return
+	}
+
+	order := GenerateOrderNumber(12)
+	if !rec.do(client, StepUpload, http.MethodPost, baseURL+"/api/user/orders", "text/plain", order) {
+		return
+	}
+
+	rec.do(client, StepPoll, http.MethodGet, baseURL+"/api/user/orders", "", "")
+
+	withdraw := fmt.Sprintf(`{"order":%q,"sum":1}`, GenerateOrderNumber(12))
+	rec.do(client, StepWithdraw, http.MethodPost, baseURL+"/api/user/balance/withdraw", "application/json", withdraw)
+}
+
+func (rec *recorder) do(client *http.Client, step, method, url, contentType, body string) bool {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		rec.add(step, 0, false)
+		return false
+	}
+	if len(contentType) != 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	SetCSRFHeader(client, req)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		rec.add(step, elapsed, false)
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	ok := resp.StatusCode < http.StatusInternalServerError
+	rec.add(step, elapsed, ok)
+	return ok
+}
+
+// SetCSRFHeader repeats the CSRF cookie from the client's jar in the header
+// the service checks on cookie-authenticated requests, as a browser script
+// would.
+func SetCSRFHeader(client *http.Client, req *http.Request) {
+	if client.Jar == nil {
+		return
+	}
+	for _, cookie := range client.Jar.Cookies(req.URL) {
+		if cookie.Name == "csrf_token" {
+			req.Header.Set("X-CSRF-Token", cookie.Value)
+			return
+		}
+	}
+}
+
+func (rec *recorder) add(step string, latency time.Duration, ok bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.latencies[step] = append(rec.latencies[step], latency)
+	if !ok {
+		rec.errors[step]++
+	}
+}
+
+func (rec *recorder) report(scenarios int) *Report {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	report := &Report{Scenarios: scenarios}
+	for _, step := range []string{StepRegister, StepUpload, StepPoll, StepWithdraw} {
+		ls := rec.latencies[step]
+		if len(ls) == 0 {
+			continue
+		}
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+		report.Steps = append(report.Steps, StepReport{
+			Name:     step,
+			Requests: len(ls),
+			Errors:   rec.errors[step],
+			P50:      percentile(ls, 50),
+			P90:      percentile(ls, 90),
+			P99:      percentile(ls, 99),
+			Max:      ls[len(ls)-1],
+		})
+	}
+
+	return report
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// GenerateOrderNumber returns a random Luhn-valid number of the given length.
+func GenerateOrderNumber(length int) string {
+	digits := make([]byte, length-1)
+	for i := range digits {
+		digits[i] = byte('0' + rand.Intn(10))
+	}
+	// A nonzero lead digit keeps the number clear of the all-zeros rule.
+	digits[0] = byte('1' + rand.Intn(9))
+
+	check, _ := validate.LuhnCheckDigit(string(digits))
+	return string(append(digits, check))
+}
@@ -0,0 +1,54 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+
+	DefaultLevel  = "info"
+	DefaultFormat = FormatJSON
+)
+
+var ErrUnknownFormat = errors.New("unknown log format")
+
+// New builds the service logger. The JSON format is zap's production setup;
+// the console format is its development setup with readable output and stack
+// traces on warnings. The returned level can be changed while the logger is
+// in use.
+func New(level, format string) (*zap.Logger, zap.AtomicLevel, error) {
+	atomicLevel, err := zap.ParseAtomicLevel(level)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+
+	var cfg zap.Config
+	switch format {
+	case FormatJSON:
+		cfg = zap.NewProductionConfig()
+	case FormatConsole:
+		cfg = zap.NewDevelopmentConfig()
+	default:
+		return nil, zap.AtomicLevel{}, fmt.Errorf("%w %q", ErrUnknownFormat, format)
+	}
+	cfg.Level = atomicLevel
+
+	logger, err := cfg.Build()
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+
+	return logger, atomicLevel, nil
+}
+
+// ValidLevel reports whether level is a level name New accepts.
+func ValidLevel(level string) bool {
+	_, err := zapcore.ParseLevel(level)
+	return err == nil
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/real-splendid/gophermart-practicum/internal/buildinfo"
+)
+
+var (
+	AccrualEnabled         = expvar.NewInt("accrual_enabled")
+	AccrualRequests        = expvar.NewMap("accrual_requests")
+	AccrualErrors          = expvar.NewMap("accrual_errors")
+	AccrualThrottled       = expvar.NewInt("accrual_throttled")
+	AccrualDeadLetters     = expvar.NewInt("accrual_dead_letters")
+	AccrualResultCacheHits = expvar.NewInt("accrual_result_cache_hits")
+	AccrualBacklog         = expvar.NewInt("accrual_backlog")
+	AccrualBacklogAge      = expvar.NewFloat("accrual_backlog_age_seconds")
+	AccrualSweptOrders     = expvar.NewInt("accrual_swept_orders")
+	BalanceDriftUsers      = expvar.NewInt("balance_drift_users")
+	HTTPPanics             = expvar.NewInt("http_panics")
+	HTTPTimeouts           = expvar.NewMap("http_timeouts")
+	NotificationsSent      = expvar.NewMap("notifications_sent")
+	NotificationErrors     = expvar.NewMap("notification_errors")
+	EventsPublished        = expvar.NewInt("events_published")
+	EventErrors            = expvar.NewMap("event_errors")
+	LiveSubscriptions      = expvar.NewInt("live_subscriptions")
+)
+
+// PublishPool exposes connection pool statistics under name. Stats are read
+// from the pool on every scrape.
+func PublishPool(name string, stat func() *pgxpool.Stat) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		s := stat()
+		return map[string]interface{}{
+			"acquire_count":              s.AcquireCount(),
+			"acquire_duration_ms":        s.AcquireDuration().Milliseconds(),
+			"acquired_conns":             s.AcquiredConns(),
+			"canceled_acquire_count":     s.CanceledAcquireCount(),
+			"constructing_conns":         s.ConstructingConns(),
+			"empty_acquire_count":        s.EmptyAcquireCount(),
+			"idle_conns":                 s.IdleConns(),
+			"max_conns":                  s.MaxConns(),
+			"total_conns":                s.TotalConns(),
+			"new_conns_count":            s.NewConnsCount(),
+			"max_lifetime_destroy_count": s.MaxLifetimeDestroyCount(),
+			"max_idle_destroy_count":     s.MaxIdleDestroyCount(),
+		}
+	}))
+}
+
+// PublishBuildInfo exposes the running build so that metric changes can be
+// matched to deploys.
+func PublishBuildInfo(info buildinfo.Info) {
+	expvar.Publish("build_info", expvar.Func(func() interface{} {
+		return info
+	}))
+}
+
+// hidden are the variables expvar publishes on its own that Handler leaves
+// out: the command line carries flags such as the database DSN and JWT secret.
+var hidden = map[string]bool{
+	"cmdline": true,
+}
+
+// Handler serves the variables as expvar.Handler does, without the hidden ones.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, "{\n")
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if hidden[kv.Key] {
+				return
+			}
+			if !first {
+				fmt.Fprint(w, ",\n")
+			}
+			first = false
+			fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		})
+		fmt.Fprint(w, "\n}\n")
+	})
+}
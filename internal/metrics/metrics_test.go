@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerHidesCommandLine(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	vars := map[string]json.RawMessage{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, rec.Body)
+	}
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("cmdline is served")
+	}
+	for _, name := range []string{"memstats", "accrual_enabled"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("%s is missing", name)
+		}
+	}
+}
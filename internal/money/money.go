@@ -0,0 +1,134 @@
+// Package money represents loyalty point amounts as integer hundredths so
+// balance arithmetic never accumulates floating point errors.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const scale = 100
+
+var ErrBadAmount = errors.New("bad monetary amount")
+
+// Amount is a number of minor units (hundredths of a point).
+type Amount int64
+
+func FromFloat(f float64) Amount {
+	return Amount(math.Round(f * scale))
+}
+
+// Parse reads a decimal string such as "500", "-12.5" or "0.01" exactly. The
+// grammar is -?digits(.d{1,2})?: no plus sign, no sign on the fraction, no
+// exponent and no more than two fractional digits.
+func Parse(s string) (Amount, error) {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	intPart, fracPart, hasFrac := strings.Cut(s, ".")
+	if !isDigits(intPart) || hasFrac && (!isDigits(fracPart) || len(fracPart) > 2) {
+		return 0, ErrBadAmount
+	}
+	fracPart += strings.Repeat("0", 2-len(fracPart))
+
+	units, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return 0, ErrBadAmount
+	}
+	cents, err := strconv.ParseInt(fracPart, 10, 64)
+	if err != nil {
+		return 0, ErrBadAmount
+	}
+	if units > (math.MaxInt64-cents)/scale {
+		return 0, ErrBadAmount
+	}
+
+	a := Amount(units*scale + cents)
+	if negative {
+		a = -a
+	}
+	return a, nil
+}
+
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Mul multiplies the amount by a factor such as an exchange rate, rounding
+// to the nearest hundredth.
+func (a Amount) Mul(f float64) Amount {
+	return Amount(math.Round(float64(a) * f))
+}
+
+func (a Amount) Float64() float64 {
+	return float64(a) / scale
+}
+
+func (a Amount) String() string {
+	sign := ""
+	v := int64(a)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/scale, v%scale)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts a plain JSON number in the Parse grammar or null.
+// Quoted amounts and exponents are rejected rather than rounded.
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*a = 0
+		return nil
+	}
+
+	v, err := Parse(string(b))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Scan reads NUMERIC columns, which pgx hands over as decimal strings.
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = 0
+	case string:
+		parsed, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		*a = parsed
+	case []byte:
+		return a.Scan(string(v))
+	case int64:
+		*a = Amount(v * scale)
+	case float64:
+		*a = FromFloat(v)
+	default:
+		return fmt.Errorf("%w: cannot scan %T", ErrBadAmount, src)
+	}
+	return nil
+}
+
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
@@ -0,0 +1,101 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr bool
+	}{
+		{in: "500", want: 50000},
+		{in: "0", want: 0},
+		{in: "0.01", want: 1},
+		{in: "-12.5", want: -1250},
+		{in: "729.98", want: 72998},
+		{in: "1.50", want: 150},
+		{in: "-0", want: 0},
+		{in: "92233720368547758.07", want: math.MaxInt64},
+		{in: "-92233720368547758.07", want: -math.MaxInt64},
+		{in: "", wantErr: true},
+		{in: "-", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "5.", wantErr: true},
+		{in: "1.234", wantErr: true},
+		{in: "1.500", wantErr: true},
+		{in: "--5", wantErr: true},
+		{in: "+5", wantErr: true},
+		{in: "1.+5", wantErr: true},
+		{in: "1.-5", wantErr: true},
+		{in: "-+5", wantErr: true},
+		{in: " 5", wantErr: true},
+		{in: "5 ", wantErr: true},
+		{in: "1e2", wantErr: true},
+		{in: "0x10", wantErr: true},
+		{in: "1,5", wantErr: true},
+		{in: "1.2.3", wantErr: true},
+		{in: "92233720368547758.08", wantErr: true},
+		{in: "92233720368547759", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if tt.wantErr {
+			if !errors.Is(err, ErrBadAmount) {
+				t.Errorf("Parse(%q) = %s, %v, want %v", tt.in, got, err, ErrBadAmount)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Parse(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr bool
+	}{
+		{in: `751`, want: 75100},
+		{in: `729.98`, want: 72998},
+		{in: `-0.5`, want: -50},
+		{in: `null`, want: 0},
+		{in: `"751"`, wantErr: true},
+		{in: `"null"`, wantErr: true},
+		{in: `7.51e2`, wantErr: true},
+		{in: `1E2`, wantErr: true},
+		{in: `0.001`, wantErr: true},
+		{in: `true`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got struct {
+			Sum Amount `json:"sum"`
+		}
+		err := json.Unmarshal([]byte(`{"sum": `+tt.in+`}`), &got)
+		if tt.wantErr {
+			if !errors.Is(err, ErrBadAmount) {
+				t.Errorf("Unmarshal(%s) = %s, %v, want %v", tt.in, got.Sum, err, ErrBadAmount)
+			}
+			continue
+		}
+		if err != nil || got.Sum != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d", tt.in, got.Sum, err, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	for _, a := range []Amount{0, 1, -1, 150, -1250, 72998, math.MaxInt64} {
+		got, err := Parse(a.String())
+		if err != nil || got != a {
+			t.Errorf("Parse(%q) = %d, %v, want %d", a.String(), got, err, a)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+)
+
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+const (
+	DefaultMaxAttempts    = 8
+	DefaultRetryBaseDelay = 30 * time.Second
+	DefaultRetryMaxDelay  = time.Hour
+	DefaultPollInterval   = 5 * time.Second
+	DefaultSendTimeout    = 10 * time.Second
+
+	// deliveryBatch deliveries are claimed at a time and sent one by one,
+	// so the claim lasts long enough for all of them to time out.
+	deliveryBatch = 10
+	deliveryLease = deliveryBatch*DefaultSendTimeout + time.Minute
+)
+
+var (
+	ErrChannelDisabled = errors.New("notification channel is disabled")
+	// ErrForbiddenAddress means a webhook URL leads to an address that is not
+	// on the public internet.
+	ErrForbiddenAddress = errors.New("webhook address is not public")
+)
+
+// nonPublicPrefixes are the special-purpose ranges netip doesn't classify:
+// shared address space, IETF protocol assignments, benchmarking, reserved
+// and NAT64, which may lead back into an internal IPv4 network.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+type Event struct {
+	OrderNumber string       `json:"order"`
+	Status      string       `json:"status"`
+	Accrual     money.Amount `json:"accrual,omitempty"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// Sender delivers an event to one address: an e-mail address or a webhook URL.
+type Sender interface {
+	Send(ctx context.Context, address string, event Event) error
+}
+
+type SMTPSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPSender(addr, from, username, password string) *SMTPSender {
+	sender := &SMTPSender{addr: addr, from: from}
+	if len(username) != 0 {
+		host, _, _ := strings.Cut(addr, ":")
+		sender.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return sender
+}
+
+func (s *SMTPSender) Send(_ context.Context, address string, event Event) error {
+	body := fmt.Sprintf("Order %s is %s.\r\n", event.OrderNumber, event.Status)
+	if event.Status == storage.StatusProcessed {
+		body += fmt.Sprintf("Accrued points: %s.\r\n", event.Accrual)
+	}
+	msg := "From: " + s.from + "\r\n" +
+		"To: " + address + "\r\n" +
+		"Subject: Order " + event.OrderNumber + " is " + event.Status + "\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{address}, []byte(msg))
+}
+
+// IsPublicAddr reports whether ip is a unicast address on the public
+// internet. Webhook URLs come from users, so they must not lead to loopback,
+// private, link-local or other internal addresses of the deployment.
+func IsPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicOnly is a dialer Control that refuses non-public addresses. It
+// checks the address actually dialed, so neither a redirect nor a host name
+// that resolves differently later can get past it.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !IsPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// WebhookSender posts events to user webhooks. It connects to public
+// addresses only and directly, without the environment's proxy.
+type WebhookSender struct {
+	client *resty.Client
+}
+
+func NewWebhookSender() *WebhookSender {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   DefaultSendTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   publicOnly,
+	}).DialContext
+
+	client := resty.New().
+		SetTransport(transport).
+		SetRetryCount(2).
+		AddRetryCondition(func(_ *resty.Response, err error) bool {
+			return err != nil && !errors.Is(err, ErrForbiddenAddress)
+		}).
+		OnBeforeRequest(requestid.Propagate)
+	return &WebhookSender{
+		client: tracing.InstrumentClient(client),
+	}
+}
+
+func (s *WebhookSender) Send(ctx context.Context, address string, event Event) error {
+	response, err := s.client.R().SetContext(ctx).SetBody(event).Post(address)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode() < http.StatusOK || response.StatusCode() >= http.StatusMultipleChoices {
+		return fmt.Errorf("bad status code: %d", response.StatusCode())
+	}
+	return nil
+}
+
+type Config struct {
+	Senders map[string]Sender
+	// A delivery is attempted MaxAttempts times, waiting RetryBaseDelay after
+	// the first failure and twice as long after each further one, up to
+	// RetryMaxDelay.
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	// PollInterval is how often the outbox is checked for due deliveries.
+	PollInterval time.Duration
+	Logger       *zap.Logger
+	storage.AppStorage
+}
+
+// Notifier tells users about orders that reached a final status. Deliveries
+// go through an outbox table and are sent in the background, so a slow or
+// unavailable mail server or webhook neither holds up accrual processing nor
+// loses notifications.
+type Notifier struct {
+	ctx context.Context
+
+	Config
+}
+
+func NewNotifier(ctx context.Context, cfg Config) *Notifier {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.RetryBaseDelay <= 0 {
+		cfg.RetryBaseDelay = DefaultRetryBaseDelay
+	}
+	if cfg.RetryMaxDelay <= 0 {
+		cfg.RetryMaxDelay = DefaultRetryMaxDelay
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+
+	n := &Notifier{
+		ctx:    ctx,
+		Config: cfg,
+	}
+	go n.run()
+
+	return n
+}
+
+// OrdersUpdated adds a delivery to the outbox for every order that is now
+// PROCESSED or INVALID, to each address the user has set up for a channel
+// with a sender.
+func (n *Notifier) OrdersUpdated(ctx context.Context, orders []storage.OrderTransition) {
+	logger := requestid.Logger(ctx, n.Logger)
+	prefs := make(map[uuid.UUID]*storage.NotificationPreferences)
+
+	var deliveries []storage.NotificationDelivery
+	for _, o := range orders {
+		if o.Status != storage.StatusProcessed && o.Status != storage.StatusInvalid {
+			continue
+		}
+
+		userPrefs, ok := prefs[o.UserID]
+		if !ok {
+			var err error
+			if userPrefs, err = n.GetNotificationPreferences(ctx, o.UserID); err != nil {
+				metrics.NotificationErrors.Add("outbox", 1)
+				logger.Error("failed to get notification preferences", zap.String("order_id", o.OrderNumber), zap.Error(err))
+				continue
+			}
+			prefs[o.UserID] = userPrefs
+		}
+
+		payload, err := json.Marshal(Event{
+			OrderNumber: o.OrderNumber,
+			Status:      o.Status,
+			Accrual:     o.Accrual,
+			UpdatedAt:   time.Now(),
+		})
+		if err != nil {
+			logger.Error("failed to encode notification", zap.String("order_id", o.OrderNumber), zap.Error(err))
+			continue
+		}
+
+		for channel, address := range map[string]string{ChannelEmail: userPrefs.Email, ChannelWebhook: userPrefs.WebhookURL} {
+			if _, ok := n.Senders[channel]; !ok || len(address) == 0 {
+				continue
+			}
+			deliveries = append(deliveries, storage.NotificationDelivery{
+				UserID:  o.UserID,
+				Channel: channel,
+				Address: address,
+				Payload: payload,
+			})
+		}
+	}
+
+	if err := n.AddNotificationDeliveries(ctx, deliveries); err != nil {
+		metrics.NotificationErrors.Add("outbox", 1)
+		logger.Error("failed to add notifications to the outbox", zap.Int("count", len(deliveries)), zap.Error(err))
+	}
+}
+
+func (n *Notifier) run() {
+	ticker := time.NewTicker(n.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.deliver()
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver sends the due deliveries, a batch at a time, until none are left.
+func (n *Notifier) deliver() {
+	for n.ctx.Err() == nil {
+		ctx := requestid.NewContext(n.ctx, "notify-")
+		deliveries, err := n.ClaimNotificationDeliveries(ctx, deliveryLease, deliveryBatch)
+		if err != nil {
+			requestid.Logger(ctx, n.Logger).Error("failed to claim notifications", zap.Error(err))
+			return
+		}
+
+		for _, d := range deliveries {
+			n.send(ctx, d)
+		}
+		if len(deliveries) < deliveryBatch {
+			return
+		}
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, d storage.NotificationDelivery) {
+	logger := requestid.Logger(ctx, n.Logger).With(zap.Int64("delivery_id", d.ID), zap.String("channel", d.Channel))
+
+	err := n.attempt(ctx, d)
+	if err == nil {
+		metrics.NotificationsSent.Add(d.Channel, 1)
+		if err := n.CompleteNotificationDelivery(ctx, d.ID); err != nil {
+			logger.Error("failed to mark notification sent", zap.Error(err))
+		}
+		return
+	}
+
+	metrics.NotificationErrors.Add(d.Channel, 1)
+	var retryAt time.Time
+	if attempts := d.Attempts + 1; attempts < n.MaxAttempts && !errors.Is(err, ErrChannelDisabled) && !errors.Is(err, ErrForbiddenAddress) {
+		retryAt = time.Now().Add(n.backoff(attempts))
+		logger.Warn("failed to send notification, will retry", zap.Int("attempts", attempts), zap.Time("retry_at", retryAt), zap.Error(err))
+	} else {
+		logger.Error("failed to send notification, giving up", zap.Int("attempts", attempts), zap.Error(err))
+	}
+	if err := n.FailNotificationDelivery(ctx, d.ID, err.Error(), retryAt); err != nil {
+		logger.Error("failed to record notification failure", zap.Error(err))
+	}
+}
+
+func (n *Notifier) attempt(ctx context.Context, d storage.NotificationDelivery) error {
+	sender, ok := n.Senders[d.Channel]
+	if !ok {
+		return ErrChannelDisabled
+	}
+
+	var event Event
+	if err := json.Unmarshal(d.Payload, &event); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DefaultSendTimeout)
+	defer cancel()
+	return sender.Send(ctx, d.Address, event)
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (n *Notifier) backoff(attempts int) time.Duration {
+	d := n.RetryBaseDelay << (attempts - 1)
+	if d <= 0 || d > n.RetryMaxDelay {
+		return n.RetryMaxDelay
+	}
+	return d
+}
@@ -0,0 +1,129 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/tracing"
+)
+
+const DefaultUpdateInterval = time.Hour
+
+var ErrBadRate = errors.New("exchange rate must be a positive finite number")
+
+type Provider interface {
+	Rate(ctx context.Context) (float64, error)
+}
+
+type StaticProvider float64
+
+func (p StaticProvider) Rate(context.Context) (float64, error) {
+	return float64(p), nil
+}
+
+type rateResponse struct {
+	Rate float64 `json:"rate"`
+}
+
+type HTTPProvider struct {
+	url    string
+	client *resty.Client
+}
+
+func NewHTTPProvider(url string) *HTTPProvider {
+	return &HTTPProvider{
+		url:    url,
+		client: tracing.InstrumentClient(resty.New().SetRetryCount(3).OnBeforeRequest(requestid.Propagate)),
+	}
+}
+
+func (p *HTTPProvider) Rate(ctx context.Context) (float64, error) {
+	response, err := p.client.R().SetContext(ctx).Get(p.url)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.StatusCode() != http.StatusOK {
+		return 0, fmt.Errorf("bad status code: %d", response.StatusCode())
+	}
+
+	var r rateResponse
+	if err := json.Unmarshal(response.Body(), &r); err != nil {
+		return 0, err
+	}
+	// A bad rate keeps the previous one rather than zeroing every balance.
+	if !(r.Rate > 0) || math.IsInf(r.Rate, 1) {
+		return 0, fmt.Errorf("%w: %v", ErrBadRate, r.Rate)
+	}
+
+	return r.Rate, nil
+}
+
+type Config struct {
+	Currency       string
+	UpdateInterval time.Duration
+	Provider       Provider
+	Logger         *zap.Logger
+}
+
+// Converter keeps the latest points-to-currency rate fetched from the provider.
+type Converter struct {
+	mu   sync.RWMutex
+	rate float64
+	Config
+}
+
+func NewConverter(ctx context.Context, cfg Config) *Converter {
+	if cfg.UpdateInterval <= 0 {
+		cfg.UpdateInterval = DefaultUpdateInterval
+	}
+
+	c := &Converter{Config: cfg}
+	c.update(ctx)
+	go c.run(ctx)
+
+	return c
+}
+
+func (c *Converter) Convert(points money.Amount) (money.Amount, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return points.Mul(c.rate), c.Currency
+}
+
+func (c *Converter) run(ctx context.Context) {
+	ticker := time.NewTicker(c.UpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.update(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Converter) update(ctx context.Context) {
+	rate, err := c.Provider.Rate(ctx)
+	if err != nil {
+		c.Logger.Error("failed to update exchange rate", zap.Error(err))
+		return
+	}
+
+	c.mu.Lock()
+	c.rate = rate
+	c.mu.Unlock()
+}
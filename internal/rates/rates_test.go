@@ -0,0 +1,40 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPProviderRate(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    float64
+		wantErr error
+	}{
+		{body: `{"rate": 1.5}`, want: 1.5},
+		{body: `{"rate": 0}`, wantErr: ErrBadRate},
+		{body: `{"rate": -2}`, wantErr: ErrBadRate},
+		{body: `{}`, wantErr: ErrBadRate},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(tt.body))
+		}))
+
+		rate, err := NewHTTPProvider(srv.URL).Rate(context.Background())
+		srv.Close()
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Rate() for %s = %v, %v, want %v", tt.body, rate, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || rate != tt.want {
+			t.Errorf("Rate() for %s = %v, %v, want %v", tt.body, rate, err, tt.want)
+		}
+	}
+}
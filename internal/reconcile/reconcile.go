@@ -0,0 +1,96 @@
+// Package reconcile periodically recomputes balances from orders, withdrawals,
+// adjustments and credits, and reports (optionally corrects) the ones that
+// drifted.
+package reconcile
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/metrics"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const DefaultInterval = 24 * time.Hour
+
+type Config struct {
+	Interval time.Duration
+	// AutoCorrect sets drifted balances to the recomputed amounts. Without it
+	// the drift is only recorded.
+	AutoCorrect bool
+	Logger      *zap.Logger
+	storage.AppStorage
+}
+
+type Engine struct {
+	Config
+}
+
+func NewEngine(ctx context.Context, cfg Config) *Engine {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+
+	e := &Engine{Config: cfg}
+	go e.run(ctx)
+
+	return e
+}
+
+func (e *Engine) run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	e.Reconcile(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			e.Reconcile(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reconcile checks every balance once and records what drifted.
+func (e *Engine) Reconcile(ctx context.Context) {
+	drifts, err := e.FindBalanceDrift(ctx)
+	if err != nil {
+		e.Logger.Error("balance reconciliation failed", zap.Error(err))
+		return
+	}
+	metrics.BalanceDriftUsers.Set(int64(len(drifts)))
+
+	corrected := 0
+	for i, d := range drifts {
+		e.Logger.Warn("balance drift",
+			zap.String("user_id", d.UserID.String()),
+			zap.Stringer("current", d.Current),
+			zap.Stringer("expected_current", d.ExpectedCurrent),
+			zap.Stringer("withdrawn", d.Withdrawn),
+			zap.Stringer("expected_withdrawn", d.ExpectedWithdrawn),
+		)
+		if !e.AutoCorrect {
+			continue
+		}
+
+		// A balance that changed since it was read is left for the next run.
+		if err := e.CorrectBalanceDrift(ctx, d); err != nil {
+			e.Logger.Error("failed to correct balance drift", zap.String("user_id", d.UserID.String()), zap.Error(err))
+			continue
+		}
+		drifts[i].Corrected = true
+		corrected++
+	}
+
+	if err := e.AddBalanceDrift(ctx, drifts); err != nil {
+		e.Logger.Error("failed to record balance drift", zap.Error(err))
+	}
+
+	e.Logger.Info("balance reconciliation done",
+		zap.Int("drifted", len(drifts)),
+		zap.Int("corrected", corrected),
+	)
+}
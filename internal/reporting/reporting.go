@@ -0,0 +1,135 @@
+package reporting
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const (
+	FormatCSV = "csv"
+	FormatXML = "xml"
+
+	dateLayout = "02.01.2006"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+type Period struct {
+	From time.Time
+	To   time.Time
+}
+
+type accountingExport struct {
+	XMLName     xml.Name          `xml:"AccountingExport"`
+	PeriodFrom  string            `xml:"PeriodFrom,attr"`
+	PeriodTo    string            `xml:"PeriodTo,attr"`
+	Accrued     string            `xml:"Accrued"`
+	Redeemed    string            `xml:"Redeemed"`
+	Liability   string            `xml:"Liability"`
+	Redemptions []redemptionEntry `xml:"Redemptions>Redemption"`
+}
+
+type redemptionEntry struct {
+	Date   string `xml:"Date"`
+	Order  string `xml:"Order"`
+	UserID string `xml:"UserID"`
+	Sum    string `xml:"Sum"`
+}
+
+type Exporter struct {
+	storage storage.AppStorage
+}
+
+func NewExporter(st storage.AppStorage) *Exporter {
+	return &Exporter{storage: st}
+}
+
+func (e *Exporter) ContentType(format string) string {
+	if format == FormatXML {
+		return "application/xml"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+func (e *Exporter) Export(ctx context.Context, w io.Writer, period Period, format string) error {
+	if format != FormatCSV && format != FormatXML {
+		return ErrUnknownFormat
+	}
+
+	summary, err := e.storage.GetAccountingSummary(ctx, period.From, period.To)
+	if err != nil {
+		return err
+	}
+
+	ws, err := e.storage.GetWithdrawalsForPeriod(ctx, period.From, period.To)
+	if err != nil {
+		return err
+	}
+
+	doc := accountingExport{
+		PeriodFrom:  period.From.Format(dateLayout),
+		PeriodTo:    period.To.Format(dateLayout),
+		Accrued:     formatAmount(summary.Accrued),
+		Redeemed:    formatAmount(summary.Redeemed),
+		Liability:   formatAmount(summary.Liability),
+		Redemptions: make([]redemptionEntry, len(ws)),
+	}
+	for i, wd := range ws {
+		doc.Redemptions[i] = redemptionEntry{
+			Date:   wd.ProcessedAt.Format(dateLayout),
+			Order:  wd.OrderNumber,
+			UserID: wd.UserID.String(),
+			Sum:    formatAmount(wd.Sum),
+		}
+	}
+
+	if format == FormatXML {
+		return writeXML(w, doc)
+	}
+	return writeCSV(w, doc)
+}
+
+func writeXML(w io.Writer, doc accountingExport) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// writeCSV uses the semicolon separator and decimal comma expected by 1C imports.
+func writeCSV(w io.Writer, doc accountingExport) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = ';'
+
+	records := [][]string{
+		{"Период", doc.PeriodFrom, doc.PeriodTo},
+		{"Начислено", doc.Accrued},
+		{"Списано", doc.Redeemed},
+		{"Обязательства", doc.Liability},
+		{"Дата", "Заказ", "Пользователь", "Сумма"},
+	}
+	for _, r := range doc.Redemptions {
+		records = append(records, []string{r.Date, r.Order, r.UserID, r.Sum})
+	}
+
+	if err := cw.WriteAll(records); err != nil {
+		return err
+	}
+
+	return cw.Error()
+}
+
+func formatAmount(v money.Amount) string {
+	return strings.Replace(v.String(), ".", ",", 1)
+}
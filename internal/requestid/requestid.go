@@ -0,0 +1,38 @@
+package requestid
+
+import (
+	"context"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const Header = "X-Request-ID"
+
+func FromContext(ctx context.Context) string {
+	return middleware.GetReqID(ctx)
+}
+
+// NewContext attaches a fresh request ID for work that doesn't originate
+// from an HTTP request, such as an accrual polling cycle.
+func NewContext(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, middleware.RequestIDKey, prefix+uuid.NewString())
+}
+
+func Logger(ctx context.Context, logger *zap.Logger) *zap.Logger {
+	id := FromContext(ctx)
+	if len(id) == 0 {
+		return logger
+	}
+	return logger.With(zap.String("request_id", id))
+}
+
+// Propagate is a resty request middleware forwarding the context request ID.
+func Propagate(_ *resty.Client, r *resty.Request) error {
+	if id := FromContext(r.Context()); len(id) != 0 {
+		r.SetHeader(Header, id)
+	}
+	return nil
+}
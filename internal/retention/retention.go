@@ -0,0 +1,111 @@
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const DefaultInterval = 24 * time.Hour
+
+type Rule struct {
+	Name   string
+	Target string
+	MaxAge time.Duration
+}
+
+type ruleJSON struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	MaxAge string `json:"max_age"`
+}
+
+type Config struct {
+	Rules    []Rule
+	Interval time.Duration
+	DryRun   bool
+	Logger   *zap.Logger
+	storage.AppStorage
+}
+
+type Engine struct {
+	Config
+}
+
+func ParseRules(value string) ([]Rule, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var raw []ruleJSON
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse retention rules: %w", err)
+	}
+
+	rules := make([]Rule, len(raw))
+	for i, r := range raw {
+		maxAge, err := time.ParseDuration(r.MaxAge)
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("retention rule %q: bad max_age %q", r.Name, r.MaxAge)
+		}
+		if !storage.IsRetentionTarget(r.Target) {
+			return nil, fmt.Errorf("retention rule %q: unknown target %q", r.Name, r.Target)
+		}
+		rules[i] = Rule{Name: r.Name, Target: r.Target, MaxAge: maxAge}
+	}
+
+	return rules, nil
+}
+
+func NewEngine(ctx context.Context, cfg Config) *Engine {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+
+	e := &Engine{Config: cfg}
+	if len(cfg.Rules) != 0 {
+		go e.run(ctx)
+	}
+
+	return e
+}
+
+func (e *Engine) run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	e.Apply(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			e.Apply(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Apply runs every rule once; in dry-run mode it only reports how many rows
+// would be affected.
+func (e *Engine) Apply(ctx context.Context) {
+	now := time.Now()
+	for _, rule := range e.Rules {
+		affected, err := e.ApplyRetention(ctx, rule.Target, now.Add(-rule.MaxAge), e.DryRun)
+		if err != nil {
+			e.Logger.Error("retention rule failed", zap.String("rule", rule.Name), zap.Error(err))
+			continue
+		}
+
+		e.Logger.Info("retention rule applied",
+			zap.String("rule", rule.Name),
+			zap.String("target", rule.Target),
+			zap.Bool("dry_run", e.DryRun),
+			zap.Int64("affected", affected),
+		)
+	}
+}
@@ -0,0 +1,177 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const (
+	// MinVersion is the oldest schema version this binary can run against:
+	// every expand migration the code relies on must be applied.
+	MinVersion int64 = 20261016180000
+	// CompatibleUpTo is the newest contract migration this binary tolerates.
+	// Contract migrations above it must wait until no such binary is running.
+	CompatibleUpTo int64 = 20261016180000
+
+	PhaseExpand   = "expand"
+	PhaseContract = "contract"
+
+	heartbeatInterval = 30 * time.Second
+	operationTimeout  = 5 * time.Second
+)
+
+var ErrSchemaTooOld = errors.New("database schema is older than required by this binary")
+
+type Migration struct {
+	Version int64
+	Name    string
+	Phase   string
+}
+
+type IncompatibleClientError struct {
+	InstanceID     uuid.UUID
+	Hostname       string
+	CompatibleUpTo int64
+}
+
+func (e *IncompatibleClientError) Error() string {
+	return fmt.Sprintf("instance %s on %s only supports schema up to %d", e.InstanceID, e.Hostname, e.CompatibleUpTo)
+}
+
+// LoadMigrations lists goose migrations in dir. Files with "_contract_" in
+// their name belong to the contract phase, everything else is expand.
+func LoadMigrations(dir string) ([]Migration, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(files))
+	for _, f := range files {
+		name := filepath.Base(f)
+		versionPart, _, found := strings.Cut(name, "_")
+		if !found {
+			continue
+		}
+		version, err := strconv.ParseInt(versionPart, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		phase := PhaseExpand
+		if strings.Contains(name, "_contract_") {
+			phase = PhaseContract
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, Phase: phase})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// ExpandTarget returns the last version that can be applied before hitting
+// the first pending contract migration.
+func ExpandTarget(migrations []Migration, current int64) int64 {
+	target := current
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if m.Phase == PhaseContract {
+			break
+		}
+		target = m.Version
+	}
+
+	return target
+}
+
+func CurrentVersion(ctx context.Context, pool *pgxpool.Pool) (int64, error) {
+	opCtx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+
+	var version int64
+	err := pool.QueryRow(opCtx, `SELECT COALESCE(MAX(version_id), 0) FROM goose_db_version WHERE is_applied;`).Scan(&version)
+	return version, err
+}
+
+func Check(ctx context.Context, pool *pgxpool.Pool) error {
+	version, err := CurrentVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	if version < MinVersion {
+		return fmt.Errorf("%w: have %d, need %d", ErrSchemaTooOld, version, MinVersion)
+	}
+
+	return nil
+}
+
+// CheckContract fails if a live instance cannot tolerate the given contract
+// migration version.
+func CheckContract(ctx context.Context, pool *pgxpool.Pool, version int64, staleAfter time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+
+	r, err := pool.Query(opCtx, `SELECT instance_id, hostname, compatible_up_to FROM schema_clients WHERE last_seen > NOW() - $1::INTERVAL AND compatible_up_to < $2;`, staleAfter.String(), version)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if r.Next() {
+		e := &IncompatibleClientError{}
+		if err := r.Scan(&e.InstanceID, &e.Hostname, &e.CompatibleUpTo); err != nil {
+			return err
+		}
+		return e
+	}
+
+	return r.Err()
+}
+
+// Register records this instance and keeps its heartbeat fresh until ctx is done.
+func Register(ctx context.Context, pool *pgxpool.Pool, logger *zap.Logger) error {
+	instanceID := uuid.New()
+	hostname, _ := os.Hostname()
+
+	opCtx, cancel := context.WithTimeout(ctx, operationTimeout)
+	defer cancel()
+
+	_, err := pool.Exec(opCtx, `INSERT INTO schema_clients (instance_id, hostname, min_version, compatible_up_to) VALUES ($1, $2, $3, $4);`,
+		instanceID, hostname, MinVersion, CompatibleUpTo)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				hbCtx, cancel := context.WithTimeout(ctx, operationTimeout)
+				if _, err := pool.Exec(hbCtx, `UPDATE schema_clients SET last_seen = NOW() WHERE instance_id = $1;`, instanceID); err != nil {
+					logger.Error("failed to update schema client heartbeat", zap.Error(err))
+				}
+				cancel()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
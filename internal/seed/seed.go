@@ -0,0 +1,163 @@
+// Package seed fills a database with generated users, orders and withdrawals
+// through the storage, so pagination and the accrual poller can be measured
+// on realistic volumes.
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/loadtest"
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const (
+	DefaultPassword = "seed-password"
+	DefaultHistory  = 365 * 24 * time.Hour
+
+	orderNumberLength = 16
+	maxAccrual        = 1000_00
+)
+
+// Order outcomes, cumulative: the rest of the orders stay NEW for the
+// accrual poller.
+const (
+	processedShare  = 0.7
+	invalidShare    = 0.8
+	processingShare = 0.9
+)
+
+type Config struct {
+	Users int
+	// Orders and Withdrawals are per user. Withdrawals are skipped once the
+	// balance runs out.
+	Orders      int
+	Withdrawals int
+	// History is how far back the activity of a user is spread.
+	History    time.Duration
+	Password   string
+	MerchantID uuid.UUID
+	// Progress, if set, is called after each user.
+	Progress func(done int)
+}
+
+type Report struct {
+	Users       int
+	Orders      int
+	Processed   int
+	Unfinished  int
+	Withdrawals int
+}
+
+// Run creates cfg.Users users with logins seed-<run>-<n>, where run is
+// random, so repeated runs add to the data.
+func Run(ctx context.Context, st storage.AppStorage, cfg Config) (*Report, error) {
+	if cfg.Users <= 0 || cfg.Orders < 0 || cfg.Withdrawals < 0 {
+		return nil, fmt.Errorf("users must be positive, orders and withdrawals not negative")
+	}
+	backdater, ok := st.(storage.Backdater)
+	if !ok {
+		return nil, fmt.Errorf("storage %T can't backdate activity", st)
+	}
+	if cfg.History <= 0 {
+		cfg.History = DefaultHistory
+	}
+	if len(cfg.Password) == 0 {
+		cfg.Password = DefaultPassword
+	}
+
+	run := strconv.FormatInt(rand.Int63(), 36)
+	report := &Report{}
+	for i := 0; i < cfg.Users; i++ {
+		if err := seedUser(ctx, st, backdater, cfg, fmt.Sprintf("seed-%s-%d", run, i), report); err != nil {
+			return report, err
+		}
+		report.Users++
+		if cfg.Progress != nil {
+			cfg.Progress(report.Users)
+		}
+	}
+
+	return report, nil
+}
+
+func seedUser(ctx context.Context, st storage.AppStorage, backdater storage.Backdater, cfg Config, login string, report *Report) error {
+	if err := st.AddUser(ctx, &storage.UserAuthorization{MerchantID: cfg.MerchantID, Login: login, Password: []byte(cfg.Password)}); err != nil {
+		return fmt.Errorf("add user %s: %w", login, err)
+	}
+	user, err := st.GetUserAuthInfo(ctx, cfg.MerchantID, login)
+	if err != nil {
+		return fmt.Errorf("get user %s: %w", login, err)
+	}
+
+	transitions := make([]storage.OrderTransition, 0, cfg.Orders)
+	var balance money.Amount
+	for i := 0; i < cfg.Orders; i++ {
+		number, err := addOrder(ctx, st, cfg.MerchantID, user.ID)
+		if err != nil {
+			return err
+		}
+		report.Orders++
+
+		order := storage.Order{UserID: user.ID, OrderNumber: number}
+		switch r := rand.Float64(); {
+		case r < processedShare:
+			order.Status = storage.StatusProcessed
+			order.Accrual = money.Amount(1 + rand.Int63n(maxAccrual))
+			balance += order.Accrual
+			report.Processed++
+		case r < invalidShare:
+			order.Status = storage.StatusInvalid
+		case r < processingShare:
+			order.Status = storage.StatusProcessing
+			report.Unfinished++
+		default:
+			report.Unfinished++
+			continue
+		}
+		transitions = append(transitions, storage.OrderTransition{Order: order, From: storage.StatusNew})
+	}
+	if err := st.UpdateBalanceFromOrders(ctx, transitions); err != nil {
+		return fmt.Errorf("update orders of %s: %w", login, err)
+	}
+
+	for i := 0; i < cfg.Withdrawals && balance > 0; i++ {
+		// Each withdrawal takes up to an even share of what is left.
+		sum := money.Amount(1 + rand.Int63n(int64(balance)/int64(cfg.Withdrawals-i)+1))
+		if sum > balance {
+			sum = balance
+		}
+		if err := st.Withdraw(ctx, user.ID, loadtest.GenerateOrderNumber(orderNumberLength), sum, ""); err != nil {
+			return fmt.Errorf("withdraw for %s: %w", login, err)
+		}
+		balance -= sum
+		report.Withdrawals++
+	}
+
+	if err := backdater.BackdateActivity(ctx, user.ID, time.Now().Add(-cfg.History)); err != nil {
+		return fmt.Errorf("backdate %s: %w", login, err)
+	}
+	return nil
+}
+
+// addOrder uploads a new random order, drawing another number on the rare
+// collision with an existing one.
+func addOrder(ctx context.Context, st storage.AppStorage, merchantID, userID uuid.UUID) (string, error) {
+	for {
+		number := loadtest.GenerateOrderNumber(orderNumberLength)
+		err := st.AddOrder(ctx, merchantID, userID, number)
+		if err == nil {
+			return number, nil
+		}
+		if !errors.Is(err, storage.ErrDuplicateOrder) {
+			return "", fmt.Errorf("add order %s: %w", number, err)
+		}
+	}
+}
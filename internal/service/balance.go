@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/rates"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+type Balance struct {
+	*storage.BalanceInfo
+	// Value is the monetary equivalent of the current balance, set only when
+	// exchange rates are configured.
+	Value    money.Amount
+	Currency string
+}
+
+type BalanceService struct {
+	storage storage.AppStorage
+	rates   *rates.Converter
+	// strict only allows withdrawals against orders the merchant has
+	// registered as being placed.
+	strict bool
+}
+
+func NewBalanceService(storage storage.AppStorage, rates *rates.Converter, strict bool) *BalanceService {
+	return &BalanceService{
+		storage: storage,
+		rates:   rates,
+		strict:  strict,
+	}
+}
+
+func (s *BalanceService) Balance(ctx context.Context, userID uuid.UUID) (*Balance, error) {
+	info, err := s.storage.GetBalance(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := &Balance{BalanceInfo: info}
+	if s.rates != nil {
+		balance.Value, balance.Currency = s.rates.Convert(info.Current)
+	}
+
+	return balance, nil
+}
+
+// Converts reports whether balances carry a monetary value.
+func (s *BalanceService) Converts() bool {
+	return s.rates != nil
+}
+
+// Withdraw spends points on an order. Repeating a withdrawal with the same
+// non-empty idempotency key has no further effect. In strict mode an order
+// that isn't being placed is reported as ErrOrderNotPlaced.
+func (s *BalanceService) Withdraw(ctx context.Context, userID uuid.UUID, orderNumber string, sum money.Amount, idempotencyKey string) error {
+	if err := validate.CheckOrderNumber(orderNumber); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidOrderNumber, err)
+	}
+	if !validate.Amount(sum.Float64()) {
+		return ErrInvalidAmount
+	}
+	if len(idempotencyKey) > MaxIdempotencyKeyLength {
+		return ErrInvalidIdempotencyKey
+	}
+	if s.strict {
+		placed, err := s.storage.IsOrderPlaced(ctx, userID, orderNumber)
+		if err != nil {
+			return err
+		}
+		if !placed {
+			return ErrOrderNotPlaced
+		}
+	}
+
+	return s.storage.Withdraw(ctx, userID, orderNumber, sum, idempotencyKey)
+}
+
+// Stats returns the user's totals, with EarnedSince counted from the start
+// of the current month in UTC.
+func (s *BalanceService) Stats(ctx context.Context, userID uuid.UUID) (*storage.UserStats, error) {
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return s.storage.GetUserStats(ctx, userID, monthStart)
+}
+
+func (s *BalanceService) Withdrawals(ctx context.Context, userID uuid.UUID) ([]storage.Withdrawal, error) {
+	return s.storage.GetWithdrawals(ctx, userID)
+}
+
+func (s *BalanceService) History(ctx context.Context, userID uuid.UUID) ([]storage.LedgerEntry, error) {
+	return s.storage.GetLedger(ctx, userID)
+}
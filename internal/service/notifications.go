@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/notify"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+const maxAddressLength = 2048
+
+type NotificationService struct {
+	storage storage.AppStorage
+}
+
+func NewNotificationService(storage storage.AppStorage) *NotificationService {
+	return &NotificationService{storage: storage}
+}
+
+// validEmail accepts a bare address such as user@example.com.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= maxAddressLength
+}
+
+// validWebhookURL accepts an http or https URL whose host isn't obviously
+// internal. Host names are checked again when the webhook is called, against
+// the address they resolve to then.
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 || len(raw) > maxAddressLength {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return notify.IsPublicAddr(ip)
+	}
+	return host != "localhost" && !strings.HasSuffix(host, ".localhost")
+}
+
+func (s *NotificationService) Preferences(ctx context.Context, userID uuid.UUID) (*storage.NotificationPreferences, error) {
+	return s.storage.GetNotificationPreferences(ctx, userID)
+}
+
+func (s *NotificationService) SetPreferences(ctx context.Context, prefs storage.NotificationPreferences) error {
+	if len(prefs.Email) != 0 && !validEmail(prefs.Email) {
+		return ErrInvalidEmail
+	}
+	if len(prefs.WebhookURL) != 0 && !validWebhookURL(prefs.WebhookURL) {
+		return ErrInvalidWebhookURL
+	}
+
+	return s.storage.SetNotificationPreferences(ctx, prefs)
+}
+
+func (s *NotificationService) DeletePreferences(ctx context.Context, userID uuid.UUID) error {
+	return s.storage.DeleteNotificationPreferences(ctx, userID)
+}
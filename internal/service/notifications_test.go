@@ -0,0 +1,26 @@
+package service
+
+import "testing"
+
+func TestValidWebhookURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://hooks.example.com/gophermart", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"ftp://hooks.example.com/", false},
+		{"https:///hook", false},
+		{"http://localhost:8080/hook", false},
+		{"http://api.LOCALHOST/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://10.0.0.5/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+	}
+	for _, tt := range tests {
+		if got := validWebhookURL(tt.url); got != tt.want {
+			t.Errorf("validWebhookURL(%q) = %t, want %t", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/fiscal"
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+type OrderService struct {
+	logger  *zap.Logger
+	storage storage.AppStorage
+	fiscal  fiscal.Validator
+}
+
+func NewOrderService(logger *zap.Logger, storage storage.AppStorage, fiscal fiscal.Validator) *OrderService {
+	return &OrderService{
+		logger:  logger,
+		storage: storage,
+		fiscal:  fiscal,
+	}
+}
+
+// Upload registers an order for accrual. It returns storage.ErrOrderAlreadyPlaced
+// if the user has already uploaded it and storage.ErrDuplicateOrder if another
+// user of the merchant has. With a fiscal validator the receipt is checked first, so a
+// rejected order is never stored and can't reach accrual.
+func (s *OrderService) Upload(ctx context.Context, merchantID, userID uuid.UUID, orderNumber string) error {
+	if err := validate.CheckOrderNumber(orderNumber); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidOrderNumber, err)
+	}
+
+	var result *fiscal.Result
+	if s.fiscal != nil {
+		result = s.checkReceipt(ctx, orderNumber)
+		if result != nil && !result.Valid {
+			return ErrReceiptRejected
+		}
+	}
+
+	if err := s.storage.AddOrder(ctx, merchantID, userID, orderNumber); err != nil {
+		return err
+	}
+
+	if result != nil {
+		if err := s.storage.SetOrderFiscalStatus(ctx, orderNumber, result.Status(), result.Reason, false); err != nil {
+			requestid.Logger(ctx, s.logger).Error("failed to save fiscal status", zap.String("order_id", orderNumber), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// checkReceipt returns nil if the fiscal API fails. That is not fatal: the
+// order is passed on to accrual unchecked.
+func (s *OrderService) checkReceipt(ctx context.Context, orderNumber string) *fiscal.Result {
+	result, err := s.fiscal.Validate(ctx, orderNumber)
+	if err != nil {
+		requestid.Logger(ctx, s.logger).Error("failed to validate receipt", zap.String("order_id", orderNumber), zap.Error(err))
+		return nil
+	}
+
+	if !result.Valid {
+		requestid.Logger(ctx, s.logger).Info("receipt rejected", zap.String("order_id", orderNumber), zap.String("reason", result.Reason))
+	}
+
+	return result
+}
+
+func (s *OrderService) List(ctx context.Context, userID uuid.UUID) ([]storage.Order, error) {
+	return s.storage.GetOrders(ctx, userID)
+}
+
+// Version identifies the current state of the user's orders without reading
+// them.
+func (s *OrderService) Version(ctx context.Context, userID uuid.UUID) (storage.OrdersVersion, error) {
+	return s.storage.GetOrdersVersion(ctx, userID)
+}
+
+// Get returns storage.ErrNoSuchOrder both for unknown orders and for orders
+// uploaded by another user.
+func (s *OrderService) Get(ctx context.Context, userID uuid.UUID, orderNumber string) (*storage.Order, error) {
+	return s.storage.GetOrderByNumber(ctx, userID, orderNumber)
+}
+
+func (s *OrderService) ListPage(ctx context.Context, userID uuid.UUID, filter storage.OrdersFilter, cursor string, limit int) (*storage.OrdersPage, error) {
+	if err := validateFilter(filter); err != nil {
+		return nil, err
+	}
+	return s.storage.GetOrdersPage(ctx, userID, filter, cursor, limit)
+}
+
+func validateFilter(filter storage.OrdersFilter) error {
+	for _, status := range filter.Statuses {
+		switch status {
+		case storage.StatusNew, storage.StatusProcessing, storage.StatusInvalid, storage.StatusProcessed:
+		default:
+			return fmt.Errorf("%w: unknown status %q", ErrInvalidFilter, status)
+		}
+	}
+
+	switch filter.Sort {
+	case "", storage.OrdersSortUploadedAt, storage.OrdersSortAccrual:
+	default:
+		return fmt.Errorf("%w: unknown sort %q", ErrInvalidFilter, filter.Sort)
+	}
+
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalidFilter)
+	}
+
+	return nil
+}
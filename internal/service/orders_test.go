@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/fiscal"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+type fiscalStub struct {
+	result *fiscal.Result
+	err    error
+}
+
+func (f fiscalStub) Validate(context.Context, string) (*fiscal.Result, error) {
+	return f.result, f.err
+}
+
+// ordersStub records the orders stored and their fiscal statuses. Other
+// AppStorage methods are not used by Upload and panic.
+type ordersStub struct {
+	storage.AppStorage
+	added    []string
+	statuses map[string]string
+}
+
+func (s *ordersStub) AddOrder(_ context.Context, _, _ uuid.UUID, orderNumber string) error {
+	s.added = append(s.added, orderNumber)
+	return nil
+}
+
+func (s *ordersStub) SetOrderFiscalStatus(_ context.Context, orderNumber string, fiscalStatus string, _ string, _ bool) error {
+	if s.statuses == nil {
+		s.statuses = make(map[string]string)
+	}
+	s.statuses[orderNumber] = fiscalStatus
+	return nil
+}
+
+func TestUploadFiscalCheck(t *testing.T) {
+	const order = "12345678903"
+
+	tests := []struct {
+		name      string
+		validator fiscalStub
+		wantErr   error
+		wantAdded bool
+		wantState string
+	}{
+		{
+			name:      "valid receipt",
+			validator: fiscalStub{result: &fiscal.Result{Valid: true}},
+			wantAdded: true,
+			wantState: fiscal.StatusValid,
+		},
+		{
+			name:      "rejected receipt is not stored",
+			validator: fiscalStub{result: &fiscal.Result{Valid: false, Reason: "receipt not found"}},
+			wantErr:   ErrReceiptRejected,
+		},
+		{
+			name:      "fiscal API failure passes the order on unchecked",
+			validator: fiscalStub{err: errors.New("connection refused")},
+			wantAdded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &ordersStub{}
+			s := NewOrderService(zap.NewNop(), st, tt.validator)
+
+			err := s.Upload(context.Background(), storage.DefaultMerchantID, uuid.New(), order)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Upload() error = %v, want %v", err, tt.wantErr)
+			}
+			if added := len(st.added) != 0; added != tt.wantAdded {
+				t.Errorf("order stored = %t, want %t", added, tt.wantAdded)
+			}
+			if got := st.statuses[order]; got != tt.wantState {
+				t.Errorf("fiscal status = %q, want %q", got, tt.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+// Package service holds the business rules of the loyalty system. Handlers
+// and other transports parse their input, call a service and map its errors;
+// services validate the input and talk to storage.
+package service
+
+import "errors"
+
+const MaxIdempotencyKeyLength = 255
+
+var (
+	ErrInvalidOrderNumber    = errors.New("invalid order number")
+	ErrInvalidAmount         = errors.New("invalid amount")
+	ErrInvalidIdempotencyKey = errors.New("idempotency key is too long")
+	ErrReceiptRejected       = errors.New("receipt rejected by fiscal check")
+	ErrInvalidCredentials    = errors.New("invalid login or password")
+	ErrInvalidFilter         = errors.New("invalid orders filter")
+	ErrInvalidEmail          = errors.New("invalid e-mail address")
+	ErrInvalidWebhookURL     = errors.New("invalid webhook URL")
+	ErrInvalidDisplayName    = errors.New("invalid display name")
+	ErrInvalidRole           = errors.New("invalid role")
+	ErrOrderNotPlaced        = errors.New("withdrawal order is not being placed")
+)
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+type UserService struct {
+	storage   storage.AppStorage
+	passwords validate.PasswordPolicy
+}
+
+func NewUserService(storage storage.AppStorage, passwords validate.PasswordPolicy) *UserService {
+	return &UserService{
+		storage:   storage,
+		passwords: passwords,
+	}
+}
+
+// Register creates a user. A password rejected by the policy is reported as
+// a *validate.PasswordError.
+func (s *UserService) Register(ctx context.Context, merchantID uuid.UUID, login, password string) (*storage.UserAuthorization, error) {
+	if err := s.passwords.Check(password); err != nil {
+		return nil, err
+	}
+
+	if err := s.storage.AddUser(ctx, &storage.UserAuthorization{
+		MerchantID: merchantID,
+		Login:      login,
+		Password:   []byte(password),
+	}); err != nil {
+		return nil, err
+	}
+
+	return s.storage.GetUserAuthInfo(ctx, merchantID, login)
+}
+
+// CreateUser registers a user with the given role. The user isn't created
+// if the role can't be set.
+func (s *UserService) CreateUser(ctx context.Context, merchantID uuid.UUID, login, password, role string) (*storage.UserAuthorization, error) {
+	if !storage.ValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	var user *storage.UserAuthorization
+	err := s.storage.WithinTx(ctx, func(st storage.AppStorage) error {
+		var err error
+		if user, err = NewUserService(st, s.passwords).Register(ctx, merchantID, login, password); err != nil {
+			return err
+		}
+		if role == storage.RoleUser {
+			return nil
+		}
+		user.Role = role
+		return st.SetUserRole(ctx, user.ID, role)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+const MaxDisplayNameLength = 100
+
+// ProfileUpdate changes the profile fields that are not nil and, when
+// NewPassword is set, the password. A password change requires the current
+// password.
+type ProfileUpdate struct {
+	DisplayName     *string
+	Email           *string
+	CurrentPassword string
+	NewPassword     string
+}
+
+func (s *UserService) Profile(ctx context.Context, userID uuid.UUID) (*storage.UserProfile, error) {
+	return s.storage.GetUserProfile(ctx, userID)
+}
+
+// UpdateProfile applies update and returns the resulting profile. A wrong
+// current password is reported as ErrInvalidCredentials and a new password
+// rejected by the policy as a *validate.PasswordError; nothing is changed in
+// either case.
+func (s *UserService) UpdateProfile(ctx context.Context, userID uuid.UUID, update ProfileUpdate) (*storage.UserProfile, error) {
+	if update.DisplayName != nil && !validDisplayName(*update.DisplayName) {
+		return nil, ErrInvalidDisplayName
+	}
+	if update.Email != nil && len(*update.Email) != 0 && !validEmail(*update.Email) {
+		return nil, ErrInvalidEmail
+	}
+
+	if len(update.NewPassword) != 0 {
+		user, err := s.storage.GetUserAuthInfoByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(user.Password, []byte(update.CurrentPassword)) {
+			return nil, ErrInvalidCredentials
+		}
+		if err := s.passwords.Check(update.NewPassword); err != nil {
+			return nil, err
+		}
+		if err := s.storage.ChangePassword(ctx, userID, []byte(update.NewPassword), time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.DisplayName == nil && update.Email == nil {
+		return s.storage.GetUserProfile(ctx, userID)
+	}
+	return s.storage.UpdateUserProfile(ctx, userID, storage.UserProfileUpdate{
+		DisplayName: update.DisplayName,
+		Email:       update.Email,
+	})
+}
+
+func validDisplayName(name string) bool {
+	if !utf8.ValidString(name) || utf8.RuneCountInString(name) > MaxDisplayNameLength {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Export is everything the service stores about a user.
+type Export struct {
+	ID          uuid.UUID             `json:"id"`
+	Login       string                `json:"login"`
+	DisplayName string                `json:"display_name"`
+	Email       string                `json:"email"`
+	CreatedAt   time.Time             `json:"created_at"`
+	Balance     *storage.BalanceInfo  `json:"balance"`
+	Orders      []storage.Order       `json:"orders"`
+	Withdrawals []storage.Withdrawal  `json:"withdrawals"`
+	History     []storage.LedgerEntry `json:"history"`
+
+	Notifications *storage.NotificationPreferences `json:"notifications"`
+}
+
+func (s *UserService) Export(ctx context.Context, userID uuid.UUID) (*Export, error) {
+	user, err := s.storage.GetUserAuthInfoByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := s.storage.GetUserProfile(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &Export{
+		ID:          user.ID,
+		Login:       user.Login,
+		DisplayName: profile.DisplayName,
+		Email:       profile.Email,
+		CreatedAt:   user.CreatedAt,
+	}
+	if export.Balance, err = s.storage.GetBalance(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Orders, err = s.storage.GetOrders(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Withdrawals, err = s.storage.GetWithdrawals(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.History, err = s.storage.GetLedger(ctx, userID); err != nil {
+		return nil, err
+	}
+	if export.Notifications, err = s.storage.GetNotificationPreferences(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+func (s *UserService) Delete(ctx context.Context, userID uuid.UUID) error {
+	return s.storage.DeleteUser(ctx, userID)
+}
+
+func (s *UserService) Authenticate(ctx context.Context, merchantID uuid.UUID, login, password string) (*storage.UserAuthorization, error) {
+	user, err := s.storage.GetUserAuthInfo(ctx, merchantID, login)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	if !bytes.Equal(user.Password, []byte(password)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func processed(userID uuid.UUID, orderNumber string, accrual money.Amount) storage.OrderTransition {
+	return storage.OrderTransition{
+		Order: storage.Order{
+			UserID:      userID,
+			OrderNumber: orderNumber,
+			Status:      storage.StatusProcessed,
+			Accrual:     accrual,
+		},
+		From: storage.StatusNew,
+	}
+}
+
+func orderStatus(t *testing.T, st storage.AppStorage, orderNumber string) string {
+	t.Helper()
+
+	order, err := st.GetOrder(context.Background(), orderNumber)
+	if err != nil {
+		t.Fatalf("GetOrder(%s) error = %v", orderNumber, err)
+	}
+	return order.Status
+}
+
+// A poller that crashes after the commit but before it forgets the results
+// applies them again on restart.
+func TestAccrualReplayCreditsOnce(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "replayed")
+		for _, order := range []string{"79927398713", "12345678903"} {
+			if err := st.AddOrder(ctx, storage.DefaultMerchantID, userID, order); err != nil {
+				t.Fatalf("AddOrder(%s) error = %v", order, err)
+			}
+		}
+
+		batch := []storage.OrderTransition{
+			processed(userID, "79927398713", 500),
+			processed(userID, "12345678903", 250),
+		}
+		for i := 0; i < 3; i++ {
+			if err := st.UpdateBalanceFromOrders(ctx, batch); err != nil {
+				t.Fatalf("UpdateBalanceFromOrders() #%d error = %v", i+1, err)
+			}
+		}
+
+		if info := balance(t, st, userID); info.Current != 750 {
+			t.Errorf("balance = %s, want 7.5", info.Current)
+		}
+		for _, tr := range batch {
+			if status := orderStatus(t, st, tr.OrderNumber); status != storage.StatusProcessed {
+				t.Errorf("order %s is %s, want %s", tr.OrderNumber, status, storage.StatusProcessed)
+			}
+		}
+	})
+}
+
+// A crash before the commit leaves neither the status nor the credit behind,
+// so the order is polled again and credited exactly once.
+func TestAccrualCrashBeforeCommit(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "crashed")
+		if err := st.AddOrder(ctx, storage.DefaultMerchantID, userID, "79927398713"); err != nil {
+			t.Fatalf("AddOrder() error = %v", err)
+		}
+		batch := []storage.OrderTransition{processed(userID, "79927398713", 500)}
+
+		errCrash := errors.New("crash")
+		err := st.WithinTx(ctx, func(tx storage.AppStorage) error {
+			if err := tx.UpdateBalanceFromOrders(ctx, batch); err != nil {
+				return err
+			}
+			return errCrash
+		})
+		if !errors.Is(err, errCrash) {
+			t.Fatalf("WithinTx() error = %v, want %v", err, errCrash)
+		}
+
+		if info := balance(t, st, userID); info.Current != 0 {
+			t.Errorf("balance after the crash = %s, want 0", info.Current)
+		}
+		if status := orderStatus(t, st, "79927398713"); status != storage.StatusNew {
+			t.Errorf("order after the crash is %s, want %s", status, storage.StatusNew)
+		}
+
+		if err := st.UpdateBalanceFromOrders(ctx, batch); err != nil {
+			t.Fatalf("UpdateBalanceFromOrders() error = %v", err)
+		}
+		if info := balance(t, st, userID); info.Current != 500 {
+			t.Errorf("balance after the retry = %s, want 5", info.Current)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestRevokedTokens(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		jti := uuid.New()
+
+		for i := 0; i < 2; i++ {
+			if err := st.RevokeToken(ctx, jti, time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("RevokeToken() #%d error = %v", i+1, err)
+			}
+		}
+		for _, tt := range []struct {
+			jti  uuid.UUID
+			want bool
+		}{
+			{jti, true},
+			{uuid.New(), false},
+		} {
+			revoked, err := st.IsTokenRevoked(ctx, tt.jti)
+			if err != nil {
+				t.Fatalf("IsTokenRevoked() error = %v", err)
+			}
+			if revoked != tt.want {
+				t.Errorf("IsTokenRevoked(%s) = %t, want %t", tt.jti, revoked, tt.want)
+			}
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "erin")
+
+		session := &storage.Session{
+			ID:        uuid.New(),
+			UserID:    userID,
+			JTI:       uuid.New(),
+			UserAgent: "curl/8.0",
+			IP:        "192.0.2.1",
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		if err := st.StartSession(ctx, session); err != nil {
+			t.Fatalf("StartSession() error = %v", err)
+		}
+		if session.CreatedAt.IsZero() || session.LastSeenAt.IsZero() {
+			t.Errorf("StartSession() left %+v", session)
+		}
+		if err := st.AddRefreshToken(ctx, "refresh-1", userID, session.ID, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("AddRefreshToken() error = %v", err)
+		}
+
+		gotUser, gotSession, err := st.ConsumeRefreshToken(ctx, "refresh-1")
+		if err != nil {
+			t.Fatalf("ConsumeRefreshToken() error = %v", err)
+		}
+		if gotUser != userID || gotSession != session.ID {
+			t.Errorf("ConsumeRefreshToken() = %s, %s, want %s, %s", gotUser, gotSession, userID, session.ID)
+		}
+		if _, _, err := st.ConsumeRefreshToken(ctx, "refresh-1"); !errors.Is(err, storage.ErrNoSuchToken) {
+			t.Errorf("ConsumeRefreshToken() twice error = %v, want %v", err, storage.ErrNoSuchToken)
+		}
+
+		if err := st.AddRefreshToken(ctx, "expired", userID, session.ID, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatalf("AddRefreshToken() error = %v", err)
+		}
+		if _, _, err := st.ConsumeRefreshToken(ctx, "expired"); !errors.Is(err, storage.ErrNoSuchToken) {
+			t.Errorf("ConsumeRefreshToken() of an expired token error = %v, want %v", err, storage.ErrNoSuchToken)
+		}
+
+		jti := uuid.New()
+		if err := st.RenewSession(ctx, session.ID, jti, time.Now().Add(2*time.Hour)); err != nil {
+			t.Fatalf("RenewSession() error = %v", err)
+		}
+		if err := st.TouchSession(ctx, userID, session.ID); err != nil {
+			t.Fatalf("TouchSession() error = %v", err)
+		}
+		if err := st.TouchSession(ctx, uuid.New(), session.ID); !errors.Is(err, storage.ErrNoSuchSession) {
+			t.Errorf("TouchSession() of another user error = %v, want %v", err, storage.ErrNoSuchSession)
+		}
+
+		sessions, err := st.GetSessions(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetSessions() error = %v", err)
+		}
+		if len(sessions) != 1 || sessions[0].ID != session.ID || sessions[0].JTI != jti || sessions[0].UserAgent != "curl/8.0" {
+			t.Fatalf("GetSessions() = %+v, want the renewed session", sessions)
+		}
+
+		if err := st.AddRefreshToken(ctx, "refresh-2", userID, session.ID, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("AddRefreshToken() error = %v", err)
+		}
+		if err := st.RevokeSession(ctx, userID, session.ID); err != nil {
+			t.Fatalf("RevokeSession() error = %v", err)
+		}
+		if err := st.RevokeSession(ctx, userID, session.ID); !errors.Is(err, storage.ErrNoSuchSession) {
+			t.Errorf("RevokeSession() twice error = %v, want %v", err, storage.ErrNoSuchSession)
+		}
+		if _, _, err := st.ConsumeRefreshToken(ctx, "refresh-2"); !errors.Is(err, storage.ErrNoSuchToken) {
+			t.Errorf("ConsumeRefreshToken() after the session was revoked error = %v, want %v", err, storage.ErrNoSuchToken)
+		}
+		if err := st.RenewSession(ctx, session.ID, uuid.New(), time.Now().Add(time.Hour)); !errors.Is(err, storage.ErrNoSuchSession) {
+			t.Errorf("RenewSession() of a revoked session error = %v, want %v", err, storage.ErrNoSuchSession)
+		}
+		if sessions, _ := st.GetSessions(ctx, userID); len(sessions) != 0 {
+			t.Errorf("GetSessions() after revoking = %+v, want none", sessions)
+		}
+	})
+}
+
+func TestLoginLockout(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		const key = "login:frank"
+
+		for want := 1; want <= 3; want++ {
+			failures, err := st.RecordLoginFailure(ctx, key, time.Now().Add(-time.Hour))
+			if err != nil {
+				t.Fatalf("RecordLoginFailure() error = %v", err)
+			}
+			if failures != want {
+				t.Errorf("RecordLoginFailure() = %d, want %d", failures, want)
+			}
+		}
+
+		until, err := st.GetLoginLock(ctx, key)
+		if err != nil || !until.IsZero() {
+			t.Errorf("GetLoginLock() before locking = %s, %v, want no lock", until, err)
+		}
+
+		lockedUntil := time.Now().Add(time.Minute).Truncate(time.Second)
+		if err := st.LockLogin(ctx, key, lockedUntil); err != nil {
+			t.Fatalf("LockLogin() error = %v", err)
+		}
+		until, err = st.GetLoginLock(ctx, key)
+		if err != nil || !until.Equal(lockedUntil) {
+			t.Errorf("GetLoginLock() = %s, %v, want %s", until, err, lockedUntil)
+		}
+
+		if err := st.ResetLoginFailures(ctx, key); err != nil {
+			t.Fatalf("ResetLoginFailures() error = %v", err)
+		}
+		if until, _ := st.GetLoginLock(ctx, key); !until.IsZero() {
+			t.Errorf("GetLoginLock() after the reset = %s, want no lock", until)
+		}
+		if failures, _ := st.RecordLoginFailure(ctx, key, time.Now().Add(-time.Hour)); failures != 1 {
+			t.Errorf("RecordLoginFailure() after the reset = %d, want 1", failures)
+		}
+		st.RecordLoginFailure(ctx, key, time.Now().Add(-time.Hour))
+		if failures, _ := st.RecordLoginFailure(ctx, key, time.Now().Add(time.Second)); failures != 1 {
+			t.Errorf("RecordLoginFailure() after a quiet window = %d, want 1", failures)
+		}
+	})
+}
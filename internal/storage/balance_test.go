@@ -0,0 +1,269 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestWithdraw(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "sybil")
+		if err := st.AddBalance(ctx, userID, 1000); err != nil {
+			t.Fatalf("AddBalance() error = %v", err)
+		}
+
+		steps := []struct {
+			name    string
+			order   string
+			sum     money.Amount
+			key     string
+			wantErr error
+		}{
+			{"first", "79927398713", 300, "key-1", nil},
+			{"retried with its key", "79927398713", 300, "key-1", nil},
+			{"key reused for another sum", "79927398713", 400, "key-1", storage.ErrIdempotencyKeyUsed},
+			{"more than the balance", "12345678903", 800, "", storage.ErrNotEnoughBalance},
+			{"order used twice", "79927398713", 100, "", storage.ErrDuplicateOrder},
+			{"second", "12345678903", 200, "key-2", nil},
+		}
+		for _, step := range steps {
+			err := st.Withdraw(ctx, userID, step.order, step.sum, step.key)
+			if !errors.Is(err, step.wantErr) {
+				t.Errorf("Withdraw() %s error = %v, want %v", step.name, err, step.wantErr)
+			}
+		}
+
+		if info := balance(t, st, userID); info.Current != 500 || info.Withdrawn != 500 {
+			t.Errorf("balance = %s current, %s withdrawn, want 5 and 5", info.Current, info.Withdrawn)
+		}
+		withdrawals, err := st.GetWithdrawals(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetWithdrawals() error = %v", err)
+		}
+		if len(withdrawals) != 2 {
+			t.Errorf("GetWithdrawals() = %+v, want 2 withdrawals", withdrawals)
+		}
+
+		now := time.Now()
+		period, err := st.GetWithdrawalsForPeriod(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("GetWithdrawalsForPeriod() error = %v", err)
+		}
+		if len(period) != 2 || period[0].UserID != userID {
+			t.Errorf("GetWithdrawalsForPeriod() = %+v, want the user's 2 withdrawals", period)
+		}
+		if earlier, _ := st.GetWithdrawalsForPeriod(ctx, now.Add(-2*time.Hour), now.Add(-time.Hour)); len(earlier) != 0 {
+			t.Errorf("GetWithdrawalsForPeriod() of an earlier hour = %+v, want none", earlier)
+		}
+
+		ledger, err := st.GetLedger(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetLedger() error = %v", err)
+		}
+		wantLedger := []storage.LedgerEntry{
+			{Kind: storage.LedgerCredit, Amount: 1000, Balance: 1000},
+			{Kind: storage.LedgerWithdrawal, Reference: "79927398713", Amount: -300, Balance: 700},
+			{Kind: storage.LedgerWithdrawal, Reference: "12345678903", Amount: -200, Balance: 500},
+		}
+		if len(ledger) != len(wantLedger) {
+			t.Fatalf("GetLedger() = %+v, want %+v", ledger, wantLedger)
+		}
+		for i, want := range wantLedger {
+			got := ledger[i]
+			got.CreatedAt = time.Time{}
+			if got != want {
+				t.Errorf("ledger[%d] = %+v, want %+v", i, got, want)
+			}
+		}
+
+		audit, err := st.GetBalanceAudit(ctx, storage.BalanceAuditFilter{UserID: userID, Reference: "12345678903", Limit: 10})
+		if err != nil {
+			t.Fatalf("GetBalanceAudit() error = %v", err)
+		}
+		if len(audit) != 1 || audit[0].CurrentBefore != 700 || audit[0].CurrentAfter != 500 || audit[0].WithdrawnBefore != 300 || audit[0].WithdrawnAfter != 500 {
+			t.Errorf("GetBalanceAudit() = %+v, want the second withdrawal", audit)
+		}
+	})
+}
+
+func TestAdjustBalance(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "trent")
+
+		info, err := st.AdjustBalance(ctx, storage.BalanceAdjustment{UserID: userID, Amount: 500, ReasonCode: storage.AdjustmentGoodwill, Reason: "late delivery", Operator: "admin"})
+		if err != nil {
+			t.Fatalf("AdjustBalance() error = %v", err)
+		}
+		if info.Current != 500 || info.UpdatedAt.IsZero() {
+			t.Errorf("AdjustBalance() = %+v, want 5 current", info)
+		}
+
+		_, err = st.AdjustBalance(ctx, storage.BalanceAdjustment{UserID: userID, Amount: -600, ReasonCode: storage.AdjustmentFraud, Operator: "admin"})
+		if !errors.Is(err, storage.ErrNotEnoughBalance) {
+			t.Errorf("AdjustBalance() below zero error = %v, want %v", err, storage.ErrNotEnoughBalance)
+		}
+		info, err = st.AdjustBalance(ctx, storage.BalanceAdjustment{UserID: userID, Amount: -200, ReasonCode: storage.AdjustmentCorrection, Operator: "admin"})
+		if err != nil {
+			t.Fatalf("AdjustBalance() error = %v", err)
+		}
+		if info.Current != 300 {
+			t.Errorf("AdjustBalance() current = %s, want 3", info.Current)
+		}
+
+		ledger, _ := st.GetLedger(ctx, userID)
+		if len(ledger) != 2 || ledger[1].Kind != storage.LedgerAdjustment || ledger[1].Reference != storage.AdjustmentCorrection || ledger[1].Amount != -200 {
+			t.Errorf("GetLedger() = %+v, want two adjustments", ledger)
+		}
+		audit, _ := st.GetBalanceAudit(ctx, storage.BalanceAuditFilter{UserID: userID, Limit: 1})
+		if len(audit) != 1 || audit[0].Source != storage.LedgerAdjustment || audit[0].CurrentBefore != 500 || audit[0].CurrentAfter != 300 {
+			t.Errorf("latest audit entry = %+v, want the correction", audit)
+		}
+	})
+}
+
+func TestBalanceAuditByMerchant(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		merchant := &storage.Merchant{Name: "Coffee"}
+		if err := st.AddMerchant(ctx, merchant, "key-hash"); err != nil {
+			t.Fatalf("AddMerchant() error = %v", err)
+		}
+		if err := st.AddUser(ctx, &storage.UserAuthorization{MerchantID: merchant.ID, Login: "ivan", Password: []byte("hash")}); err != nil {
+			t.Fatalf("AddUser() error = %v", err)
+		}
+		merchantUser, _ := st.GetUserAuthInfo(ctx, merchant.ID, "ivan")
+		defaultUser := addUser(t, st, "ivan")
+		for _, userID := range []uuid.UUID{merchantUser.ID, defaultUser} {
+			if err := st.AddBalance(ctx, userID, 100); err != nil {
+				t.Fatalf("AddBalance() error = %v", err)
+			}
+		}
+
+		for _, merchantID := range []uuid.UUID{merchant.ID, storage.DefaultMerchantID} {
+			audit, err := st.GetBalanceAudit(ctx, storage.BalanceAuditFilter{MerchantID: uuid.NullUUID{UUID: merchantID, Valid: true}, Limit: 10})
+			if err != nil {
+				t.Fatalf("GetBalanceAudit() error = %v", err)
+			}
+			if len(audit) != 1 {
+				t.Errorf("GetBalanceAudit() of merchant %s = %+v, want the entry of its user", merchantID, audit)
+			}
+		}
+		if audit, _ := st.GetBalanceAudit(ctx, storage.BalanceAuditFilter{UserID: defaultUser, MerchantID: uuid.NullUUID{UUID: merchant.ID, Valid: true}, Limit: 10}); len(audit) != 0 {
+			t.Errorf("GetBalanceAudit() of a user of another merchant = %+v, want none", audit)
+		}
+	})
+}
+
+func TestAccountingSummaryAndStats(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "uma")
+		addOrders(t, st, userID, "79927398713", "12345678903")
+		if err := st.UpdateBalanceFromOrders(ctx, []storage.OrderTransition{processed(userID, "79927398713", 500)}); err != nil {
+			t.Fatalf("UpdateBalanceFromOrders() error = %v", err)
+		}
+		if err := st.Withdraw(ctx, userID, "4561261212345467", 200, ""); err != nil {
+			t.Fatalf("Withdraw() error = %v", err)
+		}
+
+		now := time.Now()
+		summary, err := st.GetAccountingSummary(ctx, now.Add(-time.Hour), now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("GetAccountingSummary() error = %v", err)
+		}
+		if want := (storage.AccountingSummary{Accrued: 500, Redeemed: 200, Liability: 300}); *summary != want {
+			t.Errorf("GetAccountingSummary() = %+v, want %+v", summary, want)
+		}
+
+		stats, err := st.GetUserStats(ctx, userID, now.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("GetUserStats() error = %v", err)
+		}
+		if stats.TotalAccrued != 500 || stats.TotalWithdrawn != 200 || stats.EarnedSince != 500 {
+			t.Errorf("GetUserStats() = %+v", stats)
+		}
+		wantOrders := map[string]int{storage.StatusNew: 1, storage.StatusProcessing: 0, storage.StatusInvalid: 0, storage.StatusProcessed: 1}
+		for status, want := range wantOrders {
+			if got, ok := stats.OrdersByStatus[status]; !ok || got != want {
+				t.Errorf("%s orders = %d, want %d", status, got, want)
+			}
+		}
+		if stats, _ := st.GetUserStats(ctx, userID, now.Add(time.Hour)); stats.EarnedSince != 0 {
+			t.Errorf("earned since a later time = %s, want 0", stats.EarnedSince)
+		}
+	})
+}
+
+func TestBalanceDrift(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "victor")
+		if err := st.AddBalance(ctx, userID, 1000); err != nil {
+			t.Fatalf("AddBalance() error = %v", err)
+		}
+
+		if drifts, err := st.FindBalanceDrift(ctx); err != nil || len(drifts) != 0 {
+			t.Fatalf("FindBalanceDrift() = %+v, %v, want none", drifts, err)
+		}
+
+		// Correcting to an amount the records don't add up to makes a drift.
+		err := st.CorrectBalanceDrift(ctx, storage.BalanceDrift{UserID: userID, Current: 1000, ExpectedCurrent: 1200})
+		if err != nil {
+			t.Fatalf("CorrectBalanceDrift() error = %v", err)
+		}
+		drifts, err := st.FindBalanceDrift(ctx)
+		if err != nil {
+			t.Fatalf("FindBalanceDrift() error = %v", err)
+		}
+		if len(drifts) != 1 || drifts[0].UserID != userID || drifts[0].Current != 1200 || drifts[0].ExpectedCurrent != 1000 {
+			t.Fatalf("FindBalanceDrift() = %+v, want 12 instead of 10", drifts)
+		}
+		drift := drifts[0]
+
+		stale := drift
+		stale.Current = 1000
+		if err := st.CorrectBalanceDrift(ctx, stale); !errors.Is(err, storage.ErrBalanceChanged) {
+			t.Errorf("CorrectBalanceDrift() of a stale drift error = %v, want %v", err, storage.ErrBalanceChanged)
+		}
+		negative := drift
+		negative.ExpectedCurrent = -1
+		if err := st.CorrectBalanceDrift(ctx, negative); !errors.Is(err, storage.ErrNotEnoughBalance) {
+			t.Errorf("CorrectBalanceDrift() to a negative balance error = %v, want %v", err, storage.ErrNotEnoughBalance)
+		}
+
+		drift.Corrected = true
+		if err := st.CorrectBalanceDrift(ctx, drift); err != nil {
+			t.Fatalf("CorrectBalanceDrift() error = %v", err)
+		}
+		if info := balance(t, st, userID); info.Current != 1000 {
+			t.Errorf("balance after the correction = %s, want 10", info.Current)
+		}
+		if drifts, _ := st.FindBalanceDrift(ctx); len(drifts) != 0 {
+			t.Errorf("FindBalanceDrift() after the correction = %+v, want none", drifts)
+		}
+		ledger, _ := st.GetLedger(ctx, userID)
+		if last := ledger[len(ledger)-1]; last.Kind != storage.LedgerReconciliation || last.Amount != -200 || last.Balance != 1000 {
+			t.Errorf("last ledger entry = %+v, want the reconciliation", last)
+		}
+
+		if err := st.AddBalanceDrift(ctx, []storage.BalanceDrift{drift}); err != nil {
+			t.Fatalf("AddBalanceDrift() error = %v", err)
+		}
+		recorded, err := st.GetBalanceDrift(ctx, storage.BalanceDriftFilter{UserID: userID, Limit: 10})
+		if err != nil {
+			t.Fatalf("GetBalanceDrift() error = %v", err)
+		}
+		if len(recorded) != 1 || !recorded[0].Corrected || recorded[0].Current != 1200 || recorded[0].FoundAt.IsZero() {
+			t.Errorf("GetBalanceDrift() = %+v, want the corrected drift", recorded)
+		}
+	})
+}
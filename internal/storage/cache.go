@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+const DefaultCacheTTL = 30 * time.Second
+
+type CacheConfig struct {
+	// Size is the number of entries kept per cache; zero disables caching.
+	Size int
+	TTL  time.Duration
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// lru is a size-bounded cache whose entries also expire after a TTL.
+type lru[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+func newLRU[K comparable, V any](size int, ttl time.Duration) *lru[K, V] {
+	return &lru[K, V]{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[K]*list.Element, size),
+	}
+}
+
+func (c *lru[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[K, V])
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return zero, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lru[K, V]) put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (c *lru[K, V]) remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lru[K, V]) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[K]*list.Element, c.size)
+}
+
+// cachedStorage keeps user auth records, balances and merchants in process
+// memory. Balance changes made through it invalidate the cached balance; changes made
+// by other instances show up once the entry expires. Withdrawals always check
+// the balance in the database, so a stale entry can't cause an overdraft.
+type cachedStorage struct {
+	AppStorage
+	users    *lru[uuid.UUID, UserAuthorization]
+	balances *lru[uuid.UUID, BalanceInfo]
+	// merchants is keyed by "host:" or "key:" and the looked up value.
+	merchants *lru[string, Merchant]
+}
+
+// NewCachedStorage wraps st with a read cache, or returns st unchanged when
+// caching is disabled.
+func NewCachedStorage(st AppStorage, cfg CacheConfig) AppStorage {
+	if cfg.Size <= 0 {
+		return st
+	}
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultCacheTTL
+	}
+
+	return &cachedStorage{
+		AppStorage: st,
+		users:      newLRU[uuid.UUID, UserAuthorization](cfg.Size, cfg.TTL),
+		balances:   newLRU[uuid.UUID, BalanceInfo](cfg.Size, cfg.TTL),
+		merchants:  newLRU[string, Merchant](cfg.Size, cfg.TTL),
+	}
+}
+
+func (c *cachedStorage) GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID) (*UserAuthorization, error) {
+	if user, ok := c.users.get(userID); ok {
+		return &user, nil
+	}
+
+	user, err := c.AppStorage.GetUserAuthInfoByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	c.users.put(userID, *user)
+
+	return user, nil
+}
+
+func (c *cachedStorage) GetBalance(ctx context.Context, userID uuid.UUID) (*BalanceInfo, error) {
+	if balance, ok := c.balances.get(userID); ok {
+		return &balance, nil
+	}
+
+	balance, err := c.AppStorage.GetBalance(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	c.balances.put(userID, *balance)
+
+	return balance, nil
+}
+
+func (c *cachedStorage) GetMerchantByHost(ctx context.Context, host string) (*Merchant, error) {
+	return c.getMerchant("host:"+host, func() (*Merchant, error) {
+		return c.AppStorage.GetMerchantByHost(ctx, host)
+	})
+}
+
+func (c *cachedStorage) GetMerchantByAPIKey(ctx context.Context, apiKeyHash string) (*Merchant, error) {
+	return c.getMerchant("key:"+apiKeyHash, func() (*Merchant, error) {
+		return c.AppStorage.GetMerchantByAPIKey(ctx, apiKeyHash)
+	})
+}
+
+func (c *cachedStorage) getMerchant(key string, load func() (*Merchant, error)) (*Merchant, error) {
+	if merchant, ok := c.merchants.get(key); ok {
+		return &merchant, nil
+	}
+
+	merchant, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.merchants.put(key, *merchant)
+
+	return merchant, nil
+}
+
+func (c *cachedStorage) DeleteUser(ctx context.Context, userID uuid.UUID) error {
+	defer c.users.remove(userID)
+	return c.AppStorage.DeleteUser(ctx, userID)
+}
+
+func (c *cachedStorage) ChangePassword(ctx context.Context, userID uuid.UUID, password []byte, changedAt time.Time) error {
+	defer c.users.remove(userID)
+	return c.AppStorage.ChangePassword(ctx, userID, password, changedAt)
+}
+
+// WithinTx bypasses the cache for the transaction, so afterwards nothing
+// cached can be trusted to reflect its writes.
+func (c *cachedStorage) WithinTx(ctx context.Context, fn func(s AppStorage) error) error {
+	err := c.AppStorage.WithinTx(ctx, fn)
+	if err == nil {
+		c.users.purge()
+		c.balances.purge()
+		c.merchants.purge()
+	}
+	return err
+}
+
+func (c *cachedStorage) SetUserRole(ctx context.Context, userID uuid.UUID, role string) error {
+	defer c.users.remove(userID)
+	return c.AppStorage.SetUserRole(ctx, userID, role)
+}
+
+func (c *cachedStorage) Withdraw(ctx context.Context, userID uuid.UUID, order string, sum money.Amount, idempotencyKey string) error {
+	defer c.balances.remove(userID)
+	return c.AppStorage.Withdraw(ctx, userID, order, sum, idempotencyKey)
+}
+
+func (c *cachedStorage) AddBalance(ctx context.Context, userID uuid.UUID, amount money.Amount) error {
+	defer c.balances.remove(userID)
+	return c.AppStorage.AddBalance(ctx, userID, amount)
+}
+
+func (c *cachedStorage) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (*BalanceInfo, error) {
+	defer c.balances.remove(adjustment.UserID)
+	return c.AppStorage.AdjustBalance(ctx, adjustment)
+}
+
+// CorrectBalanceDrift is how the reconcile engine rewrites a balance, so the
+// corrected amount must not be hidden behind the cached drifted one.
+func (c *cachedStorage) CorrectBalanceDrift(ctx context.Context, drift BalanceDrift) error {
+	defer c.balances.remove(drift.UserID)
+	return c.AppStorage.CorrectBalanceDrift(ctx, drift)
+}
+
+func (c *cachedStorage) MergeUsers(ctx context.Context, merge AccountMerge) (*AccountMerge, error) {
+	defer func() {
+		c.users.remove(merge.SourceUserID)
+		c.balances.remove(merge.SourceUserID)
+		c.balances.remove(merge.TargetUserID)
+	}()
+	return c.AppStorage.MergeUsers(ctx, merge)
+}
+
+func (c *cachedStorage) UpdateBalanceFromOrders(ctx context.Context, transitions []OrderTransition) error {
+	defer func() {
+		for _, t := range transitions {
+			c.balances.remove(t.UserID)
+		}
+	}()
+	return c.AppStorage.UpdateBalanceFromOrders(ctx, transitions)
+}
+
+func (c *cachedStorage) ApplyRetention(ctx context.Context, target string, cutoff time.Time, dryRun bool) (int64, error) {
+	if !dryRun {
+		defer c.users.purge()
+		defer c.balances.purge()
+	}
+	return c.AppStorage.ApplyRetention(ctx, target, cutoff, dryRun)
+}
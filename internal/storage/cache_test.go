@@ -0,0 +1,30 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestCachedBalanceDriftCorrection(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		cached := storage.NewCachedStorage(st, storage.CacheConfig{Size: 10})
+		userID := addUser(t, cached, "victor")
+		if err := cached.AddBalance(ctx, userID, 1000); err != nil {
+			t.Fatalf("AddBalance() error = %v", err)
+		}
+		if info := balance(t, cached, userID); info.Current != 1000 {
+			t.Fatalf("cached balance = %s, want 10", info.Current)
+		}
+
+		err := cached.CorrectBalanceDrift(ctx, storage.BalanceDrift{UserID: userID, Current: 1000, ExpectedCurrent: 1200})
+		if err != nil {
+			t.Fatalf("CorrectBalanceDrift() error = %v", err)
+		}
+		if info := balance(t, cached, userID); info.Current != 1200 {
+			t.Errorf("cached balance after the correction = %s, want 12", info.Current)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+// encodeOrdersCursor keeps the sort key and the number of the last order on
+// the page. The sort key is the upload time or the accrual, depending on sort.
+func encodeOrdersCursor(sort string, last Order) string {
+	key := last.UploadedAt.UTC().Format(time.RFC3339Nano)
+	if sort == OrdersSortAccrual {
+		key = last.Accrual.String()
+	}
+
+	raw := key + "|" + last.OrderNumber
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeOrdersCursor(sort, cursor string) (interface{}, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", ErrBadCursor
+	}
+
+	key, orderNumber, found := strings.Cut(string(raw), "|")
+	if !found {
+		return nil, "", ErrBadCursor
+	}
+
+	if sort == OrdersSortAccrual {
+		accrual, err := money.Parse(key)
+		if err != nil {
+			return nil, "", ErrBadCursor
+		}
+		return accrual, orderNumber, nil
+	}
+
+	uploadedAt, err := time.Parse(time.RFC3339Nano, key)
+	if err != nil {
+		return nil, "", ErrBadCursor
+	}
+
+	return uploadedAt, orderNumber, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Error is returned by AppStorage methods on failure. It records the
+// operation that failed and classifies the cause, so callers can match both
+// the specific sentinel (e.g. ErrNoSuchUser) and the class (e.g. ErrNotFound)
+// with errors.Is.
+type Error struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+var errorKinds = map[error]error{
+	ErrNoSuchUser:         ErrNotFound,
+	ErrNoSuchOrder:        ErrNotFound,
+	ErrNoSuchToken:        ErrNotFound,
+	ErrNoSuchMerchant:     ErrNotFound,
+	ErrNoSuchSession:      ErrNotFound,
+	ErrDuplicateUser:      ErrConflict,
+	ErrDuplicateOrder:     ErrConflict,
+	ErrDuplicateMerchant:  ErrConflict,
+	ErrOrderAlreadyPlaced: ErrConflict,
+	ErrInvalidTransition:  ErrConflict,
+	ErrIdempotencyKeyUsed: ErrConflict,
+	ErrBalanceChanged:     ErrConflict,
+	ErrMergeIntoSelf:      ErrConflict,
+	ErrDifferentMerchants: ErrConflict,
+}
+
+func classify(err error) error {
+	for sentinel, kind := range errorKinds {
+		if errors.Is(err, sentinel) {
+			return kind
+		}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case UniqueViolationCode:
+			return ErrConflict
+		case CheckViolationCode, NotNullViolationCode, ForeignKeyViolationCode:
+			return ErrInvariant
+		}
+	}
+	code := sqliteCode(err)
+	switch code {
+	case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+		return ErrConflict
+	case sqlite3.SQLITE_CONSTRAINT_CHECK, sqlite3.SQLITE_CONSTRAINT_NOTNULL, sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY, sqlite3.SQLITE_CONSTRAINT_TRIGGER:
+		return ErrInvariant
+	}
+	// The primary result code is the low byte of an extended one.
+	if code&0xff == sqlite3.SQLITE_BUSY || code&0xff == sqlite3.SQLITE_LOCKED {
+		return ErrUnavailable
+	}
+	if IsTransient(err) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrUnavailable
+	}
+
+	return nil
+}
+
+// wrapError is deferred by AppStorage methods to wrap the returned error.
+func wrapError(op string, err *error) {
+	if *err == nil {
+		return
+	}
+	var se *Error
+	if errors.As(*err, &se) {
+		return
+	}
+	*err = &Error{Op: op, Kind: classify(*err), Err: *err}
+}
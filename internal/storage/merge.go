@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+func (p *pgxStorage) MergeUsers(ctx context.Context, merge AccountMerge) (_ *AccountMerge, err error) {
+	defer wrapError("MergeUsers", &err)
+
+	if merge.SourceUserID == merge.TargetUserID {
+		return nil, ErrMergeIntoSelf
+	}
+
+	var result *AccountMerge
+	err = p.retry(ctx, "MergeUsers", func() (err error) {
+		result, err = p.mergeUsers(ctx, merge)
+		return err
+	})
+	return result, err
+}
+
+// mergeUsers moves the orders before it reads the source's balance, so an
+// accrual result for one of them that commits meanwhile is either already in
+// that balance or credited to the target.
+func (p *pgxStorage) mergeUsers(ctx context.Context, merge AccountMerge) (*AccountMerge, error) {
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(p.ctx)
+
+	source, target := merge.SourceUserID, merge.TargetUserID
+
+	// Both users are locked in id order, so concurrent merges can't deadlock.
+	r, err := tx.Query(opCtx, `SELECT id, merchant_id FROM users WHERE id IN ($1, $2) AND deleted_at IS NULL ORDER BY id FOR UPDATE;`, source, target)
+	if err != nil {
+		return nil, err
+	}
+	merchants := make(map[uuid.UUID]uuid.UUID, 2)
+	for r.Next() {
+		var userID, merchantID uuid.UUID
+		if err := r.Scan(&userID, &merchantID); err != nil {
+			r.Close()
+			return nil, err
+		}
+		merchants[userID] = merchantID
+	}
+	r.Close()
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	if len(merchants) != 2 {
+		return nil, ErrNoSuchUser
+	}
+	if merchants[source] != merchants[target] {
+		return nil, ErrDifferentMerchants
+	}
+
+	tag, err := tx.Exec(opCtx, `UPDATE orders SET user_id = $2 WHERE user_id = $1;`, source, target)
+	if err != nil {
+		return nil, err
+	}
+	merge.Orders = int(tag.RowsAffected())
+
+	tag, err = tx.Exec(opCtx, `UPDATE withdrawal SET idempotency_key = NULL
+		WHERE user_id = $1 AND idempotency_key IN (SELECT idempotency_key FROM withdrawal WHERE user_id = $2 AND idempotency_key IS NOT NULL);`, source, target)
+	if err != nil {
+		return nil, err
+	}
+	merge.DroppedIdempotencyKeys = int(tag.RowsAffected())
+
+	tag, err = tx.Exec(opCtx, `UPDATE withdrawal SET user_id = $2 WHERE user_id = $1;`, source, target)
+	if err != nil {
+		return nil, err
+	}
+	merge.Withdrawals = int(tag.RowsAffected())
+
+	if _, err := tx.Exec(opCtx, `UPDATE balance_adjustments SET user_id = $2 WHERE user_id = $1;`, source, target); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(opCtx, `UPDATE ledger SET user_id = $2 WHERE user_id = $1;`, source, target); err != nil {
+		return nil, err
+	}
+
+	// The target keeps its own notification addresses if it has any.
+	_, err = tx.Exec(opCtx, `INSERT INTO notification_preferences (user_id, email, webhook_url, updated_at)
+		SELECT $2::UUID, email, webhook_url, updated_at FROM notification_preferences WHERE user_id = $1
+		ON CONFLICT (user_id) DO NOTHING;`, source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceBalance := BalanceInfo{}
+	err = tx.QueryRow(opCtx, `SELECT current, withdrawn FROM balance WHERE user_id = $1 FOR UPDATE;`, source).
+		Scan(&sourceBalance.Current, &sourceBalance.Withdrawn)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	if _, err := tx.Exec(opCtx, `UPDATE balance SET current = 0, withdrawn = 0, updated_at = NOW() WHERE user_id = $1;`, source); err != nil {
+		return nil, err
+	}
+
+	targetBalance := BalanceInfo{}
+	err = tx.QueryRow(opCtx, `UPDATE balance SET current = current + $1, withdrawn = withdrawn + $2, updated_at = NOW() WHERE user_id = $3 RETURNING current, withdrawn;`,
+		sourceBalance.Current, sourceBalance.Withdrawn, target).Scan(&targetBalance.Current, &targetBalance.Withdrawn)
+	if err != nil {
+		return nil, err
+	}
+
+	merge.ID = uuid.New()
+	merge.Current = sourceBalance.Current
+	merge.Withdrawn = sourceBalance.Withdrawn
+
+	if err := addLedgerEntry(opCtx, tx, target, LedgerMerge, "", 0, targetBalance.Current); err != nil {
+		return nil, err
+	}
+	for _, e := range mergeAuditEntries(merge, sourceBalance, targetBalance) {
+		if err := addAuditEntry(opCtx, tx, e); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := softDeleteUser(opCtx, tx, source); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(opCtx, `INSERT INTO account_merges (id, source_user_id, target_user_id, orders, withdrawals, dropped_idempotency_keys, current, withdrawn, reason, operator)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING created_at;`,
+		merge.ID, source, target, merge.Orders, merge.Withdrawals, merge.DroppedIdempotencyKeys, merge.Current, merge.Withdrawn, merge.Reason, merge.Operator).
+		Scan(&merge.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(opCtx); err != nil {
+		return nil, err
+	}
+
+	return &merge, nil
+}
+
+// mergeAuditEntries records the source's balance emptied and the target's
+// grown by it, both referring to the merge.
+func mergeAuditEntries(merge AccountMerge, source, target BalanceInfo) []BalanceAuditEntry {
+	return []BalanceAuditEntry{
+		{
+			UserID:          merge.SourceUserID,
+			Source:          LedgerMerge,
+			Reference:       merge.ID.String(),
+			CurrentBefore:   source.Current,
+			WithdrawnBefore: source.Withdrawn,
+		},
+		{
+			UserID:          merge.TargetUserID,
+			Source:          LedgerMerge,
+			Reference:       merge.ID.String(),
+			CurrentBefore:   target.Current - source.Current,
+			CurrentAfter:    target.Current,
+			WithdrawnBefore: target.Withdrawn - source.Withdrawn,
+			WithdrawnAfter:  target.Withdrawn,
+		},
+	}
+}
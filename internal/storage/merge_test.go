@@ -0,0 +1,132 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestMergeUsers(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		source := addUser(t, st, "walter")
+		target := addUser(t, st, "wendy")
+
+		addOrders(t, st, source, "79927398713")
+		if err := st.UpdateBalanceFromOrders(ctx, []storage.OrderTransition{processed(source, "79927398713", 500)}); err != nil {
+			t.Fatalf("UpdateBalanceFromOrders() error = %v", err)
+		}
+		if err := st.Withdraw(ctx, source, "12345678903", 200, "shared-key"); err != nil {
+			t.Fatalf("Withdraw() error = %v", err)
+		}
+		if err := st.AddBalance(ctx, target, 1000); err != nil {
+			t.Fatalf("AddBalance() error = %v", err)
+		}
+		if err := st.Withdraw(ctx, target, "4561261212345467", 100, "shared-key"); err != nil {
+			t.Fatalf("Withdraw() error = %v", err)
+		}
+
+		merge, err := st.MergeUsers(ctx, storage.AccountMerge{SourceUserID: source, TargetUserID: target, Reason: "duplicate account", Operator: "admin"})
+		if err != nil {
+			t.Fatalf("MergeUsers() error = %v", err)
+		}
+		if merge.ID == uuid.Nil || merge.CreatedAt.IsZero() {
+			t.Errorf("MergeUsers() = %+v, want a stored merge", merge)
+		}
+		if merge.Orders != 1 || merge.Withdrawals != 1 || merge.DroppedIdempotencyKeys != 1 || merge.Current != 300 || merge.Withdrawn != 200 {
+			t.Errorf("MergeUsers() = %+v", merge)
+		}
+
+		if info := balance(t, st, target); info.Current != 1200 || info.Withdrawn != 300 {
+			t.Errorf("target balance = %s current, %s withdrawn, want 12 and 3", info.Current, info.Withdrawn)
+		}
+		if _, err := st.GetOrderByNumber(ctx, target, "79927398713"); err != nil {
+			t.Errorf("GetOrderByNumber() of the merged order error = %v", err)
+		}
+		if withdrawals, _ := st.GetWithdrawals(ctx, target); len(withdrawals) != 2 {
+			t.Errorf("target withdrawals = %+v, want 2", withdrawals)
+		}
+		if drifts, _ := st.FindBalanceDrift(ctx); len(drifts) != 0 {
+			t.Errorf("FindBalanceDrift() after the merge = %+v, want none", drifts)
+		}
+		if _, err := st.GetUserAuthInfoByID(ctx, source); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("GetUserAuthInfoByID() of the merged user error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+
+		merchant := &storage.Merchant{Name: "Coffee"}
+		if err := st.AddMerchant(ctx, merchant, "key-hash"); err != nil {
+			t.Fatalf("AddMerchant() error = %v", err)
+		}
+		if err := st.AddUser(ctx, &storage.UserAuthorization{MerchantID: merchant.ID, Login: "xavier", Password: []byte("hash")}); err != nil {
+			t.Fatalf("AddUser() error = %v", err)
+		}
+		stranger, _ := st.GetUserAuthInfo(ctx, merchant.ID, "xavier")
+
+		tests := []struct {
+			name    string
+			source  uuid.UUID
+			wantErr error
+		}{
+			{"into itself", target, storage.ErrMergeIntoSelf},
+			{"a merged user", source, storage.ErrNoSuchUser},
+			{"another merchant's user", stranger.ID, storage.ErrDifferentMerchants},
+		}
+		for _, tt := range tests {
+			_, err := st.MergeUsers(ctx, storage.AccountMerge{SourceUserID: tt.source, TargetUserID: target})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("MergeUsers() of %s error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+	})
+}
+
+func TestWithinTx(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "yolanda")
+		errAbort := errors.New("abort")
+
+		err := st.WithinTx(ctx, func(tx storage.AppStorage) error {
+			if err := tx.AddOrder(ctx, storage.DefaultMerchantID, userID, "79927398713"); err != nil {
+				return err
+			}
+			if err := tx.AddBalance(ctx, userID, 500); err != nil {
+				return err
+			}
+			return errAbort
+		})
+		if !errors.Is(err, errAbort) {
+			t.Fatalf("WithinTx() error = %v, want %v", err, errAbort)
+		}
+		if _, err := st.GetOrder(ctx, "79927398713"); !errors.Is(err, storage.ErrNoSuchOrder) {
+			t.Errorf("GetOrder() after a rollback error = %v, want %v", err, storage.ErrNoSuchOrder)
+		}
+		if info := balance(t, st, userID); info.Current != 0 {
+			t.Errorf("balance after a rollback = %s, want 0", info.Current)
+		}
+
+		err = st.WithinTx(ctx, func(tx storage.AppStorage) error {
+			if err := tx.AddOrder(ctx, storage.DefaultMerchantID, userID, "79927398713"); err != nil {
+				return err
+			}
+			// A failed call inside the transaction doesn't undo the others.
+			if err := tx.Withdraw(ctx, userID, "12345678903", 100, ""); !errors.Is(err, storage.ErrNotEnoughBalance) {
+				t.Errorf("Withdraw() in the transaction error = %v, want %v", err, storage.ErrNotEnoughBalance)
+			}
+			return tx.AddBalance(ctx, userID, 500)
+		})
+		if err != nil {
+			t.Fatalf("WithinTx() error = %v", err)
+		}
+		if _, err := st.GetOrder(ctx, "79927398713"); err != nil {
+			t.Errorf("GetOrder() after a commit error = %v", err)
+		}
+		if info := balance(t, st, userID); info.Current != 500 {
+			t.Errorf("balance after a commit = %s, want 5", info.Current)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestNotificationPreferences(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "grace")
+
+		prefs, err := st.GetNotificationPreferences(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetNotificationPreferences() error = %v", err)
+		}
+		if len(prefs.Email) != 0 || len(prefs.WebhookURL) != 0 {
+			t.Errorf("GetNotificationPreferences() before any were set = %+v, want none", prefs)
+		}
+
+		for _, want := range []storage.NotificationPreferences{
+			{UserID: userID, Email: "grace@example.com"},
+			{UserID: userID, WebhookURL: "https://example.com/hook"},
+		} {
+			if err := st.SetNotificationPreferences(ctx, want); err != nil {
+				t.Fatalf("SetNotificationPreferences() error = %v", err)
+			}
+			prefs, err := st.GetNotificationPreferences(ctx, userID)
+			if err != nil {
+				t.Fatalf("GetNotificationPreferences() error = %v", err)
+			}
+			if *prefs != want {
+				t.Errorf("GetNotificationPreferences() = %+v, want %+v", prefs, want)
+			}
+		}
+
+		if err := st.DeleteNotificationPreferences(ctx, userID); err != nil {
+			t.Fatalf("DeleteNotificationPreferences() error = %v", err)
+		}
+		if prefs, _ := st.GetNotificationPreferences(ctx, userID); len(prefs.WebhookURL) != 0 {
+			t.Errorf("GetNotificationPreferences() after deleting = %+v, want none", prefs)
+		}
+	})
+}
+
+func TestNotificationDeliveries(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "heidi")
+
+		deliveries := []storage.NotificationDelivery{
+			{UserID: userID, Channel: "email", Address: "heidi@example.com", Payload: json.RawMessage(`{"order":"79927398713"}`)},
+			{UserID: userID, Channel: "webhook", Address: "https://example.com/hook", Payload: json.RawMessage(`{"order":"79927398713"}`)},
+		}
+		if err := st.AddNotificationDeliveries(ctx, deliveries); err != nil {
+			t.Fatalf("AddNotificationDeliveries() error = %v", err)
+		}
+
+		claimed, err := st.ClaimNotificationDeliveries(ctx, time.Minute, 10)
+		if err != nil {
+			t.Fatalf("ClaimNotificationDeliveries() error = %v", err)
+		}
+		if len(claimed) != 2 {
+			t.Fatalf("ClaimNotificationDeliveries() = %d deliveries, want 2", len(claimed))
+		}
+		for _, d := range claimed {
+			var payload struct{ Order string }
+			if err := json.Unmarshal(d.Payload, &payload); err != nil || payload.Order != "79927398713" {
+				t.Errorf("delivery payload = %s, %v", d.Payload, err)
+			}
+			if d.Status != storage.DeliveryPending || d.UserID != userID {
+				t.Errorf("claimed delivery = %+v", d)
+			}
+		}
+		// The lease keeps them from being claimed again.
+		if again, _ := st.ClaimNotificationDeliveries(ctx, time.Minute, 10); len(again) != 0 {
+			t.Errorf("ClaimNotificationDeliveries() during the lease = %d deliveries, want 0", len(again))
+		}
+
+		sent, failed := claimed[0], claimed[1]
+		if err := st.CompleteNotificationDelivery(ctx, sent.ID); err != nil {
+			t.Fatalf("CompleteNotificationDelivery() error = %v", err)
+		}
+		if err := st.FailNotificationDelivery(ctx, failed.ID, "timeout", time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("FailNotificationDelivery() error = %v", err)
+		}
+		retried, err := st.ClaimNotificationDeliveries(ctx, time.Minute, 10)
+		if err != nil {
+			t.Fatalf("ClaimNotificationDeliveries() error = %v", err)
+		}
+		if len(retried) != 1 || retried[0].ID != failed.ID || retried[0].Attempts != 1 || retried[0].LastError != "timeout" {
+			t.Fatalf("ClaimNotificationDeliveries() after a failure = %+v, want the failed delivery", retried)
+		}
+		if err := st.FailNotificationDelivery(ctx, failed.ID, "timeout again", time.Time{}); err != nil {
+			t.Fatalf("FailNotificationDelivery() error = %v", err)
+		}
+
+		for _, tt := range []struct {
+			status string
+			want   int64
+		}{
+			{storage.DeliverySent, sent.ID},
+			{storage.DeliveryFailed, failed.ID},
+		} {
+			got, err := st.GetNotificationDeliveries(ctx, storage.NotificationDeliveryFilter{UserID: userID, Status: tt.status, Limit: 10})
+			if err != nil {
+				t.Fatalf("GetNotificationDeliveries() error = %v", err)
+			}
+			if len(got) != 1 || got[0].ID != tt.want {
+				t.Errorf("%s deliveries = %+v, want #%d", tt.status, got, tt.want)
+				continue
+			}
+			if tt.status == storage.DeliverySent && got[0].SentAt == nil {
+				t.Errorf("sent delivery has no sent_at")
+			}
+		}
+		if pending, _ := st.GetNotificationDeliveries(ctx, storage.NotificationDeliveryFilter{Status: storage.DeliveryPending, Limit: 10}); len(pending) != 0 {
+			t.Errorf("pending deliveries = %+v, want none", pending)
+		}
+	})
+}
@@ -0,0 +1,383 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+// Luhn-valid order numbers.
+var orderNumbers = []string{"79927398713", "12345678903", "4561261212345467", "49927398716", "1234567812345670"}
+
+func addOrders(t *testing.T, st storage.AppStorage, userID uuid.UUID, orders ...string) {
+	t.Helper()
+	for _, order := range orders {
+		if err := st.AddOrder(context.Background(), storage.DefaultMerchantID, userID, order); err != nil {
+			t.Fatalf("AddOrder(%s) error = %v", order, err)
+		}
+	}
+}
+
+func TestAddOrder(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		owner := addUser(t, st, "ivan")
+		other := addUser(t, st, "judy")
+		addOrders(t, st, owner, "79927398713")
+
+		tests := []struct {
+			name    string
+			userID  uuid.UUID
+			wantErr error
+		}{
+			{"again by the owner", owner, storage.ErrOrderAlreadyPlaced},
+			{"by another user", other, storage.ErrDuplicateOrder},
+		}
+		for _, tt := range tests {
+			if err := st.AddOrder(ctx, storage.DefaultMerchantID, tt.userID, "79927398713"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("AddOrder() %s error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		}
+
+		order, err := st.GetOrderByNumber(ctx, owner, "79927398713")
+		if err != nil {
+			t.Fatalf("GetOrderByNumber() error = %v", err)
+		}
+		if order.Status != storage.StatusNew || order.Accrual != 0 || order.Registered || order.UploadedAt.IsZero() {
+			t.Errorf("GetOrderByNumber() = %+v, want a new order", order)
+		}
+		if _, err := st.GetOrderByNumber(ctx, other, "79927398713"); !errors.Is(err, storage.ErrNoSuchOrder) {
+			t.Errorf("GetOrderByNumber() of another user's order error = %v, want %v", err, storage.ErrNoSuchOrder)
+		}
+		if _, err := st.GetOrder(ctx, "12345678903"); !errors.Is(err, storage.ErrNoSuchOrder) {
+			t.Errorf("GetOrder() of an unknown order error = %v, want %v", err, storage.ErrNoSuchOrder)
+		}
+	})
+}
+
+// Merchants number their orders independently: the same number is a
+// separate order at each merchant and the accrual result credits both.
+func TestAddOrderPerMerchant(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		merchant := &storage.Merchant{Name: "Coffee"}
+		if err := st.AddMerchant(ctx, merchant, "key-hash"); err != nil {
+			t.Fatalf("AddMerchant() error = %v", err)
+		}
+		if err := st.AddUser(ctx, &storage.UserAuthorization{MerchantID: merchant.ID, Login: "ivan", Password: []byte("hash")}); err != nil {
+			t.Fatalf("AddUser() error = %v", err)
+		}
+		merchantUser, _ := st.GetUserAuthInfo(ctx, merchant.ID, "ivan")
+		defaultUser := addUser(t, st, "judy")
+		addOrders(t, st, defaultUser, "79927398713")
+
+		if err := st.AddOrder(ctx, merchant.ID, merchantUser.ID, "79927398713"); err != nil {
+			t.Fatalf("AddOrder() of another merchant's number error = %v", err)
+		}
+		if err := st.AddOrder(ctx, merchant.ID, merchantUser.ID, "79927398713"); !errors.Is(err, storage.ErrOrderAlreadyPlaced) {
+			t.Errorf("AddOrder() again error = %v, want %v", err, storage.ErrOrderAlreadyPlaced)
+		}
+
+		err := st.UpdateBalanceFromOrders(ctx, []storage.OrderTransition{{
+			Order: storage.Order{OrderNumber: "79927398713", Status: storage.StatusProcessed, Accrual: 500},
+			From:  storage.StatusNew,
+		}})
+		if err != nil {
+			t.Fatalf("UpdateBalanceFromOrders() error = %v", err)
+		}
+		for _, userID := range []uuid.UUID{defaultUser, merchantUser.ID} {
+			if info := balance(t, st, userID); info.Current != 500 {
+				t.Errorf("balance of %s = %s, want 5", userID, info.Current)
+			}
+		}
+	})
+}
+
+func TestUpdateOrder(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "kim")
+		addOrders(t, st, userID, "79927398713")
+
+		steps := []struct {
+			status  string
+			wantErr error
+		}{
+			{storage.StatusProcessing, nil},
+			{storage.StatusNew, storage.ErrInvalidTransition},
+			{storage.StatusProcessed, nil},
+			{storage.StatusInvalid, storage.ErrInvalidTransition},
+		}
+		for _, step := range steps {
+			err := st.UpdateOrder(ctx, storage.Order{OrderNumber: "79927398713", Status: step.status, Accrual: 500})
+			if !errors.Is(err, step.wantErr) {
+				t.Errorf("UpdateOrder() to %s error = %v, want %v", step.status, err, step.wantErr)
+			}
+		}
+		if status := orderStatus(t, st, "79927398713"); status != storage.StatusProcessed {
+			t.Errorf("status = %s, want %s", status, storage.StatusProcessed)
+		}
+
+		// A processed order is final, even for an operator.
+		if err := st.RequeueOrder(ctx, "79927398713"); !errors.Is(err, storage.ErrNoSuchOrder) {
+			t.Errorf("RequeueOrder() of a processed order error = %v, want %v", err, storage.ErrNoSuchOrder)
+		}
+
+		addOrders(t, st, userID, "12345678903")
+		if err := st.SetOrderFiscalStatus(ctx, "12345678903", "invalid", "receipt not found", true); err != nil {
+			t.Fatalf("SetOrderFiscalStatus() error = %v", err)
+		}
+		if status := orderStatus(t, st, "12345678903"); status != storage.StatusInvalid {
+			t.Errorf("status after a rejected receipt = %s, want %s", status, storage.StatusInvalid)
+		}
+		if err := st.RequeueOrder(ctx, "12345678903"); err != nil {
+			t.Fatalf("RequeueOrder() error = %v", err)
+		}
+		if status := orderStatus(t, st, "12345678903"); status != storage.StatusNew {
+			t.Errorf("status after requeueing = %s, want %s", status, storage.StatusNew)
+		}
+	})
+}
+
+func TestGetOrders(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "leo")
+		other := addUser(t, st, "mallory")
+
+		version, err := st.GetOrdersVersion(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetOrdersVersion() error = %v", err)
+		}
+		if version.Count != 0 {
+			t.Errorf("GetOrdersVersion() without orders = %+v", version)
+		}
+
+		addOrders(t, st, userID, orderNumbers...)
+		addOrders(t, st, other, "4111111111111111")
+		if err := st.UpdateOrder(ctx, storage.Order{OrderNumber: orderNumbers[0], Status: storage.StatusProcessed, Accrual: 900}); err != nil {
+			t.Fatalf("UpdateOrder() error = %v", err)
+		}
+
+		orders, err := st.GetOrders(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetOrders() error = %v", err)
+		}
+		if len(orders) != len(orderNumbers) {
+			t.Errorf("GetOrders() = %d orders, want %d", len(orders), len(orderNumbers))
+		}
+		for _, o := range orders {
+			if o.UserID != userID {
+				t.Errorf("GetOrders() returned %+v of another user", o)
+			}
+		}
+
+		version, _ = st.GetOrdersVersion(ctx, userID)
+		if version.Count != len(orderNumbers) || version.UpdatedAt.IsZero() {
+			t.Errorf("GetOrdersVersion() = %+v, want %d orders", version, len(orderNumbers))
+		}
+
+		// Two orders a page walk through all of them exactly once.
+		seen := make(map[string]bool)
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(orderNumbers) {
+				t.Fatalf("GetOrdersPage() didn't run out of pages")
+			}
+			page, err := st.GetOrdersPage(ctx, userID, storage.OrdersFilter{}, cursor, 2)
+			if err != nil {
+				t.Fatalf("GetOrdersPage() error = %v", err)
+			}
+			if page.Total != len(orderNumbers) {
+				t.Errorf("GetOrdersPage() total = %d, want %d", page.Total, len(orderNumbers))
+			}
+			for _, o := range page.Orders {
+				if seen[o.OrderNumber] {
+					t.Errorf("order %s is on two pages", o.OrderNumber)
+				}
+				seen[o.OrderNumber] = true
+			}
+			if len(page.NextCursor) == 0 {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		if len(seen) != len(orderNumbers) {
+			t.Errorf("pages had %d orders, want %d", len(seen), len(orderNumbers))
+		}
+
+		page, err := st.GetOrdersPage(ctx, userID, storage.OrdersFilter{Statuses: []string{storage.StatusProcessed}, Sort: storage.OrdersSortAccrual}, "", 10)
+		if err != nil {
+			t.Fatalf("GetOrdersPage() error = %v", err)
+		}
+		if page.Total != 1 || len(page.Orders) != 1 || page.Orders[0].Accrual != 900 {
+			t.Errorf("processed orders page = %+v, want %s", page, orderNumbers[0])
+		}
+
+		if _, err := st.GetOrdersPage(ctx, userID, storage.OrdersFilter{}, "not a cursor", 2); !errors.Is(err, storage.ErrBadCursor) {
+			t.Errorf("GetOrdersPage() with a bad cursor error = %v, want %v", err, storage.ErrBadCursor)
+		}
+	})
+}
+
+func TestClaimUnfinishedOrders(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "niaj")
+		addOrders(t, st, userID, orderNumbers[:3]...)
+		if err := st.UpdateOrder(ctx, storage.Order{OrderNumber: orderNumbers[0], Status: storage.StatusInvalid}); err != nil {
+			t.Fatalf("UpdateOrder() error = %v", err)
+		}
+
+		claimed, err := st.ClaimUnfinishedOrders(ctx, "poller-1", time.Minute, storage.ClaimFilter{}, 10)
+		if err != nil {
+			t.Fatalf("ClaimUnfinishedOrders() error = %v", err)
+		}
+		if len(claimed) != 2 {
+			t.Fatalf("ClaimUnfinishedOrders() = %+v, want the 2 unfinished orders", claimed)
+		}
+		if other, _ := st.ClaimUnfinishedOrders(ctx, "poller-2", time.Minute, storage.ClaimFilter{}, 10); len(other) != 0 {
+			t.Errorf("another poller claimed %+v during the lease", other)
+		}
+		// The owner of a claim gets its orders again.
+		if again, _ := st.ClaimUnfinishedOrders(ctx, "poller-1", time.Minute, storage.ClaimFilter{}, 10); len(again) != 2 {
+			t.Errorf("the claiming poller got %d orders again, want 2", len(again))
+		}
+
+		if err := st.ReleaseOrderClaims(ctx, "poller-1"); err != nil {
+			t.Fatalf("ReleaseOrderClaims() error = %v", err)
+		}
+		released, err := st.ClaimUnfinishedOrders(ctx, "poller-2", time.Minute, storage.ClaimFilter{ByNumber: true, AfterNumber: orderNumbers[1]}, 10)
+		if err != nil {
+			t.Fatalf("ClaimUnfinishedOrders() error = %v", err)
+		}
+		if len(released) != 1 || released[0].OrderNumber != orderNumbers[2] {
+			t.Errorf("ClaimUnfinishedOrders() after %s = %+v, want %s", orderNumbers[1], released, orderNumbers[2])
+		}
+
+		backlog, err := st.GetAccrualBacklog(ctx)
+		if err != nil {
+			t.Fatalf("GetAccrualBacklog() error = %v", err)
+		}
+		if backlog.Orders != 2 || backlog.OldestUploadedAt.IsZero() {
+			t.Errorf("GetAccrualBacklog() = %+v, want 2 orders", backlog)
+		}
+	})
+}
+
+func TestDeadLetters(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "olivia")
+		addOrders(t, st, userID, "79927398713")
+
+		for want := 1; want <= 2; want++ {
+			failures, err := st.RecordAccrualFailure(ctx, "79927398713")
+			if err != nil || failures != want {
+				t.Errorf("RecordAccrualFailure() = %d, %v, want %d", failures, err, want)
+			}
+		}
+		if notFound, err := st.RecordAccrualNotFound(ctx, "79927398713"); err != nil || notFound != 1 {
+			t.Errorf("RecordAccrualNotFound() = %d, %v, want 1", notFound, err)
+		}
+		if _, err := st.RecordAccrualFailure(ctx, "12345678903"); !errors.Is(err, storage.ErrNoSuchOrder) {
+			t.Errorf("RecordAccrualFailure() of an unknown order error = %v, want %v", err, storage.ErrNoSuchOrder)
+		}
+
+		if err := st.DeadLetterOrder(ctx, storage.DeadLetter{OrderNumber: "79927398713", Failures: 2, LastError: "bad response"}); err != nil {
+			t.Fatalf("DeadLetterOrder() error = %v", err)
+		}
+		letters, err := st.GetDeadLetters(ctx)
+		if err != nil {
+			t.Fatalf("GetDeadLetters() error = %v", err)
+		}
+		if len(letters) != 1 || letters[0].OrderNumber != "79927398713" || letters[0].Failures != 2 || letters[0].LastError != "bad response" {
+			t.Errorf("GetDeadLetters() = %+v", letters)
+		}
+		if claimed, _ := st.ClaimUnfinishedOrders(ctx, "poller", time.Minute, storage.ClaimFilter{}, 10); len(claimed) != 0 {
+			t.Errorf("a dead-lettered order was claimed: %+v", claimed)
+		}
+
+		if err := st.RedriveOrder(ctx, "79927398713"); err != nil {
+			t.Fatalf("RedriveOrder() error = %v", err)
+		}
+		if err := st.RedriveOrder(ctx, "79927398713"); !errors.Is(err, storage.ErrNoSuchOrder) {
+			t.Errorf("RedriveOrder() twice error = %v, want %v", err, storage.ErrNoSuchOrder)
+		}
+		// The counters start over.
+		if failures, _ := st.RecordAccrualFailure(ctx, "79927398713"); failures != 1 {
+			t.Errorf("RecordAccrualFailure() after the redrive = %d, want 1", failures)
+		}
+		if claimed, _ := st.ClaimUnfinishedOrders(ctx, "poller", time.Minute, storage.ClaimFilter{}, 10); len(claimed) != 1 {
+			t.Errorf("the redriven order wasn't claimed: %+v", claimed)
+		}
+	})
+}
+
+func TestOrderRegistration(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "peggy")
+		addOrders(t, st, userID, "79927398713")
+
+		if err := st.SetOrderRegistrationError(ctx, "79927398713", "accrual system is down"); err != nil {
+			t.Fatalf("SetOrderRegistrationError() error = %v", err)
+		}
+		order, _ := st.GetOrderByNumber(ctx, userID, "79927398713")
+		if order.Registered || order.RegistrationError != "accrual system is down" {
+			t.Errorf("order after a failed registration = %+v", order)
+		}
+
+		if err := st.MarkOrderRegistered(ctx, "79927398713"); err != nil {
+			t.Fatalf("MarkOrderRegistered() error = %v", err)
+		}
+		order, _ = st.GetOrderByNumber(ctx, userID, "79927398713")
+		if !order.Registered || len(order.RegistrationError) != 0 {
+			t.Errorf("order after registering = %+v", order)
+		}
+		claimed, _ := st.ClaimUnfinishedOrders(ctx, "poller", time.Minute, storage.ClaimFilter{}, 10)
+		if len(claimed) != 1 || !claimed[0].Registered {
+			t.Errorf("ClaimUnfinishedOrders() = %+v, want the registered order", claimed)
+		}
+	})
+}
+
+func TestAccrualJournal(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "rupert")
+		addOrders(t, st, userID, "79927398713")
+
+		entries := []storage.AccrualJournalEntry{
+			{OrderNumber: "79927398713", Provider: "primary", Status: storage.StatusProcessed, Accrual: 500},
+			{OrderNumber: "79927398713", Provider: "backup", Error: "timeout"},
+		}
+		if err := st.AddAccrualJournalEntries(ctx, entries); err != nil {
+			t.Fatalf("AddAccrualJournalEntries() error = %v", err)
+		}
+
+		journal, err := st.GetAccrualJournal(ctx, "79927398713")
+		if err != nil {
+			t.Fatalf("GetAccrualJournal() error = %v", err)
+		}
+		if len(journal) != len(entries) {
+			t.Fatalf("GetAccrualJournal() = %+v, want %d entries", journal, len(entries))
+		}
+		byProvider := make(map[string]storage.AccrualJournalEntry)
+		for _, e := range journal {
+			byProvider[e.Provider] = e
+		}
+		for _, want := range entries {
+			got := byProvider[want.Provider]
+			got.CreatedAt = time.Time{}
+			if got != want {
+				t.Errorf("journal entry = %+v, want %+v", got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+)
+
+// orderTransitions is the order state machine: the statuses an order may
+// move to from each status. PROCESSED and INVALID are final. Requeueing an
+// order is an operator's reset, not a transition.
+var orderTransitions = map[string][]string{
+	StatusNew:        {StatusProcessing, StatusProcessed, StatusInvalid},
+	StatusProcessing: {StatusProcessed, StatusInvalid},
+}
+
+// OrderTransition is an order that has moved from status From to
+// Order.Status.
+type OrderTransition struct {
+	Order
+	From string
+}
+
+func CanTransition(from, to string) bool {
+	return slices.Contains(orderTransitions[from], to)
+}
+
+// IsFinalStatus reports whether an order in status is done with accrual
+// processing.
+func IsFinalStatus(status string) bool {
+	return len(orderTransitions[status]) == 0
+}
+
+func (t OrderTransition) Check() error {
+	if !CanTransition(t.From, t.Status) {
+		return fmt.Errorf("%w: order %s from %s to %s", ErrInvalidTransition, t.OrderNumber, t.From, t.Status)
+	}
+	return nil
+}
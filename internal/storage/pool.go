@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const poolCheckInterval = 10 * time.Second
+
+// WatchPool warns while all connections of the pool are in use and queries
+// have been waiting for one, which means DB_MAX_CONNS is too low for the
+// load or queries are slow. It returns when ctx is done.
+func WatchPool(ctx context.Context, name string, pool *pgxpool.Pool, logger *zap.Logger) {
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+
+	prev := pool.Stat()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		stat := pool.Stat()
+		waited := stat.EmptyAcquireCount() - prev.EmptyAcquireCount()
+		if waited > 0 && stat.AcquiredConns() >= stat.MaxConns() {
+			logger.Warn("Database connection pool is saturated",
+				zap.String("pool", name),
+				zap.Int32("max_conns", stat.MaxConns()),
+				zap.Int64("waited_acquires", waited),
+				zap.Duration("acquire_wait", stat.AcquireDuration()-prev.AcquireDuration()),
+			)
+		}
+		prev = stat
+	}
+}
+
+// WaitForDB pings the database until it answers or maxWait has passed,
+// backing off between attempts, so the service can start before Postgres
+// is ready.
+func WaitForDB(ctx context.Context, pool *pgxpool.Pool, maxWait time.Duration, logger *zap.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := pool.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+
+		logger.Info("Database is not ready yet", zap.Int("attempt", attempt), zap.Duration("retry_in", delay), zap.Error(err))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(delay*2, 5*time.Second)
+	}
+}
@@ -2,42 +2,76 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgconn"
-	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
 )
 
 const (
 	DatabaseOperationTimeout = 5 * time.Second
 	UniqueViolationCode      = "23505"
+	ForeignKeyViolationCode  = "23503"
+	CheckViolationCode       = "23514"
+	NotNullViolationCode     = "23502"
 )
 
 type pgxStorage struct {
-	ctx    context.Context
-	dbConn *pgxpool.Pool
-	logger zap.Logger
+	ctx         context.Context
+	dbConn      dbConn
+	logger      zap.Logger
+	retryConfig RetryConfig
+	timeouts    Timeouts
+	inTx        bool
+
+	replica          *pgxpool.Pool
+	replicaDownUntil atomic.Int64
+}
+
+type Options struct {
+	// Replica, if not nil, serves some reads.
+	Replica  *pgxpool.Pool
+	Retry    RetryConfig
+	Timeouts Timeouts
 }
 
-func NewDatabaseStorage(ctx context.Context, connection *pgxpool.Pool, logger *zap.Logger) (AppStorage, error) {
+// NewDatabaseStorage creates a storage on the primary pool connection.
+func NewDatabaseStorage(ctx context.Context, connection *pgxpool.Pool, logger *zap.Logger, opts Options) (AppStorage, error) {
 	if err := connection.Ping(ctx); err != nil {
 		return nil, err
 	}
 
 	storage := &pgxStorage{
-		ctx:    ctx,
-		dbConn: connection,
-		logger: *logger,
+		ctx:         ctx,
+		dbConn:      connection,
+		logger:      *logger,
+		retryConfig: opts.Retry,
+		timeouts:    opts.Timeouts.withDefaults(),
+		replica:     opts.Replica,
 	}
 	return storage, nil
 }
 
-func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) (err error) {
+	defer wrapError("AddUser", &err)
+
+	return p.retry(ctx, "AddUser", func() error {
+		return p.addUser(ctx, auth)
+	})
+}
+
+func (p *pgxStorage) addUser(ctx context.Context, auth *UserAuthorization) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -46,8 +80,13 @@ func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) error
 	}
 	defer tx.Rollback(p.ctx)
 
+	role := auth.Role
+	if len(role) == 0 {
+		role = RoleUser
+	}
+
 	userUUID := uuid.New()
-	_, err = tx.Exec(opCtx, `INSERT INTO users (id, login, password) VALUES ($1, $2, $3);`, userUUID, auth.Login, auth.Password)
+	_, err = tx.Exec(opCtx, `INSERT INTO users (id, merchant_id, login, password, role) VALUES ($1, $2, $3, $4, $5);`, userUUID, auth.MerchantID, auth.Login, auth.Password, role)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		if errors.As(err, &pgErr) {
@@ -60,18 +99,20 @@ func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) error
 
 	_, err = tx.Exec(opCtx, `INSERT INTO balance (id, user_id, current, withdrawn) VALUES ($1, $2, 0, 0);`, uuid.New(), userUUID)
 	if err != nil {
-		p.logger.Sugar().Error(err)
 		return err
 	}
 
 	return tx.Commit(opCtx)
 }
 
-func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, userName string) (*UserAuthorization, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, merchantID uuid.UUID, userName string) (_ *UserAuthorization, err error) {
+	defer wrapError("GetUserAuthInfo", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
 	defer cancel()
 
-	r, err := p.dbConn.Query(opCtx, `SELECT id, login, password FROM users WHERE login = $1;`, userName)
+	r, err := p.dbConn.Query(opCtx, `SELECT id, merchant_id, login, password, role, created_at, COALESCE(password_changed_at, to_timestamp(0)) FROM users
+		WHERE merchant_id = $1 AND login = $2 AND deleted_at IS NULL;`, merchantID, userName)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +120,7 @@ func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, userName string) (*Use
 
 	if r.Next() {
 		authData := UserAuthorization{}
-		if err := r.Scan(&authData.ID, &authData.Login, &authData.Password); err != nil {
+		if err := r.Scan(&authData.ID, &authData.MerchantID, &authData.Login, &authData.Password, &authData.Role, &authData.CreatedAt, &authData.PasswordChangedAt); err != nil {
 			return nil, err
 		}
 		return &authData, nil
@@ -92,11 +133,14 @@ func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, userName string) (*Use
 	return nil, ErrNoSuchUser
 }
 
-func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID) (*UserAuthorization, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID) (_ *UserAuthorization, err error) {
+	defer wrapError("GetUserAuthInfoByID", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
 	defer cancel()
 
-	r, err := p.dbConn.Query(opCtx, `SELECT login, password FROM users WHERE id = $1;`, userID)
+	r, err := p.dbConn.Query(opCtx, `SELECT merchant_id, login, password, role, created_at, COALESCE(password_changed_at, to_timestamp(0)) FROM users
+		WHERE id = $1 AND deleted_at IS NULL;`, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +148,7 @@ func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID)
 
 	if r.Next() {
 		authData := UserAuthorization{ID: userID}
-		if err := r.Scan(&authData.Login, &authData.Password); err != nil {
+		if err := r.Scan(&authData.MerchantID, &authData.Login, &authData.Password, &authData.Role, &authData.CreatedAt, &authData.PasswordChangedAt); err != nil {
 			return nil, err
 		}
 
@@ -118,8 +162,20 @@ func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID)
 	return nil, ErrNoSuchUser
 }
 
-func (p *pgxStorage) AddOrder(ctx context.Context, userID uuid.UUID, orderNumber string) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+// DeleteUser soft-deletes the user: the login is replaced with a placeholder,
+// the password is erased, refresh tokens and notification addresses are
+// dropped. Orders, withdrawals
+// and the ledger are kept for accounting.
+func (p *pgxStorage) DeleteUser(ctx context.Context, userID uuid.UUID) (err error) {
+	defer wrapError("DeleteUser", &err)
+
+	return p.retry(ctx, "DeleteUser", func() error {
+		return p.deleteUser(ctx, userID)
+	})
+}
+
+func (p *pgxStorage) deleteUser(ctx context.Context, userID uuid.UUID) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -128,111 +184,86 @@ func (p *pgxStorage) AddOrder(ctx context.Context, userID uuid.UUID, orderNumber
 	}
 	defer tx.Rollback(p.ctx)
 
-	insertQuery := `INSERT INTO orders (id, user_id, order_number) VALUES ($1, $2, $3)`
-	_, err = tx.Exec(opCtx, insertQuery, uuid.New(), userID, orderNumber)
-	if err != nil {
-		var pgErr *pgconn.PgError
-		if !errors.As(err, &pgErr) || pgErr.Code != UniqueViolationCode {
-			return err
-		}
-	} else {
-		return tx.Commit(opCtx)
+	if err := softDeleteUser(opCtx, tx, userID); err != nil {
+		return err
 	}
 
-	return checkDuplicateOrder(p, opCtx, orderNumber, userID)
+	return tx.Commit(opCtx)
 }
 
-func checkDuplicateOrder(p *pgxStorage, opCtx context.Context, orderNumber string, userID uuid.UUID) error {
-	query := `SELECT user_id FROM orders WHERE order_number = $1`
-	r, err := p.dbConn.Query(opCtx, query, orderNumber)
+func softDeleteUser(ctx context.Context, tx pgx.Tx, userID uuid.UUID) error {
+	tag, err := tx.Exec(ctx, `UPDATE users SET login = 'deleted-' || id::text, password = '', display_name = '', email = '', deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL;`, userID)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchUser
+	}
 
-	if r.Next() {
-		clientID := uuid.UUID{}
-		if err := r.Scan(&clientID); err != nil {
-			return err
-		}
-		if clientID == userID {
-			return ErrOrderAlreadyPlaced
-		}
+	if _, err := tx.Exec(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1;`, userID); err != nil {
+		return err
 	}
-	if err := r.Err(); err != nil {
+	if _, err := tx.Exec(ctx, `UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL;`, userID); err != nil {
 		return err
 	}
-
-	return ErrDuplicateOrder
-}
-
-func (p *pgxStorage) UpdateOrder(ctx context.Context, order Order) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
-	defer cancel()
-
-	p.logger.Info("updating order", zap.Any("order_number", order.OrderNumber), zap.Float64("accrual", order.Accrual))
-	_, err := p.dbConn.Exec(opCtx, `UPDATE orders SET status=$1, accrual=$2, updated_at=NOW() WHERE order_number=$3;`, order.Status, order.Accrual, order.OrderNumber)
+	_, err = tx.Exec(ctx, `DELETE FROM notification_preferences WHERE user_id = $1;`, userID)
 	return err
 }
 
-func (p *pgxStorage) GetOrders(ctx context.Context, userID uuid.UUID) ([]Order, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
-	defer cancel()
+func (p *pgxStorage) GetUserProfile(ctx context.Context, userID uuid.UUID) (_ *UserProfile, err error) {
+	defer wrapError("GetUserProfile", &err)
 
-	r, err := p.dbConn.Query(opCtx, `SELECT order_number, status, accrual, uploaded_at FROM orders WHERE user_id = $1;`, userID)
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
 
+	profile := UserProfile{}
+	err = p.dbConn.QueryRow(opCtx, `SELECT login, display_name, email, created_at FROM users WHERE id = $1 AND deleted_at IS NULL;`, userID).
+		Scan(&profile.Login, &profile.DisplayName, &profile.Email, &profile.CreatedAt)
 	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-
-	orders := make([]Order, 0)
-	for r.Next() {
-		order := Order{
-			UserID: userID,
-		}
-		if err := r.Scan(&order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
-			return nil, err
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoSuchUser
 		}
-		orders = append(orders, order)
-	}
-	if err := r.Err(); err != nil {
 		return nil, err
 	}
 
-	return orders, nil
+	return &profile, nil
 }
 
-func (p *pgxStorage) GetUnfinishedOrders(ctx context.Context) ([]Order, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
-	defer cancel()
-
-	r, err := p.dbConn.Query(opCtx, `SELECT order_number, user_id, status, accrual, uploaded_at FROM orders WHERE status IN ('NEW', 'PROCESSING');`)
-	if err != nil {
-		return nil, err
+func (p *pgxStorage) UpdateUserProfile(ctx context.Context, userID uuid.UUID, update UserProfileUpdate) (_ *UserProfile, err error) {
+	defer wrapError("UpdateUserProfile", &err)
+
+	var profile *UserProfile
+	err = p.retry(ctx, "UpdateUserProfile", func() error {
+		opCtx, cancel := p.withTimeout(ctx, opWrite)
+		defer cancel()
+
+		profile = &UserProfile{}
+		return p.dbConn.QueryRow(opCtx, `UPDATE users SET display_name = COALESCE($2, display_name), email = COALESCE($3, email)
+			WHERE id = $1 AND deleted_at IS NULL
+			RETURNING login, display_name, email, created_at;`, userID, update.DisplayName, update.Email).
+			Scan(&profile.Login, &profile.DisplayName, &profile.Email, &profile.CreatedAt)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoSuchUser
 	}
-	defer r.Close()
+	return profile, err
+}
 
-	orders := make([]Order, 0)
-	for r.Next() {
-		order := Order{}
-		var userID uuid.UUID
-		if err := r.Scan(&order.OrderNumber, &userID, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
-			return nil, err
-		}
-		order.UserID = userID
-		orders = append(orders, order)
-	}
-	if err := r.Err(); err != nil {
-		return nil, err
-	}
+// ChangePassword replaces the password and drops the user's refresh tokens.
+// Access tokens issued before changedAt are rejected by their issue time;
+// it is passed in rather than taken from the database clock so that tokens
+// issued right after the change by this server stay valid.
+func (p *pgxStorage) ChangePassword(ctx context.Context, userID uuid.UUID, password []byte, changedAt time.Time) (err error) {
+	defer wrapError("ChangePassword", &err)
 
-	p.logger.Info("unfinished orders", zap.Any("orders", orders))
-	return orders, nil
+	return p.retry(ctx, "ChangePassword", func() error {
+		return p.changePassword(ctx, userID, password, changedAt)
+	})
 }
 
-func (p *pgxStorage) Withdraw(ctx context.Context, userID uuid.UUID, order string, sum float64) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) changePassword(ctx context.Context, userID uuid.UUID, password []byte, changedAt time.Time) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -241,145 +272,1727 @@ func (p *pgxStorage) Withdraw(ctx context.Context, userID uuid.UUID, order strin
 	}
 	defer tx.Rollback(p.ctx)
 
-	r, err := tx.Query(opCtx, `SELECT current, withdrawn FROM balance WHERE user_id = $1 FOR UPDATE;`, userID)
+	tag, err := tx.Exec(opCtx, `UPDATE users SET password = $2, password_changed_at = $3 WHERE id = $1 AND deleted_at IS NULL;`, userID, password, changedAt)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchUser
+	}
 
-	info := BalanceInfo{}
-	if r.Next() {
-		if err := r.Scan(&info.Current, &info.Withdrawn); err != nil {
-			return err
-		}
+	if _, err := tx.Exec(opCtx, `DELETE FROM refresh_tokens WHERE user_id = $1;`, userID); err != nil {
+		return err
 	}
-	if err := r.Err(); err != nil {
+	if _, err := tx.Exec(opCtx, `UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL;`, userID); err != nil {
 		return err
 	}
 
-	if info.Current-sum < 0 {
-		return ErrNotEnoughBalance
-	}
+	return tx.Commit(opCtx)
+}
+
+func (p *pgxStorage) SetUserRole(ctx context.Context, userID uuid.UUID, role string) (err error) {
+	defer wrapError("SetUserRole", &err)
 
-	r.Close()
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
 
-	_, err = tx.Exec(opCtx, `INSERT INTO withdrawal (id, order_number, user_id, sum) VALUES ($1, $2, $3, $4);`, uuid.New(), order, userID, sum)
+	tag, err := p.dbConn.Exec(opCtx, `UPDATE users SET role = $2 WHERE id = $1 AND deleted_at IS NULL;`, userID, role)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+func (p *pgxStorage) AddMerchant(ctx context.Context, merchant *Merchant, apiKeyHash string) (err error) {
+	defer wrapError("AddMerchant", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
 
-	_, err = tx.Exec(opCtx, `UPDATE balance SET current = current - $1, withdrawn = withdrawn + $1, updated_at = NOW() WHERE user_id = $2;`, sum, userID)
+	var host interface{}
+	if len(merchant.Host) != 0 {
+		host = merchant.Host
+	}
+
+	merchant.ID = uuid.New()
+	err = p.dbConn.QueryRow(opCtx, `INSERT INTO merchants (id, name, api_key_hash, host) VALUES ($1, $2, $3, $4) RETURNING created_at;`,
+		merchant.ID, merchant.Name, apiKeyHash, host).Scan(&merchant.CreatedAt)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == UniqueViolationCode {
+			return ErrDuplicateMerchant
+		}
 		return err
 	}
 
-	return tx.Commit(opCtx)
+	return nil
 }
 
-func (p *pgxStorage) AddBalance(ctx context.Context, userID uuid.UUID, amount float64) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+// AddPlacedOrder records that the merchant is placing an order, so points
+// can be withdrawn against it in strict mode. Adding it again has no effect.
+func (p *pgxStorage) AddPlacedOrder(ctx context.Context, merchantID uuid.UUID, orderNumber string) (err error) {
+	defer wrapError("AddPlacedOrder", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
 	defer cancel()
 
-	tx, err := p.dbConn.Begin(opCtx)
+	_, err = p.dbConn.Exec(opCtx, `INSERT INTO placed_orders (merchant_id, order_number) VALUES ($1, $2) ON CONFLICT DO NOTHING;`, merchantID, orderNumber)
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == ForeignKeyViolationCode {
+			return ErrNoSuchMerchant
+		}
 		return err
 	}
-	defer tx.Rollback(p.ctx)
 
-	// log
-	fmt.Printf("AddBalance: %f to user %s\n", amount, userID)
-	_, err = tx.Exec(opCtx, `UPDATE balance SET current = current + $1, updated_at = NOW() WHERE user_id = $2;`, amount, userID)
+	return nil
+}
+
+// IsOrderPlaced reports whether the user's merchant is placing the order.
+func (p *pgxStorage) IsOrderPlaced(ctx context.Context, userID uuid.UUID, orderNumber string) (placed bool, err error) {
+	defer wrapError("IsOrderPlaced", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	err = p.dbConn.QueryRow(opCtx, `SELECT EXISTS (
+		SELECT 1 FROM placed_orders po JOIN users u ON u.merchant_id = po.merchant_id
+		WHERE u.id = $1 AND po.order_number = $2);`, userID, orderNumber).Scan(&placed)
+	return placed, err
+}
+
+func (p *pgxStorage) GetMerchantByAPIKey(ctx context.Context, apiKeyHash string) (_ *Merchant, err error) {
+	defer wrapError("GetMerchantByAPIKey", &err)
+
+	return p.getMerchant(ctx, `api_key_hash = $1`, apiKeyHash)
+}
+
+func (p *pgxStorage) GetMerchantByHost(ctx context.Context, host string) (_ *Merchant, err error) {
+	defer wrapError("GetMerchantByHost", &err)
+
+	return p.getMerchant(ctx, `host = $1`, host)
+}
+
+func (p *pgxStorage) getMerchant(ctx context.Context, condition string, value string) (*Merchant, error) {
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	merchant := Merchant{}
+	var host *string
+	err := p.dbConn.QueryRow(opCtx, `SELECT id, name, host, created_at FROM merchants WHERE `+condition+`;`, value).
+		Scan(&merchant.ID, &merchant.Name, &host, &merchant.CreatedAt)
 	if err != nil {
-		return err
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoSuchMerchant
+		}
+		return nil, err
+	}
+	if host != nil {
+		merchant.Host = *host
 	}
 
-	return tx.Commit(opCtx)
+	return &merchant, nil
+}
+
+// GetNotificationPreferences returns empty preferences for users who never
+// set any.
+func (p *pgxStorage) GetNotificationPreferences(ctx context.Context, userID uuid.UUID) (_ *NotificationPreferences, err error) {
+	defer wrapError("GetNotificationPreferences", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	prefs := NotificationPreferences{UserID: userID}
+	err = p.dbConn.QueryRow(opCtx, `SELECT email, webhook_url FROM notification_preferences WHERE user_id = $1;`, userID).
+		Scan(&prefs.Email, &prefs.WebhookURL)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	return &prefs, nil
+}
+
+func (p *pgxStorage) SetNotificationPreferences(ctx context.Context, prefs NotificationPreferences) (err error) {
+	defer wrapError("SetNotificationPreferences", &err)
+
+	return p.retry(ctx, "SetNotificationPreferences", func() error {
+		return p.setNotificationPreferences(ctx, prefs)
+	})
+}
+
+func (p *pgxStorage) setNotificationPreferences(ctx context.Context, prefs NotificationPreferences) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err := p.dbConn.Exec(opCtx, `INSERT INTO notification_preferences (user_id, email, webhook_url) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET email = EXCLUDED.email, webhook_url = EXCLUDED.webhook_url, updated_at = NOW();`,
+		prefs.UserID, prefs.Email, prefs.WebhookURL)
+	return err
+}
+
+func (p *pgxStorage) DeleteNotificationPreferences(ctx context.Context, userID uuid.UUID) (err error) {
+	defer wrapError("DeleteNotificationPreferences", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `DELETE FROM notification_preferences WHERE user_id = $1;`, userID)
+	return err
 }
 
-func (p *pgxStorage) UpdateBalanceFromOrders(ctx context.Context, orders []Order) error {
-	if len(orders) == 0 {
+func (p *pgxStorage) AddNotificationDeliveries(ctx context.Context, deliveries []NotificationDelivery) (err error) {
+	defer wrapError("AddNotificationDeliveries", &err)
+
+	if len(deliveries) == 0 {
 		return nil
 	}
 
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
 	defer cancel()
 
-	tx, err := p.dbConn.Begin(opCtx)
-	if err != nil {
-		return err
+	userIDs := make([]uuid.UUID, 0, len(deliveries))
+	channels := make([]string, 0, len(deliveries))
+	addresses := make([]string, 0, len(deliveries))
+	payloads := make([]string, 0, len(deliveries))
+	for _, d := range deliveries {
+		userIDs = append(userIDs, d.UserID)
+		channels = append(channels, d.Channel)
+		addresses = append(addresses, d.Address)
+		payloads = append(payloads, string(d.Payload))
 	}
-	defer tx.Rollback(p.ctx)
 
-	totalAmount := make(map[uuid.UUID]float64)
-	for _, o := range orders {
-		_, err = tx.Exec(opCtx, `UPDATE orders SET status=$1, accrual=$2, updated_at=NOW() WHERE order_number=$3;`, o.Status, o.Accrual, o.OrderNumber)
-		if err != nil {
-			p.logger.Sugar().Errorf("UpdateOrders: %s\n", err)
-			return err
+	_, err = p.dbConn.Exec(opCtx, `INSERT INTO notification_outbox (user_id, channel, address, payload)
+		SELECT user_id, channel, address, payload::JSONB FROM unnest($1::UUID[], $2::TEXT[], $3::TEXT[], $4::TEXT[]) AS v(user_id, channel, address, payload);`,
+		userIDs, channels, addresses, payloads)
+	return err
+}
+
+const notificationDeliveryColumns = `id, user_id, channel, address, payload::TEXT, status, attempts, COALESCE(last_error, ''), next_attempt_at, created_at, sent_at`
+
+func scanNotificationDeliveries(r pgx.Rows) ([]NotificationDelivery, error) {
+	deliveries := make([]NotificationDelivery, 0)
+	for r.Next() {
+		d := NotificationDelivery{}
+		var payload string
+		if err := r.Scan(&d.ID, &d.UserID, &d.Channel, &d.Address, &payload, &d.Status, &d.Attempts, &d.LastError, &d.NextAttemptAt, &d.CreatedAt, &d.SentAt); err != nil {
+			return nil, err
 		}
-		totalAmount[o.UserID] += o.Accrual
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
 	}
+	return deliveries, r.Err()
+}
 
-	for id, amount := range totalAmount {
-		_, err = tx.Exec(opCtx, `UPDATE balance SET current = current + $1, updated_at = NOW() WHERE user_id = $2;`, amount, id)
-		if err != nil {
-			p.logger.Sugar().Errorf("UpdateBalanceFromOrders: %s\n", err)
-			return err
-		}
+func (p *pgxStorage) ClaimNotificationDeliveries(ctx context.Context, lease time.Duration, limit int) (_ []NotificationDelivery, err error) {
+	defer wrapError("ClaimNotificationDeliveries", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, `UPDATE notification_outbox SET next_attempt_at = NOW() + make_interval(secs => $1)
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+notificationDeliveryColumns+`;`, lease.Seconds(), limit)
+	if err != nil {
+		return nil, err
 	}
+	defer r.Close()
 
-	return tx.Commit(opCtx)
+	return scanNotificationDeliveries(r)
+}
+
+func (p *pgxStorage) CompleteNotificationDelivery(ctx context.Context, id int64) (err error) {
+	defer wrapError("CompleteNotificationDelivery", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `UPDATE notification_outbox SET status = 'sent', attempts = attempts + 1, sent_at = NOW() WHERE id = $1;`, id)
+	return err
+}
+
+func (p *pgxStorage) FailNotificationDelivery(ctx context.Context, id int64, lastError string, retryAt time.Time) (err error) {
+	defer wrapError("FailNotificationDelivery", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if retryAt.IsZero() {
+		_, err = p.dbConn.Exec(opCtx, `UPDATE notification_outbox SET status = 'failed', attempts = attempts + 1, last_error = $2 WHERE id = $1;`, id, lastError)
+		return err
+	}
+	_, err = p.dbConn.Exec(opCtx, `UPDATE notification_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1;`, id, lastError, retryAt)
+	return err
 }
 
-func (p *pgxStorage) GetBalance(ctx context.Context, userID uuid.UUID) (*BalanceInfo, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetNotificationDeliveries(ctx context.Context, filter NotificationDeliveryFilter) (_ []NotificationDelivery, err error) {
+	defer wrapError("GetNotificationDeliveries", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
 	defer cancel()
 
-	r, err := p.dbConn.Query(opCtx, `SELECT current, withdrawn FROM balance WHERE user_id = $1;`, userID)
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if filter.UserID != uuid.Nil {
+		addCondition("user_id = $%d", filter.UserID)
+	}
+	if filter.MerchantID.Valid {
+		addCondition("user_id IN (SELECT id FROM users WHERE merchant_id = $%d)", filter.MerchantID.UUID)
+	}
+	if len(filter.Status) != 0 {
+		addCondition("status = $%d", filter.Status)
+	}
+	args = append(args, filter.Limit)
 
+	query := fmt.Sprintf(`SELECT %s FROM notification_outbox WHERE %s ORDER BY id DESC LIMIT $%d;`,
+		notificationDeliveryColumns, strings.Join(conditions, " AND "), len(args))
+	r, err := p.dbConn.Query(opCtx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
 
-	info := BalanceInfo{}
+	return scanNotificationDeliveries(r)
+}
+
+func (p *pgxStorage) RevokeToken(ctx context.Context, jti uuid.UUID, expiresAt time.Time) (err error) {
+	defer wrapError("RevokeToken", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if _, err := p.dbConn.Exec(opCtx, `DELETE FROM revoked_tokens WHERE expires_at < NOW();`); err != nil {
+		return err
+	}
+
+	_, err = p.dbConn.Exec(opCtx, `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING;`, jti, expiresAt)
+	return err
+}
+
+func (p *pgxStorage) IsTokenRevoked(ctx context.Context, jti uuid.UUID) (_ bool, err error) {
+	defer wrapError("IsTokenRevoked", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var revoked bool
+	err = p.dbConn.QueryRow(opCtx, `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1);`, jti).Scan(&revoked)
+	return revoked, err
+}
+
+func (p *pgxStorage) AddRefreshToken(ctx context.Context, tokenHash string, userID, sessionID uuid.UUID, expiresAt time.Time) (err error) {
+	defer wrapError("AddRefreshToken", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at) VALUES ($1, $2, $3, $4);`, tokenHash, userID, sessionID, expiresAt)
+	return err
+}
+
+// ConsumeRefreshToken deletes the token and returns its user and session.
+// Tokens issued before sessions were tracked have no session: uuid.Nil is
+// returned for them.
+func (p *pgxStorage) ConsumeRefreshToken(ctx context.Context, tokenHash string) (_, _ uuid.UUID, err error) {
+	defer wrapError("ConsumeRefreshToken", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, `DELETE FROM refresh_tokens WHERE token_hash = $1 RETURNING user_id, session_id, expires_at;`, tokenHash)
+	if err != nil {
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+	defer r.Close()
+
 	if r.Next() {
-		if err := r.Scan(&info.Current, &info.Withdrawn); err != nil {
-			return nil, err
+		var (
+			userID    uuid.UUID
+			sessionID uuid.NullUUID
+			expiresAt time.Time
+		)
+		if err := r.Scan(&userID, &sessionID, &expiresAt); err != nil {
+			return uuid.UUID{}, uuid.UUID{}, err
 		}
+		if expiresAt.Before(time.Now()) {
+			return uuid.UUID{}, uuid.UUID{}, ErrNoSuchToken
+		}
+		return userID, sessionID.UUID, nil
 	}
 	if err := r.Err(); err != nil {
-		return nil, err
+		return uuid.UUID{}, uuid.UUID{}, err
 	}
 
-	return &info, nil
+	return uuid.UUID{}, uuid.UUID{}, ErrNoSuchToken
+}
+
+func (p *pgxStorage) StartSession(ctx context.Context, session *Session) (err error) {
+	defer wrapError("StartSession", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return p.dbConn.QueryRow(opCtx, `INSERT INTO sessions (id, user_id, jti, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING created_at, last_seen_at;`,
+		session.ID, session.UserID, session.JTI, session.UserAgent, session.IP, session.ExpiresAt).
+		Scan(&session.CreatedAt, &session.LastSeenAt)
+}
+
+// RenewSession records a new token pair issued to a session.
+func (p *pgxStorage) RenewSession(ctx context.Context, sessionID, jti uuid.UUID, expiresAt time.Time) (err error) {
+	defer wrapError("RenewSession", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tag, err := p.dbConn.Exec(opCtx, `UPDATE sessions SET jti = $2, expires_at = $3, last_seen_at = NOW() WHERE id = $1 AND revoked_at IS NULL;`,
+		sessionID, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchSession
+	}
+	return nil
 }
 
-func (p *pgxStorage) GetWithdrawals(ctx context.Context, userID uuid.UUID) ([]Withdrawal, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+// TouchSession fails with ErrNoSuchSession unless the session is active. It
+// updates the last seen time at most once a minute to spare the writes.
+func (p *pgxStorage) TouchSession(ctx context.Context, userID, sessionID uuid.UUID) (err error) {
+	defer wrapError("TouchSession", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
 	defer cancel()
 
-	r, err := p.dbConn.Query(opCtx, `SELECT order_number, sum, processed_at FROM withdrawal WHERE user_id = $1;`, userID)
+	var active bool
+	err = p.dbConn.QueryRow(opCtx, `WITH s AS (
+			SELECT id, last_seen_at FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+		), touched AS (
+			UPDATE sessions SET last_seen_at = NOW() FROM s
+			WHERE sessions.id = s.id AND s.last_seen_at < NOW() - INTERVAL '1 minute'
+		)
+		SELECT EXISTS (SELECT 1 FROM s);`, sessionID, userID).Scan(&active)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrNoSuchSession
+	}
+	return nil
+}
+
+func (p *pgxStorage) GetSessions(ctx context.Context, userID uuid.UUID) (_ []Session, err error) {
+	defer wrapError("GetSessions", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
 
+	r, err := p.dbConn.Query(opCtx, `SELECT id, jti, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW() ORDER BY last_seen_at DESC;`, userID)
 	if err != nil {
-		p.logger.Sugar().Errorf("GetWithdrawals: %s\n", err)
 		return nil, err
 	}
 	defer r.Close()
 
-	ws := make([]Withdrawal, 0)
+	sessions := make([]Session, 0)
 	for r.Next() {
-		w := Withdrawal{}
-		if err := r.Scan(&w.OrderNumber, &w.Sum, &w.ProcessedAt); err != nil {
-			p.logger.Sugar().Errorf("GetWithdrawals: %s\n", err)
+		s := Session{UserID: userID}
+		if err := r.Scan(&s.ID, &s.JTI, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
 			return nil, err
 		}
-		ws = append(ws, w)
-	}
-	if err := r.Err(); err != nil {
-		return nil, err
+		sessions = append(sessions, s)
 	}
 
-	p.logger.Sugar().Infof("GetWithdrawals: %v", ws)
-	return ws, nil
+	return sessions, r.Err()
+}
+
+// RevokeSession ends a session of the user and drops its refresh tokens.
+func (p *pgxStorage) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) (err error) {
+	defer wrapError("RevokeSession", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	tag, err := tx.Exec(opCtx, `UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchSession
+	}
+
+	if _, err := tx.Exec(opCtx, `DELETE FROM refresh_tokens WHERE session_id = $1;`, sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit(opCtx)
+}
+
+// RecordLoginFailure counts a failed login for key and returns the number of
+// failures since the given time. A key that failed last before then starts
+// over at one.
+func (p *pgxStorage) RecordLoginFailure(ctx context.Context, key string, since time.Time) (_ int, err error) {
+	defer wrapError("RecordLoginFailure", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var failures int
+	err = p.dbConn.QueryRow(opCtx, `INSERT INTO login_attempts (key, failures) VALUES ($1, 1)
+		ON CONFLICT (key) DO UPDATE SET updated_at = NOW(),
+			failures = CASE WHEN login_attempts.updated_at < $2 THEN 1 ELSE login_attempts.failures + 1 END
+		RETURNING failures;`, key, since).Scan(&failures)
+	return failures, err
+}
+
+func (p *pgxStorage) LockLogin(ctx context.Context, key string, until time.Time) (err error) {
+	defer wrapError("LockLogin", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `UPDATE login_attempts SET locked_until = $2, updated_at = NOW() WHERE key = $1;`, key, until)
+	return err
+}
+
+// GetLoginLock returns when the lock on key expires, or the zero time when
+// key isn't locked.
+func (p *pgxStorage) GetLoginLock(ctx context.Context, key string) (_ time.Time, err error) {
+	defer wrapError("GetLoginLock", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var until *time.Time
+	err = p.dbConn.QueryRow(opCtx, `SELECT locked_until FROM login_attempts WHERE key = $1 AND locked_until > NOW();`, key).Scan(&until)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if until == nil {
+		return time.Time{}, nil
+	}
+	return *until, nil
+}
+
+func (p *pgxStorage) ResetLoginFailures(ctx context.Context, key string) (err error) {
+	defer wrapError("ResetLoginFailures", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `DELETE FROM login_attempts WHERE key = $1;`, key)
+	return err
+}
+
+func (p *pgxStorage) AddOrder(ctx context.Context, merchantID, userID uuid.UUID, orderNumber string) (err error) {
+	defer wrapError("AddOrder", &err)
+
+	return p.retry(ctx, "AddOrder", func() error {
+		return p.addOrder(ctx, merchantID, userID, orderNumber)
+	})
+}
+
+func (p *pgxStorage) addOrder(ctx context.Context, merchantID, userID uuid.UUID, orderNumber string) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	insertQuery := `INSERT INTO orders (id, user_id, merchant_id, order_number) VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(opCtx, insertQuery, uuid.New(), userID, merchantID, orderNumber)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != UniqueViolationCode {
+			return err
+		}
+	} else {
+		return tx.Commit(opCtx)
+	}
+
+	return checkDuplicateOrder(p, opCtx, merchantID, orderNumber, userID)
+}
+
+func checkDuplicateOrder(p *pgxStorage, opCtx context.Context, merchantID uuid.UUID, orderNumber string, userID uuid.UUID) error {
+	query := `SELECT user_id FROM orders WHERE merchant_id = $1 AND order_number = $2`
+	r, err := p.dbConn.Query(opCtx, query, merchantID, orderNumber)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if r.Next() {
+		clientID := uuid.UUID{}
+		if err := r.Scan(&clientID); err != nil {
+			return err
+		}
+		if clientID == userID {
+			return ErrOrderAlreadyPlaced
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	return ErrDuplicateOrder
+}
+
+func (p *pgxStorage) UpdateOrder(ctx context.Context, order Order) (err error) {
+	defer wrapError("UpdateOrder", &err)
+
+	return p.retry(ctx, "UpdateOrder", func() error {
+		return p.updateOrder(ctx, order)
+	})
+}
+
+// updateOrder only moves the order to a status the order state machine
+// allows from its current one.
+func (p *pgxStorage) updateOrder(ctx context.Context, order Order) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var sources []string
+	for from := range orderTransitions {
+		if CanTransition(from, order.Status) {
+			sources = append(sources, from)
+		}
+	}
+
+	tag, err := p.dbConn.Exec(opCtx, `UPDATE orders SET status=$1, accrual=$2, updated_at=NOW() WHERE order_number=$3 AND status = ANY($4);`, order.Status, order.Accrual, order.OrderNumber, sources)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidTransition
+	}
+	return nil
+}
+
+// RequeueOrder puts a non-final order back into the accrual queue.
+func (p *pgxStorage) RequeueOrder(ctx context.Context, orderNumber string) (err error) {
+	defer wrapError("RequeueOrder", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tag, err := p.dbConn.Exec(opCtx, `UPDATE orders SET status='NEW', updated_at=NOW() WHERE order_number=$1 AND status <> 'PROCESSED';`, orderNumber)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchOrder
+	}
+
+	return nil
+}
+
+func (p *pgxStorage) SetOrderFiscalStatus(ctx context.Context, orderNumber string, fiscalStatus string, reason string, invalid bool) (err error) {
+	defer wrapError("SetOrderFiscalStatus", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	query := `UPDATE orders SET fiscal_status=$1, fiscal_reason=$2, updated_at=NOW() WHERE order_number=$3;`
+	if invalid {
+		query = `UPDATE orders SET fiscal_status=$1, fiscal_reason=$2, status='INVALID', updated_at=NOW() WHERE order_number=$3;`
+	}
+
+	_, err = p.dbConn.Exec(opCtx, query, fiscalStatus, reason, orderNumber)
+	return err
+}
+
+func (p *pgxStorage) GetOrders(ctx context.Context, userID uuid.UUID) (_ []Order, err error) {
+	defer wrapError("GetOrders", &err)
+
+	var result []Order
+	err = p.read(ctx, func(db dbConn) (err error) {
+		result, err = p.getOrders(ctx, db, userID)
+		return err
+	})
+	return result, err
+}
+
+func (p *pgxStorage) GetOrdersVersion(ctx context.Context, userID uuid.UUID) (_ OrdersVersion, err error) {
+	defer wrapError("GetOrdersVersion", &err)
+
+	var version OrdersVersion
+	err = p.read(ctx, func(db dbConn) error {
+		opCtx, cancel := p.withTimeout(ctx, opRead)
+		defer cancel()
+
+		return db.QueryRow(opCtx, `SELECT COALESCE(MAX(updated_at), to_timestamp(0)), COUNT(*) FROM orders WHERE user_id = $1;`, userID).
+			Scan(&version.UpdatedAt, &version.Count)
+	})
+	return version, err
+}
+
+func (p *pgxStorage) getOrders(ctx context.Context, db dbConn, userID uuid.UUID) ([]Order, error) {
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := db.Query(opCtx, `SELECT order_number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC;`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	orders := make([]Order, 0)
+	for r.Next() {
+		order := Order{
+			UserID: userID,
+		}
+		if err := r.Scan(&order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (p *pgxStorage) GetOrdersPage(ctx context.Context, userID uuid.UUID, filter OrdersFilter, cursor string, limit int) (_ *OrdersPage, err error) {
+	defer wrapError("GetOrdersPage", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	sortColumn := "uploaded_at"
+	if filter.Sort == OrdersSortAccrual {
+		sortColumn = "accrual"
+	}
+
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{userID}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if len(filter.Statuses) != 0 {
+		addCondition("status = ANY($%d)", filter.Statuses)
+	}
+	if !filter.From.IsZero() {
+		addCondition("uploaded_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("uploaded_at < $%d", filter.To)
+	}
+
+	page := &OrdersPage{Orders: make([]Order, 0, limit)}
+	where := strings.Join(conditions, " AND ")
+	if err := p.dbConn.QueryRow(opCtx, `SELECT COUNT(*) FROM orders WHERE `+where+`;`, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	if len(cursor) != 0 {
+		key, orderNumber, err := decodeOrdersCursor(filter.Sort, cursor)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, key, orderNumber)
+		conditions = append(conditions, fmt.Sprintf("(%s, order_number) < ($%d, $%d)", sortColumn, len(args)-1, len(args)))
+		where = strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`SELECT order_number, status, accrual, uploaded_at FROM orders WHERE %s
+		ORDER BY %s DESC, order_number DESC LIMIT $%d;`, where, sortColumn, len(args))
+	r, err := p.dbConn.Query(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		order := Order{UserID: userID}
+		if err := r.Scan(&order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
+			return nil, err
+		}
+		page.Orders = append(page.Orders, order)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Orders) == limit {
+		page.NextCursor = encodeOrdersCursor(filter.Sort, page.Orders[len(page.Orders)-1])
+	}
+
+	return page, nil
+}
+
+// ClaimUnfinishedOrders leases up to limit unfinished orders that match filter
+// to owner, so several instances can share the accrual workload without
+// polling the same orders. Orders already leased to owner are renewed; those
+// leased to another instance are skipped until the lease expires, e.g. after
+// that instance crashed.
+func (p *pgxStorage) ClaimUnfinishedOrders(ctx context.Context, owner string, lease time.Duration, filter ClaimFilter, limit int) (_ []Order, err error) {
+	defer wrapError("ClaimUnfinishedOrders", &err)
+
+	var result []Order
+	err = p.retry(ctx, "ClaimUnfinishedOrders", func() (err error) {
+		result, err = p.claimUnfinishedOrders(ctx, owner, lease, filter, limit)
+		return err
+	})
+	return result, err
+}
+
+func (p *pgxStorage) claimUnfinishedOrders(ctx context.Context, owner string, lease time.Duration, filter ClaimFilter, limit int) ([]Order, error) {
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{owner, lease.Seconds()}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if !filter.UpdatedSince.IsZero() {
+		addCondition("updated_at >= $%d", filter.UpdatedSince)
+	}
+	if !filter.UpdatedBefore.IsZero() {
+		addCondition("updated_at < $%d", filter.UpdatedBefore)
+	}
+	orderBy := "uploaded_at"
+	if filter.ByNumber {
+		addCondition("order_number > $%d", filter.AfterNumber)
+		orderBy = "order_number"
+	}
+	args = append(args, limit)
+
+	// SKIP LOCKED lets concurrent claims pass each other instead of waiting
+	// for, and then taking, the same rows.
+	query := fmt.Sprintf(`UPDATE orders SET claimed_by = $1, claimed_until = NOW() + make_interval(secs => $2)
+		WHERE order_number IN (
+			SELECT order_number FROM orders
+			WHERE status IN ('NEW', 'PROCESSING')
+				AND (claimed_until IS NULL OR claimed_until < NOW() OR claimed_by = $1)
+				AND NOT EXISTS (SELECT 1 FROM accrual_dead_letter d WHERE d.order_number = orders.order_number)
+				AND %s
+			ORDER BY %s
+			LIMIT $%d
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING order_number, user_id, status, accrual, uploaded_at, accrual_registered_at IS NOT NULL;`, strings.Join(conditions, " AND "), orderBy, len(args))
+	r, err := p.dbConn.Query(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	orders := make([]Order, 0)
+	for r.Next() {
+		order := Order{}
+		if err := r.Scan(&order.OrderNumber, &order.UserID, &order.Status, &order.Accrual, &order.UploadedAt, &order.Registered); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	p.logger.Debug("claimed unfinished orders", zap.String("owner", owner), zap.Int("count", len(orders)))
+	return orders, nil
+}
+
+// ReleaseOrderClaims gives up the leases held by owner, so other instances
+// can take over its orders at once instead of after the lease expires.
+func (p *pgxStorage) ReleaseOrderClaims(ctx context.Context, owner string) (err error) {
+	defer wrapError("ReleaseOrderClaims", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `UPDATE orders SET claimed_by = NULL, claimed_until = NULL WHERE claimed_by = $1 AND status IN ('NEW', 'PROCESSING');`, owner)
+	return err
+}
+
+func (p *pgxStorage) GetOrder(ctx context.Context, orderNumber string) (_ *Order, err error) {
+	defer wrapError("GetOrder", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	order := Order{}
+	var userID uuid.UUID
+	err = p.dbConn.QueryRow(opCtx, `SELECT order_number, user_id, status, accrual, uploaded_at FROM orders WHERE order_number = $1;`, orderNumber).
+		Scan(&order.OrderNumber, &userID, &order.Status, &order.Accrual, &order.UploadedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoSuchOrder
+		}
+		return nil, err
+	}
+	order.UserID = userID
+
+	return &order, nil
+}
+
+// GetOrderByNumber returns the order only if it belongs to the user, so that
+// foreign and unknown orders are indistinguishable to the caller.
+func (p *pgxStorage) GetOrderByNumber(ctx context.Context, userID uuid.UUID, orderNumber string) (_ *Order, err error) {
+	defer wrapError("GetOrderByNumber", &err)
+
+	var result *Order
+	err = p.read(ctx, func(db dbConn) (err error) {
+		result, err = p.getOrderByNumber(ctx, db, userID, orderNumber)
+		return err
+	})
+	return result, err
+}
+
+func (p *pgxStorage) getOrderByNumber(ctx context.Context, db dbConn, userID uuid.UUID, orderNumber string) (*Order, error) {
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	order := Order{UserID: userID}
+	err := db.QueryRow(opCtx, `SELECT order_number, status, accrual, uploaded_at, updated_at,
+		accrual_registered_at IS NOT NULL, COALESCE(accrual_registration_error, '') FROM orders
+		WHERE order_number = $1 AND user_id = $2;`, orderNumber, userID).
+		Scan(&order.OrderNumber, &order.Status, &order.Accrual, &order.UploadedAt, &order.UpdatedAt, &order.Registered, &order.RegistrationError)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoSuchOrder
+		}
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+// RecordAccrualNotFound counts a "not found" answer from the accrual system
+// for the order and returns how many it has received so far.
+func (p *pgxStorage) RecordAccrualNotFound(ctx context.Context, orderNumber string) (_ int, err error) {
+	defer wrapError("RecordAccrualNotFound", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var count int
+	err = p.dbConn.QueryRow(opCtx, `UPDATE orders SET not_found_count = not_found_count + 1 WHERE order_number = $1 RETURNING not_found_count;`, orderNumber).
+		Scan(&count)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNoSuchOrder
+		}
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// RecordAccrualFailure counts a failed accrual lookup for the order and
+// returns how many it has had so far.
+func (p *pgxStorage) RecordAccrualFailure(ctx context.Context, orderNumber string) (_ int, err error) {
+	defer wrapError("RecordAccrualFailure", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var count int
+	err = p.dbConn.QueryRow(opCtx, `UPDATE orders SET accrual_failures = accrual_failures + 1 WHERE order_number = $1 RETURNING accrual_failures;`, orderNumber).
+		Scan(&count)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, ErrNoSuchOrder
+		}
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// DeadLetterOrder stops polling the accrual system for the order until it is
+// redriven.
+func (p *pgxStorage) DeadLetterOrder(ctx context.Context, letter DeadLetter) (err error) {
+	defer wrapError("DeadLetterOrder", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `INSERT INTO accrual_dead_letter (order_number, failures, last_error) VALUES ($1, $2, $3)
+		ON CONFLICT (order_number) DO UPDATE SET failures = EXCLUDED.failures, last_error = EXCLUDED.last_error;`,
+		letter.OrderNumber, letter.Failures, letter.LastError)
+	return err
+}
+
+func (p *pgxStorage) MarkOrderRegistered(ctx context.Context, orderNumber string) (err error) {
+	defer wrapError("MarkOrderRegistered", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `UPDATE orders SET accrual_registered_at = NOW(), accrual_registration_error = NULL WHERE order_number = $1;`, orderNumber)
+	return err
+}
+
+// SetOrderRegistrationError records why registering the order with the
+// accrual system failed; the user sees it on the order.
+func (p *pgxStorage) SetOrderRegistrationError(ctx context.Context, orderNumber string, message string) (err error) {
+	defer wrapError("SetOrderRegistrationError", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = p.dbConn.Exec(opCtx, `UPDATE orders SET accrual_registration_error = $2, updated_at = NOW() WHERE order_number = $1;`, orderNumber, message)
+	return err
+}
+
+func (p *pgxStorage) GetAccrualBacklog(ctx context.Context) (_ *AccrualBacklog, err error) {
+	defer wrapError("GetAccrualBacklog", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var backlog AccrualBacklog
+	var oldest *time.Time
+	err = p.dbConn.QueryRow(opCtx, `SELECT COUNT(*), MIN(uploaded_at) FROM orders WHERE status IN ('NEW', 'PROCESSING');`).Scan(&backlog.Orders, &oldest)
+	if err != nil {
+		return nil, err
+	}
+	if oldest != nil {
+		backlog.OldestUploadedAt = *oldest
+	}
+
+	return &backlog, nil
+}
+
+func (p *pgxStorage) GetDeadLetters(ctx context.Context) (_ []DeadLetter, err error) {
+	defer wrapError("GetDeadLetters", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, `SELECT order_number, failures, last_error, created_at FROM accrual_dead_letter ORDER BY created_at;`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	letters := make([]DeadLetter, 0)
+	for r.Next() {
+		l := DeadLetter{}
+		if err := r.Scan(&l.OrderNumber, &l.Failures, &l.LastError, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return letters, nil
+}
+
+// RedriveOrder takes the order out of the dead-letter queue with fresh
+// failure counters, so the accrual poller picks it up again.
+func (p *pgxStorage) RedriveOrder(ctx context.Context, orderNumber string) (err error) {
+	defer wrapError("RedriveOrder", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	tag, err := tx.Exec(opCtx, `DELETE FROM accrual_dead_letter WHERE order_number = $1;`, orderNumber)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchOrder
+	}
+
+	if _, err := tx.Exec(opCtx, `UPDATE orders SET accrual_failures = 0, not_found_count = 0, updated_at = NOW() WHERE order_number = $1;`, orderNumber); err != nil {
+		return err
+	}
+
+	return tx.Commit(opCtx)
+}
+
+func (p *pgxStorage) Withdraw(ctx context.Context, userID uuid.UUID, order string, sum money.Amount, idempotencyKey string) (err error) {
+	defer wrapError("Withdraw", &err)
+
+	return p.retry(ctx, "Withdraw", func() error {
+		return p.withdraw(ctx, userID, order, sum, idempotencyKey)
+	})
+}
+
+func (p *pgxStorage) withdraw(ctx context.Context, userID uuid.UUID, order string, sum money.Amount, idempotencyKey string) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if len(idempotencyKey) != 0 {
+		replayed, err := p.replayWithdrawal(opCtx, userID, order, sum, idempotencyKey)
+		if replayed || err != nil {
+			return err
+		}
+	}
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	// The balance check and the debit are a single conditional UPDATE, so
+	// concurrent withdrawals serialize on the row lock and can't overdraw.
+	info := BalanceInfo{}
+	err = tx.QueryRow(opCtx, `UPDATE balance SET current = current - $1, withdrawn = withdrawn + $1, updated_at = NOW() WHERE user_id = $2 AND current >= $1 RETURNING current, withdrawn;`, sum, userID).
+		Scan(&info.Current, &info.Withdrawn)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotEnoughBalance
+		}
+		return err
+	}
+
+	var key *string
+	if len(idempotencyKey) != 0 {
+		key = &idempotencyKey
+	}
+
+	_, err = tx.Exec(opCtx, `INSERT INTO withdrawal (id, order_number, user_id, sum, idempotency_key) VALUES ($1, $2, $3, $4, $5);`, uuid.New(), order, userID, sum, key)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == UniqueViolationCode {
+			// A concurrent request with the same key may have won the race.
+			if key != nil {
+				tx.Rollback(p.ctx)
+				if replayed, err := p.replayWithdrawal(opCtx, userID, order, sum, idempotencyKey); replayed || err != nil {
+					return err
+				}
+			}
+			return ErrDuplicateOrder
+		}
+		return err
+	}
+
+	if err := addLedgerEntry(opCtx, tx, userID, LedgerWithdrawal, order, -sum, info.Current); err != nil {
+		return err
+	}
+
+	err = addAuditEntry(opCtx, tx, BalanceAuditEntry{
+		UserID:          userID,
+		Source:          LedgerWithdrawal,
+		Reference:       order,
+		CurrentBefore:   info.Current + sum,
+		CurrentAfter:    info.Current,
+		WithdrawnBefore: info.Withdrawn - sum,
+		WithdrawnAfter:  info.Withdrawn,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(opCtx)
+}
+
+// replayWithdrawal reports whether a withdrawal with the same idempotency key
+// has already been made. A key reused for a different order or sum is an error.
+func (p *pgxStorage) replayWithdrawal(ctx context.Context, userID uuid.UUID, order string, sum money.Amount, idempotencyKey string) (bool, error) {
+	var storedOrder string
+	var storedSum money.Amount
+	err := p.dbConn.QueryRow(ctx, `SELECT order_number, sum FROM withdrawal WHERE user_id = $1 AND idempotency_key = $2;`, userID, idempotencyKey).
+		Scan(&storedOrder, &storedSum)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if storedOrder != order || storedSum != sum {
+		return true, ErrIdempotencyKeyUsed
+	}
+	return true, nil
+}
+
+func (p *pgxStorage) AddBalance(ctx context.Context, userID uuid.UUID, amount money.Amount) (err error) {
+	defer wrapError("AddBalance", &err)
+
+	return p.retry(ctx, "AddBalance", func() error {
+		return p.addBalance(ctx, userID, amount)
+	})
+}
+
+func (p *pgxStorage) addBalance(ctx context.Context, userID uuid.UUID, amount money.Amount) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	if err := creditBalance(opCtx, tx, userID, LedgerCredit, "", amount); err != nil {
+		return err
+	}
+
+	return tx.Commit(opCtx)
+}
+
+func (p *pgxStorage) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (_ *BalanceInfo, err error) {
+	defer wrapError("AdjustBalance", &err)
+
+	var result *BalanceInfo
+	err = p.retry(ctx, "AdjustBalance", func() (err error) {
+		result, err = p.adjustBalance(ctx, adjustment)
+		return err
+	})
+	return result, err
+}
+
+func (p *pgxStorage) adjustBalance(ctx context.Context, adjustment BalanceAdjustment) (*BalanceInfo, error) {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(p.ctx)
+
+	info := BalanceInfo{}
+	err = tx.QueryRow(opCtx, `UPDATE balance SET current = current + $1, updated_at = NOW() WHERE user_id = $2 AND current + $1 >= 0 RETURNING current, withdrawn;`,
+		adjustment.Amount, adjustment.UserID).Scan(&info.Current, &info.Withdrawn)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotEnoughBalance
+		}
+		return nil, err
+	}
+
+	adjustmentID := uuid.New()
+	_, err = tx.Exec(opCtx, `INSERT INTO balance_adjustments (id, user_id, amount, reason_code, reason, operator) VALUES ($1, $2, $3, $4, $5, $6);`,
+		adjustmentID, adjustment.UserID, adjustment.Amount, adjustment.ReasonCode, adjustment.Reason, adjustment.Operator)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user sees the reason code in their history; the free-text reason
+	// is for staff only.
+	if err := addLedgerEntry(opCtx, tx, adjustment.UserID, LedgerAdjustment, adjustment.ReasonCode, adjustment.Amount, info.Current); err != nil {
+		return nil, err
+	}
+
+	err = addAuditEntry(opCtx, tx, BalanceAuditEntry{
+		UserID:          adjustment.UserID,
+		Source:          LedgerAdjustment,
+		Reference:       adjustmentID.String(),
+		CurrentBefore:   info.Current - adjustment.Amount,
+		CurrentAfter:    info.Current,
+		WithdrawnBefore: info.Withdrawn,
+		WithdrawnAfter:  info.Withdrawn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(opCtx); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// UpdateBalanceFromOrders stores accrual results and credits balances in one
+// transaction. Orders no longer in the status a transition starts from are
+// skipped, so replaying the same results after a crash never credits a
+// balance twice. A transition the order state machine doesn't allow fails the
+// whole batch with ErrInvalidTransition.
+func (p *pgxStorage) UpdateBalanceFromOrders(ctx context.Context, transitions []OrderTransition) (err error) {
+	defer wrapError("UpdateBalanceFromOrders", &err)
+
+	for _, t := range transitions {
+		if err := t.Check(); err != nil {
+			return err
+		}
+	}
+
+	return p.retry(ctx, "UpdateBalanceFromOrders", func() error {
+		return p.updateBalanceFromOrders(ctx, transitions)
+	})
+}
+
+func (p *pgxStorage) updateBalanceFromOrders(ctx context.Context, transitions []OrderTransition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	numbers := make([]string, 0, len(transitions))
+	froms := make([]string, 0, len(transitions))
+	statuses := make([]string, 0, len(transitions))
+	accruals := make([]string, 0, len(transitions))
+	seen := make(map[string]bool, len(transitions))
+	for _, t := range transitions {
+		if seen[t.OrderNumber] {
+			continue
+		}
+		seen[t.OrderNumber] = true
+		numbers = append(numbers, t.OrderNumber)
+		froms = append(froms, t.From)
+		statuses = append(statuses, t.Status)
+		accruals = append(accruals, t.Accrual.String())
+	}
+
+	// One statement updates the orders and credits the accruals, so the
+	// whole batch is a single round-trip and needs no explicit transaction.
+	// An order is only updated while still in the status the transition
+	// starts from, so a repeated result is not paid twice. Ledger and audit
+	// entries carry the running balance per user in order number order.
+	_, err := p.dbConn.Exec(opCtx, `
+		WITH updated AS (
+			UPDATE orders o SET status = v.status, accrual = v.accrual::NUMERIC, updated_at = NOW()
+			FROM unnest($1::TEXT[], $2::TEXT[], $3::TEXT[], $6::TEXT[]) AS v(order_number, status, accrual, from_status)
+			WHERE o.order_number = v.order_number AND o.status = v.from_status
+			RETURNING o.user_id, o.order_number, o.status, o.accrual
+		), credited AS (
+			SELECT user_id, order_number, accrual FROM updated WHERE status = $4 AND accrual <> 0
+		), totals AS (
+			SELECT user_id, SUM(accrual) AS total FROM credited GROUP BY user_id
+		), b AS (
+			UPDATE balance SET current = current + t.total, updated_at = NOW()
+			FROM totals t WHERE balance.user_id = t.user_id
+			RETURNING balance.user_id, balance.current - t.total AS before, balance.withdrawn
+		), l AS (
+			INSERT INTO ledger (user_id, kind, reference, amount, balance)
+			SELECT c.user_id, $5, c.order_number, c.accrual,
+				b.before + SUM(c.accrual) OVER (PARTITION BY c.user_id ORDER BY c.order_number)
+			FROM credited c JOIN b ON b.user_id = c.user_id
+			ORDER BY c.user_id, c.order_number
+			RETURNING id, user_id, reference, amount, balance
+		)
+		INSERT INTO balance_audit (user_id, source, reference, current_before, current_after, withdrawn_before, withdrawn_after)
+		SELECT l.user_id, $5, l.reference, l.balance - l.amount, l.balance, b.withdrawn, b.withdrawn
+		FROM l JOIN b ON b.user_id = l.user_id
+		ORDER BY l.id;`,
+		numbers, statuses, accruals, StatusProcessed, LedgerAccrual, froms)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func creditBalance(ctx context.Context, tx pgx.Tx, userID uuid.UUID, kind, reference string, amount money.Amount) error {
+	info := BalanceInfo{}
+	err := tx.QueryRow(ctx, `UPDATE balance SET current = current + $1, updated_at = NOW() WHERE user_id = $2 RETURNING current, withdrawn;`, amount, userID).
+		Scan(&info.Current, &info.Withdrawn)
+	if err != nil {
+		return err
+	}
+
+	if err := addLedgerEntry(ctx, tx, userID, kind, reference, amount, info.Current); err != nil {
+		return err
+	}
+
+	return addAuditEntry(ctx, tx, BalanceAuditEntry{
+		UserID:          userID,
+		Source:          kind,
+		Reference:       reference,
+		CurrentBefore:   info.Current - amount,
+		CurrentAfter:    info.Current,
+		WithdrawnBefore: info.Withdrawn,
+		WithdrawnAfter:  info.Withdrawn,
+	})
+}
+
+func addLedgerEntry(ctx context.Context, tx pgx.Tx, userID uuid.UUID, kind, reference string, amount, balance money.Amount) error {
+	var ref *string
+	if len(reference) != 0 {
+		ref = &reference
+	}
+
+	_, err := tx.Exec(ctx, `INSERT INTO ledger (user_id, kind, reference, amount, balance) VALUES ($1, $2, $3, $4, $5);`, userID, kind, ref, amount, balance)
+	return err
+}
+
+func addAuditEntry(ctx context.Context, tx pgx.Tx, e BalanceAuditEntry) error {
+	var ref *string
+	if len(e.Reference) != 0 {
+		ref = &e.Reference
+	}
+
+	_, err := tx.Exec(ctx, `INSERT INTO balance_audit (user_id, source, reference, current_before, current_after, withdrawn_before, withdrawn_after) VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+		e.UserID, e.Source, ref, e.CurrentBefore, e.CurrentAfter, e.WithdrawnBefore, e.WithdrawnAfter)
+	return err
+}
+
+func (p *pgxStorage) GetLedger(ctx context.Context, userID uuid.UUID) (_ []LedgerEntry, err error) {
+	defer wrapError("GetLedger", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, `SELECT kind, COALESCE(reference, ''), amount, balance, created_at FROM ledger WHERE user_id = $1 ORDER BY id;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]LedgerEntry, 0)
+	for r.Next() {
+		e := LedgerEntry{}
+		if err := r.Scan(&e.Kind, &e.Reference, &e.Amount, &e.Balance, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (p *pgxStorage) GetBalanceAudit(ctx context.Context, filter BalanceAuditFilter) (_ []BalanceAuditEntry, err error) {
+	defer wrapError("GetBalanceAudit", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if filter.UserID != uuid.Nil {
+		addCondition("user_id = $%d", filter.UserID)
+	}
+	if filter.MerchantID.Valid {
+		addCondition("user_id IN (SELECT id FROM users WHERE merchant_id = $%d)", filter.MerchantID.UUID)
+	}
+	if len(filter.Reference) != 0 {
+		addCondition("reference = $%d", filter.Reference)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at < $%d", filter.To)
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`SELECT id, user_id, source, COALESCE(reference, ''), current_before, current_after, withdrawn_before, withdrawn_after, created_at
+		FROM balance_audit WHERE %s ORDER BY id DESC LIMIT $%d;`, strings.Join(conditions, " AND "), len(args))
+	r, err := p.dbConn.Query(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]BalanceAuditEntry, 0)
+	for r.Next() {
+		e := BalanceAuditEntry{}
+		if err := r.Scan(&e.ID, &e.UserID, &e.Source, &e.Reference, &e.CurrentBefore, &e.CurrentAfter, &e.WithdrawnBefore, &e.WithdrawnAfter, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, r.Err()
+}
+
+func (p *pgxStorage) GetBalance(ctx context.Context, userID uuid.UUID) (_ *BalanceInfo, err error) {
+	defer wrapError("GetBalance", &err)
+
+	var result *BalanceInfo
+	err = p.retryRead(ctx, "GetBalance", func() error {
+		return p.read(ctx, func(db dbConn) (err error) {
+			result, err = p.getBalance(ctx, db, userID)
+			return err
+		})
+	})
+	return result, err
+}
+
+func (p *pgxStorage) getBalance(ctx context.Context, db dbConn, userID uuid.UUID) (*BalanceInfo, error) {
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := db.Query(opCtx, `SELECT current, withdrawn, COALESCE(updated_at, to_timestamp(0)) FROM balance WHERE user_id = $1;`, userID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	info := BalanceInfo{}
+	if r.Next() {
+		if err := r.Scan(&info.Current, &info.Withdrawn, &info.UpdatedAt); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (p *pgxStorage) GetWithdrawals(ctx context.Context, userID uuid.UUID) (_ []Withdrawal, err error) {
+	defer wrapError("GetWithdrawals", &err)
+
+	var result []Withdrawal
+	err = p.read(ctx, func(db dbConn) (err error) {
+		result, err = p.getWithdrawals(ctx, db, userID)
+		return err
+	})
+	return result, err
+}
+
+func (p *pgxStorage) getWithdrawals(ctx context.Context, db dbConn, userID uuid.UUID) ([]Withdrawal, error) {
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := db.Query(opCtx, `SELECT order_number, sum, processed_at FROM withdrawal WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ws := make([]Withdrawal, 0)
+	for r.Next() {
+		w := Withdrawal{}
+		if err := r.Scan(&w.OrderNumber, &w.Sum, &w.ProcessedAt); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func (p *pgxStorage) GetWithdrawalsForPeriod(ctx context.Context, from, to time.Time) (_ []Withdrawal, err error) {
+	defer wrapError("GetWithdrawalsForPeriod", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, `SELECT order_number, user_id, sum, processed_at FROM withdrawal WHERE processed_at >= $1 AND processed_at < $2 ORDER BY processed_at;`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ws := make([]Withdrawal, 0)
+	for r.Next() {
+		w := Withdrawal{}
+		if err := r.Scan(&w.OrderNumber, &w.UserID, &w.Sum, &w.ProcessedAt); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+func (p *pgxStorage) GetAccountingSummary(ctx context.Context, from, to time.Time) (_ *AccountingSummary, err error) {
+	defer wrapError("GetAccountingSummary", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	query := `SELECT
+		(SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE status = 'PROCESSED' AND updated_at >= $1 AND updated_at < $2),
+		(SELECT COALESCE(SUM(sum), 0) FROM withdrawal WHERE processed_at >= $1 AND processed_at < $2),
+		(SELECT COALESCE(SUM(current), 0) FROM balance);`
+
+	summary := AccountingSummary{}
+	if err := p.dbConn.QueryRow(opCtx, query, from, to).Scan(&summary.Accrued, &summary.Redeemed, &summary.Liability); err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+func (p *pgxStorage) GetUserStats(ctx context.Context, userID uuid.UUID, since time.Time) (_ *UserStats, err error) {
+	defer wrapError("GetUserStats", &err)
+
+	var result *UserStats
+	err = p.retryRead(ctx, "GetUserStats", func() error {
+		return p.read(ctx, func(db dbConn) (err error) {
+			result, err = p.getUserStats(ctx, db, userID, since)
+			return err
+		})
+	})
+	return result, err
+}
+
+func (p *pgxStorage) getUserStats(ctx context.Context, db dbConn, userID uuid.UUID, since time.Time) (*UserStats, error) {
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	stats := UserStats{
+		OrdersByStatus: map[string]int{
+			StatusNew:        0,
+			StatusProcessing: 0,
+			StatusInvalid:    0,
+			StatusProcessed:  0,
+		},
+	}
+
+	query := `SELECT
+		(SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE user_id = $1 AND status = 'PROCESSED'),
+		(SELECT COALESCE(SUM(withdrawn), 0) FROM balance WHERE user_id = $1),
+		(SELECT COALESCE(SUM(amount), 0) FROM ledger WHERE user_id = $1 AND kind = $2 AND created_at >= $3);`
+	if err := db.QueryRow(opCtx, query, userID, LedgerAccrual, since).Scan(&stats.TotalAccrued, &stats.TotalWithdrawn, &stats.EarnedSince); err != nil {
+		return nil, err
+	}
+
+	r, err := db.Query(opCtx, `SELECT status, COUNT(*) FROM orders WHERE user_id = $1 GROUP BY status;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var status string
+		var count int
+		if err := r.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		stats.OrdersByStatus[status] = count
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (p *pgxStorage) AddAccrualJournalEntries(ctx context.Context, entries []AccrualJournalEntry) (err error) {
+	defer wrapError("AddAccrualJournalEntries", &err)
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	for _, e := range entries {
+		if len(e.OrderNumber) == 0 {
+			continue
+		}
+		_, err = tx.Exec(opCtx, `INSERT INTO accrual_journal (id, order_number, provider, status, accrual, error) VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''));`,
+			uuid.New(), e.OrderNumber, e.Provider, e.Status, e.Accrual, e.Error)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(opCtx)
+}
+
+func (p *pgxStorage) GetAccrualJournal(ctx context.Context, orderNumber string) (_ []AccrualJournalEntry, err error) {
+	defer wrapError("GetAccrualJournal", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, `SELECT provider, COALESCE(status, ''), COALESCE(accrual, 0), COALESCE(error, ''), created_at FROM accrual_journal WHERE order_number = $1 ORDER BY created_at;`, orderNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]AccrualJournalEntry, 0)
+	for r.Next() {
+		e := AccrualJournalEntry{OrderNumber: orderNumber}
+		if err := r.Scan(&e.Provider, &e.Status, &e.Accrual, &e.Error, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (p *pgxStorage) BackdateActivity(ctx context.Context, userID uuid.UUID, since time.Time) (err error) {
+	defer wrapError("BackdateActivity", &err)
+
+	return p.retry(ctx, "BackdateActivity", func() error {
+		return p.backdateActivity(ctx, userID, since)
+	})
+}
+
+func (p *pgxStorage) backdateActivity(ctx context.Context, userID uuid.UUID, since time.Time) error {
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	if _, err := tx.Exec(opCtx, `UPDATE users SET created_at = $2 WHERE id = $1;`, userID, since); err != nil {
+		return err
+	}
+	_, err = tx.Exec(opCtx, `
+		UPDATE orders o SET uploaded_at = v.t, updated_at = v.t
+		FROM (SELECT id, $2::TIMESTAMPTZ + random() * (NOW() - $2::TIMESTAMPTZ) AS t FROM orders WHERE user_id = $1) v
+		WHERE o.id = v.id;`, userID, since)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(opCtx, `UPDATE withdrawal SET processed_at = $2::TIMESTAMPTZ + random() * (NOW() - $2::TIMESTAMPTZ) WHERE user_id = $1;`, userID, since)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(opCtx)
 }
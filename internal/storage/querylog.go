@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/real-splendid/gophermart-practicum/internal/requestid"
+)
+
+const DefaultSlowQueryThreshold = 500 * time.Millisecond
+
+type queryLogKey struct{}
+
+type queryLogEntry struct {
+	sql   string
+	args  []interface{}
+	start time.Time
+}
+
+// QueryLogger is a pgx tracer logging every statement at debug level and
+// statements slower than SlowThreshold at warn level. Arguments are logged
+// as their types only unless LogArgs is set, as they carry logins, password
+// hashes and tokens. Next, if set, receives the same events, so the logger
+// can be chained with tracing.
+type QueryLogger struct {
+	Logger        *zap.Logger
+	SlowThreshold time.Duration
+	LogArgs       bool
+	Next          pgx.QueryTracer
+}
+
+func (l QueryLogger) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx = context.WithValue(ctx, queryLogKey{}, queryLogEntry{sql: data.SQL, args: data.Args, start: time.Now()})
+	if l.Next != nil {
+		ctx = l.Next.TraceQueryStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (l QueryLogger) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	if l.Next != nil {
+		l.Next.TraceQueryEnd(ctx, conn, data)
+	}
+
+	entry, ok := ctx.Value(queryLogKey{}).(queryLogEntry)
+	if !ok {
+		return
+	}
+	l.log(ctx, "query", entry, data.CommandTag.RowsAffected(), data.Err)
+}
+
+func (l QueryLogger) TraceBatchStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	sql := "batch"
+	if data.Batch != nil {
+		sql = fmt.Sprintf("batch of %d statements", data.Batch.Len())
+	}
+	ctx = context.WithValue(ctx, queryLogKey{}, queryLogEntry{sql: sql, start: time.Now()})
+	if next, ok := l.Next.(pgx.BatchTracer); ok {
+		ctx = next.TraceBatchStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (l QueryLogger) TraceBatchQuery(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchQueryData) {
+	if next, ok := l.Next.(pgx.BatchTracer); ok {
+		next.TraceBatchQuery(ctx, conn, data)
+	}
+}
+
+func (l QueryLogger) TraceBatchEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceBatchEndData) {
+	if next, ok := l.Next.(pgx.BatchTracer); ok {
+		next.TraceBatchEnd(ctx, conn, data)
+	}
+
+	entry, ok := ctx.Value(queryLogKey{}).(queryLogEntry)
+	if !ok {
+		return
+	}
+	l.log(ctx, "batch", entry, 0, data.Err)
+}
+
+func (l QueryLogger) log(ctx context.Context, msg string, entry queryLogEntry, rows int64, err error) {
+	elapsed := time.Since(entry.start)
+
+	level := zapcore.DebugLevel
+	if l.SlowThreshold > 0 && elapsed >= l.SlowThreshold {
+		level = zapcore.WarnLevel
+		msg = "slow " + msg
+	}
+
+	ce := l.Logger.Check(level, msg)
+	if ce == nil {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("sql", strings.Join(strings.Fields(entry.sql), " ")),
+		zap.Duration("elapsed", elapsed),
+	}
+	if len(entry.args) != 0 {
+		fields = append(fields, zap.Strings("args", l.formatArgs(entry.args)))
+	}
+	if rows != 0 {
+		fields = append(fields, zap.Int64("rows", rows))
+	}
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		fields = append(fields, zap.Error(err))
+	}
+	if id := requestid.FromContext(ctx); len(id) != 0 {
+		fields = append(fields, zap.String("request_id", id))
+	}
+	ce.Write(fields...)
+}
+
+func (l QueryLogger) formatArgs(args []interface{}) []string {
+	formatted := make([]string, len(args))
+	for i, arg := range args {
+		if l.LogArgs {
+			formatted[i] = fmt.Sprintf("%v", arg)
+		} else {
+			formatted[i] = fmt.Sprintf("<%T>", arg)
+		}
+	}
+	return formatted
+}
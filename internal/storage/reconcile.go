@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// balanceDriftQuery recomputes every balance from its sources and returns the
+// ones that differ, with $1 the processed status and $2 the credit ledger kind.
+// Reconciliation entries are left out: a corrected balance matches its
+// sources again.
+const balanceDriftQuery = `
+	SELECT user_id, current, expected_current, withdrawn, expected_withdrawn FROM (
+		SELECT b.user_id, b.current, b.withdrawn,
+			COALESCE((SELECT SUM(o.accrual) FROM orders o WHERE o.user_id = b.user_id AND o.status = $1), 0)
+			+ COALESCE((SELECT SUM(a.amount) FROM balance_adjustments a WHERE a.user_id = b.user_id), 0)
+			+ COALESCE((SELECT SUM(l.amount) FROM ledger l WHERE l.user_id = b.user_id AND l.kind = $2), 0)
+			- COALESCE((SELECT SUM(w.sum) FROM withdrawal w WHERE w.user_id = b.user_id), 0) AS expected_current,
+			COALESCE((SELECT SUM(w.sum) FROM withdrawal w WHERE w.user_id = b.user_id), 0) AS expected_withdrawn
+		FROM balance b
+	) e
+	WHERE current <> expected_current OR withdrawn <> expected_withdrawn
+	ORDER BY user_id;`
+
+func (p *pgxStorage) FindBalanceDrift(ctx context.Context) (_ []BalanceDrift, err error) {
+	defer wrapError("FindBalanceDrift", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, balanceDriftQuery, StatusProcessed, LedgerCredit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	drifts := make([]BalanceDrift, 0)
+	for r.Next() {
+		d := BalanceDrift{}
+		if err := r.Scan(&d.UserID, &d.Current, &d.ExpectedCurrent, &d.Withdrawn, &d.ExpectedWithdrawn); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, d)
+	}
+
+	return drifts, r.Err()
+}
+
+func (p *pgxStorage) CorrectBalanceDrift(ctx context.Context, drift BalanceDrift) (err error) {
+	defer wrapError("CorrectBalanceDrift", &err)
+
+	if drift.ExpectedCurrent < 0 || drift.ExpectedWithdrawn < 0 {
+		return ErrNotEnoughBalance
+	}
+
+	return p.retry(ctx, "CorrectBalanceDrift", func() error {
+		return p.correctBalanceDrift(ctx, drift)
+	})
+}
+
+func (p *pgxStorage) correctBalanceDrift(ctx context.Context, drift BalanceDrift) error {
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	tag, err := tx.Exec(opCtx, `UPDATE balance SET current = $1, withdrawn = $2, updated_at = NOW() WHERE user_id = $3 AND current = $4 AND withdrawn = $5;`,
+		drift.ExpectedCurrent, drift.ExpectedWithdrawn, drift.UserID, drift.Current, drift.Withdrawn)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrBalanceChanged
+	}
+
+	if err := addLedgerEntry(opCtx, tx, drift.UserID, LedgerReconciliation, "", drift.ExpectedCurrent-drift.Current, drift.ExpectedCurrent); err != nil {
+		return err
+	}
+
+	err = addAuditEntry(opCtx, tx, BalanceAuditEntry{
+		UserID:          drift.UserID,
+		Source:          LedgerReconciliation,
+		CurrentBefore:   drift.Current,
+		CurrentAfter:    drift.ExpectedCurrent,
+		WithdrawnBefore: drift.Withdrawn,
+		WithdrawnAfter:  drift.ExpectedWithdrawn,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(opCtx)
+}
+
+func (p *pgxStorage) AddBalanceDrift(ctx context.Context, drifts []BalanceDrift) (err error) {
+	defer wrapError("AddBalanceDrift", &err)
+
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := p.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	userIDs := make([]uuid.UUID, 0, len(drifts))
+	currents := make([]string, 0, len(drifts))
+	expectedCurrents := make([]string, 0, len(drifts))
+	withdrawns := make([]string, 0, len(drifts))
+	expectedWithdrawns := make([]string, 0, len(drifts))
+	corrected := make([]bool, 0, len(drifts))
+	for _, d := range drifts {
+		userIDs = append(userIDs, d.UserID)
+		currents = append(currents, d.Current.String())
+		expectedCurrents = append(expectedCurrents, d.ExpectedCurrent.String())
+		withdrawns = append(withdrawns, d.Withdrawn.String())
+		expectedWithdrawns = append(expectedWithdrawns, d.ExpectedWithdrawn.String())
+		corrected = append(corrected, d.Corrected)
+	}
+
+	_, err = p.dbConn.Exec(opCtx, `INSERT INTO balance_drift (user_id, current, expected_current, withdrawn, expected_withdrawn, corrected)
+		SELECT user_id, current::NUMERIC, expected_current::NUMERIC, withdrawn::NUMERIC, expected_withdrawn::NUMERIC, corrected
+		FROM unnest($1::UUID[], $2::TEXT[], $3::TEXT[], $4::TEXT[], $5::TEXT[], $6::BOOL[]) AS v(user_id, current, expected_current, withdrawn, expected_withdrawn, corrected);`,
+		userIDs, currents, expectedCurrents, withdrawns, expectedWithdrawns, corrected)
+	return err
+}
+
+func (p *pgxStorage) GetBalanceDrift(ctx context.Context, filter BalanceDriftFilter) (_ []BalanceDrift, err error) {
+	defer wrapError("GetBalanceDrift", &err)
+
+	opCtx, cancel := p.withTimeout(ctx, opRead)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if filter.UserID != uuid.Nil {
+		addCondition("user_id = $%d", filter.UserID)
+	}
+	if filter.MerchantID.Valid {
+		addCondition("user_id IN (SELECT id FROM users WHERE merchant_id = $%d)", filter.MerchantID.UUID)
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`SELECT id, user_id, current, expected_current, withdrawn, expected_withdrawn, corrected, created_at
+		FROM balance_drift WHERE %s ORDER BY id DESC LIMIT $%d;`, strings.Join(conditions, " AND "), len(args))
+	r, err := p.dbConn.Query(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	drifts := make([]BalanceDrift, 0)
+	for r.Next() {
+		d := BalanceDrift{}
+		if err := r.Scan(&d.ID, &d.UserID, &d.Current, &d.ExpectedCurrent, &d.Withdrawn, &d.ExpectedWithdrawn, &d.Corrected, &d.FoundAt); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, d)
+	}
+
+	return drifts, r.Err()
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+)
+
+const (
+	// replicaRetryAfter is how long reads go to the primary after the
+	// replica has failed.
+	replicaRetryAfter = 10 * time.Second
+
+	OperatorInterventionClass = "57P"
+)
+
+// read runs fn on the replica when one is configured and available, and on
+// the primary otherwise. A read that fails because the replica can't be
+// reached is repeated on the primary.
+func (p *pgxStorage) read(ctx context.Context, fn func(db dbConn) error) error {
+	if p.replica == nil || time.Now().UnixNano() < p.replicaDownUntil.Load() {
+		return fn(p.dbConn)
+	}
+
+	err := fn(p.replica)
+	if err == nil || !replicaUnavailable(ctx, err) {
+		return err
+	}
+
+	p.logger.Warn("read replica is unavailable, reading from primary", zap.Duration("retry_after", replicaRetryAfter), zap.Error(err))
+	p.replicaDownUntil.Store(time.Now().Add(replicaRetryAfter).UnixNano())
+	return fn(p.dbConn)
+}
+
+func replicaUnavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, ConnectionExceptionClass) ||
+			strings.HasPrefix(pgErr.Code, OperatorInterventionClass)
+	}
+
+	// Anything else the server didn't answer with is a failure to reach
+	// it: refused or dropped connections, timeouts.
+	return true
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	RetentionInactiveUsers  = "inactive_users"
+	RetentionAccrualJournal = "accrual_journal"
+	RetentionRefreshTokens  = "refresh_tokens"
+	RetentionNotifications  = "notification_outbox"
+	RetentionLoginAttempts  = "login_attempts"
+)
+
+type retentionQuery struct {
+	count string
+	apply string
+}
+
+// retentionTargets maps retention rule targets to the statements used to
+// count and purge (or anonymize) rows older than the cutoff passed as $1.
+var retentionTargets = map[string]retentionQuery{
+	RetentionInactiveUsers: {
+		count: `SELECT COUNT(*) FROM users u WHERE ` + inactiveUserCondition,
+		apply: `UPDATE users AS u SET login = 'anonymized-' || u.id, password = '' WHERE ` + inactiveUserCondition,
+	},
+	RetentionAccrualJournal: {
+		count: `SELECT COUNT(*) FROM accrual_journal WHERE created_at < $1`,
+		apply: `DELETE FROM accrual_journal WHERE created_at < $1`,
+	},
+	RetentionRefreshTokens: {
+		count: `SELECT COUNT(*) FROM refresh_tokens WHERE expires_at < $1`,
+		apply: `DELETE FROM refresh_tokens WHERE expires_at < $1`,
+	},
+	RetentionNotifications: {
+		count: `SELECT COUNT(*) FROM notification_outbox WHERE status <> 'pending' AND created_at < $1`,
+		apply: `DELETE FROM notification_outbox WHERE status <> 'pending' AND created_at < $1`,
+	},
+	RetentionLoginAttempts: {
+		count: `SELECT COUNT(*) FROM login_attempts WHERE ` + staleLoginAttemptCondition,
+		apply: `DELETE FROM login_attempts WHERE ` + staleLoginAttemptCondition,
+	},
+}
+
+// Failures that old no longer count, but a lock is kept until it expires.
+const staleLoginAttemptCondition = `updated_at < $1 AND (locked_until IS NULL OR locked_until < $1)`
+
+const inactiveUserCondition = `u.created_at < $1
+	AND u.login NOT LIKE 'anonymized-%'
+	AND NOT EXISTS (SELECT 1 FROM orders o WHERE o.user_id = u.id AND o.uploaded_at >= $1)
+	AND NOT EXISTS (SELECT 1 FROM withdrawal w WHERE w.user_id = u.id AND w.processed_at >= $1)`
+
+func IsRetentionTarget(target string) bool {
+	_, ok := retentionTargets[target]
+	return ok
+}
+
+func (p *pgxStorage) ApplyRetention(ctx context.Context, target string, cutoff time.Time, dryRun bool) (_ int64, err error) {
+	defer wrapError("ApplyRetention", &err)
+
+	q, ok := retentionTargets[target]
+	if !ok {
+		return 0, fmt.Errorf("unknown retention target %q", target)
+	}
+
+	opCtx, cancel := p.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	if dryRun {
+		var count int64
+		err := p.dbConn.QueryRow(opCtx, q.count, cutoff).Scan(&count)
+		return count, err
+	}
+
+	tag, err := p.dbConn.Exec(opCtx, q.apply, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,127 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func backdate(t *testing.T, st storage.AppStorage, userID uuid.UUID, since time.Time) {
+	t.Helper()
+	if err := st.(storage.Backdater).BackdateActivity(context.Background(), userID, since); err != nil {
+		t.Fatalf("BackdateActivity() error = %v", err)
+	}
+}
+
+func TestBackdateActivity(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "zoe")
+		addOrders(t, st, userID, orderNumbers...)
+
+		since := time.Now().AddDate(0, -1, 0)
+		backdate(t, st, userID, since)
+
+		auth, _ := st.GetUserAuthInfoByID(ctx, userID)
+		if d := auth.CreatedAt.Sub(since); d < -time.Second || d > time.Second {
+			t.Errorf("user created at %s, want %s", auth.CreatedAt, since)
+		}
+		orders, err := st.GetOrders(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetOrders() error = %v", err)
+		}
+		for _, o := range orders {
+			if o.UploadedAt.Before(since.Add(-time.Second)) || o.UploadedAt.After(time.Now()) {
+				t.Errorf("order %s uploaded at %s, want between %s and now", o.OrderNumber, o.UploadedAt, since)
+			}
+		}
+	})
+}
+
+func TestApplyRetention(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		now := time.Now()
+
+		// BackdateActivity spreads orders until now, so only the active
+		// user has any.
+		inactive := addUser(t, st, "inactive")
+		backdate(t, st, inactive, now.AddDate(-2, 0, 0))
+		active := addUser(t, st, "active")
+		addOrders(t, st, active, "12345678903")
+		backdate(t, st, active, now.AddDate(-2, 0, 0))
+		addOrders(t, st, active, "4561261212345467")
+
+		session := &storage.Session{ID: uuid.New(), UserID: active, JTI: uuid.New(), ExpiresAt: now.Add(time.Hour)}
+		if err := st.StartSession(ctx, session); err != nil {
+			t.Fatalf("StartSession() error = %v", err)
+		}
+		if err := st.AddRefreshToken(ctx, "expired", active, session.ID, now.Add(-48*time.Hour)); err != nil {
+			t.Fatalf("AddRefreshToken() error = %v", err)
+		}
+		if err := st.AddRefreshToken(ctx, "live", active, session.ID, now.Add(time.Hour)); err != nil {
+			t.Fatalf("AddRefreshToken() error = %v", err)
+		}
+
+		// Failures are recorded now, so only a cutoff in the future
+		// covers them.
+		if _, err := st.RecordLoginFailure(ctx, "ip:192.0.2.1", now); err != nil {
+			t.Fatalf("RecordLoginFailure() error = %v", err)
+		}
+		if _, err := st.RecordLoginFailure(ctx, "ip:192.0.2.2", now); err != nil {
+			t.Fatalf("RecordLoginFailure() error = %v", err)
+		}
+		if err := st.LockLogin(ctx, "ip:192.0.2.2", now.Add(time.Hour)); err != nil {
+			t.Fatalf("LockLogin() error = %v", err)
+		}
+
+		tests := []struct {
+			target string
+			cutoff time.Time
+			want   int64
+		}{
+			{storage.RetentionInactiveUsers, now.AddDate(-1, 0, 0), 1},
+			{storage.RetentionRefreshTokens, now.Add(-24 * time.Hour), 1},
+			{storage.RetentionAccrualJournal, now, 0},
+			{storage.RetentionNotifications, now, 0},
+			{storage.RetentionLoginAttempts, now.Add(time.Minute), 1},
+		}
+		for _, tt := range tests {
+			for _, dryRun := range []bool{true, false} {
+				n, err := st.ApplyRetention(ctx, tt.target, tt.cutoff, dryRun)
+				if err != nil {
+					t.Fatalf("ApplyRetention(%s, dry run %t) error = %v", tt.target, dryRun, err)
+				}
+				if n != tt.want {
+					t.Errorf("ApplyRetention(%s, dry run %t) = %d, want %d", tt.target, dryRun, n, tt.want)
+				}
+			}
+			if n, _ := st.ApplyRetention(ctx, tt.target, tt.cutoff, true); n != 0 {
+				t.Errorf("ApplyRetention(%s) left %d rows", tt.target, n)
+			}
+		}
+
+		if _, err := st.GetUserAuthInfo(ctx, storage.DefaultMerchantID, "inactive"); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("GetUserAuthInfo() of an anonymized user error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+		if _, err := st.GetUserAuthInfo(ctx, storage.DefaultMerchantID, "active"); err != nil {
+			t.Errorf("GetUserAuthInfo() of an active user error = %v", err)
+		}
+		if _, _, err := st.ConsumeRefreshToken(ctx, "live"); err != nil {
+			t.Errorf("ConsumeRefreshToken() of a live token error = %v", err)
+		}
+
+		if until, _ := st.GetLoginLock(ctx, "ip:192.0.2.2"); until.IsZero() {
+			t.Errorf("ApplyRetention() removed a live login lock")
+		}
+
+		if _, err := st.ApplyRetention(ctx, "orders", now, true); err == nil {
+			t.Errorf("ApplyRetention() of an unknown target succeeded")
+		}
+	})
+}
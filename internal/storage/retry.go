@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+)
+
+const (
+	SerializationFailureCode = "40001"
+	DeadlockDetectedCode     = "40P01"
+	ConnectionExceptionClass = "08"
+	DefaultRetryPolicyName   = "default"
+)
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    time.Second,
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// RetryConfig holds the default policy and per-operation overrides keyed by
+// the storage method name, e.g. "Withdraw" or "UpdateBalanceFromOrders".
+type RetryConfig struct {
+	Default    RetryPolicy
+	Operations map[string]RetryPolicy
+}
+
+type retryPolicyJSON struct {
+	MaxAttempts int    `json:"max_attempts"`
+	BaseDelay   string `json:"base_delay"`
+	MaxDelay    string `json:"max_delay"`
+}
+
+func ParseRetryConfig(value string) (RetryConfig, error) {
+	cfg := RetryConfig{Default: DefaultRetryPolicy, Operations: map[string]RetryPolicy{}}
+	if len(value) == 0 {
+		return cfg, nil
+	}
+
+	var raw map[string]retryPolicyJSON
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return cfg, fmt.Errorf("failed to parse database retry policies: %w", err)
+	}
+
+	for name, r := range raw {
+		policy := DefaultRetryPolicy
+		if r.MaxAttempts > 0 {
+			policy.MaxAttempts = r.MaxAttempts
+		}
+		if len(r.BaseDelay) != 0 {
+			d, err := time.ParseDuration(r.BaseDelay)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("retry policy %q: bad base_delay %q", name, r.BaseDelay)
+			}
+			policy.BaseDelay = d
+		}
+		if len(r.MaxDelay) != 0 {
+			d, err := time.ParseDuration(r.MaxDelay)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("retry policy %q: bad max_delay %q", name, r.MaxDelay)
+			}
+			policy.MaxDelay = d
+		}
+
+		if name == DefaultRetryPolicyName {
+			cfg.Default = policy
+		} else {
+			cfg.Operations[name] = policy
+		}
+	}
+
+	return cfg, nil
+}
+
+func (c RetryConfig) policy(op string) RetryPolicy {
+	if policy, ok := c.Operations[op]; ok {
+		return policy
+	}
+	if c.Default.MaxAttempts <= 0 {
+		return DefaultRetryPolicy
+	}
+	return c.Default
+}
+
+func (rp RetryPolicy) backoff(attempt int) time.Duration {
+	d := rp.BaseDelay << attempt
+	if d <= 0 || (rp.MaxDelay > 0 && d > rp.MaxDelay) {
+		d = rp.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Full jitter keeps concurrent retries of the same conflict apart.
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// IsTransient reports whether err is a database error that is expected to go
+// away when the operation is retried.
+func IsTransient(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == SerializationFailureCode ||
+			pgErr.Code == DeadlockDetectedCode ||
+			strings.HasPrefix(pgErr.Code, ConnectionExceptionClass)
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// safeToRepeat reports whether a write that failed with err certainly didn't
+// commit. A serialization failure or a deadlock rolls the transaction back,
+// and pgconn reports whether the connection failed before anything was sent.
+// A connection that drops later may have lost the reply to a COMMIT that went
+// through, so running the write again could apply it twice.
+func safeToRepeat(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == SerializationFailureCode || pgErr.Code == DeadlockDetectedCode
+	}
+	return pgconn.SafeToRetry(err)
+}
+
+// retry runs the write fn again while it fails in a way safeToRepeat allows.
+func (p *pgxStorage) retry(ctx context.Context, op string, fn func() error) error {
+	return p.retryIf(ctx, op, safeToRepeat, fn)
+}
+
+// retryRead runs the read fn again on any transient error, including a
+// dropped connection.
+func (p *pgxStorage) retryRead(ctx context.Context, op string, fn func() error) error {
+	return p.retryIf(ctx, op, IsTransient, fn)
+}
+
+func (p *pgxStorage) retryIf(ctx context.Context, op string, retryable func(error) bool, fn func() error) error {
+	if p.inTx {
+		return fn()
+	}
+	policy := p.retryConfig.policy(op)
+
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			delay := policy.backoff(attempt - 1)
+			p.logger.Warn("retrying database operation", zap.String("operation", op), zap.Int("attempt", attempt+1), zap.Duration("delay", delay), zap.Error(err))
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+		}
+
+		err = fn()
+		if err == nil || !retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type unsentError struct{}
+
+func (unsentError) Error() string     { return "dial failed" }
+func (unsentError) SafeToRetry() bool { return true }
+
+func TestSafeToRepeat(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		write     bool
+		transient bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: SerializationFailureCode}, true, true},
+		{"deadlock", fmt.Errorf("commit: %w", &pgconn.PgError{Code: DeadlockDetectedCode}), true, true},
+		{"nothing sent", unsentError{}, true, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, false, true},
+		{"connection lost during commit", fmt.Errorf("commit: %w", io.ErrUnexpectedEOF), false, false},
+		{"unique violation", &pgconn.PgError{Code: UniqueViolationCode}, false, false},
+		{"other", errors.New("boom"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := safeToRepeat(tt.err); got != tt.write {
+				t.Errorf("safeToRepeat() = %t, want %t", got, tt.write)
+			}
+			if got := IsTransient(tt.err); got != tt.transient {
+				t.Errorf("IsTransient() = %t, want %t", got, tt.transient)
+			}
+		})
+	}
+}
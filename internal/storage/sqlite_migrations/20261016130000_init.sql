@@ -0,0 +1,211 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The SQLite schema matches the Postgres one as of 20261016120000. Amounts
+-- are integer hundredths and times are fixed-width UTC text, so both sort
+-- and compare correctly.
+CREATE TABLE merchants (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    api_key_hash TEXT UNIQUE,
+    host TEXT UNIQUE,
+    created_at TEXT NOT NULL
+);
+
+INSERT INTO merchants (id, name, created_at) VALUES ('00000000-0000-0000-0000-000000000000', 'default', strftime('%Y-%m-%dT%H:%M:%fZ', 'now'));
+
+CREATE TABLE users (
+    id TEXT PRIMARY KEY,
+    merchant_id TEXT NOT NULL REFERENCES merchants(id),
+    login TEXT NOT NULL,
+    password BLOB NOT NULL,
+    role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'support', 'admin')),
+    display_name TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    password_changed_at TEXT,
+    deleted_at TEXT,
+    UNIQUE (merchant_id, login)
+);
+
+CREATE TABLE orders (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    order_number TEXT NOT NULL UNIQUE,
+    status TEXT NOT NULL DEFAULT 'NEW',
+    accrual INTEGER NOT NULL DEFAULT 0,
+    uploaded_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    fiscal_status TEXT,
+    fiscal_reason TEXT,
+    not_found_count INTEGER NOT NULL DEFAULT 0,
+    accrual_failures INTEGER NOT NULL DEFAULT 0,
+    claimed_by TEXT,
+    claimed_until TEXT,
+    accrual_registered_at TEXT,
+    accrual_registration_error TEXT
+);
+
+CREATE INDEX orders_user_uploaded_idx ON orders (user_id, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_status_uploaded_idx ON orders (user_id, status, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_accrual_idx ON orders (user_id, accrual DESC, order_number DESC);
+CREATE INDEX orders_user_updated_idx ON orders (user_id, updated_at DESC);
+CREATE INDEX orders_unfinished_idx ON orders (uploaded_at) WHERE status IN ('NEW', 'PROCESSING');
+
+CREATE TABLE balance (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    current INTEGER NOT NULL DEFAULT 0 CHECK (current >= 0),
+    withdrawn INTEGER NOT NULL DEFAULT 0 CHECK (withdrawn >= 0),
+    updated_at TEXT
+);
+
+CREATE TABLE withdrawal (
+    id TEXT PRIMARY KEY,
+    order_number TEXT NOT NULL UNIQUE,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    sum INTEGER NOT NULL DEFAULT 0 CHECK (sum >= 0),
+    idempotency_key TEXT,
+    processed_at TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX withdrawal_user_idempotency_key_idx ON withdrawal (user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+
+CREATE TABLE accrual_journal (
+    id TEXT PRIMARY KEY,
+    order_number TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    status TEXT,
+    accrual INTEGER,
+    error TEXT,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX accrual_journal_order_number_idx ON accrual_journal (order_number, created_at);
+
+CREATE TABLE revoked_tokens (
+    jti TEXT PRIMARY KEY,
+    expires_at TEXT NOT NULL
+);
+
+CREATE TABLE sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    jti TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL,
+    last_seen_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL,
+    revoked_at TEXT
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    session_id TEXT REFERENCES sessions(id) ON DELETE CASCADE,
+    expires_at TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+
+CREATE TABLE balance_adjustments (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL,
+    reason_code TEXT NOT NULL CHECK (reason_code IN ('goodwill', 'correction', 'refund', 'fraud', 'other')),
+    reason TEXT NOT NULL,
+    operator TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX balance_adjustments_user_id_idx ON balance_adjustments (user_id, created_at);
+
+CREATE TABLE ledger (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    reference TEXT,
+    amount INTEGER NOT NULL,
+    balance INTEGER NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX ledger_user_id_idx ON ledger (user_id, id);
+CREATE INDEX ledger_user_kind_created_idx ON ledger (user_id, kind, created_at);
+
+CREATE TABLE login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    locked_until TEXT,
+    updated_at TEXT NOT NULL
+);
+
+CREATE TABLE accrual_dead_letter (
+    order_number TEXT PRIMARY KEY REFERENCES orders (order_number) ON DELETE CASCADE,
+    failures INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE notification_preferences (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL DEFAULT '',
+    webhook_url TEXT NOT NULL DEFAULT '',
+    updated_at TEXT NOT NULL
+);
+
+CREATE TABLE balance_audit (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL,
+    source TEXT NOT NULL,
+    reference TEXT,
+    current_before INTEGER NOT NULL,
+    current_after INTEGER NOT NULL,
+    withdrawn_before INTEGER NOT NULL,
+    withdrawn_after INTEGER NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX balance_audit_user_id_idx ON balance_audit (user_id, id);
+CREATE INDEX balance_audit_reference_idx ON balance_audit (reference);
+
+CREATE TRIGGER balance_audit_no_update BEFORE UPDATE ON balance_audit
+BEGIN
+    SELECT RAISE(ABORT, 'balance_audit is append-only');
+END;
+
+CREATE TRIGGER balance_audit_no_delete BEFORE DELETE ON balance_audit
+BEGIN
+    SELECT RAISE(ABORT, 'balance_audit is append-only');
+END;
+
+CREATE TABLE placed_orders (
+    merchant_id TEXT NOT NULL REFERENCES merchants(id),
+    order_number TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (merchant_id, order_number)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE placed_orders;
+DROP TABLE balance_audit;
+DROP TABLE notification_preferences;
+DROP TABLE accrual_dead_letter;
+DROP TABLE login_attempts;
+DROP TABLE ledger;
+DROP TABLE balance_adjustments;
+DROP TABLE refresh_tokens;
+DROP TABLE sessions;
+DROP TABLE revoked_tokens;
+DROP TABLE accrual_journal;
+DROP TABLE withdrawal;
+DROP TABLE balance;
+DROP TABLE orders;
+DROP TABLE users;
+DROP TABLE merchants;
+-- +goose StatementEnd
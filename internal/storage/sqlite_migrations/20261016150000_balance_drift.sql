@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE balance_drift (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    current INTEGER NOT NULL,
+    expected_current INTEGER NOT NULL,
+    withdrawn INTEGER NOT NULL,
+    expected_withdrawn INTEGER NOT NULL,
+    corrected INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX balance_drift_user_id_idx ON balance_drift (user_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE balance_drift;
+-- +goose StatementEnd
@@ -0,0 +1,52 @@
+-- +goose Up
+-- +goose StatementBegin
+-- SQLite can't add constraints to existing tables, so the checks the
+-- Postgres migration adds are triggers here. The unique balance per user and
+-- the NOT NULL timestamps were part of the SQLite schema from the start, except
+-- balance.updated_at, which every write sets.
+CREATE TRIGGER orders_accrual_check BEFORE INSERT ON orders
+WHEN NEW.accrual < 0
+BEGIN
+    SELECT RAISE(ABORT, 'orders.accrual must not be negative');
+END;
+
+CREATE TRIGGER orders_accrual_update_check BEFORE UPDATE OF accrual ON orders
+WHEN NEW.accrual < 0
+BEGIN
+    SELECT RAISE(ABORT, 'orders.accrual must not be negative');
+END;
+
+CREATE TRIGGER orders_status_check BEFORE INSERT ON orders
+WHEN NEW.status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')
+BEGIN
+    SELECT RAISE(ABORT, 'orders.status is not a known status');
+END;
+
+CREATE TRIGGER orders_status_update_check BEFORE UPDATE OF status ON orders
+WHEN NEW.status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')
+BEGIN
+    SELECT RAISE(ABORT, 'orders.status is not a known status');
+END;
+
+CREATE TRIGGER withdrawal_sum_check BEFORE INSERT ON withdrawal
+WHEN NEW.sum <= 0
+BEGIN
+    SELECT RAISE(ABORT, 'withdrawal.sum must be positive');
+END;
+
+CREATE TRIGGER balance_adjustments_amount_check BEFORE INSERT ON balance_adjustments
+WHEN NEW.amount = 0
+BEGIN
+    SELECT RAISE(ABORT, 'balance_adjustments.amount must not be zero');
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER balance_adjustments_amount_check;
+DROP TRIGGER withdrawal_sum_check;
+DROP TRIGGER orders_status_update_check;
+DROP TRIGGER orders_status_check;
+DROP TRIGGER orders_accrual_update_check;
+DROP TRIGGER orders_accrual_check;
+-- +goose StatementEnd
@@ -0,0 +1,141 @@
+-- +goose Up
+-- +goose StatementBegin
+-- SQLite can't drop a column constraint, so orders is rebuilt with the order
+-- number unique per merchant. accrual_dead_letter is rebuilt first: its
+-- foreign key needs a unique order number, and dropping orders under it
+-- would cascade.
+CREATE TABLE accrual_dead_letter_new (
+    order_number TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+INSERT INTO accrual_dead_letter_new SELECT order_number, failures, last_error, created_at FROM accrual_dead_letter;
+DROP TABLE accrual_dead_letter;
+ALTER TABLE accrual_dead_letter_new RENAME TO accrual_dead_letter;
+
+CREATE TABLE orders_new (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    merchant_id TEXT NOT NULL REFERENCES merchants(id),
+    order_number TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'NEW',
+    accrual INTEGER NOT NULL DEFAULT 0,
+    uploaded_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    fiscal_status TEXT,
+    fiscal_reason TEXT,
+    not_found_count INTEGER NOT NULL DEFAULT 0,
+    accrual_failures INTEGER NOT NULL DEFAULT 0,
+    claimed_by TEXT,
+    claimed_until TEXT,
+    accrual_registered_at TEXT,
+    accrual_registration_error TEXT,
+    UNIQUE (merchant_id, order_number)
+);
+INSERT INTO orders_new
+SELECT o.id, o.user_id, u.merchant_id, o.order_number, o.status, o.accrual, o.uploaded_at, o.updated_at,
+    o.fiscal_status, o.fiscal_reason, o.not_found_count, o.accrual_failures, o.claimed_by, o.claimed_until,
+    o.accrual_registered_at, o.accrual_registration_error
+FROM orders o JOIN users u ON u.id = o.user_id;
+DROP TABLE orders;
+ALTER TABLE orders_new RENAME TO orders;
+
+CREATE INDEX orders_order_number_idx ON orders (order_number);
+CREATE INDEX orders_user_uploaded_idx ON orders (user_id, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_status_uploaded_idx ON orders (user_id, status, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_accrual_idx ON orders (user_id, accrual DESC, order_number DESC);
+CREATE INDEX orders_user_updated_idx ON orders (user_id, updated_at DESC);
+CREATE INDEX orders_unfinished_idx ON orders (uploaded_at) WHERE status IN ('NEW', 'PROCESSING');
+
+CREATE TRIGGER orders_accrual_check BEFORE INSERT ON orders
+WHEN NEW.accrual < 0
+BEGIN
+    SELECT RAISE(ABORT, 'orders.accrual must not be negative');
+END;
+
+CREATE TRIGGER orders_accrual_update_check BEFORE UPDATE OF accrual ON orders
+WHEN NEW.accrual < 0
+BEGIN
+    SELECT RAISE(ABORT, 'orders.accrual must not be negative');
+END;
+
+CREATE TRIGGER orders_status_check BEFORE INSERT ON orders
+WHEN NEW.status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')
+BEGIN
+    SELECT RAISE(ABORT, 'orders.status is not a known status');
+END;
+
+CREATE TRIGGER orders_status_update_check BEFORE UPDATE OF status ON orders
+WHEN NEW.status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')
+BEGIN
+    SELECT RAISE(ABORT, 'orders.status is not a known status');
+END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE orders_old (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    order_number TEXT NOT NULL UNIQUE,
+    status TEXT NOT NULL DEFAULT 'NEW',
+    accrual INTEGER NOT NULL DEFAULT 0,
+    uploaded_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    fiscal_status TEXT,
+    fiscal_reason TEXT,
+    not_found_count INTEGER NOT NULL DEFAULT 0,
+    accrual_failures INTEGER NOT NULL DEFAULT 0,
+    claimed_by TEXT,
+    claimed_until TEXT,
+    accrual_registered_at TEXT,
+    accrual_registration_error TEXT
+);
+INSERT INTO orders_old
+SELECT id, user_id, order_number, status, accrual, uploaded_at, updated_at, fiscal_status, fiscal_reason,
+    not_found_count, accrual_failures, claimed_by, claimed_until, accrual_registered_at, accrual_registration_error
+FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_old RENAME TO orders;
+
+CREATE INDEX orders_user_uploaded_idx ON orders (user_id, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_status_uploaded_idx ON orders (user_id, status, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_accrual_idx ON orders (user_id, accrual DESC, order_number DESC);
+CREATE INDEX orders_user_updated_idx ON orders (user_id, updated_at DESC);
+CREATE INDEX orders_unfinished_idx ON orders (uploaded_at) WHERE status IN ('NEW', 'PROCESSING');
+
+CREATE TRIGGER orders_accrual_check BEFORE INSERT ON orders
+WHEN NEW.accrual < 0
+BEGIN
+    SELECT RAISE(ABORT, 'orders.accrual must not be negative');
+END;
+
+CREATE TRIGGER orders_accrual_update_check BEFORE UPDATE OF accrual ON orders
+WHEN NEW.accrual < 0
+BEGIN
+    SELECT RAISE(ABORT, 'orders.accrual must not be negative');
+END;
+
+CREATE TRIGGER orders_status_check BEFORE INSERT ON orders
+WHEN NEW.status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')
+BEGIN
+    SELECT RAISE(ABORT, 'orders.status is not a known status');
+END;
+
+CREATE TRIGGER orders_status_update_check BEFORE UPDATE OF status ON orders
+WHEN NEW.status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')
+BEGIN
+    SELECT RAISE(ABORT, 'orders.status is not a known status');
+END;
+
+CREATE TABLE accrual_dead_letter_old (
+    order_number TEXT PRIMARY KEY REFERENCES orders (order_number) ON DELETE CASCADE,
+    failures INTEGER NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+INSERT INTO accrual_dead_letter_old SELECT order_number, failures, last_error, created_at FROM accrual_dead_letter;
+DROP TABLE accrual_dead_letter;
+ALTER TABLE accrual_dead_letter_old RENAME TO accrual_dead_letter;
+-- +goose StatementEnd
@@ -0,0 +1,2101 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pressly/goose/v3"
+	"go.uber.org/zap"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+)
+
+// SQLiteScheme prefixes DATABASE_URI values that name a SQLite database
+// file, e.g. sqlite:///var/lib/gophermart/gophermart.db, sqlite://local.db or
+// sqlite::memory:.
+const SQLiteScheme = "sqlite:"
+
+// sqliteTimeLayout is fixed-width UTC, so stored times compare correctly as
+// text.
+const sqliteTimeLayout = "2006-01-02T15:04:05.000000Z"
+
+const sqliteEpoch = `'1970-01-01T00:00:00.000000Z'`
+
+//go:embed sqlite_migrations/*.sql
+var sqliteMigrations embed.FS
+
+// SQLiteMigrations are the goose migrations of the SQLite schema. They are
+// kept apart from the Postgres ones in migrations/.
+var SQLiteMigrations, _ = fs.Sub(sqliteMigrations, "sqlite_migrations")
+
+func IsSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, SQLiteScheme)
+}
+
+// SQLiteDriverDSN turns a sqlite: DATABASE_URI into a data source name of
+// the SQLite driver, with foreign keys on and a busy timeout.
+func SQLiteDriverDSN(dsn string) string {
+	path := strings.TrimPrefix(strings.TrimPrefix(dsn, SQLiteScheme), "//")
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return "file:" + path + sep + "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
+
+// OpenSQLite opens the database and applies the pending SQLite migrations,
+// so a single node needs no separate migration step.
+func OpenSQLite(ctx context.Context, dsn string, logger *zap.Logger) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", SQLiteDriverDSN(dsn))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer. One connection queues writes instead of
+	// failing them as busy, and keeps an in-memory database alive.
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxIdleTime(0)
+	db.SetConnMaxLifetime(0)
+
+	provider, err := goose.NewProvider(goose.DialectSQLite3, db, SQLiteMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	results, err := provider.Up(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, r := range results {
+		logger.Info("applied SQLite migration", zap.String("migration", r.Source.Path), zap.Duration("duration", r.Duration))
+	}
+
+	return db, nil
+}
+
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqliteStorage is AppStorage on SQLite for single-node deployments and
+// tests. Amounts are stored as integer hundredths, times as sqliteTime text.
+type sqliteStorage struct {
+	db       *sql.DB
+	conn     sqlConn
+	logger   zap.Logger
+	timeouts Timeouts
+	inTx     bool
+}
+
+// NewSQLiteStorage creates a storage on a database opened by OpenSQLite.
+// Only Options.Timeouts applies: there is no replica, and writes don't fail
+// with serialization errors that would be worth retrying.
+func NewSQLiteStorage(ctx context.Context, db *sql.DB, logger *zap.Logger, opts Options) (AppStorage, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return &sqliteStorage{
+		db:       db,
+		conn:     db,
+		logger:   *logger,
+		timeouts: opts.Timeouts.withDefaults(),
+	}, nil
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func sqliteNow() string {
+	return sqliteTime(time.Now())
+}
+
+// sqliteList passes values for use as `IN (SELECT value FROM json_each($n))`.
+func sqliteList(values []string) string {
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// sqlTime scans a time stored by sqliteTime. NULL is the zero time.
+type sqlTime struct{ t *time.Time }
+
+func (s sqlTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*s.t = time.Time{}
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return err
+		}
+		*s.t = t
+	case []byte:
+		return s.Scan(string(v))
+	case time.Time:
+		*s.t = v
+	default:
+		return fmt.Errorf("cannot scan %T into time", src)
+	}
+	return nil
+}
+
+// sqlAmount scans an amount stored in hundredths. NULL is zero.
+type sqlAmount struct{ a *money.Amount }
+
+func (s sqlAmount) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*s.a = 0
+	case int64:
+		*s.a = money.Amount(v)
+	default:
+		return fmt.Errorf("%w: cannot scan %T", money.ErrBadAmount, src)
+	}
+	return nil
+}
+
+func sqliteCode(err error) int {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()
+	}
+	return 0
+}
+
+func (s *sqliteStorage) withTimeout(ctx context.Context, class opClass) (context.Context, context.CancelFunc) {
+	return s.timeouts.context(ctx, class)
+}
+
+// transact runs fn in a transaction, or in a savepoint when the storage is
+// already in one, so methods nest inside WithinTx.
+func (s *sqliteStorage) transact(ctx context.Context, fn func(c sqlConn) error) error {
+	if s.inTx {
+		if _, err := s.conn.ExecContext(ctx, `SAVEPOINT nested;`); err != nil {
+			return err
+		}
+		if err := fn(s.conn); err != nil {
+			s.conn.ExecContext(context.WithoutCancel(ctx), `ROLLBACK TO nested;`)
+			s.conn.ExecContext(context.WithoutCancel(ctx), `RELEASE nested;`)
+			return err
+		}
+		_, err := s.conn.ExecContext(ctx, `RELEASE nested;`)
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// WithinTx works as it does on Postgres. With a single connection, fn must
+// not use any storage but the one it is passed, or it waits forever.
+func (s *sqliteStorage) WithinTx(ctx context.Context, fn func(s AppStorage) error) error {
+	var fnErr error
+	err := s.transact(ctx, func(c sqlConn) error {
+		fnErr = fn(&sqliteStorage{
+			db:       s.db,
+			conn:     c,
+			logger:   s.logger,
+			timeouts: s.timeouts,
+			inTx:     true,
+		})
+		return fnErr
+	})
+	if err != nil && fnErr == nil {
+		wrapError("WithinTx", &err)
+	}
+	return err
+}
+
+func (s *sqliteStorage) AddUser(ctx context.Context, auth *UserAuthorization) (err error) {
+	defer wrapError("AddUser", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	role := auth.Role
+	if len(role) == 0 {
+		role = RoleUser
+	}
+
+	now := sqliteNow()
+	return s.transact(opCtx, func(c sqlConn) error {
+		userID := uuid.New()
+		_, err := c.ExecContext(opCtx, `INSERT INTO users (id, merchant_id, login, password, role, created_at) VALUES ($1, $2, $3, $4, $5, $6);`,
+			userID, auth.MerchantID, auth.Login, auth.Password, role, now)
+		if err != nil {
+			if sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+				return ErrDuplicateUser
+			}
+			return err
+		}
+
+		_, err = c.ExecContext(opCtx, `INSERT INTO balance (id, user_id, updated_at) VALUES ($1, $2, $3);`, uuid.New(), userID, now)
+		return err
+	})
+}
+
+func (s *sqliteStorage) GetUserAuthInfo(ctx context.Context, merchantID uuid.UUID, userName string) (_ *UserAuthorization, err error) {
+	defer wrapError("GetUserAuthInfo", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	authData := UserAuthorization{}
+	err = s.conn.QueryRowContext(opCtx, `SELECT id, merchant_id, login, password, role, created_at, COALESCE(password_changed_at, `+sqliteEpoch+`) FROM users
+		WHERE merchant_id = $1 AND login = $2 AND deleted_at IS NULL;`, merchantID, userName).
+		Scan(&authData.ID, &authData.MerchantID, &authData.Login, &authData.Password, &authData.Role, sqlTime{&authData.CreatedAt}, sqlTime{&authData.PasswordChangedAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchUser
+		}
+		return nil, err
+	}
+
+	return &authData, nil
+}
+
+func (s *sqliteStorage) GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID) (_ *UserAuthorization, err error) {
+	defer wrapError("GetUserAuthInfoByID", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	authData := UserAuthorization{ID: userID}
+	err = s.conn.QueryRowContext(opCtx, `SELECT merchant_id, login, password, role, created_at, COALESCE(password_changed_at, `+sqliteEpoch+`) FROM users
+		WHERE id = $1 AND deleted_at IS NULL;`, userID).
+		Scan(&authData.MerchantID, &authData.Login, &authData.Password, &authData.Role, sqlTime{&authData.CreatedAt}, sqlTime{&authData.PasswordChangedAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchUser
+		}
+		return nil, err
+	}
+
+	return &authData, nil
+}
+
+func (s *sqliteStorage) DeleteUser(ctx context.Context, userID uuid.UUID) (err error) {
+	defer wrapError("DeleteUser", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		return sqliteSoftDeleteUser(opCtx, c, userID)
+	})
+}
+
+func sqliteSoftDeleteUser(ctx context.Context, c sqlConn, userID uuid.UUID) error {
+	now := sqliteNow()
+	res, err := c.ExecContext(ctx, `UPDATE users SET login = 'deleted-' || id, password = '', display_name = '', email = '', deleted_at = $2
+		WHERE id = $1 AND deleted_at IS NULL;`, userID, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchUser
+	}
+
+	if _, err := c.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1;`, userID); err != nil {
+		return err
+	}
+	if _, err := c.ExecContext(ctx, `UPDATE sessions SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL;`, userID, now); err != nil {
+		return err
+	}
+	_, err = c.ExecContext(ctx, `DELETE FROM notification_preferences WHERE user_id = $1;`, userID)
+	return err
+}
+
+func (s *sqliteStorage) GetUserProfile(ctx context.Context, userID uuid.UUID) (_ *UserProfile, err error) {
+	defer wrapError("GetUserProfile", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	profile := UserProfile{}
+	err = s.conn.QueryRowContext(opCtx, `SELECT login, display_name, email, created_at FROM users WHERE id = $1 AND deleted_at IS NULL;`, userID).
+		Scan(&profile.Login, &profile.DisplayName, &profile.Email, sqlTime{&profile.CreatedAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchUser
+		}
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+func (s *sqliteStorage) UpdateUserProfile(ctx context.Context, userID uuid.UUID, update UserProfileUpdate) (_ *UserProfile, err error) {
+	defer wrapError("UpdateUserProfile", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	profile := UserProfile{}
+	err = s.conn.QueryRowContext(opCtx, `UPDATE users SET display_name = COALESCE($2, display_name), email = COALESCE($3, email)
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING login, display_name, email, created_at;`, userID, update.DisplayName, update.Email).
+		Scan(&profile.Login, &profile.DisplayName, &profile.Email, sqlTime{&profile.CreatedAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchUser
+		}
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+func (s *sqliteStorage) ChangePassword(ctx context.Context, userID uuid.UUID, password []byte, changedAt time.Time) (err error) {
+	defer wrapError("ChangePassword", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		res, err := c.ExecContext(opCtx, `UPDATE users SET password = $2, password_changed_at = $3 WHERE id = $1 AND deleted_at IS NULL;`,
+			userID, password, sqliteTime(changedAt))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrNoSuchUser
+		}
+
+		if _, err := c.ExecContext(opCtx, `DELETE FROM refresh_tokens WHERE user_id = $1;`, userID); err != nil {
+			return err
+		}
+		_, err = c.ExecContext(opCtx, `UPDATE sessions SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL;`, userID, sqliteNow())
+		return err
+	})
+}
+
+func (s *sqliteStorage) SetUserRole(ctx context.Context, userID uuid.UUID, role string) (err error) {
+	defer wrapError("SetUserRole", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	res, err := s.conn.ExecContext(opCtx, `UPDATE users SET role = $2 WHERE id = $1 AND deleted_at IS NULL;`, userID, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+func (s *sqliteStorage) AddMerchant(ctx context.Context, merchant *Merchant, apiKeyHash string) (err error) {
+	defer wrapError("AddMerchant", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var host interface{}
+	if len(merchant.Host) != 0 {
+		host = merchant.Host
+	}
+
+	merchant.ID = uuid.New()
+	err = s.conn.QueryRowContext(opCtx, `INSERT INTO merchants (id, name, api_key_hash, host, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING created_at;`,
+		merchant.ID, merchant.Name, apiKeyHash, host, sqliteNow()).Scan(sqlTime{&merchant.CreatedAt})
+	if err != nil {
+		if sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+			return ErrDuplicateMerchant
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *sqliteStorage) AddPlacedOrder(ctx context.Context, merchantID uuid.UUID, orderNumber string) (err error) {
+	defer wrapError("AddPlacedOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `INSERT INTO placed_orders (merchant_id, order_number, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`,
+		merchantID, orderNumber, sqliteNow())
+	if err != nil {
+		if sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY {
+			return ErrNoSuchMerchant
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *sqliteStorage) IsOrderPlaced(ctx context.Context, userID uuid.UUID, orderNumber string) (placed bool, err error) {
+	defer wrapError("IsOrderPlaced", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	err = s.conn.QueryRowContext(opCtx, `SELECT EXISTS (
+		SELECT 1 FROM placed_orders po JOIN users u ON u.merchant_id = po.merchant_id
+		WHERE u.id = $1 AND po.order_number = $2);`, userID, orderNumber).Scan(&placed)
+	return placed, err
+}
+
+func (s *sqliteStorage) GetMerchantByAPIKey(ctx context.Context, apiKeyHash string) (_ *Merchant, err error) {
+	defer wrapError("GetMerchantByAPIKey", &err)
+
+	return s.getMerchant(ctx, `api_key_hash = $1`, apiKeyHash)
+}
+
+func (s *sqliteStorage) GetMerchantByHost(ctx context.Context, host string) (_ *Merchant, err error) {
+	defer wrapError("GetMerchantByHost", &err)
+
+	return s.getMerchant(ctx, `host = $1`, host)
+}
+
+func (s *sqliteStorage) getMerchant(ctx context.Context, condition string, value string) (*Merchant, error) {
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	merchant := Merchant{}
+	var host sql.NullString
+	err := s.conn.QueryRowContext(opCtx, `SELECT id, name, host, created_at FROM merchants WHERE `+condition+`;`, value).
+		Scan(&merchant.ID, &merchant.Name, &host, sqlTime{&merchant.CreatedAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchMerchant
+		}
+		return nil, err
+	}
+	merchant.Host = host.String
+
+	return &merchant, nil
+}
+
+func (s *sqliteStorage) GetNotificationPreferences(ctx context.Context, userID uuid.UUID) (_ *NotificationPreferences, err error) {
+	defer wrapError("GetNotificationPreferences", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	prefs := NotificationPreferences{UserID: userID}
+	err = s.conn.QueryRowContext(opCtx, `SELECT email, webhook_url FROM notification_preferences WHERE user_id = $1;`, userID).
+		Scan(&prefs.Email, &prefs.WebhookURL)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &prefs, nil
+}
+
+func (s *sqliteStorage) SetNotificationPreferences(ctx context.Context, prefs NotificationPreferences) (err error) {
+	defer wrapError("SetNotificationPreferences", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `INSERT INTO notification_preferences (user_id, email, webhook_url, updated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET email = excluded.email, webhook_url = excluded.webhook_url, updated_at = excluded.updated_at;`,
+		prefs.UserID, prefs.Email, prefs.WebhookURL, sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) DeleteNotificationPreferences(ctx context.Context, userID uuid.UUID) (err error) {
+	defer wrapError("DeleteNotificationPreferences", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `DELETE FROM notification_preferences WHERE user_id = $1;`, userID)
+	return err
+}
+
+func (s *sqliteStorage) AddNotificationDeliveries(ctx context.Context, deliveries []NotificationDelivery) (err error) {
+	defer wrapError("AddNotificationDeliveries", &err)
+
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := sqliteNow()
+	return s.transact(opCtx, func(c sqlConn) error {
+		for _, d := range deliveries {
+			_, err := c.ExecContext(opCtx, `INSERT INTO notification_outbox (user_id, channel, address, payload, next_attempt_at, created_at) VALUES ($1, $2, $3, $4, $5, $5);`,
+				d.UserID, d.Channel, d.Address, string(d.Payload), now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const sqliteNotificationDeliveryColumns = `id, user_id, channel, address, payload, status, attempts, COALESCE(last_error, ''), next_attempt_at, created_at, sent_at`
+
+func sqliteScanNotificationDeliveries(r *sql.Rows) ([]NotificationDelivery, error) {
+	deliveries := make([]NotificationDelivery, 0)
+	for r.Next() {
+		d := NotificationDelivery{}
+		var payload string
+		var sentAt time.Time
+		if err := r.Scan(&d.ID, &d.UserID, &d.Channel, &d.Address, &payload, &d.Status, &d.Attempts, &d.LastError,
+			sqlTime{&d.NextAttemptAt}, sqlTime{&d.CreatedAt}, sqlTime{&sentAt}); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		if !sentAt.IsZero() {
+			d.SentAt = &sentAt
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, r.Err()
+}
+
+func (s *sqliteStorage) ClaimNotificationDeliveries(ctx context.Context, lease time.Duration, limit int) (_ []NotificationDelivery, err error) {
+	defer wrapError("ClaimNotificationDeliveries", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	now := time.Now()
+	r, err := s.conn.QueryContext(opCtx, `UPDATE notification_outbox SET next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE status = 'pending' AND next_attempt_at <= $2
+			ORDER BY next_attempt_at
+			LIMIT $3
+		)
+		RETURNING `+sqliteNotificationDeliveryColumns+`;`, sqliteTime(now.Add(lease)), sqliteTime(now), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return sqliteScanNotificationDeliveries(r)
+}
+
+func (s *sqliteStorage) CompleteNotificationDelivery(ctx context.Context, id int64) (err error) {
+	defer wrapError("CompleteNotificationDelivery", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `UPDATE notification_outbox SET status = 'sent', attempts = attempts + 1, sent_at = $2 WHERE id = $1;`, id, sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) FailNotificationDelivery(ctx context.Context, id int64, lastError string, retryAt time.Time) (err error) {
+	defer wrapError("FailNotificationDelivery", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if retryAt.IsZero() {
+		_, err = s.conn.ExecContext(opCtx, `UPDATE notification_outbox SET status = 'failed', attempts = attempts + 1, last_error = $2 WHERE id = $1;`, id, lastError)
+		return err
+	}
+	_, err = s.conn.ExecContext(opCtx, `UPDATE notification_outbox SET attempts = attempts + 1, last_error = $2, next_attempt_at = $3 WHERE id = $1;`, id, lastError, sqliteTime(retryAt))
+	return err
+}
+
+func (s *sqliteStorage) GetNotificationDeliveries(ctx context.Context, filter NotificationDeliveryFilter) (_ []NotificationDelivery, err error) {
+	defer wrapError("GetNotificationDeliveries", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if filter.UserID != uuid.Nil {
+		addCondition("user_id = $%d", filter.UserID)
+	}
+	if filter.MerchantID.Valid {
+		addCondition("user_id IN (SELECT id FROM users WHERE merchant_id = $%d)", filter.MerchantID.UUID)
+	}
+	if len(filter.Status) != 0 {
+		addCondition("status = $%d", filter.Status)
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`SELECT %s FROM notification_outbox WHERE %s ORDER BY id DESC LIMIT $%d;`,
+		sqliteNotificationDeliveryColumns, strings.Join(conditions, " AND "), len(args))
+	r, err := s.conn.QueryContext(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return sqliteScanNotificationDeliveries(r)
+}
+
+func (s *sqliteStorage) RevokeToken(ctx context.Context, jti uuid.UUID, expiresAt time.Time) (err error) {
+	defer wrapError("RevokeToken", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	if _, err := s.conn.ExecContext(opCtx, `DELETE FROM revoked_tokens WHERE expires_at < $1;`, sqliteNow()); err != nil {
+		return err
+	}
+
+	_, err = s.conn.ExecContext(opCtx, `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING;`, jti, sqliteTime(expiresAt))
+	return err
+}
+
+func (s *sqliteStorage) IsTokenRevoked(ctx context.Context, jti uuid.UUID) (revoked bool, err error) {
+	defer wrapError("IsTokenRevoked", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	err = s.conn.QueryRowContext(opCtx, `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1);`, jti).Scan(&revoked)
+	return revoked, err
+}
+
+func (s *sqliteStorage) AddRefreshToken(ctx context.Context, tokenHash string, userID, sessionID uuid.UUID, expiresAt time.Time) (err error) {
+	defer wrapError("AddRefreshToken", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `INSERT INTO refresh_tokens (token_hash, user_id, session_id, expires_at, created_at) VALUES ($1, $2, $3, $4, $5);`,
+		tokenHash, userID, sessionID, sqliteTime(expiresAt), sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) ConsumeRefreshToken(ctx context.Context, tokenHash string) (_, _ uuid.UUID, err error) {
+	defer wrapError("ConsumeRefreshToken", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var (
+		userID    uuid.UUID
+		sessionID uuid.NullUUID
+		expiresAt time.Time
+	)
+	err = s.conn.QueryRowContext(opCtx, `DELETE FROM refresh_tokens WHERE token_hash = $1 RETURNING user_id, session_id, expires_at;`, tokenHash).
+		Scan(&userID, &sessionID, sqlTime{&expiresAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.UUID{}, uuid.UUID{}, ErrNoSuchToken
+		}
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+	if expiresAt.Before(time.Now()) {
+		return uuid.UUID{}, uuid.UUID{}, ErrNoSuchToken
+	}
+
+	return userID, sessionID.UUID, nil
+}
+
+func (s *sqliteStorage) StartSession(ctx context.Context, session *Session) (err error) {
+	defer wrapError("StartSession", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := sqliteNow()
+	return s.conn.QueryRowContext(opCtx, `INSERT INTO sessions (id, user_id, jti, user_agent, ip, created_at, last_seen_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $6, $7)
+		RETURNING created_at, last_seen_at;`,
+		session.ID, session.UserID, session.JTI, session.UserAgent, session.IP, now, sqliteTime(session.ExpiresAt)).
+		Scan(sqlTime{&session.CreatedAt}, sqlTime{&session.LastSeenAt})
+}
+
+func (s *sqliteStorage) RenewSession(ctx context.Context, sessionID, jti uuid.UUID, expiresAt time.Time) (err error) {
+	defer wrapError("RenewSession", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	res, err := s.conn.ExecContext(opCtx, `UPDATE sessions SET jti = $2, expires_at = $3, last_seen_at = $4 WHERE id = $1 AND revoked_at IS NULL;`,
+		sessionID, jti, sqliteTime(expiresAt), sqliteNow())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchSession
+	}
+	return nil
+}
+
+func (s *sqliteStorage) TouchSession(ctx context.Context, userID, sessionID uuid.UUID) (err error) {
+	defer wrapError("TouchSession", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := time.Now()
+	var lastSeen time.Time
+	err = s.conn.QueryRowContext(opCtx, `SELECT last_seen_at FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > $3;`,
+		sessionID, userID, sqliteTime(now)).Scan(sqlTime{&lastSeen})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoSuchSession
+		}
+		return err
+	}
+	if lastSeen.After(now.Add(-time.Minute)) {
+		return nil
+	}
+
+	_, err = s.conn.ExecContext(opCtx, `UPDATE sessions SET last_seen_at = $2 WHERE id = $1;`, sessionID, sqliteTime(now))
+	return err
+}
+
+func (s *sqliteStorage) GetSessions(ctx context.Context, userID uuid.UUID) (_ []Session, err error) {
+	defer wrapError("GetSessions", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT id, jti, user_agent, ip, created_at, last_seen_at, expires_at FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2 ORDER BY last_seen_at DESC;`, userID, sqliteNow())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	sessions := make([]Session, 0)
+	for r.Next() {
+		session := Session{UserID: userID}
+		if err := r.Scan(&session.ID, &session.JTI, &session.UserAgent, &session.IP, sqlTime{&session.CreatedAt}, sqlTime{&session.LastSeenAt}, sqlTime{&session.ExpiresAt}); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, r.Err()
+}
+
+func (s *sqliteStorage) RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) (err error) {
+	defer wrapError("RevokeSession", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		res, err := c.ExecContext(opCtx, `UPDATE sessions SET revoked_at = $3 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;`, sessionID, userID, sqliteNow())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrNoSuchSession
+		}
+
+		_, err = c.ExecContext(opCtx, `DELETE FROM refresh_tokens WHERE session_id = $1;`, sessionID)
+		return err
+	})
+}
+
+func (s *sqliteStorage) RecordLoginFailure(ctx context.Context, key string, since time.Time) (failures int, err error) {
+	defer wrapError("RecordLoginFailure", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	err = s.conn.QueryRowContext(opCtx, `INSERT INTO login_attempts (key, failures, updated_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET updated_at = excluded.updated_at,
+			failures = CASE WHEN login_attempts.updated_at < $3 THEN 1 ELSE login_attempts.failures + 1 END
+		RETURNING failures;`, key, sqliteNow(), sqliteTime(since)).Scan(&failures)
+	return failures, err
+}
+
+func (s *sqliteStorage) LockLogin(ctx context.Context, key string, until time.Time) (err error) {
+	defer wrapError("LockLogin", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `UPDATE login_attempts SET locked_until = $2, updated_at = $3 WHERE key = $1;`, key, sqliteTime(until), sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) GetLoginLock(ctx context.Context, key string) (until time.Time, err error) {
+	defer wrapError("GetLoginLock", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	err = s.conn.QueryRowContext(opCtx, `SELECT locked_until FROM login_attempts WHERE key = $1 AND locked_until > $2;`, key, sqliteNow()).
+		Scan(sqlTime{&until})
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+func (s *sqliteStorage) ResetLoginFailures(ctx context.Context, key string) (err error) {
+	defer wrapError("ResetLoginFailures", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `DELETE FROM login_attempts WHERE key = $1;`, key)
+	return err
+}
+
+func (s *sqliteStorage) AddOrder(ctx context.Context, merchantID, userID uuid.UUID, orderNumber string) (err error) {
+	defer wrapError("AddOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := sqliteNow()
+	_, err = s.conn.ExecContext(opCtx, `INSERT INTO orders (id, user_id, merchant_id, order_number, uploaded_at, updated_at) VALUES ($1, $2, $3, $4, $5, $5);`,
+		uuid.New(), userID, merchantID, orderNumber, now)
+	if err == nil || sqliteCode(err) != sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return err
+	}
+
+	var ownerID uuid.UUID
+	if err := s.conn.QueryRowContext(opCtx, `SELECT user_id FROM orders WHERE merchant_id = $1 AND order_number = $2;`, merchantID, orderNumber).Scan(&ownerID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if ownerID == userID {
+		return ErrOrderAlreadyPlaced
+	}
+	return ErrDuplicateOrder
+}
+
+func (s *sqliteStorage) UpdateOrder(ctx context.Context, order Order) (err error) {
+	defer wrapError("UpdateOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var sources []string
+	for from := range orderTransitions {
+		if CanTransition(from, order.Status) {
+			sources = append(sources, from)
+		}
+	}
+
+	res, err := s.conn.ExecContext(opCtx, `UPDATE orders SET status = $1, accrual = $2, updated_at = $3
+		WHERE order_number = $4 AND status IN (SELECT value FROM json_each($5));`,
+		order.Status, int64(order.Accrual), sqliteNow(), order.OrderNumber, sqliteList(sources))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidTransition
+	}
+	return nil
+}
+
+func (s *sqliteStorage) RequeueOrder(ctx context.Context, orderNumber string) (err error) {
+	defer wrapError("RequeueOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	res, err := s.conn.ExecContext(opCtx, `UPDATE orders SET status = 'NEW', updated_at = $2 WHERE order_number = $1 AND status <> 'PROCESSED';`, orderNumber, sqliteNow())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoSuchOrder
+	}
+	return nil
+}
+
+func (s *sqliteStorage) SetOrderFiscalStatus(ctx context.Context, orderNumber string, fiscalStatus string, reason string, invalid bool) (err error) {
+	defer wrapError("SetOrderFiscalStatus", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	query := `UPDATE orders SET fiscal_status = $1, fiscal_reason = $2, updated_at = $4 WHERE order_number = $3;`
+	if invalid {
+		query = `UPDATE orders SET fiscal_status = $1, fiscal_reason = $2, status = 'INVALID', updated_at = $4 WHERE order_number = $3;`
+	}
+
+	_, err = s.conn.ExecContext(opCtx, query, fiscalStatus, reason, orderNumber, sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) GetOrders(ctx context.Context, userID uuid.UUID) (_ []Order, err error) {
+	defer wrapError("GetOrders", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT order_number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	orders := make([]Order, 0)
+	for r.Next() {
+		order := Order{UserID: userID}
+		if err := r.Scan(&order.OrderNumber, &order.Status, sqlAmount{&order.Accrual}, sqlTime{&order.UploadedAt}); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, r.Err()
+}
+
+func (s *sqliteStorage) GetOrdersVersion(ctx context.Context, userID uuid.UUID) (_ OrdersVersion, err error) {
+	defer wrapError("GetOrdersVersion", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var version OrdersVersion
+	err = s.conn.QueryRowContext(opCtx, `SELECT COALESCE(MAX(updated_at), `+sqliteEpoch+`), COUNT(*) FROM orders WHERE user_id = $1;`, userID).
+		Scan(sqlTime{&version.UpdatedAt}, &version.Count)
+	return version, err
+}
+
+func (s *sqliteStorage) GetOrdersPage(ctx context.Context, userID uuid.UUID, filter OrdersFilter, cursor string, limit int) (_ *OrdersPage, err error) {
+	defer wrapError("GetOrdersPage", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	sortColumn := "uploaded_at"
+	if filter.Sort == OrdersSortAccrual {
+		sortColumn = "accrual"
+	}
+
+	conditions := []string{"user_id = $1"}
+	args := []interface{}{userID}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if len(filter.Statuses) != 0 {
+		addCondition("status IN (SELECT value FROM json_each($%d))", sqliteList(filter.Statuses))
+	}
+	if !filter.From.IsZero() {
+		addCondition("uploaded_at >= $%d", sqliteTime(filter.From))
+	}
+	if !filter.To.IsZero() {
+		addCondition("uploaded_at < $%d", sqliteTime(filter.To))
+	}
+
+	page := &OrdersPage{Orders: make([]Order, 0, limit)}
+	where := strings.Join(conditions, " AND ")
+	if err := s.conn.QueryRowContext(opCtx, `SELECT COUNT(*) FROM orders WHERE `+where+`;`, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+
+	if len(cursor) != 0 {
+		key, orderNumber, err := decodeOrdersCursor(filter.Sort, cursor)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case time.Time:
+			key = sqliteTime(k)
+		case money.Amount:
+			key = int64(k)
+		}
+		args = append(args, key, orderNumber)
+		conditions = append(conditions, fmt.Sprintf("(%s, order_number) < ($%d, $%d)", sortColumn, len(args)-1, len(args)))
+		where = strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`SELECT order_number, status, accrual, uploaded_at FROM orders WHERE %s
+		ORDER BY %s DESC, order_number DESC LIMIT $%d;`, where, sortColumn, len(args))
+	r, err := s.conn.QueryContext(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		order := Order{UserID: userID}
+		if err := r.Scan(&order.OrderNumber, &order.Status, sqlAmount{&order.Accrual}, sqlTime{&order.UploadedAt}); err != nil {
+			return nil, err
+		}
+		page.Orders = append(page.Orders, order)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Orders) == limit {
+		page.NextCursor = encodeOrdersCursor(filter.Sort, page.Orders[len(page.Orders)-1])
+	}
+
+	return page, nil
+}
+
+// ClaimUnfinishedOrders needs no row locks: SQLite runs one write at a time,
+// so concurrent claims can't take the same orders.
+func (s *sqliteStorage) ClaimUnfinishedOrders(ctx context.Context, owner string, lease time.Duration, filter ClaimFilter, limit int) (_ []Order, err error) {
+	defer wrapError("ClaimUnfinishedOrders", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	now := time.Now()
+	conditions := []string{"TRUE"}
+	args := []interface{}{owner, sqliteTime(now.Add(lease)), sqliteTime(now)}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if !filter.UpdatedSince.IsZero() {
+		addCondition("updated_at >= $%d", sqliteTime(filter.UpdatedSince))
+	}
+	if !filter.UpdatedBefore.IsZero() {
+		addCondition("updated_at < $%d", sqliteTime(filter.UpdatedBefore))
+	}
+	orderBy := "uploaded_at"
+	if filter.ByNumber {
+		addCondition("order_number > $%d", filter.AfterNumber)
+		orderBy = "order_number"
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`UPDATE orders SET claimed_by = $1, claimed_until = $2
+		WHERE order_number IN (
+			SELECT order_number FROM orders
+			WHERE status IN ('NEW', 'PROCESSING')
+				AND (claimed_until IS NULL OR claimed_until < $3 OR claimed_by = $1)
+				AND NOT EXISTS (SELECT 1 FROM accrual_dead_letter d WHERE d.order_number = orders.order_number)
+				AND %s
+			ORDER BY %s
+			LIMIT $%d
+		)
+		RETURNING order_number, user_id, status, accrual, uploaded_at, accrual_registered_at IS NOT NULL;`, strings.Join(conditions, " AND "), orderBy, len(args))
+	r, err := s.conn.QueryContext(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	orders := make([]Order, 0)
+	for r.Next() {
+		order := Order{}
+		if err := r.Scan(&order.OrderNumber, &order.UserID, &order.Status, sqlAmount{&order.Accrual}, sqlTime{&order.UploadedAt}, &order.Registered); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	s.logger.Debug("claimed unfinished orders", zap.String("owner", owner), zap.Int("count", len(orders)))
+	return orders, nil
+}
+
+func (s *sqliteStorage) ReleaseOrderClaims(ctx context.Context, owner string) (err error) {
+	defer wrapError("ReleaseOrderClaims", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `UPDATE orders SET claimed_by = NULL, claimed_until = NULL WHERE claimed_by = $1 AND status IN ('NEW', 'PROCESSING');`, owner)
+	return err
+}
+
+func (s *sqliteStorage) GetOrder(ctx context.Context, orderNumber string) (_ *Order, err error) {
+	defer wrapError("GetOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	order := Order{}
+	err = s.conn.QueryRowContext(opCtx, `SELECT order_number, user_id, status, accrual, uploaded_at FROM orders WHERE order_number = $1;`, orderNumber).
+		Scan(&order.OrderNumber, &order.UserID, &order.Status, sqlAmount{&order.Accrual}, sqlTime{&order.UploadedAt})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchOrder
+		}
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+func (s *sqliteStorage) GetOrderByNumber(ctx context.Context, userID uuid.UUID, orderNumber string) (_ *Order, err error) {
+	defer wrapError("GetOrderByNumber", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	order := Order{UserID: userID}
+	err = s.conn.QueryRowContext(opCtx, `SELECT order_number, status, accrual, uploaded_at, updated_at,
+		accrual_registered_at IS NOT NULL, COALESCE(accrual_registration_error, '') FROM orders
+		WHERE order_number = $1 AND user_id = $2;`, orderNumber, userID).
+		Scan(&order.OrderNumber, &order.Status, sqlAmount{&order.Accrual}, sqlTime{&order.UploadedAt}, sqlTime{&order.UpdatedAt}, &order.Registered, &order.RegistrationError)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoSuchOrder
+		}
+		return nil, err
+	}
+
+	return &order, nil
+}
+
+func (s *sqliteStorage) RecordAccrualNotFound(ctx context.Context, orderNumber string) (_ int, err error) {
+	defer wrapError("RecordAccrualNotFound", &err)
+
+	return s.incrementOrderCounter(ctx, "not_found_count", orderNumber)
+}
+
+func (s *sqliteStorage) RecordAccrualFailure(ctx context.Context, orderNumber string) (_ int, err error) {
+	defer wrapError("RecordAccrualFailure", &err)
+
+	return s.incrementOrderCounter(ctx, "accrual_failures", orderNumber)
+}
+
+func (s *sqliteStorage) incrementOrderCounter(ctx context.Context, column string, orderNumber string) (int, error) {
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	var count int
+	err := s.conn.QueryRowContext(opCtx, `UPDATE orders SET `+column+` = `+column+` + 1 WHERE order_number = $1 RETURNING `+column+`;`, orderNumber).
+		Scan(&count)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoSuchOrder
+		}
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *sqliteStorage) DeadLetterOrder(ctx context.Context, letter DeadLetter) (err error) {
+	defer wrapError("DeadLetterOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `INSERT INTO accrual_dead_letter (order_number, failures, last_error, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (order_number) DO UPDATE SET failures = excluded.failures, last_error = excluded.last_error;`,
+		letter.OrderNumber, letter.Failures, letter.LastError, sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) MarkOrderRegistered(ctx context.Context, orderNumber string) (err error) {
+	defer wrapError("MarkOrderRegistered", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `UPDATE orders SET accrual_registered_at = $2, accrual_registration_error = NULL WHERE order_number = $1;`, orderNumber, sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) SetOrderRegistrationError(ctx context.Context, orderNumber string, message string) (err error) {
+	defer wrapError("SetOrderRegistrationError", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	_, err = s.conn.ExecContext(opCtx, `UPDATE orders SET accrual_registration_error = $2, updated_at = $3 WHERE order_number = $1;`, orderNumber, message, sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) GetAccrualBacklog(ctx context.Context) (_ *AccrualBacklog, err error) {
+	defer wrapError("GetAccrualBacklog", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	var backlog AccrualBacklog
+	err = s.conn.QueryRowContext(opCtx, `SELECT COUNT(*), MIN(uploaded_at) FROM orders WHERE status IN ('NEW', 'PROCESSING');`).
+		Scan(&backlog.Orders, sqlTime{&backlog.OldestUploadedAt})
+	if err != nil {
+		return nil, err
+	}
+
+	return &backlog, nil
+}
+
+func (s *sqliteStorage) GetDeadLetters(ctx context.Context) (_ []DeadLetter, err error) {
+	defer wrapError("GetDeadLetters", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT order_number, failures, last_error, created_at FROM accrual_dead_letter ORDER BY created_at;`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	letters := make([]DeadLetter, 0)
+	for r.Next() {
+		l := DeadLetter{}
+		if err := r.Scan(&l.OrderNumber, &l.Failures, &l.LastError, sqlTime{&l.CreatedAt}); err != nil {
+			return nil, err
+		}
+		letters = append(letters, l)
+	}
+
+	return letters, r.Err()
+}
+
+func (s *sqliteStorage) RedriveOrder(ctx context.Context, orderNumber string) (err error) {
+	defer wrapError("RedriveOrder", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		res, err := c.ExecContext(opCtx, `DELETE FROM accrual_dead_letter WHERE order_number = $1;`, orderNumber)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrNoSuchOrder
+		}
+
+		_, err = c.ExecContext(opCtx, `UPDATE orders SET accrual_failures = 0, not_found_count = 0, updated_at = $2 WHERE order_number = $1;`, orderNumber, sqliteNow())
+		return err
+	})
+}
+
+func (s *sqliteStorage) Withdraw(ctx context.Context, userID uuid.UUID, order string, sum money.Amount, idempotencyKey string) (err error) {
+	defer wrapError("Withdraw", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	// The transaction holds the write lock from the start (_txlock), so
+	// the idempotency check can't race another withdrawal.
+	return s.transact(opCtx, func(c sqlConn) error {
+		var key *string
+		if len(idempotencyKey) != 0 {
+			key = &idempotencyKey
+
+			var storedOrder string
+			var storedSum money.Amount
+			err := c.QueryRowContext(opCtx, `SELECT order_number, sum FROM withdrawal WHERE user_id = $1 AND idempotency_key = $2;`, userID, idempotencyKey).
+				Scan(&storedOrder, sqlAmount{&storedSum})
+			switch {
+			case err == nil && (storedOrder != order || storedSum != sum):
+				return ErrIdempotencyKeyUsed
+			case err == nil:
+				return nil
+			case !errors.Is(err, sql.ErrNoRows):
+				return err
+			}
+		}
+
+		now := sqliteNow()
+		info := BalanceInfo{}
+		err := c.QueryRowContext(opCtx, `UPDATE balance SET current = current - $1, withdrawn = withdrawn + $1, updated_at = $3 WHERE user_id = $2 AND current >= $1 RETURNING current, withdrawn;`,
+			int64(sum), userID, now).Scan(sqlAmount{&info.Current}, sqlAmount{&info.Withdrawn})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotEnoughBalance
+			}
+			return err
+		}
+
+		_, err = c.ExecContext(opCtx, `INSERT INTO withdrawal (id, order_number, user_id, sum, idempotency_key, processed_at) VALUES ($1, $2, $3, $4, $5, $6);`,
+			uuid.New(), order, userID, int64(sum), key, now)
+		if err != nil {
+			if sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+				return ErrDuplicateOrder
+			}
+			return err
+		}
+
+		if err := sqliteAddLedgerEntry(opCtx, c, userID, LedgerWithdrawal, order, -sum, info.Current); err != nil {
+			return err
+		}
+		return sqliteAddAuditEntry(opCtx, c, BalanceAuditEntry{
+			UserID:          userID,
+			Source:          LedgerWithdrawal,
+			Reference:       order,
+			CurrentBefore:   info.Current + sum,
+			CurrentAfter:    info.Current,
+			WithdrawnBefore: info.Withdrawn - sum,
+			WithdrawnAfter:  info.Withdrawn,
+		})
+	})
+}
+
+func (s *sqliteStorage) AddBalance(ctx context.Context, userID uuid.UUID, amount money.Amount) (err error) {
+	defer wrapError("AddBalance", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		return sqliteCreditBalance(opCtx, c, userID, LedgerCredit, "", amount)
+	})
+}
+
+func (s *sqliteStorage) AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (_ *BalanceInfo, err error) {
+	defer wrapError("AdjustBalance", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	info := BalanceInfo{}
+	err = s.transact(opCtx, func(c sqlConn) error {
+		now := sqliteNow()
+		err := c.QueryRowContext(opCtx, `UPDATE balance SET current = current + $1, updated_at = $3 WHERE user_id = $2 AND current + $1 >= 0 RETURNING current, withdrawn, updated_at;`,
+			int64(adjustment.Amount), adjustment.UserID, now).Scan(sqlAmount{&info.Current}, sqlAmount{&info.Withdrawn}, sqlTime{&info.UpdatedAt})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotEnoughBalance
+			}
+			return err
+		}
+
+		adjustmentID := uuid.New()
+		_, err = c.ExecContext(opCtx, `INSERT INTO balance_adjustments (id, user_id, amount, reason_code, reason, operator, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+			adjustmentID, adjustment.UserID, int64(adjustment.Amount), adjustment.ReasonCode, adjustment.Reason, adjustment.Operator, now)
+		if err != nil {
+			return err
+		}
+
+		if err := sqliteAddLedgerEntry(opCtx, c, adjustment.UserID, LedgerAdjustment, adjustment.ReasonCode, adjustment.Amount, info.Current); err != nil {
+			return err
+		}
+		return sqliteAddAuditEntry(opCtx, c, BalanceAuditEntry{
+			UserID:          adjustment.UserID,
+			Source:          LedgerAdjustment,
+			Reference:       adjustmentID.String(),
+			CurrentBefore:   info.Current - adjustment.Amount,
+			CurrentAfter:    info.Current,
+			WithdrawnBefore: info.Withdrawn,
+			WithdrawnAfter:  info.Withdrawn,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// UpdateBalanceFromOrders has the semantics of the Postgres version: orders
+// that already left the status a transition starts from are skipped, and the
+// accruals are credited in user and order number order.
+func (s *sqliteStorage) UpdateBalanceFromOrders(ctx context.Context, transitions []OrderTransition) (err error) {
+	defer wrapError("UpdateBalanceFromOrders", &err)
+
+	for _, t := range transitions {
+		if err := t.Check(); err != nil {
+			return err
+		}
+	}
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		now := sqliteNow()
+		var credited []Order
+		seen := make(map[string]bool, len(transitions))
+		for _, t := range transitions {
+			if seen[t.OrderNumber] {
+				continue
+			}
+			seen[t.OrderNumber] = true
+
+			// Merchants number their orders independently, so the result
+			// is credited to every user who uploaded the number.
+			users, err := sqliteUpdateOrderStatus(opCtx, c, t, now)
+			if err != nil {
+				return err
+			}
+			if t.Status != StatusProcessed || t.Accrual == 0 {
+				continue
+			}
+			for _, userID := range users {
+				order := t.Order
+				order.UserID = userID
+				credited = append(credited, order)
+			}
+		}
+
+		sort.Slice(credited, func(i, j int) bool {
+			if credited[i].UserID != credited[j].UserID {
+				return credited[i].UserID.String() < credited[j].UserID.String()
+			}
+			return credited[i].OrderNumber < credited[j].OrderNumber
+		})
+		for _, order := range credited {
+			if err := sqliteCreditBalance(opCtx, c, order.UserID, LedgerAccrual, order.OrderNumber, order.Accrual); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sqliteUpdateOrderStatus(ctx context.Context, c sqlConn, t OrderTransition, now string) ([]uuid.UUID, error) {
+	r, err := c.QueryContext(ctx, `UPDATE orders SET status = $1, accrual = $2, updated_at = $3 WHERE order_number = $4 AND status = $5 RETURNING user_id;`,
+		t.Status, int64(t.Accrual), now, t.OrderNumber, t.From)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var users []uuid.UUID
+	for r.Next() {
+		var userID uuid.UUID
+		if err := r.Scan(&userID); err != nil {
+			return nil, err
+		}
+		users = append(users, userID)
+	}
+	return users, r.Err()
+}
+
+func sqliteCreditBalance(ctx context.Context, c sqlConn, userID uuid.UUID, kind, reference string, amount money.Amount) error {
+	info := BalanceInfo{}
+	err := c.QueryRowContext(ctx, `UPDATE balance SET current = current + $1, updated_at = $3 WHERE user_id = $2 RETURNING current, withdrawn;`,
+		int64(amount), userID, sqliteNow()).Scan(sqlAmount{&info.Current}, sqlAmount{&info.Withdrawn})
+	if err != nil {
+		return err
+	}
+
+	if err := sqliteAddLedgerEntry(ctx, c, userID, kind, reference, amount, info.Current); err != nil {
+		return err
+	}
+
+	return sqliteAddAuditEntry(ctx, c, BalanceAuditEntry{
+		UserID:          userID,
+		Source:          kind,
+		Reference:       reference,
+		CurrentBefore:   info.Current - amount,
+		CurrentAfter:    info.Current,
+		WithdrawnBefore: info.Withdrawn,
+		WithdrawnAfter:  info.Withdrawn,
+	})
+}
+
+func sqliteAddLedgerEntry(ctx context.Context, c sqlConn, userID uuid.UUID, kind, reference string, amount, balance money.Amount) error {
+	var ref *string
+	if len(reference) != 0 {
+		ref = &reference
+	}
+
+	_, err := c.ExecContext(ctx, `INSERT INTO ledger (user_id, kind, reference, amount, balance, created_at) VALUES ($1, $2, $3, $4, $5, $6);`,
+		userID, kind, ref, int64(amount), int64(balance), sqliteNow())
+	return err
+}
+
+func sqliteAddAuditEntry(ctx context.Context, c sqlConn, e BalanceAuditEntry) error {
+	var ref *string
+	if len(e.Reference) != 0 {
+		ref = &e.Reference
+	}
+
+	_, err := c.ExecContext(ctx, `INSERT INTO balance_audit (user_id, source, reference, current_before, current_after, withdrawn_before, withdrawn_after, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		e.UserID, e.Source, ref, int64(e.CurrentBefore), int64(e.CurrentAfter), int64(e.WithdrawnBefore), int64(e.WithdrawnAfter), sqliteNow())
+	return err
+}
+
+func (s *sqliteStorage) GetLedger(ctx context.Context, userID uuid.UUID) (_ []LedgerEntry, err error) {
+	defer wrapError("GetLedger", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT kind, COALESCE(reference, ''), amount, balance, created_at FROM ledger WHERE user_id = $1 ORDER BY id;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]LedgerEntry, 0)
+	for r.Next() {
+		e := LedgerEntry{}
+		if err := r.Scan(&e.Kind, &e.Reference, sqlAmount{&e.Amount}, sqlAmount{&e.Balance}, sqlTime{&e.CreatedAt}); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, r.Err()
+}
+
+func (s *sqliteStorage) GetBalanceAudit(ctx context.Context, filter BalanceAuditFilter) (_ []BalanceAuditEntry, err error) {
+	defer wrapError("GetBalanceAudit", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if filter.UserID != uuid.Nil {
+		addCondition("user_id = $%d", filter.UserID)
+	}
+	if filter.MerchantID.Valid {
+		addCondition("user_id IN (SELECT id FROM users WHERE merchant_id = $%d)", filter.MerchantID.UUID)
+	}
+	if len(filter.Reference) != 0 {
+		addCondition("reference = $%d", filter.Reference)
+	}
+	if !filter.From.IsZero() {
+		addCondition("created_at >= $%d", sqliteTime(filter.From))
+	}
+	if !filter.To.IsZero() {
+		addCondition("created_at < $%d", sqliteTime(filter.To))
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`SELECT id, user_id, source, COALESCE(reference, ''), current_before, current_after, withdrawn_before, withdrawn_after, created_at
+		FROM balance_audit WHERE %s ORDER BY id DESC LIMIT $%d;`, strings.Join(conditions, " AND "), len(args))
+	r, err := s.conn.QueryContext(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]BalanceAuditEntry, 0)
+	for r.Next() {
+		e := BalanceAuditEntry{}
+		if err := r.Scan(&e.ID, &e.UserID, &e.Source, &e.Reference, sqlAmount{&e.CurrentBefore}, sqlAmount{&e.CurrentAfter},
+			sqlAmount{&e.WithdrawnBefore}, sqlAmount{&e.WithdrawnAfter}, sqlTime{&e.CreatedAt}); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, r.Err()
+}
+
+func (s *sqliteStorage) GetBalance(ctx context.Context, userID uuid.UUID) (_ *BalanceInfo, err error) {
+	defer wrapError("GetBalance", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	info := BalanceInfo{}
+	err = s.conn.QueryRowContext(opCtx, `SELECT current, withdrawn, COALESCE(updated_at, `+sqliteEpoch+`) FROM balance WHERE user_id = $1;`, userID).
+		Scan(sqlAmount{&info.Current}, sqlAmount{&info.Withdrawn}, sqlTime{&info.UpdatedAt})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (s *sqliteStorage) GetWithdrawals(ctx context.Context, userID uuid.UUID) (_ []Withdrawal, err error) {
+	defer wrapError("GetWithdrawals", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT order_number, sum, processed_at FROM withdrawal WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ws := make([]Withdrawal, 0)
+	for r.Next() {
+		w := Withdrawal{}
+		if err := r.Scan(&w.OrderNumber, sqlAmount{&w.Sum}, sqlTime{&w.ProcessedAt}); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	return ws, r.Err()
+}
+
+func (s *sqliteStorage) GetWithdrawalsForPeriod(ctx context.Context, from, to time.Time) (_ []Withdrawal, err error) {
+	defer wrapError("GetWithdrawalsForPeriod", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT order_number, user_id, sum, processed_at FROM withdrawal WHERE processed_at >= $1 AND processed_at < $2 ORDER BY processed_at;`,
+		sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ws := make([]Withdrawal, 0)
+	for r.Next() {
+		w := Withdrawal{}
+		if err := r.Scan(&w.OrderNumber, &w.UserID, sqlAmount{&w.Sum}, sqlTime{&w.ProcessedAt}); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	return ws, r.Err()
+}
+
+func (s *sqliteStorage) GetAccountingSummary(ctx context.Context, from, to time.Time) (_ *AccountingSummary, err error) {
+	defer wrapError("GetAccountingSummary", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	query := `SELECT
+		(SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE status = 'PROCESSED' AND updated_at >= $1 AND updated_at < $2),
+		(SELECT COALESCE(SUM(sum), 0) FROM withdrawal WHERE processed_at >= $1 AND processed_at < $2),
+		(SELECT COALESCE(SUM(current), 0) FROM balance);`
+
+	summary := AccountingSummary{}
+	err = s.conn.QueryRowContext(opCtx, query, sqliteTime(from), sqliteTime(to)).
+		Scan(sqlAmount{&summary.Accrued}, sqlAmount{&summary.Redeemed}, sqlAmount{&summary.Liability})
+	if err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+func (s *sqliteStorage) GetUserStats(ctx context.Context, userID uuid.UUID, since time.Time) (_ *UserStats, err error) {
+	defer wrapError("GetUserStats", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	stats := UserStats{
+		OrdersByStatus: map[string]int{
+			StatusNew:        0,
+			StatusProcessing: 0,
+			StatusInvalid:    0,
+			StatusProcessed:  0,
+		},
+	}
+
+	query := `SELECT
+		(SELECT COALESCE(SUM(accrual), 0) FROM orders WHERE user_id = $1 AND status = 'PROCESSED'),
+		(SELECT COALESCE(SUM(withdrawn), 0) FROM balance WHERE user_id = $1),
+		(SELECT COALESCE(SUM(amount), 0) FROM ledger WHERE user_id = $1 AND kind = $2 AND created_at >= $3);`
+	err = s.conn.QueryRowContext(opCtx, query, userID, LedgerAccrual, sqliteTime(since)).
+		Scan(sqlAmount{&stats.TotalAccrued}, sqlAmount{&stats.TotalWithdrawn}, sqlAmount{&stats.EarnedSince})
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT status, COUNT(*) FROM orders WHERE user_id = $1 GROUP BY status;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var status string
+		var count int
+		if err := r.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		stats.OrdersByStatus[status] = count
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+func (s *sqliteStorage) AddAccrualJournalEntries(ctx context.Context, entries []AccrualJournalEntry) (err error) {
+	defer wrapError("AddAccrualJournalEntries", &err)
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	now := sqliteNow()
+	return s.transact(opCtx, func(c sqlConn) error {
+		for _, e := range entries {
+			if len(e.OrderNumber) == 0 {
+				continue
+			}
+			_, err := c.ExecContext(opCtx, `INSERT INTO accrual_journal (id, order_number, provider, status, accrual, error, created_at) VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), $7);`,
+				uuid.New(), e.OrderNumber, e.Provider, e.Status, int64(e.Accrual), e.Error, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) GetAccrualJournal(ctx context.Context, orderNumber string) (_ []AccrualJournalEntry, err error) {
+	defer wrapError("GetAccrualJournal", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, `SELECT provider, COALESCE(status, ''), COALESCE(accrual, 0), COALESCE(error, ''), created_at FROM accrual_journal WHERE order_number = $1 ORDER BY created_at;`, orderNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]AccrualJournalEntry, 0)
+	for r.Next() {
+		e := AccrualJournalEntry{OrderNumber: orderNumber}
+		if err := r.Scan(&e.Provider, &e.Status, sqlAmount{&e.Accrual}, &e.Error, sqlTime{&e.CreatedAt}); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, r.Err()
+}
+
+// ApplyRetention runs the statements of retentionTargets, which are plain
+// enough for both databases.
+func (s *sqliteStorage) ApplyRetention(ctx context.Context, target string, cutoff time.Time, dryRun bool) (_ int64, err error) {
+	defer wrapError("ApplyRetention", &err)
+
+	q, ok := retentionTargets[target]
+	if !ok {
+		return 0, fmt.Errorf("unknown retention target %q", target)
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	if dryRun {
+		var count int64
+		err := s.conn.QueryRowContext(opCtx, q.count, sqliteTime(cutoff)).Scan(&count)
+		return count, err
+	}
+
+	res, err := s.conn.ExecContext(opCtx, q.apply, sqliteTime(cutoff))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *sqliteStorage) FindBalanceDrift(ctx context.Context) (_ []BalanceDrift, err error) {
+	defer wrapError("FindBalanceDrift", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	r, err := s.conn.QueryContext(opCtx, balanceDriftQuery, StatusProcessed, LedgerCredit)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	drifts := make([]BalanceDrift, 0)
+	for r.Next() {
+		d := BalanceDrift{}
+		if err := r.Scan(&d.UserID, sqlAmount{&d.Current}, sqlAmount{&d.ExpectedCurrent}, sqlAmount{&d.Withdrawn}, sqlAmount{&d.ExpectedWithdrawn}); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, d)
+	}
+
+	return drifts, r.Err()
+}
+
+func (s *sqliteStorage) CorrectBalanceDrift(ctx context.Context, drift BalanceDrift) (err error) {
+	defer wrapError("CorrectBalanceDrift", &err)
+
+	if drift.ExpectedCurrent < 0 || drift.ExpectedWithdrawn < 0 {
+		return ErrNotEnoughBalance
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		res, err := c.ExecContext(opCtx, `UPDATE balance SET current = $1, withdrawn = $2, updated_at = $3 WHERE user_id = $4 AND current = $5 AND withdrawn = $6;`,
+			int64(drift.ExpectedCurrent), int64(drift.ExpectedWithdrawn), sqliteNow(), drift.UserID, int64(drift.Current), int64(drift.Withdrawn))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrBalanceChanged
+		}
+
+		if err := sqliteAddLedgerEntry(opCtx, c, drift.UserID, LedgerReconciliation, "", drift.ExpectedCurrent-drift.Current, drift.ExpectedCurrent); err != nil {
+			return err
+		}
+		return sqliteAddAuditEntry(opCtx, c, BalanceAuditEntry{
+			UserID:          drift.UserID,
+			Source:          LedgerReconciliation,
+			CurrentBefore:   drift.Current,
+			CurrentAfter:    drift.ExpectedCurrent,
+			WithdrawnBefore: drift.Withdrawn,
+			WithdrawnAfter:  drift.ExpectedWithdrawn,
+		})
+	})
+}
+
+func (s *sqliteStorage) AddBalanceDrift(ctx context.Context, drifts []BalanceDrift) (err error) {
+	defer wrapError("AddBalanceDrift", &err)
+
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opWrite)
+	defer cancel()
+
+	now := sqliteNow()
+	return s.transact(opCtx, func(c sqlConn) error {
+		for _, d := range drifts {
+			_, err := c.ExecContext(opCtx, `INSERT INTO balance_drift (user_id, current, expected_current, withdrawn, expected_withdrawn, corrected, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7);`,
+				d.UserID, int64(d.Current), int64(d.ExpectedCurrent), int64(d.Withdrawn), int64(d.ExpectedWithdrawn), d.Corrected, now)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) GetBalanceDrift(ctx context.Context, filter BalanceDriftFilter) (_ []BalanceDrift, err error) {
+	defer wrapError("GetBalanceDrift", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opRead)
+	defer cancel()
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(format string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if filter.UserID != uuid.Nil {
+		addCondition("user_id = $%d", filter.UserID)
+	}
+	if filter.MerchantID.Valid {
+		addCondition("user_id IN (SELECT id FROM users WHERE merchant_id = $%d)", filter.MerchantID.UUID)
+	}
+	args = append(args, filter.Limit)
+
+	query := fmt.Sprintf(`SELECT id, user_id, current, expected_current, withdrawn, expected_withdrawn, corrected, created_at
+		FROM balance_drift WHERE %s ORDER BY id DESC LIMIT $%d;`, strings.Join(conditions, " AND "), len(args))
+	r, err := s.conn.QueryContext(opCtx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	drifts := make([]BalanceDrift, 0)
+	for r.Next() {
+		d := BalanceDrift{}
+		if err := r.Scan(&d.ID, &d.UserID, sqlAmount{&d.Current}, sqlAmount{&d.ExpectedCurrent}, sqlAmount{&d.Withdrawn}, sqlAmount{&d.ExpectedWithdrawn}, &d.Corrected, sqlTime{&d.FoundAt}); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, d)
+	}
+
+	return drifts, r.Err()
+}
+
+// MergeUsers works as it does on Postgres. The transaction holds the only
+// connection, so nothing can change either user meanwhile.
+func (s *sqliteStorage) MergeUsers(ctx context.Context, merge AccountMerge) (_ *AccountMerge, err error) {
+	defer wrapError("MergeUsers", &err)
+
+	if merge.SourceUserID == merge.TargetUserID {
+		return nil, ErrMergeIntoSelf
+	}
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	source, target := merge.SourceUserID, merge.TargetUserID
+	err = s.transact(opCtx, func(c sqlConn) error {
+		r, err := c.QueryContext(opCtx, `SELECT id, merchant_id FROM users WHERE id IN ($1, $2) AND deleted_at IS NULL;`, source, target)
+		if err != nil {
+			return err
+		}
+		merchants := make(map[uuid.UUID]uuid.UUID, 2)
+		for r.Next() {
+			var userID, merchantID uuid.UUID
+			if err := r.Scan(&userID, &merchantID); err != nil {
+				r.Close()
+				return err
+			}
+			merchants[userID] = merchantID
+		}
+		r.Close()
+		if err := r.Err(); err != nil {
+			return err
+		}
+		if len(merchants) != 2 {
+			return ErrNoSuchUser
+		}
+		if merchants[source] != merchants[target] {
+			return ErrDifferentMerchants
+		}
+
+		counts := []struct {
+			query string
+			n     *int
+		}{
+			{`UPDATE orders SET user_id = $2 WHERE user_id = $1;`, &merge.Orders},
+			{`UPDATE withdrawal SET idempotency_key = NULL
+				WHERE user_id = $1 AND idempotency_key IN (SELECT idempotency_key FROM withdrawal WHERE user_id = $2 AND idempotency_key IS NOT NULL);`, &merge.DroppedIdempotencyKeys},
+			{`UPDATE withdrawal SET user_id = $2 WHERE user_id = $1;`, &merge.Withdrawals},
+			{`UPDATE balance_adjustments SET user_id = $2 WHERE user_id = $1;`, nil},
+			{`UPDATE ledger SET user_id = $2 WHERE user_id = $1;`, nil},
+			{`INSERT INTO notification_preferences (user_id, email, webhook_url, updated_at)
+				SELECT $2, email, webhook_url, updated_at FROM notification_preferences WHERE user_id = $1
+				ON CONFLICT (user_id) DO NOTHING;`, nil},
+		}
+		for _, q := range counts {
+			res, err := c.ExecContext(opCtx, q.query, source, target)
+			if err != nil {
+				return err
+			}
+			if q.n != nil {
+				n, _ := res.RowsAffected()
+				*q.n = int(n)
+			}
+		}
+
+		merge.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		now := sqliteTime(merge.CreatedAt)
+		sourceBalance := BalanceInfo{}
+		err = c.QueryRowContext(opCtx, `SELECT current, withdrawn FROM balance WHERE user_id = $1;`, source).
+			Scan(sqlAmount{&sourceBalance.Current}, sqlAmount{&sourceBalance.Withdrawn})
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if _, err := c.ExecContext(opCtx, `UPDATE balance SET current = 0, withdrawn = 0, updated_at = $2 WHERE user_id = $1;`, source, now); err != nil {
+			return err
+		}
+
+		targetBalance := BalanceInfo{}
+		err = c.QueryRowContext(opCtx, `UPDATE balance SET current = current + $1, withdrawn = withdrawn + $2, updated_at = $4 WHERE user_id = $3 RETURNING current, withdrawn;`,
+			int64(sourceBalance.Current), int64(sourceBalance.Withdrawn), target, now).Scan(sqlAmount{&targetBalance.Current}, sqlAmount{&targetBalance.Withdrawn})
+		if err != nil {
+			return err
+		}
+
+		merge.ID = uuid.New()
+		merge.Current = sourceBalance.Current
+		merge.Withdrawn = sourceBalance.Withdrawn
+
+		if err := sqliteAddLedgerEntry(opCtx, c, target, LedgerMerge, "", 0, targetBalance.Current); err != nil {
+			return err
+		}
+		for _, e := range mergeAuditEntries(merge, sourceBalance, targetBalance) {
+			if err := sqliteAddAuditEntry(opCtx, c, e); err != nil {
+				return err
+			}
+		}
+
+		if err := sqliteSoftDeleteUser(opCtx, c, source); err != nil {
+			return err
+		}
+
+		_, err = c.ExecContext(opCtx, `INSERT INTO account_merges (id, source_user_id, target_user_id, orders, withdrawals, dropped_idempotency_keys, current, withdrawn, reason, operator, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);`,
+			merge.ID, source, target, merge.Orders, merge.Withdrawals, merge.DroppedIdempotencyKeys, int64(merge.Current), int64(merge.Withdrawn), merge.Reason, merge.Operator, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &merge, nil
+}
+
+// BackdateActivity picks the times in Go: SQLite can't produce them in
+// sqliteTimeLayout.
+func (s *sqliteStorage) BackdateActivity(ctx context.Context, userID uuid.UUID, since time.Time) (err error) {
+	defer wrapError("BackdateActivity", &err)
+
+	opCtx, cancel := s.withTimeout(ctx, opBatch)
+	defer cancel()
+
+	span := time.Since(since)
+	if span <= 0 {
+		span = 1
+	}
+	randomTime := func() string {
+		return sqliteTime(since.Add(time.Duration(rand.Int63n(int64(span)))))
+	}
+
+	return s.transact(opCtx, func(c sqlConn) error {
+		if _, err := c.ExecContext(opCtx, `UPDATE users SET created_at = $2 WHERE id = $1;`, userID, sqliteTime(since)); err != nil {
+			return err
+		}
+
+		for _, table := range []struct{ name, set string }{
+			{"orders", "uploaded_at = $2, updated_at = $2"},
+			{"withdrawal", "processed_at = $2"},
+		} {
+			ids, err := sqliteUserRowIDs(opCtx, c, table.name, userID)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if _, err := c.ExecContext(opCtx, `UPDATE `+table.name+` SET `+table.set+` WHERE id = $1;`, id, randomTime()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func sqliteUserRowIDs(ctx context.Context, c sqlConn, table string, userID uuid.UUID) ([]string, error) {
+	rows, err := c.QueryContext(ctx, `SELECT id FROM `+table+` WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -2,10 +2,13 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
 )
 
 const (
@@ -15,56 +18,460 @@ const (
 	StatusProcessed  = "PROCESSED"
 )
 
+const (
+	OrdersSortUploadedAt = "uploaded_at"
+	OrdersSortAccrual    = "accrual"
+)
+
+// User roles. Support staff may read other users' data, admins may also
+// change it.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleSupport || role == RoleAdmin
+}
+
+// Reason codes of balance adjustments. The free-text reason explains the
+// particular case.
+const (
+	AdjustmentGoodwill   = "goodwill"
+	AdjustmentCorrection = "correction"
+	AdjustmentRefund     = "refund"
+	AdjustmentFraud      = "fraud"
+	AdjustmentOther      = "other"
+)
+
+func ValidAdjustmentReason(code string) bool {
+	switch code {
+	case AdjustmentGoodwill, AdjustmentCorrection, AdjustmentRefund, AdjustmentFraud, AdjustmentOther:
+		return true
+	}
+	return false
+}
+
+const (
+	LedgerAccrual    = "accrual"
+	LedgerWithdrawal = "withdrawal"
+	LedgerAdjustment = "adjustment"
+	LedgerCredit     = "credit"
+	// LedgerReconciliation entries correct a balance that had drifted from
+	// what its orders, withdrawals and adjustments add up to.
+	LedgerReconciliation = "reconciliation"
+	// LedgerMerge marks where another account was merged into the user's.
+	// Its amount is zero: the merged account's entries move along with it.
+	LedgerMerge = "merge"
+)
+
 var (
 	ErrDuplicateUser      = errors.New("duplicate user")
 	ErrNoSuchUser         = errors.New("no such user")
 	ErrNotEnoughBalance   = errors.New("not enough balance")
 	ErrDuplicateOrder     = errors.New("duplicate order")
 	ErrOrderAlreadyPlaced = errors.New("order already placed")
+	ErrBadCursor          = errors.New("bad page cursor")
+	ErrNoSuchToken        = errors.New("no such token")
+	ErrNoSuchOrder        = errors.New("no such order")
+	ErrIdempotencyKeyUsed = errors.New("idempotency key was used for another request")
+	ErrNoSuchMerchant     = errors.New("no such merchant")
+	ErrDuplicateMerchant  = errors.New("duplicate merchant")
+	ErrNoSuchSession      = errors.New("no such session")
+	ErrInvalidTransition  = errors.New("invalid order status transition")
+	ErrBalanceChanged     = errors.New("balance changed since it was checked")
+	ErrMergeIntoSelf      = errors.New("user can't be merged into itself")
+	ErrDifferentMerchants = errors.New("users belong to different merchants")
+
+	// Error classes, see Error.
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("storage unavailable")
+	// ErrInvariant is a write the schema rejected, such as a negative
+	// balance. The application never makes one on purpose, so it is a bug.
+	ErrInvariant = errors.New("data invariant violated")
 )
 
-type UserAuthorization struct {
+// DefaultMerchantID is the merchant of requests that don't name one. It is
+// created by the merchants migration, so single-tenant deployments keep
+// working unchanged.
+var DefaultMerchantID = uuid.Nil
+
+// Merchant is a loyalty program served by the deployment. Users, and with
+// them their orders and balances, belong to exactly one merchant.
+type Merchant struct {
 	ID        uuid.UUID `json:"id"`
-	Login     string    `json:"login"`
-	Password  []byte    `json:"password"`
+	Name      string    `json:"name"`
+	Host      string    `json:"host,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+type UserAuthorization struct {
+	ID                uuid.UUID `json:"id"`
+	MerchantID        uuid.UUID `json:"merchant_id"`
+	Login             string    `json:"login"`
+	Password          []byte    `json:"password"`
+	Role              string    `json:"role"`
+	CreatedAt         time.Time `json:"created_at"`
+	PasswordChangedAt time.Time `json:"password_changed_at"`
+}
+
+// Session is a device the user is signed in on. It outlives the access
+// tokens issued to it and ends when revoked or when its last refresh token
+// expires.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     uuid.UUID `json:"-"`
+	JTI        uuid.UUID `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type UserProfile struct {
+	Login       string    `json:"login"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// UserProfileUpdate changes the profile fields that are not nil.
+type UserProfileUpdate struct {
+	DisplayName *string
+	Email       *string
+}
+
 type BalanceInfo struct {
-	Current   float64   `json:"current"`
-	Withdrawn float64   `json:"withdrawn"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Current   money.Amount `json:"current"`
+	Withdrawn money.Amount `json:"withdrawn"`
+	UpdatedAt time.Time    `json:"updated_at"`
 }
 
 type Withdrawal struct {
-	OrderNumber string    `json:"order"`
-	UserID      uuid.UUID `json:"user_id"`
-	Sum         float64   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	OrderNumber string       `json:"order"`
+	UserID      uuid.UUID    `json:"user_id"`
+	Sum         money.Amount `json:"sum"`
+	ProcessedAt time.Time    `json:"processed_at"`
 }
 
 type Order struct {
-	UserID      uuid.UUID `json:"user_id"`
-	OrderNumber string    `json:"order_number"`
-	Status      string    `json:"status"`
-	Accrual     float64   `json:"accrual"`
-	UploadedAt  time.Time `json:"uploaded_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      uuid.UUID    `json:"user_id"`
+	OrderNumber string       `json:"order_number"`
+	Status      string       `json:"status"`
+	Accrual     money.Amount `json:"accrual"`
+	UploadedAt  time.Time    `json:"uploaded_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	// Registered is set once the accrual system has accepted the order;
+	// RegistrationError holds why the last attempt failed.
+	Registered        bool   `json:"-"`
+	RegistrationError string `json:"registration_error,omitempty"`
+}
+
+type BalanceAdjustment struct {
+	ID         uuid.UUID    `json:"id"`
+	UserID     uuid.UUID    `json:"user_id"`
+	Amount     money.Amount `json:"amount"`
+	ReasonCode string       `json:"reason_code"`
+	Reason     string       `json:"reason"`
+	Operator   string       `json:"operator"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+type LedgerEntry struct {
+	Kind      string       `json:"kind"`
+	Reference string       `json:"reference,omitempty"`
+	Amount    money.Amount `json:"amount"`
+	Balance   money.Amount `json:"balance"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// AccountMerge records a merge of the source user into the target. Orders,
+// withdrawals, adjustments and ledger entries move to the target, the balances
+// add up, and the source is deleted. Order numbers are unique across users,
+// so they never collide; a withdrawal idempotency key of the source that the
+// target has used too is dropped and counted in DroppedIdempotencyKeys.
+// Current and Withdrawn are the amounts the source's balance brought.
+type AccountMerge struct {
+	ID                     uuid.UUID    `json:"id"`
+	SourceUserID           uuid.UUID    `json:"source_user_id"`
+	TargetUserID           uuid.UUID    `json:"target_user_id"`
+	Orders                 int          `json:"orders"`
+	Withdrawals            int          `json:"withdrawals"`
+	DroppedIdempotencyKeys int          `json:"dropped_idempotency_keys"`
+	Current                money.Amount `json:"current"`
+	Withdrawn              money.Amount `json:"withdrawn"`
+	Reason                 string       `json:"reason"`
+	Operator               string       `json:"operator"`
+	CreatedAt              time.Time    `json:"created_at"`
+}
+
+// BalanceAuditEntry is one change of a user's balance with the values before
+// and after it. Source is one of the Ledger kinds; Reference is the order
+// number for accruals and withdrawals and the adjustment ID for adjustments.
+type BalanceAuditEntry struct {
+	ID              int64        `json:"id"`
+	UserID          uuid.UUID    `json:"user_id"`
+	Source          string       `json:"source"`
+	Reference       string       `json:"reference,omitempty"`
+	CurrentBefore   money.Amount `json:"current_before"`
+	CurrentAfter    money.Amount `json:"current_after"`
+	WithdrawnBefore money.Amount `json:"withdrawn_before"`
+	WithdrawnAfter  money.Amount `json:"withdrawn_after"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// BalanceAuditFilter selects audit entries. Zero fields don't filter.
+type BalanceAuditFilter struct {
+	UserID uuid.UUID
+	// MerchantID, when valid, keeps only the users of that merchant.
+	MerchantID uuid.NullUUID
+	Reference  string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+// BalanceDrift is a balance that differs from the sum of the user's processed
+// orders, credits and adjustments less withdrawals.
+type BalanceDrift struct {
+	ID                int64        `json:"id"`
+	UserID            uuid.UUID    `json:"user_id"`
+	Current           money.Amount `json:"current"`
+	ExpectedCurrent   money.Amount `json:"expected_current"`
+	Withdrawn         money.Amount `json:"withdrawn"`
+	ExpectedWithdrawn money.Amount `json:"expected_withdrawn"`
+	Corrected         bool         `json:"corrected"`
+	FoundAt           time.Time    `json:"found_at"`
+}
+
+type BalanceDriftFilter struct {
+	UserID     uuid.UUID
+	MerchantID uuid.NullUUID
+	Limit      int
+}
+
+// AccrualBacklog counts the orders waiting for an accrual result.
+type AccrualBacklog struct {
+	Orders           int       `json:"orders"`
+	OldestUploadedAt time.Time `json:"oldest_uploaded_at"`
+}
+
+// Age is how long the oldest unfinished order has been waiting.
+func (b AccrualBacklog) Age(now time.Time) time.Duration {
+	if b.Orders == 0 {
+		return 0
+	}
+	return now.Sub(b.OldestUploadedAt)
+}
+
+type DeadLetter struct {
+	OrderNumber string    `json:"order"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// OrdersFilter narrows and orders a page of orders. Zero fields don't
+// filter; orders are sorted newest first unless Sort is OrdersSortAccrual.
+type OrdersFilter struct {
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	Sort     string
+}
+
+// ClaimFilter narrows the unfinished orders a claim takes. Zero fields don't
+// filter. Orders are taken oldest upload first, or by number after
+// AfterNumber when ByNumber is set, so a scan can page through them.
+type ClaimFilter struct {
+	UpdatedSince  time.Time
+	UpdatedBefore time.Time
+	ByNumber      bool
+	AfterNumber   string
+}
+
+// NotificationPreferences holds where the user wants to hear about finished
+// orders. An empty address turns the channel off.
+type NotificationPreferences struct {
+	UserID     uuid.UUID `json:"-"`
+	Email      string    `json:"email"`
+	WebhookURL string    `json:"webhook_url"`
+}
+
+// Notification delivery statuses. A pending delivery is retried until it is
+// sent or runs out of attempts and fails.
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+)
+
+// NotificationDelivery is a notification to one address, kept in the outbox
+// so it survives restarts and outages of the mail server or webhook.
+type NotificationDelivery struct {
+	ID            int64           `json:"id"`
+	UserID        uuid.UUID       `json:"user_id"`
+	Channel       string          `json:"channel"`
+	Address       string          `json:"address"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	SentAt        *time.Time      `json:"sent_at,omitempty"`
+}
+
+type NotificationDeliveryFilter struct {
+	UserID     uuid.UUID
+	MerchantID uuid.NullUUID
+	Status     string
+	Limit      int
+}
+
+// OrdersVersion changes whenever an order of the user is added, updated or
+// removed. It is much cheaper to read than the orders themselves.
+type OrdersVersion struct {
+	UpdatedAt time.Time
+	Count     int
+}
+
+type OrdersPage struct {
+	Orders     []Order
+	NextCursor string
+	Total      int
+}
+
+type AccrualJournalEntry struct {
+	OrderNumber string       `json:"order"`
+	Provider    string       `json:"provider"`
+	Status      string       `json:"status,omitempty"`
+	Accrual     money.Amount `json:"accrual,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+type AccountingSummary struct {
+	Accrued   money.Amount `json:"accrued"`
+	Redeemed  money.Amount `json:"redeemed"`
+	Liability money.Amount `json:"liability"`
+}
+
+// UserStats are a user's totals. OrdersByStatus has every order status, and
+// EarnedSince is accrued since the time the stats were asked for.
+type UserStats struct {
+	TotalAccrued   money.Amount   `json:"total_accrued"`
+	TotalWithdrawn money.Amount   `json:"total_withdrawn"`
+	OrdersByStatus map[string]int `json:"orders_by_status"`
+	EarnedSince    money.Amount   `json:"earned_since"`
+}
+
+// TxManager lets callers make several storage calls atomically.
+type TxManager interface {
+	WithinTx(ctx context.Context, fn func(s AppStorage) error) error
 }
 
 type AppStorage interface {
+	TxManager
+
 	AddUser(ctx context.Context, auth *UserAuthorization) error
-	GetUserAuthInfo(ctx context.Context, userName string) (*UserAuthorization, error)
+	GetUserAuthInfo(ctx context.Context, merchantID uuid.UUID, userName string) (*UserAuthorization, error)
 	GetUserAuthInfoByID(ctx context.Context, userID uuid.UUID) (*UserAuthorization, error)
+	RevokeToken(ctx context.Context, jti uuid.UUID, expiresAt time.Time) error
+	IsTokenRevoked(ctx context.Context, jti uuid.UUID) (bool, error)
+	AddRefreshToken(ctx context.Context, tokenHash string, userID, sessionID uuid.UUID, expiresAt time.Time) error
+	ConsumeRefreshToken(ctx context.Context, tokenHash string) (userID, sessionID uuid.UUID, err error)
+	StartSession(ctx context.Context, session *Session) error
+	RenewSession(ctx context.Context, sessionID, jti uuid.UUID, expiresAt time.Time) error
+	TouchSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	GetSessions(ctx context.Context, userID uuid.UUID) ([]Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	// RecordLoginFailure counts a failed login for key and returns the
+	// failures since the given time; older ones are forgotten.
+	RecordLoginFailure(ctx context.Context, key string, since time.Time) (int, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	GetLoginLock(ctx context.Context, key string) (time.Time, error)
+	ResetLoginFailures(ctx context.Context, key string) error
+	DeleteUser(ctx context.Context, userID uuid.UUID) error
+	GetUserProfile(ctx context.Context, userID uuid.UUID) (*UserProfile, error)
+	UpdateUserProfile(ctx context.Context, userID uuid.UUID, update UserProfileUpdate) (*UserProfile, error)
+	ChangePassword(ctx context.Context, userID uuid.UUID, password []byte, changedAt time.Time) error
+	SetUserRole(ctx context.Context, userID uuid.UUID, role string) error
+	AddMerchant(ctx context.Context, merchant *Merchant, apiKeyHash string) error
+	GetMerchantByAPIKey(ctx context.Context, apiKeyHash string) (*Merchant, error)
+	GetMerchantByHost(ctx context.Context, host string) (*Merchant, error)
+	AddPlacedOrder(ctx context.Context, merchantID uuid.UUID, orderNumber string) error
+	IsOrderPlaced(ctx context.Context, userID uuid.UUID, orderNumber string) (bool, error)
+	GetNotificationPreferences(ctx context.Context, userID uuid.UUID) (*NotificationPreferences, error)
+	SetNotificationPreferences(ctx context.Context, prefs NotificationPreferences) error
+	DeleteNotificationPreferences(ctx context.Context, userID uuid.UUID) error
+	AddNotificationDeliveries(ctx context.Context, deliveries []NotificationDelivery) error
+	// ClaimNotificationDeliveries returns pending deliveries that are due and
+	// postpones them by lease, so other instances don't send them meanwhile.
+	ClaimNotificationDeliveries(ctx context.Context, lease time.Duration, limit int) ([]NotificationDelivery, error)
+	CompleteNotificationDelivery(ctx context.Context, id int64) error
+	// FailNotificationDelivery records a failed attempt. The delivery is
+	// retried at retryAt or, if retryAt is zero, fails for good.
+	FailNotificationDelivery(ctx context.Context, id int64, lastError string, retryAt time.Time) error
+	GetNotificationDeliveries(ctx context.Context, filter NotificationDeliveryFilter) ([]NotificationDelivery, error)
 
-	Withdraw(ctx context.Context, userID uuid.UUID, order string, sum float64) error
-	AddBalance(ctx context.Context, userID uuid.UUID, amount float64) error
-	UpdateBalanceFromOrders(ctx context.Context, orders []Order) error
+	Withdraw(ctx context.Context, userID uuid.UUID, order string, sum money.Amount, idempotencyKey string) error
+	AddBalance(ctx context.Context, userID uuid.UUID, amount money.Amount) error
+	UpdateBalanceFromOrders(ctx context.Context, transitions []OrderTransition) error
 	GetBalance(ctx context.Context, userID uuid.UUID) (*BalanceInfo, error)
 	GetWithdrawals(ctx context.Context, userID uuid.UUID) ([]Withdrawal, error)
+	AdjustBalance(ctx context.Context, adjustment BalanceAdjustment) (*BalanceInfo, error)
+	GetWithdrawalsForPeriod(ctx context.Context, from, to time.Time) ([]Withdrawal, error)
+	GetAccountingSummary(ctx context.Context, from, to time.Time) (*AccountingSummary, error)
+	GetLedger(ctx context.Context, userID uuid.UUID) ([]LedgerEntry, error)
+	GetBalanceAudit(ctx context.Context, filter BalanceAuditFilter) ([]BalanceAuditEntry, error)
+	GetUserStats(ctx context.Context, userID uuid.UUID, since time.Time) (*UserStats, error)
+	FindBalanceDrift(ctx context.Context) ([]BalanceDrift, error)
+	// CorrectBalanceDrift sets the balance to the expected amounts, unless
+	// it no longer holds the amounts in drift.
+	CorrectBalanceDrift(ctx context.Context, drift BalanceDrift) error
+	AddBalanceDrift(ctx context.Context, drifts []BalanceDrift) error
+	GetBalanceDrift(ctx context.Context, filter BalanceDriftFilter) ([]BalanceDrift, error)
+	// MergeUsers merges merge.SourceUserID into merge.TargetUserID in one
+	// transaction and returns the stored record.
+	MergeUsers(ctx context.Context, merge AccountMerge) (*AccountMerge, error)
 
-	AddOrder(ctx context.Context, userID uuid.UUID, orderNumber string) error
+	// AddOrder stores the user's order. Order numbers are unique within a
+	// merchant, so ErrDuplicateOrder only reports another user of merchantID.
+	AddOrder(ctx context.Context, merchantID, userID uuid.UUID, orderNumber string) error
 	UpdateOrder(ctx context.Context, order Order) error
+	RequeueOrder(ctx context.Context, orderNumber string) error
+	SetOrderFiscalStatus(ctx context.Context, orderNumber string, fiscalStatus string, reason string, invalid bool) error
 	GetOrders(ctx context.Context, userID uuid.UUID) ([]Order, error)
-	GetUnfinishedOrders(ctx context.Context) ([]Order, error)
+	GetOrdersPage(ctx context.Context, userID uuid.UUID, filter OrdersFilter, cursor string, limit int) (*OrdersPage, error)
+	GetOrdersVersion(ctx context.Context, userID uuid.UUID) (OrdersVersion, error)
+	ClaimUnfinishedOrders(ctx context.Context, owner string, lease time.Duration, filter ClaimFilter, limit int) ([]Order, error)
+	ReleaseOrderClaims(ctx context.Context, owner string) error
+	GetOrder(ctx context.Context, orderNumber string) (*Order, error)
+	GetOrderByNumber(ctx context.Context, userID uuid.UUID, orderNumber string) (*Order, error)
+	RecordAccrualNotFound(ctx context.Context, orderNumber string) (int, error)
+	RecordAccrualFailure(ctx context.Context, orderNumber string) (int, error)
+	DeadLetterOrder(ctx context.Context, letter DeadLetter) error
+	MarkOrderRegistered(ctx context.Context, orderNumber string) error
+	SetOrderRegistrationError(ctx context.Context, orderNumber string, message string) error
+	GetDeadLetters(ctx context.Context) ([]DeadLetter, error)
+	GetAccrualBacklog(ctx context.Context) (*AccrualBacklog, error)
+	RedriveOrder(ctx context.Context, orderNumber string) error
+
+	AddAccrualJournalEntries(ctx context.Context, entries []AccrualJournalEntry) error
+	GetAccrualJournal(ctx context.Context, orderNumber string) ([]AccrualJournalEntry, error)
+
+	ApplyRetention(ctx context.Context, target string, cutoff time.Time, dryRun bool) (int64, error)
+}
+
+// Backdater is implemented by the database storages for the seed command
+// only; the service never rewrites history.
+type Backdater interface {
+	// BackdateActivity moves the user's creation to since and spreads their
+	// orders and withdrawals over the time from since until now. Ledger and
+	// audit entries keep their real times.
+	BackdateActivity(ctx context.Context, userID uuid.UUID, since time.Time) error
 }
@@ -0,0 +1,80 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+// backend opens an empty storage for one test.
+type backend struct {
+	name string
+	open func(t *testing.T) storage.AppStorage
+}
+
+var backends = []backend{
+	{name: "sqlite", open: openSQLite},
+}
+
+// runOnBackends runs test against a fresh storage of every backend.
+func runOnBackends(t *testing.T, test func(t *testing.T, st storage.AppStorage)) {
+	t.Helper()
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			test(t, b.open(t))
+		})
+	}
+}
+
+func openSQLite(t *testing.T) storage.AppStorage {
+	t.Helper()
+
+	ctx := context.Background()
+	logger := zap.NewNop()
+	db, err := storage.OpenSQLite(ctx, "sqlite://"+t.TempDir()+"/gophermart.db", logger)
+	if err != nil {
+		t.Fatalf("can't open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	st, err := storage.NewSQLiteStorage(ctx, db, logger, storage.Options{})
+	if err != nil {
+		t.Fatalf("can't create SQLite storage: %v", err)
+	}
+	return st
+}
+
+// addUser registers a user of the default merchant and returns its ID.
+func addUser(t *testing.T, st storage.AppStorage, login string) uuid.UUID {
+	t.Helper()
+
+	ctx := context.Background()
+	err := st.AddUser(ctx, &storage.UserAuthorization{
+		MerchantID: storage.DefaultMerchantID,
+		Login:      login,
+		Password:   []byte("hash"),
+	})
+	if err != nil {
+		t.Fatalf("AddUser(%s) error = %v", login, err)
+	}
+
+	user, err := st.GetUserAuthInfo(ctx, storage.DefaultMerchantID, login)
+	if err != nil {
+		t.Fatalf("GetUserAuthInfo(%s) error = %v", login, err)
+	}
+	return user.ID
+}
+
+func balance(t *testing.T, st storage.AppStorage, userID uuid.UUID) *storage.BalanceInfo {
+	t.Helper()
+
+	info, err := st.GetBalance(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("GetBalance() error = %v", err)
+	}
+	return info
+}
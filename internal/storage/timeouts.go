@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type opClass int
+
+const (
+	opRead opClass = iota
+	opWrite
+	// opBatch is for background jobs and reports that touch many rows.
+	opBatch
+)
+
+// Timeouts bound a single storage operation per class. Zero fields default
+// to DatabaseOperationTimeout.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Batch time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	for _, d := range []*time.Duration{&t.Read, &t.Write, &t.Batch} {
+		if *d <= 0 {
+			*d = DatabaseOperationTimeout
+		}
+	}
+	return t
+}
+
+// withTimeout limits ctx by the timeout of the operation class. A caller
+// deadline that is already closer, such as the HTTP request timeout, is kept
+// as it is.
+func (p *pgxStorage) withTimeout(ctx context.Context, class opClass) (context.Context, context.CancelFunc) {
+	return p.timeouts.context(ctx, class)
+}
+
+func (t Timeouts) context(ctx context.Context, class opClass) (context.Context, context.CancelFunc) {
+	d := t.Read
+	switch class {
+	case opWrite:
+		d = t.Write
+	case opBatch:
+		d = t.Batch
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// dbConn is what queries run on: the pool, or a transaction started by
+// WithinTx. Begin on a transaction opens a savepoint, so methods that use
+// their own transaction nest inside it.
+type dbConn interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// WithinTx runs fn with a storage whose methods all share one transaction,
+// which commits if fn returns nil and rolls back otherwise. The storage
+// passed to fn must not be used concurrently or after fn returns. Nested
+// calls use savepoints.
+func (p *pgxStorage) WithinTx(ctx context.Context, fn func(s AppStorage) error) (err error) {
+	tx, err := p.dbConn.Begin(ctx)
+	if err != nil {
+		wrapError("WithinTx", &err)
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	// Reads see the transaction's own writes, so they can't go to the
+	// replica, and a failed statement aborts the transaction, so there is
+	// nothing to retry.
+	txStorage := &pgxStorage{
+		ctx:         p.ctx,
+		dbConn:      tx,
+		logger:      p.logger,
+		retryConfig: p.retryConfig,
+		timeouts:    p.timeouts,
+		inTx:        true,
+	}
+	if err := fn(txStorage); err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	wrapError("WithinTx", &err)
+	return err
+}
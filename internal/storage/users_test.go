@@ -0,0 +1,167 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestUsers(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "alice")
+
+		err := st.AddUser(ctx, &storage.UserAuthorization{MerchantID: storage.DefaultMerchantID, Login: "alice", Password: []byte("other")})
+		if !errors.Is(err, storage.ErrDuplicateUser) {
+			t.Errorf("AddUser() with a taken login error = %v, want %v", err, storage.ErrDuplicateUser)
+		}
+
+		auth, err := st.GetUserAuthInfoByID(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetUserAuthInfoByID() error = %v", err)
+		}
+		if auth.Login != "alice" || auth.Role != storage.RoleUser || string(auth.Password) != "hash" {
+			t.Errorf("GetUserAuthInfoByID() = %+v", auth)
+		}
+		if _, err := st.GetUserAuthInfo(ctx, storage.DefaultMerchantID, "bob"); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("GetUserAuthInfo() of an unknown user error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+
+		if err := st.SetUserRole(ctx, userID, storage.RoleSupport); err != nil {
+			t.Fatalf("SetUserRole() error = %v", err)
+		}
+		if auth, _ := st.GetUserAuthInfoByID(ctx, userID); auth.Role != storage.RoleSupport {
+			t.Errorf("role = %s, want %s", auth.Role, storage.RoleSupport)
+		}
+		if err := st.SetUserRole(ctx, uuid.New(), storage.RoleAdmin); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("SetUserRole() of an unknown user error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+
+		changedAt := time.Now().Truncate(time.Second)
+		if err := st.ChangePassword(ctx, userID, []byte("new hash"), changedAt); err != nil {
+			t.Fatalf("ChangePassword() error = %v", err)
+		}
+		auth, _ = st.GetUserAuthInfo(ctx, storage.DefaultMerchantID, "alice")
+		if string(auth.Password) != "new hash" || !auth.PasswordChangedAt.Equal(changedAt) {
+			t.Errorf("after ChangePassword() password = %q changed at %s, want %q at %s", auth.Password, auth.PasswordChangedAt, "new hash", changedAt)
+		}
+
+		if err := st.DeleteUser(ctx, userID); err != nil {
+			t.Fatalf("DeleteUser() error = %v", err)
+		}
+		if _, err := st.GetUserAuthInfoByID(ctx, userID); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("GetUserAuthInfoByID() of a deleted user error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+		if err := st.DeleteUser(ctx, userID); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("DeleteUser() twice error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+		// The login is free again.
+		addUser(t, st, "alice")
+	})
+}
+
+func TestUserProfile(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+		userID := addUser(t, st, "carol")
+
+		profile, err := st.GetUserProfile(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetUserProfile() error = %v", err)
+		}
+		if profile.Login != "carol" || len(profile.DisplayName) != 0 || len(profile.Email) != 0 {
+			t.Errorf("GetUserProfile() = %+v", profile)
+		}
+
+		name := "Carol"
+		profile, err = st.UpdateUserProfile(ctx, userID, storage.UserProfileUpdate{DisplayName: &name})
+		if err != nil {
+			t.Fatalf("UpdateUserProfile() error = %v", err)
+		}
+		email := "carol@example.com"
+		profile, err = st.UpdateUserProfile(ctx, userID, storage.UserProfileUpdate{Email: &email})
+		if err != nil {
+			t.Fatalf("UpdateUserProfile() error = %v", err)
+		}
+		if profile.DisplayName != name || profile.Email != email {
+			t.Errorf("UpdateUserProfile() = %+v, want display name %q and e-mail %q", profile, name, email)
+		}
+
+		if _, err := st.UpdateUserProfile(ctx, uuid.New(), storage.UserProfileUpdate{DisplayName: &name}); !errors.Is(err, storage.ErrNoSuchUser) {
+			t.Errorf("UpdateUserProfile() of an unknown user error = %v, want %v", err, storage.ErrNoSuchUser)
+		}
+	})
+}
+
+func TestMerchants(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		ctx := context.Background()
+
+		merchant := &storage.Merchant{Name: "Coffee", Host: "coffee.example.com"}
+		if err := st.AddMerchant(ctx, merchant, "key-hash"); err != nil {
+			t.Fatalf("AddMerchant() error = %v", err)
+		}
+		if merchant.ID == uuid.Nil || merchant.CreatedAt.IsZero() {
+			t.Errorf("AddMerchant() left %+v", merchant)
+		}
+		if err := st.AddMerchant(ctx, &storage.Merchant{Name: "Tea"}, "key-hash"); !errors.Is(err, storage.ErrDuplicateMerchant) {
+			t.Errorf("AddMerchant() with a used key error = %v, want %v", err, storage.ErrDuplicateMerchant)
+		}
+
+		byKey, err := st.GetMerchantByAPIKey(ctx, "key-hash")
+		if err != nil {
+			t.Fatalf("GetMerchantByAPIKey() error = %v", err)
+		}
+		byHost, err := st.GetMerchantByHost(ctx, "coffee.example.com")
+		if err != nil {
+			t.Fatalf("GetMerchantByHost() error = %v", err)
+		}
+		if byKey.ID != merchant.ID || byHost.ID != merchant.ID || byHost.Name != "Coffee" {
+			t.Errorf("merchant by key = %+v, by host = %+v, want %s", byKey, byHost, merchant.ID)
+		}
+		if _, err := st.GetMerchantByHost(ctx, "tea.example.com"); !errors.Is(err, storage.ErrNoSuchMerchant) {
+			t.Errorf("GetMerchantByHost() of an unknown host error = %v, want %v", err, storage.ErrNoSuchMerchant)
+		}
+
+		// The same login can sign up with another merchant.
+		err = st.AddUser(ctx, &storage.UserAuthorization{MerchantID: merchant.ID, Login: "dave", Password: []byte("hash")})
+		if err != nil {
+			t.Fatalf("AddUser() error = %v", err)
+		}
+		defaultUser := addUser(t, st, "dave")
+		merchantUser, err := st.GetUserAuthInfo(ctx, merchant.ID, "dave")
+		if err != nil {
+			t.Fatalf("GetUserAuthInfo() error = %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := st.AddPlacedOrder(ctx, merchant.ID, "79927398713"); err != nil {
+				t.Fatalf("AddPlacedOrder() #%d error = %v", i+1, err)
+			}
+		}
+		if err := st.AddPlacedOrder(ctx, uuid.New(), "79927398713"); !errors.Is(err, storage.ErrNoSuchMerchant) {
+			t.Errorf("AddPlacedOrder() for an unknown merchant error = %v, want %v", err, storage.ErrNoSuchMerchant)
+		}
+
+		for _, tt := range []struct {
+			userID uuid.UUID
+			want   bool
+		}{
+			{merchantUser.ID, true},
+			{defaultUser, false},
+		} {
+			placed, err := st.IsOrderPlaced(ctx, tt.userID, "79927398713")
+			if err != nil {
+				t.Fatalf("IsOrderPlaced() error = %v", err)
+			}
+			if placed != tt.want {
+				t.Errorf("IsOrderPlaced() for %s = %t, want %t", tt.userID, placed, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/real-splendid/gophermart-practicum/internal/money"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+)
+
+func TestConcurrentWithdrawalsDontOverdraw(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		const (
+			workers = 20
+			sum     = money.Amount(300)
+		)
+		ctx := context.Background()
+		userID := addUser(t, st, "spender")
+		if err := st.AddBalance(ctx, userID, 1000); err != nil {
+			t.Fatalf("AddBalance() error = %v", err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, workers)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = st.Withdraw(ctx, userID, strconv.Itoa(1000+i), sum, "")
+			}(i)
+		}
+		wg.Wait()
+
+		succeeded := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, storage.ErrNotEnoughBalance):
+				t.Errorf("Withdraw() error = %v", err)
+			}
+		}
+		if succeeded != 3 {
+			t.Errorf("%d withdrawals succeeded, want 3", succeeded)
+		}
+
+		info := balance(t, st, userID)
+		if info.Current != 100 || info.Withdrawn != 900 {
+			t.Errorf("balance = %s current, %s withdrawn, want 1 and 9", info.Current, info.Withdrawn)
+		}
+	})
+}
+
+// Credits racing withdrawals must neither be lost nor let the balance go
+// below zero, and every change must reach the ledger.
+func TestConcurrentCreditsAndWithdrawals(t *testing.T) {
+	runOnBackends(t, func(t *testing.T, st storage.AppStorage) {
+		const (
+			workers = 20
+			amount  = money.Amount(100)
+		)
+		ctx := context.Background()
+		userID := addUser(t, st, "racer")
+
+		var wg sync.WaitGroup
+		withdrawErrs := make([]error, workers)
+		creditErrs := make([]error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				creditErrs[i] = st.AddBalance(ctx, userID, amount)
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				withdrawErrs[i] = st.Withdraw(ctx, userID, strconv.Itoa(2000+i), amount, "")
+			}(i)
+		}
+		wg.Wait()
+
+		withdrawn := money.Amount(0)
+		for i := 0; i < workers; i++ {
+			if creditErrs[i] != nil {
+				t.Errorf("AddBalance() error = %v", creditErrs[i])
+			}
+			switch err := withdrawErrs[i]; {
+			case err == nil:
+				withdrawn += amount
+			case !errors.Is(err, storage.ErrNotEnoughBalance):
+				t.Errorf("Withdraw() error = %v", err)
+			}
+		}
+
+		info := balance(t, st, userID)
+		if info.Withdrawn != withdrawn || info.Current != workers*amount-withdrawn {
+			t.Errorf("balance = %s current, %s withdrawn, want %s and %s", info.Current, info.Withdrawn, workers*amount-withdrawn, withdrawn)
+		}
+		ledger, err := st.GetLedger(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetLedger() error = %v", err)
+		}
+		if want := workers + int(withdrawn/amount); len(ledger) != want {
+			t.Errorf("ledger has %d entries, want %d", len(ledger), want)
+		}
+		if drifts, _ := st.FindBalanceDrift(ctx); len(drifts) != 0 {
+			t.Errorf("FindBalanceDrift() = %+v, want none", drifts)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-resty/resty/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// Middleware starts a server span per request, continuing the caller's trace
+// and naming the span after the matched chi route.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := Start(Extract(r.Context(), r.Header), r.Method+" "+r.URL.Path, KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			if pattern := rctx.RoutePattern(); len(pattern) != 0 {
+				span.SetName(r.Method + " " + pattern)
+			}
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("http.status_code", ww.Status())
+		if id := middleware.GetReqID(r.Context()); len(id) != 0 {
+			span.SetAttribute("http.request_id", id)
+		}
+		if ww.Status() >= http.StatusInternalServerError {
+			span.SetError(errors.New(http.StatusText(ww.Status())))
+		}
+	})
+}
+
+type clientSpanKey struct{}
+
+func clientSpan(ctx context.Context) *Span {
+	s, _ := ctx.Value(clientSpanKey{}).(*Span)
+	return s
+}
+
+// InstrumentClient adds a client span to every request attempt made by c and
+// propagates the trace to the remote service.
+func InstrumentClient(c *resty.Client) *resty.Client {
+	return c.
+		OnBeforeRequest(func(_ *resty.Client, r *resty.Request) error {
+			ctx := r.Context()
+			// A retry reuses the request: close the previous attempt's span
+			// and start the new one from the same parent.
+			if prev := clientSpan(ctx); prev != nil {
+				prev.SetAttribute("http.retried", true)
+				prev.End()
+				ctx = prev.parent
+			}
+
+			ctx, span := Start(ctx, r.Method+" "+hostOf(r.URL), KindClient)
+			if span == nil {
+				return nil
+			}
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.url", r.URL)
+			Inject(ctx, r.Header)
+			r.SetContext(context.WithValue(ctx, clientSpanKey{}, span))
+			return nil
+		}).
+		OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+			span := clientSpan(resp.Request.Context())
+			span.SetAttribute("http.status_code", resp.StatusCode())
+			if resp.StatusCode() >= http.StatusInternalServerError {
+				span.SetError(errors.New(resp.Status()))
+			}
+			span.End()
+			return nil
+		}).
+		OnError(func(r *resty.Request, err error) {
+			span := clientSpan(r.Context())
+			span.SetError(err)
+			span.End()
+		})
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+type dbSpanKey struct{}
+
+// PgxTracer turns the statements pgx runs into client spans of the current
+// trace. Statements outside a trace are not recorded.
+type PgxTracer struct{}
+
+func (PgxTracer) start(ctx context.Context, op, sql string) context.Context {
+	if !hasSpan(ctx) {
+		return ctx
+	}
+
+	ctx, span := Start(ctx, "postgres "+op, KindClient)
+	if span == nil {
+		return ctx
+	}
+	span.SetAttribute("db.system", "postgresql")
+	if len(sql) != 0 {
+		span.SetAttribute("db.statement", sql)
+	}
+	return context.WithValue(ctx, dbSpanKey{}, span)
+}
+
+func (PgxTracer) end(ctx context.Context, err error) {
+	span, _ := ctx.Value(dbSpanKey{}).(*Span)
+	span.SetError(err)
+	span.End()
+}
+
+func (t PgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return t.start(ctx, "query", data.SQL)
+}
+
+func (t PgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t PgxTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	ctx = t.start(ctx, "batch", "")
+	if span, ok := ctx.Value(dbSpanKey{}).(*Span); ok && data.Batch != nil {
+		span.SetAttribute("db.batch_size", data.Batch.Len())
+	}
+	return ctx
+}
+
+func (PgxTracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (t PgxTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	t.end(ctx, data.Err)
+}
@@ -0,0 +1,238 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ServiceName = "gophermart"
+
+	TraceparentHeader = "traceparent"
+)
+
+type Kind int
+
+// Span kinds as numbered by OTLP.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+type Config struct {
+	Endpoint    string
+	SampleRatio float64
+	Logger      *zap.Logger
+}
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+type Span struct {
+	mu       sync.Mutex
+	tracer   *Tracer
+	sc       spanContext
+	parentID [8]byte
+	parent   context.Context
+	name     string
+	kind     Kind
+	start    time.Time
+	end      time.Time
+	attrs    []attribute
+	errMsg   string
+	ended    bool
+}
+
+var current atomic.Pointer[Tracer]
+
+// Start begins a span as a child of the span in ctx. It returns a nil span,
+// whose methods are no-ops, when tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	return startAt(ctx, name, kind, time.Now())
+}
+
+func startAt(ctx context.Context, name string, kind Kind, start time.Time) (context.Context, *Span) {
+	t := current.Load()
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{tracer: t, parent: ctx, name: name, kind: kind, start: start}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		s.sc.traceID = parent.traceID
+		s.sc.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.sc.traceID[:])
+		s.sc.sampled = t.sample()
+	}
+	rand.Read(s.sc.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s.sc), s
+}
+
+func hasSpan(ctx context.Context) bool {
+	_, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return ok
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+func (s *Span) End() {
+	s.endAt(time.Now())
+}
+
+func (s *Span) endAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = end
+	s.mu.Unlock()
+
+	if s.sc.sampled {
+		s.tracer.export(s)
+	}
+}
+
+// Inject writes the W3C traceparent header for the span in ctx.
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	if !ok {
+		return
+	}
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	header.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]), flags))
+}
+
+// Extract continues a trace started by the caller, if the request carries a
+// valid traceparent header.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	parts := strings.Split(header.Get(TraceparentHeader), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return ctx
+	}
+
+	var sc spanContext
+	if b, err := hex.DecodeString(parts[1]); err != nil || len(b) != len(sc.traceID) {
+		return ctx
+	} else {
+		copy(sc.traceID[:], b)
+	}
+	if b, err := hex.DecodeString(parts[2]); err != nil || len(b) != len(sc.spanID) {
+		return ctx
+	} else {
+		copy(sc.spanID[:], b)
+	}
+	sc.sampled = strings.HasSuffix(parts[3], "1")
+
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+type Tracer struct {
+	Config
+	spans  chan *Span
+	client *http.Client
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Init enables tracing for the process and starts the exporter.
+func Init(cfg Config) *Tracer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Tracer{
+		Config: cfg,
+		spans:  make(chan *Span, exportQueueSize),
+		client: &http.Client{Timeout: exportTimeout},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	current.Store(t)
+	go t.run(ctx)
+
+	return t
+}
+
+// Shutdown disables tracing and waits for the queued spans to be exported.
+func (t *Tracer) Shutdown() {
+	current.CompareAndSwap(t, nil)
+	t.cancel()
+	<-t.done
+}
+
+func (t *Tracer) sample() bool {
+	if t.SampleRatio >= 1 {
+		return true
+	}
+	if t.SampleRatio <= 0 {
+		return false
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1<<53))
+	if err != nil {
+		return false
+	}
+	return float64(n.Int64())/(1<<53) < t.SampleRatio
+}
+
+func (t *Tracer) export(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		// The exporter is behind; dropping a span is better than blocking
+		// a request.
+	}
+}
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN fiscal_status TEXT;
+ALTER TABLE orders ADD COLUMN fiscal_reason TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders DROP COLUMN fiscal_reason;
+ALTER TABLE orders DROP COLUMN fiscal_status;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE accrual_journal (
+    id UUID PRIMARY KEY,
+    order_number VARCHAR NOT NULL,
+    provider TEXT NOT NULL,
+    status TEXT,
+    accrual NUMERIC(15, 2),
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX accrual_journal_order_number_idx ON accrual_journal (order_number, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE accrual_journal;
+-- +goose StatementEnd
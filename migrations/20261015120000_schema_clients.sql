@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE schema_clients (
+    instance_id UUID PRIMARY KEY,
+    hostname TEXT NOT NULL,
+    min_version BIGINT NOT NULL,
+    compatible_up_to BIGINT NOT NULL,
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    last_seen TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE schema_clients;
+-- +goose StatementEnd
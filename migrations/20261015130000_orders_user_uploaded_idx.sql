@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX orders_user_uploaded_idx ON orders (user_id, uploaded_at DESC, order_number DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX orders_user_uploaded_idx;
+-- +goose StatementEnd
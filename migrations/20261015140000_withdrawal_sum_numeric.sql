@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE withdrawal ALTER COLUMN sum TYPE NUMERIC(15, 2) USING ROUND(sum::NUMERIC, 2);
+ALTER TABLE withdrawal ALTER COLUMN sum SET DEFAULT 0.00;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE withdrawal ALTER COLUMN sum TYPE DOUBLE PRECISION USING sum::DOUBLE PRECISION;
+ALTER TABLE withdrawal ALTER COLUMN sum SET DEFAULT 0.0;
+-- +goose StatementEnd
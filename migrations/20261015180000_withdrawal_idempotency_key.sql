@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE withdrawal ADD COLUMN idempotency_key TEXT;
+
+CREATE UNIQUE INDEX withdrawal_user_idempotency_key_idx ON withdrawal (user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX withdrawal_user_idempotency_key_idx;
+
+ALTER TABLE withdrawal DROP COLUMN idempotency_key;
+-- +goose StatementEnd
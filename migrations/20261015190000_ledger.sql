@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE ledger (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE NOT NULL,
+    kind TEXT NOT NULL,
+    reference TEXT,
+    amount NUMERIC(15, 2) NOT NULL,
+    balance NUMERIC(15, 2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX ledger_user_id_idx ON ledger (user_id, id);
+
+-- Backfill the history that predates the ledger with a running balance.
+INSERT INTO ledger (user_id, kind, reference, amount, balance, created_at)
+SELECT user_id, kind, reference, amount,
+       SUM(amount) OVER (PARTITION BY user_id ORDER BY created_at, kind ROWS UNBOUNDED PRECEDING),
+       created_at
+FROM (
+    SELECT user_id, 'accrual' AS kind, order_number AS reference, accrual AS amount, updated_at AS created_at
+    FROM orders WHERE status = 'PROCESSED' AND accrual > 0
+    UNION ALL
+    SELECT user_id, 'withdrawal', order_number, -sum, processed_at
+    FROM withdrawal
+    UNION ALL
+    SELECT user_id, 'adjustment', NULL, amount, created_at
+    FROM balance_adjustments
+) history
+ORDER BY created_at;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE ledger;
+-- +goose StatementEnd
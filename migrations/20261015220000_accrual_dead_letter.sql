@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN accrual_failures INT NOT NULL DEFAULT 0;
+
+CREATE TABLE accrual_dead_letter (
+    order_number VARCHAR PRIMARY KEY REFERENCES orders (order_number) ON DELETE CASCADE,
+    failures INT NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE accrual_dead_letter;
+ALTER TABLE orders DROP COLUMN accrual_failures;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX orders_user_status_uploaded_idx ON orders (user_id, status, uploaded_at DESC, order_number DESC);
+CREATE INDEX orders_user_accrual_idx ON orders (user_id, accrual DESC, order_number DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX orders_user_accrual_idx;
+DROP INDEX orders_user_status_uploaded_idx;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE merchants (
+    id UUID PRIMARY KEY,
+    name TEXT NOT NULL,
+    api_key_hash TEXT UNIQUE,
+    host TEXT UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+INSERT INTO merchants (id, name) VALUES ('00000000-0000-0000-0000-000000000000', 'default');
+
+ALTER TABLE users ADD COLUMN merchant_id UUID NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000' REFERENCES merchants(id);
+ALTER TABLE users DROP CONSTRAINT users_login_key;
+ALTER TABLE users ADD CONSTRAINT users_merchant_id_login_key UNIQUE (merchant_id, login);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP CONSTRAINT users_merchant_id_login_key;
+ALTER TABLE users ADD CONSTRAINT users_login_key UNIQUE (login);
+ALTER TABLE users DROP COLUMN merchant_id;
+DROP TABLE merchants;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE balance_audit (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    source TEXT NOT NULL,
+    reference TEXT,
+    current_before NUMERIC(15, 2) NOT NULL,
+    current_after NUMERIC(15, 2) NOT NULL,
+    withdrawn_before NUMERIC(15, 2) NOT NULL,
+    withdrawn_after NUMERIC(15, 2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX balance_audit_user_id_idx ON balance_audit (user_id, id);
+CREATE INDEX balance_audit_reference_idx ON balance_audit (reference);
+
+-- The audit log is evidence in disputes: rows are never changed or removed,
+-- not even when the user is deleted.
+CREATE FUNCTION balance_audit_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'balance_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER balance_audit_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON balance_audit
+    FOR EACH STATEMENT EXECUTE FUNCTION balance_audit_append_only();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE balance_audit;
+DROP FUNCTION balance_audit_append_only();
+-- +goose StatementEnd
@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN claimed_by TEXT;
+ALTER TABLE orders ADD COLUMN claimed_until TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX orders_unfinished_idx ON orders (uploaded_at) WHERE status IN ('NEW', 'PROCESSING');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX orders_unfinished_idx;
+ALTER TABLE orders DROP COLUMN claimed_until;
+ALTER TABLE orders DROP COLUMN claimed_by;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE balance_adjustments ADD COLUMN reason_code TEXT NOT NULL DEFAULT 'other'
+    CHECK (reason_code IN ('goodwill', 'correction', 'refund', 'fraud', 'other'));
+ALTER TABLE balance_adjustments ALTER COLUMN reason_code DROP DEFAULT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE balance_adjustments DROP COLUMN reason_code;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders ADD COLUMN accrual_registered_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE orders ADD COLUMN accrual_registration_error TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders DROP COLUMN accrual_registration_error;
+ALTER TABLE orders DROP COLUMN accrual_registered_at;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX ledger_user_kind_created_idx ON ledger (user_id, kind, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX ledger_user_kind_created_idx;
+-- +goose StatementEnd
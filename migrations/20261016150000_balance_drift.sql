@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE balance_drift (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    current NUMERIC(15, 2) NOT NULL,
+    expected_current NUMERIC(15, 2) NOT NULL,
+    withdrawn NUMERIC(15, 2) NOT NULL,
+    expected_withdrawn NUMERIC(15, 2) NOT NULL,
+    corrected BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX balance_drift_user_id_idx ON balance_drift (user_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE balance_drift;
+-- +goose StatementEnd
@@ -0,0 +1,38 @@
+-- +goose Up
+-- +goose StatementBegin
+-- The application never writes rows that break these; a violation is a bug
+-- and must fail the statement rather than leave a balance that doesn't add up.
+-- balance.current and balance.withdrawn are already checked since init.
+ALTER TABLE orders ADD CONSTRAINT orders_accrual_check CHECK (accrual >= 0);
+ALTER TABLE orders ADD CONSTRAINT orders_status_check CHECK (status IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED'));
+ALTER TABLE withdrawal DROP CONSTRAINT withdrawal_sum_check;
+ALTER TABLE withdrawal ADD CONSTRAINT withdrawal_sum_check CHECK (sum > 0);
+ALTER TABLE balance_adjustments ADD CONSTRAINT balance_adjustments_amount_check CHECK (amount <> 0);
+ALTER TABLE balance ADD CONSTRAINT balance_user_id_key UNIQUE (user_id);
+
+ALTER TABLE users ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN uploaded_at SET NOT NULL;
+ALTER TABLE orders ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE balance ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE withdrawal ALTER COLUMN processed_at SET NOT NULL;
+ALTER TABLE balance_adjustments ALTER COLUMN created_at SET NOT NULL;
+ALTER TABLE ledger ALTER COLUMN created_at SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE ledger ALTER COLUMN created_at DROP NOT NULL;
+ALTER TABLE balance_adjustments ALTER COLUMN created_at DROP NOT NULL;
+ALTER TABLE withdrawal ALTER COLUMN processed_at DROP NOT NULL;
+ALTER TABLE balance ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE orders ALTER COLUMN updated_at DROP NOT NULL;
+ALTER TABLE orders ALTER COLUMN uploaded_at DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN created_at DROP NOT NULL;
+
+ALTER TABLE balance DROP CONSTRAINT balance_user_id_key;
+ALTER TABLE balance_adjustments DROP CONSTRAINT balance_adjustments_amount_check;
+ALTER TABLE withdrawal DROP CONSTRAINT withdrawal_sum_check;
+ALTER TABLE withdrawal ADD CONSTRAINT withdrawal_sum_check CHECK (sum >= 0);
+ALTER TABLE orders DROP CONSTRAINT orders_status_check;
+ALTER TABLE orders DROP CONSTRAINT orders_accrual_check;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE account_merges (
+    id UUID PRIMARY KEY,
+    source_user_id UUID NOT NULL REFERENCES users(id),
+    target_user_id UUID NOT NULL REFERENCES users(id),
+    orders INTEGER NOT NULL,
+    withdrawals INTEGER NOT NULL,
+    dropped_idempotency_keys INTEGER NOT NULL,
+    current NUMERIC(15, 2) NOT NULL,
+    withdrawn NUMERIC(15, 2) NOT NULL,
+    reason TEXT NOT NULL,
+    operator TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX account_merges_source_user_id_idx ON account_merges (source_user_id);
+CREATE INDEX account_merges_target_user_id_idx ON account_merges (target_user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE account_merges;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Merchants number their orders independently, so an order number is only
+-- unique within a merchant. The dead letter queue and the accrual journal
+-- stay keyed by number like the accrual system itself.
+ALTER TABLE orders ADD COLUMN merchant_id UUID NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000' REFERENCES merchants(id);
+UPDATE orders SET merchant_id = users.merchant_id FROM users WHERE users.id = orders.user_id;
+
+ALTER TABLE accrual_dead_letter DROP CONSTRAINT accrual_dead_letter_order_number_fkey;
+ALTER TABLE orders DROP CONSTRAINT orders_order_number_key;
+ALTER TABLE orders ADD CONSTRAINT orders_merchant_id_order_number_key UNIQUE (merchant_id, order_number);
+CREATE INDEX orders_order_number_idx ON orders (order_number);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX orders_order_number_idx;
+ALTER TABLE orders DROP CONSTRAINT orders_merchant_id_order_number_key;
+ALTER TABLE orders ADD CONSTRAINT orders_order_number_key UNIQUE (order_number);
+ALTER TABLE accrual_dead_letter ADD CONSTRAINT accrual_dead_letter_order_number_fkey
+    FOREIGN KEY (order_number) REFERENCES orders (order_number) ON DELETE CASCADE;
+ALTER TABLE orders DROP COLUMN merchant_id;
+-- +goose StatementEnd
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+func (c *Client) Balance(ctx context.Context) (*Balance, error) {
+	balance := &Balance{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/balance", auth: true, idempotent: true}, balance); err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+// BalanceHistory returns every change of the balance, newest first.
+func (c *Client) BalanceHistory(ctx context.Context) ([]LedgerEntry, error) {
+	entries := make([]LedgerEntry, 0)
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/balance/history", auth: true, idempotent: true}, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (c *Client) Withdrawals(ctx context.Context) ([]Withdrawal, error) {
+	withdrawals := make([]Withdrawal, 0)
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/withdrawals", auth: true, idempotent: true}, &withdrawals); err != nil {
+		return nil, err
+	}
+	return withdrawals, nil
+}
+
+func (c *Client) Stats(ctx context.Context) (*UserStats, error) {
+	stats := &UserStats{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/stats", auth: true, idempotent: true}, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Withdraw spends sum points on order. The request is sent with
+// idempotencyKey, or a random one when it is empty, so it is retried without
+// the risk of withdrawing twice; reuse a key to retry a call that failed.
+// Too low a balance is ErrNotEnoughBalance.
+func (c *Client) Withdraw(ctx context.Context, order string, sum float64, idempotencyKey string) error {
+	if len(idempotencyKey) == 0 {
+		idempotencyKey = uuid.NewString()
+	}
+
+	body := struct {
+		Order string  `json:"order"`
+		Sum   float64 `json:"sum"`
+	}{order, sum}
+
+	_, err := c.do(ctx, request{
+		method:     http.MethodPost,
+		path:       "/api/user/balance/withdraw",
+		body:       body,
+		header:     http.Header{idempotencyKeyHeader: {idempotencyKey}},
+		auth:       true,
+		idempotent: true,
+	}, nil)
+	return err
+}
@@ -0,0 +1,336 @@
+// Package client is a Go SDK for the Gophermart user API. It keeps the token
+// pair of the signed-in user, refreshes it when the access token expires and
+// retries requests that are safe to repeat.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout        = 30 * time.Second
+	DefaultMaxRetries     = 3
+	DefaultRetryBaseDelay = 200 * time.Millisecond
+	DefaultRetryMaxDelay  = 5 * time.Second
+
+	merchantKeyHeader    = "X-Merchant-Key"
+	idempotencyKeyHeader = "Idempotency-Key"
+	envelopeMediaType    = "application/vnd.gophermart.envelope+json"
+)
+
+type Config struct {
+	// BaseURL is the service root, e.g. https://mart.example.com.
+	BaseURL string
+	// HTTPClient defaults to a client with DefaultTimeout.
+	HTTPClient *http.Client
+	// MerchantKey selects the merchant on multi-merchant deployments.
+	MerchantKey string
+	// MaxRetries is how often a request that is safe to repeat is retried
+	// after a network error, 429 or 5xx gateway status. Negative disables
+	// retries.
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+}
+
+// Tokens is the token pair of the signed-in user. Clients that outlive a
+// process can save it and restore it with SetTokens.
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type Client struct {
+	cfg Config
+
+	mu     sync.Mutex
+	tokens Tokens
+	// refreshMu lets one request refresh the tokens while the others that got
+	// 401 with the same access token wait for it.
+	refreshMu sync.Mutex
+}
+
+func New(cfg Config) *Client {
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryBaseDelay <= 0 {
+		cfg.RetryBaseDelay = DefaultRetryBaseDelay
+	}
+	if cfg.RetryMaxDelay < cfg.RetryBaseDelay {
+		cfg.RetryMaxDelay = DefaultRetryMaxDelay
+	}
+
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) Tokens() Tokens {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens
+}
+
+func (c *Client) SetTokens(tokens Tokens) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens = tokens
+}
+
+var (
+	ErrBadRequest       = errors.New("bad request")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrNotEnoughBalance = errors.New("not enough balance")
+	ErrForbidden        = errors.New("forbidden")
+	ErrNotFound         = errors.New("not found")
+	ErrConflict         = errors.New("conflict")
+	ErrInvalid          = errors.New("invalid input")
+	ErrLocked           = errors.New("login locked")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrServer           = errors.New("server error")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:          ErrBadRequest,
+	http.StatusUnauthorized:        ErrUnauthorized,
+	http.StatusPaymentRequired:     ErrNotEnoughBalance,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusConflict:            ErrConflict,
+	http.StatusUnprocessableEntity: ErrInvalid,
+	http.StatusLocked:              ErrLocked,
+	http.StatusTooManyRequests:     ErrRateLimited,
+}
+
+// Error is an unexpected response status. It matches the Err* variable of its
+// status with errors.Is; any 5xx matches ErrServer.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	// Code is the machine-readable reason some responses carry, e.g.
+	// order_not_placed. Rule names the violated password or order number
+	// rule.
+	Code    string
+	Rule    string
+	Message string
+	// RetryAfter is set on 423 and 429.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	if len(e.Message) != 0 {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	if e.StatusCode >= 500 {
+		return target == ErrServer
+	}
+	return statusErrors[e.StatusCode] == target
+}
+
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   interface{}
+	// rawBody is sent as text/plain instead of body.
+	rawBody string
+	header  http.Header
+	// auth sends the access token and refreshes it once on 401.
+	auth bool
+	// idempotent requests are retried.
+	idempotent bool
+}
+
+// do sends req and decodes a 2xx JSON body into out, if out is not nil. It
+// returns the status code.
+func (c *Client) do(ctx context.Context, req request, out interface{}) (int, error) {
+	var body []byte
+	contentType := ""
+	switch {
+	case req.body != nil:
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return 0, err
+		}
+		body, contentType = b, "application/json"
+	case len(req.rawBody) != 0:
+		body, contentType = []byte(req.rawBody), "text/plain"
+	}
+
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		token := c.Tokens().Token
+		resp, err := c.send(ctx, req, body, contentType, token)
+		if err != nil {
+			if ctx.Err() != nil || !req.idempotent || attempt >= c.cfg.MaxRetries {
+				return 0, err
+			}
+			if err := c.wait(ctx, attempt, 0); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && req.auth && !refreshed {
+			refreshed = true
+			if c.refreshStale(ctx, token) == nil {
+				attempt--
+				continue
+			}
+		}
+
+		if resp.StatusCode >= 300 {
+			apiErr := newError(req, resp, respBody)
+			if !req.idempotent || attempt >= c.cfg.MaxRetries || !retryableStatus(resp.StatusCode) {
+				return resp.StatusCode, apiErr
+			}
+			if err := c.wait(ctx, attempt, apiErr.RetryAfter); err != nil {
+				return resp.StatusCode, err
+			}
+			continue
+		}
+
+		if out != nil && len(respBody) != 0 {
+			if err := json.Unmarshal(respBody, out); err != nil {
+				return resp.StatusCode, fmt.Errorf("%s %s: decode response: %w", req.method, req.path, err)
+			}
+		}
+		return resp.StatusCode, nil
+	}
+}
+
+// refreshStale refreshes the tokens unless another request already replaced
+// the rejected access token.
+func (c *Client) refreshStale(ctx context.Context, rejected string) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	tokens := c.Tokens()
+	if tokens.Token != rejected {
+		return nil
+	}
+	if len(tokens.RefreshToken) == 0 {
+		return ErrUnauthorized
+	}
+	return c.Refresh(ctx)
+}
+
+func (c *Client) send(ctx context.Context, req request, body []byte, contentType, token string) (*http.Response, error) {
+	u := c.cfg.BaseURL + req.path
+	if len(req.query) != 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	if len(contentType) != 0 {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if len(c.cfg.MerchantKey) != 0 {
+		httpReq.Header.Set(merchantKeyHeader, c.cfg.MerchantKey)
+	}
+	if req.auth && len(token) != 0 {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return c.cfg.HTTPClient.Do(httpReq)
+}
+
+// wait sleeps before retry attempt+1: retryAfter if the server sent one,
+// else an exponential backoff.
+func (c *Client) wait(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	delay := retryAfter
+	if delay <= 0 {
+		delay = c.cfg.RetryBaseDelay << attempt
+		if delay <= 0 || delay > c.cfg.RetryMaxDelay {
+			delay = c.cfg.RetryMaxDelay
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func newError(req request, resp *http.Response, body []byte) *Error {
+	e := &Error{Method: req.method, Path: req.path, StatusCode: resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	var details struct {
+		Error   string `json:"error"`
+		Code    string `json:"code"`
+		Rule    string `json:"rule"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &details) == nil {
+		e.Code, e.Rule, e.Message = details.Code, details.Rule, details.Message
+		if len(e.Message) == 0 {
+			e.Message = details.Error
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	health := &Health{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/health", idempotent: true}, health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	version := &Version{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/version", idempotent: true}, version); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
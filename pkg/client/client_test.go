@@ -0,0 +1,334 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/real-splendid/gophermart-practicum/internal/app"
+	"github.com/real-splendid/gophermart-practicum/internal/storage"
+	"github.com/real-splendid/gophermart-practicum/pkg/client"
+	"github.com/real-splendid/gophermart-practicum/pkg/validate"
+)
+
+// newServer serves the real API on SQLite storage in a temporary directory.
+// wrap, if not nil, wraps the API handler.
+func newServer(t *testing.T, wrap func(http.Handler) http.Handler) (*httptest.Server, storage.AppStorage) {
+	t.Helper()
+
+	ctx := context.Background()
+	logger := zap.NewNop()
+	db, err := storage.OpenSQLite(ctx, "sqlite://"+t.TempDir()+"/gophermart.db", logger)
+	if err != nil {
+		t.Fatalf("can't open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	st, err := storage.NewSQLiteStorage(ctx, db, logger, storage.Options{})
+	if err != nil {
+		t.Fatalf("can't create SQLite storage: %v", err)
+	}
+
+	handler, err := app.NewHandler(ctx, app.Config{
+		Logger:         logger,
+		Storage:        st,
+		JWTSecret:      []byte("client-tests-secret"),
+		Timeouts:       app.DefaultTimeouts,
+		CSRFMode:       app.CSRFOff,
+		PasswordPolicy: validate.DefaultPasswordPolicy(),
+	})
+	if err != nil {
+		t.Fatalf("NewHandler() error = %v", err)
+	}
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv, st
+}
+
+func newClient(srv *httptest.Server) *client.Client {
+	return client.New(client.Config{BaseURL: srv.URL, HTTPClient: srv.Client(), RetryBaseDelay: time.Millisecond})
+}
+
+// signedIn registers login on srv and returns a client signed in as it.
+func signedIn(t *testing.T, srv *httptest.Server, login string) *client.Client {
+	t.Helper()
+
+	c := newClient(srv)
+	if err := c.Register(context.Background(), login, "correct horse"); err != nil {
+		t.Fatalf("Register(%s) error = %v", login, err)
+	}
+	return c
+}
+
+func TestAuth(t *testing.T) {
+	srv, _ := newServer(t, nil)
+	ctx := context.Background()
+	c := signedIn(t, srv, "alice")
+
+	if tokens := c.Tokens(); len(tokens.Token) == 0 || len(tokens.RefreshToken) == 0 {
+		t.Fatalf("Register() left tokens %+v, want a pair", tokens)
+	}
+	profile, err := c.Profile(ctx)
+	if err != nil {
+		t.Fatalf("Profile() error = %v", err)
+	}
+	if profile.Login != "alice" {
+		t.Errorf("Profile() login = %q, want alice", profile.Login)
+	}
+
+	other := newClient(srv)
+	if err := other.Register(ctx, "alice", "battery staple"); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("Register() of a taken login error = %v, want %v", err, client.ErrConflict)
+	}
+	err = other.Register(ctx, "bob", "short")
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || !errors.Is(err, client.ErrBadRequest) || len(apiErr.Rule) == 0 {
+		t.Errorf("Register() with a weak password error = %v, want %v with a rule", err, client.ErrBadRequest)
+	}
+	if err := other.Login(ctx, "alice", "wrong"); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Login() with a wrong password error = %v, want %v", err, client.ErrUnauthorized)
+	}
+	if _, err := other.Profile(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Profile() signed out error = %v, want %v", err, client.ErrUnauthorized)
+	}
+	if err := other.Login(ctx, "alice", "correct horse"); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	sessions, err := other.Sessions(ctx)
+	if err != nil {
+		t.Fatalf("Sessions() error = %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Errorf("Sessions() = %d sessions, want 2", len(sessions))
+	}
+
+	if err := other.Logout(ctx); err != nil {
+		t.Fatalf("Logout() error = %v", err)
+	}
+	if tokens := other.Tokens(); tokens != (client.Tokens{}) {
+		t.Errorf("Logout() left tokens %+v", tokens)
+	}
+	if _, err := c.Profile(ctx); err != nil {
+		t.Errorf("Profile() of another session after Logout() error = %v", err)
+	}
+}
+
+func TestRefreshOnExpiredToken(t *testing.T) {
+	srv, _ := newServer(t, nil)
+	ctx := context.Background()
+	c := signedIn(t, srv, "alice")
+
+	refreshToken := c.Tokens().RefreshToken
+	c.SetTokens(client.Tokens{Token: "expired", RefreshToken: refreshToken})
+	if _, err := c.Balance(ctx); err != nil {
+		t.Fatalf("Balance() with an expired token error = %v", err)
+	}
+	if tokens := c.Tokens(); tokens.Token == "expired" || tokens.RefreshToken == refreshToken {
+		t.Errorf("tokens were not refreshed: %+v", tokens)
+	}
+
+	c.SetTokens(client.Tokens{Token: "expired", RefreshToken: refreshToken})
+	if _, err := c.Balance(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Balance() with a used refresh token error = %v, want %v", err, client.ErrUnauthorized)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	srv, _ := newServer(t, nil)
+	ctx := context.Background()
+	c := signedIn(t, srv, "alice")
+
+	tests := []struct {
+		name      string
+		number    string
+		wantNew   bool
+		wantErr   error
+		wantRule  string
+		onAnother bool
+	}{
+		{name: "new", number: "79927398713", wantNew: true},
+		{name: "again", number: "79927398713"},
+		{name: "another", number: "4561261212345467", wantNew: true},
+		{name: "checksum", number: "79927398710", wantErr: client.ErrInvalid, wantRule: validate.RuleOrderChecksum},
+		{name: "letters", number: "7992739871a", wantErr: client.ErrInvalid, wantRule: validate.RuleOrderDigits},
+		{name: "another user's", number: "79927398713", wantErr: client.ErrConflict, onAnother: true},
+	}
+	bob := signedIn(t, srv, "bob")
+	for _, tt := range tests {
+		uploader := c
+		if tt.onAnother {
+			uploader = bob
+		}
+		isNew, err := uploader.UploadOrder(ctx, tt.number)
+		if !errors.Is(err, tt.wantErr) || isNew != tt.wantNew {
+			t.Errorf("UploadOrder(%s) = %t, %v, want %t, %v", tt.name, isNew, err, tt.wantNew, tt.wantErr)
+		}
+		var apiErr *client.Error
+		if errors.As(err, &apiErr) && apiErr.Rule != tt.wantRule {
+			t.Errorf("UploadOrder(%s) rule = %q, want %q", tt.name, apiErr.Rule, tt.wantRule)
+		}
+	}
+
+	orders, err := c.Orders(ctx)
+	if err != nil {
+		t.Fatalf("Orders() error = %v", err)
+	}
+	if len(orders) != 2 || orders[0].Number != "4561261212345467" || orders[0].Status != client.StatusNew {
+		t.Errorf("Orders() = %+v, want the two new orders, newest first", orders)
+	}
+
+	page, err := c.OrdersPage(ctx, client.OrdersQuery{Limit: 1})
+	if err != nil {
+		t.Fatalf("OrdersPage() error = %v", err)
+	}
+	if len(page.Orders) != 1 || page.Total != 2 || len(page.NextCursor) == 0 {
+		t.Errorf("OrdersPage() = %+v, want 1 of 2 orders and a cursor", page)
+	}
+	page, err = c.OrdersPage(ctx, client.OrdersQuery{Limit: 1, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("OrdersPage() of the next page error = %v", err)
+	}
+	if len(page.Orders) != 1 || page.Orders[0].Number != "79927398713" {
+		t.Errorf("OrdersPage() of the next page = %+v, want the last order", page)
+	}
+	// A full page can't tell there is nothing after it.
+	page, err = c.OrdersPage(ctx, client.OrdersQuery{Limit: 1, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("OrdersPage() past the end error = %v", err)
+	}
+	if len(page.Orders) != 0 || len(page.NextCursor) != 0 {
+		t.Errorf("OrdersPage() past the end = %+v, want no orders and no cursor", page)
+	}
+
+	order, err := c.Order(ctx, "79927398713")
+	if err != nil {
+		t.Fatalf("Order() error = %v", err)
+	}
+	if order.Number != "79927398713" || order.UpdatedAt.IsZero() {
+		t.Errorf("Order() = %+v", order)
+	}
+	if _, err := bob.Order(ctx, "79927398713"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Order() of another user's order error = %v, want %v", err, client.ErrNotFound)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	srv, st := newServer(t, nil)
+	ctx := context.Background()
+	c := signedIn(t, srv, "alice")
+
+	if _, err := c.UploadOrder(ctx, "79927398713"); err != nil {
+		t.Fatalf("UploadOrder() error = %v", err)
+	}
+	// As the accrual worker does once the order is processed.
+	if err := st.UpdateOrder(ctx, storage.Order{OrderNumber: "79927398713", Status: storage.StatusProcessed, Accrual: 90050}); err != nil {
+		t.Fatalf("UpdateOrder() error = %v", err)
+	}
+	auth, err := st.GetUserAuthInfo(ctx, storage.DefaultMerchantID, "alice")
+	if err != nil {
+		t.Fatalf("GetUserAuthInfo() error = %v", err)
+	}
+	if err := st.AddBalance(ctx, auth.ID, 90050); err != nil {
+		t.Fatalf("AddBalance() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		order   string
+		sum     float64
+		key     string
+		wantErr error
+	}{
+		{"first", "2377225624", 100.25, "key-1", nil},
+		{"retried with its key", "2377225624", 100.25, "key-1", nil},
+		{"key reused for another sum", "2377225624", 200, "key-1", client.ErrConflict},
+		{"more than the balance", "12345678903", 1000, "", client.ErrNotEnoughBalance},
+		{"bad order number", "12345678900", 10, "", client.ErrInvalid},
+		{"second", "12345678903", 300, "", nil},
+	}
+	for _, tt := range tests {
+		if err := c.Withdraw(ctx, tt.order, tt.sum, tt.key); !errors.Is(err, tt.wantErr) {
+			t.Errorf("Withdraw(%s) error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	balance, err := c.Balance(ctx)
+	if err != nil {
+		t.Fatalf("Balance() error = %v", err)
+	}
+	if balance.Current != 500.25 || balance.Withdrawn != 400.25 {
+		t.Errorf("Balance() = %+v, want 500.25 current and 400.25 withdrawn", balance)
+	}
+	withdrawals, err := c.Withdrawals(ctx)
+	if err != nil {
+		t.Fatalf("Withdrawals() error = %v", err)
+	}
+	if len(withdrawals) != 2 {
+		t.Errorf("Withdrawals() = %+v, want 2", withdrawals)
+	}
+	history, err := c.BalanceHistory(ctx)
+	if err != nil {
+		t.Fatalf("BalanceHistory() error = %v", err)
+	}
+	if len(history) != 3 {
+		t.Errorf("BalanceHistory() = %+v, want an accrual and 2 withdrawals", history)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// The first two requests get 503, as from a restarting server.
+	var requests int32
+	srv, _ := newServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				http.Error(w, "", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	ctx := context.Background()
+
+	c := newClient(srv)
+	if _, err := c.Health(ctx); err != nil {
+		t.Fatalf("Health() error = %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Health() sent %d requests, want 3", n)
+	}
+
+	// Registration is not safe to repeat.
+	atomic.StoreInt32(&requests, 0)
+	if err := c.Register(ctx, "alice", "correct horse"); !errors.Is(err, client.ErrServer) {
+		t.Errorf("Register() error = %v, want %v", err, client.ErrServer)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Register() sent %d requests, want 1", n)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	noRetries := client.New(client.Config{BaseURL: srv.URL, HTTPClient: srv.Client(), MaxRetries: -1})
+	if _, err := noRetries.Health(ctx); !errors.Is(err, client.ErrServer) {
+		t.Errorf("Health() without retries error = %v, want %v", err, client.ErrServer)
+	}
+}
+
+func TestContextCanceled(t *testing.T) {
+	srv, _ := newServer(t, nil)
+	c := signedIn(t, srv, "alice")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Orders(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Orders() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+}
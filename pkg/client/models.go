@@ -0,0 +1,151 @@
+package client
+
+import "time"
+
+// Order statuses.
+const (
+	StatusNew        = "NEW"
+	StatusProcessing = "PROCESSING"
+	StatusInvalid    = "INVALID"
+	StatusProcessed  = "PROCESSED"
+)
+
+// Amounts are points with two decimal places.
+
+type Order struct {
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	Accrual    float64   `json:"accrual,omitempty"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+type OrderDetails struct {
+	Order
+	UpdatedAt time.Time `json:"updated_at"`
+	// RegistrationError is why registering the order with the accrual system
+	// last failed; it is retried.
+	RegistrationError string `json:"registration_error,omitempty"`
+	// AccrualThrottledUntil is set on unfinished orders while the accrual
+	// system throttles their processing.
+	AccrualThrottledUntil *time.Time `json:"accrual_throttled_until,omitempty"`
+}
+
+// OrdersQuery selects a page of orders. Zero fields are not sent.
+type OrdersQuery struct {
+	Limit    int
+	Cursor   string
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	// Sort is uploaded_at (the default) or accrual.
+	Sort string
+}
+
+type OrdersPage struct {
+	Orders []Order
+	Total  int
+	// NextCursor is empty once no orders are left. A full last page still
+	// has one, which leads to an empty page.
+	NextCursor string
+}
+
+type Balance struct {
+	Current   float64   `json:"current"`
+	Withdrawn float64   `json:"withdrawn"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Value and Currency are set when the service converts points to money.
+	Value    float64 `json:"value,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+type Withdrawal struct {
+	Order       string    `json:"order"`
+	Sum         float64   `json:"sum"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type LedgerEntry struct {
+	Kind      string    `json:"kind"`
+	Reference string    `json:"reference,omitempty"`
+	Amount    float64   `json:"amount"`
+	Balance   float64   `json:"balance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type UserStats struct {
+	TotalAccrued    float64        `json:"total_accrued"`
+	TotalWithdrawn  float64        `json:"total_withdrawn"`
+	OrdersByStatus  map[string]int `json:"orders_by_status"`
+	EarnedThisMonth float64        `json:"earned_this_month"`
+}
+
+type Profile struct {
+	Login       string    `json:"login"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Value and Currency are set when the service converts points to money.
+	Value    float64 `json:"value,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+// ProfileUpdate changes the fields that are not nil. Changing the password
+// needs the current one.
+type ProfileUpdate struct {
+	DisplayName     *string `json:"display_name,omitempty"`
+	Email           *string `json:"email,omitempty"`
+	CurrentPassword string  `json:"current_password,omitempty"`
+	NewPassword     string  `json:"new_password,omitempty"`
+}
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Current is the session of the client's own token.
+	Current bool `json:"current"`
+}
+
+type NotificationPreferences struct {
+	Email      string `json:"email"`
+	WebhookURL string `json:"webhook_url"`
+}
+
+type ExportedOrder struct {
+	OrderNumber string    `json:"order_number"`
+	Status      string    `json:"status"`
+	Accrual     float64   `json:"accrual"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+type Export struct {
+	ID          string    `json:"id"`
+	Login       string    `json:"login"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	Balance     struct {
+		Current   float64 `json:"current"`
+		Withdrawn float64 `json:"withdrawn"`
+	} `json:"balance"`
+	Orders        []ExportedOrder          `json:"orders"`
+	Withdrawals   []Withdrawal             `json:"withdrawals"`
+	History       []LedgerEntry            `json:"history"`
+	Notifications *NotificationPreferences `json:"notifications"`
+}
+
+type Health struct {
+	// Status is ok, or degraded while accrual processing is off.
+	Status  string `json:"status"`
+	Accrual string `json:"accrual"`
+}
+
+type Version struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
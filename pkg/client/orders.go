@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadOrder submits an order number for accrual. isNew is false when the
+// user had already uploaded it. An order of another user is ErrConflict; a
+// number that fails the Luhn check is ErrInvalid.
+func (c *Client) UploadOrder(ctx context.Context, number string) (isNew bool, err error) {
+	status, err := c.do(ctx, request{method: http.MethodPost, path: "/api/user/orders", rawBody: number, auth: true}, nil)
+	if err != nil {
+		return false, err
+	}
+	return status == http.StatusAccepted, nil
+}
+
+// Orders returns all orders of the user, newest first.
+func (c *Client) Orders(ctx context.Context) ([]Order, error) {
+	orders := make([]Order, 0)
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/orders", auth: true, idempotent: true}, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// OrdersPage returns one page of the orders that match query. Pass the
+// returned NextCursor in query.Cursor for the next one.
+func (c *Client) OrdersPage(ctx context.Context, query OrdersQuery) (*OrdersPage, error) {
+	values := url.Values{}
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+	if len(query.Cursor) != 0 {
+		values.Set("cursor", query.Cursor)
+	}
+	if len(query.Statuses) != 0 {
+		values.Set("status", strings.Join(query.Statuses, ","))
+	}
+	if !query.From.IsZero() {
+		values.Set("from", query.From.Format(time.RFC3339))
+	}
+	if !query.To.IsZero() {
+		values.Set("to", query.To.Format(time.RFC3339))
+	}
+	if len(query.Sort) != 0 {
+		values.Set("sort", query.Sort)
+	}
+
+	var resp struct {
+		Data []Order `json:"data"`
+		Page struct {
+			Total      int    `json:"total"`
+			NextCursor string `json:"next_cursor"`
+		} `json:"page"`
+	}
+	req := request{
+		method:     http.MethodGet,
+		path:       "/api/user/orders",
+		query:      values,
+		header:     http.Header{"Accept": {envelopeMediaType}},
+		auth:       true,
+		idempotent: true,
+	}
+	if _, err := c.do(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+
+	page := &OrdersPage{Orders: resp.Data, Total: resp.Page.Total, NextCursor: resp.Page.NextCursor}
+	if page.Orders == nil {
+		page.Orders = make([]Order, 0)
+	}
+	return page, nil
+}
+
+// Order returns ErrNotFound for an order the user hasn't uploaded.
+func (c *Client) Order(ctx context.Context, number string) (*OrderDetails, error) {
+	order := &OrderDetails{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/orders/" + url.PathEscape(number), auth: true, idempotent: true}, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
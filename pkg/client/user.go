@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+type credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// Register creates a user and signs the client in as it. A taken login is
+// ErrConflict; a password that breaks a rule is ErrBadRequest with Error.Rule
+// set.
+func (c *Client) Register(ctx context.Context, login, password string) error {
+	return c.signIn(ctx, "/api/user/register", login, password)
+}
+
+// Login signs the client in. Wrong credentials are ErrUnauthorized; a login
+// locked after too many failures is ErrLocked.
+func (c *Client) Login(ctx context.Context, login, password string) error {
+	return c.signIn(ctx, "/api/user/login", login, password)
+}
+
+func (c *Client) signIn(ctx context.Context, path, login, password string) error {
+	tokens := Tokens{}
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: path, body: credentials{login, password}}, &tokens); err != nil {
+		return err
+	}
+	c.SetTokens(tokens)
+	return nil
+}
+
+// Refresh trades the refresh token for a new token pair. Requests refresh on
+// their own when the access token has expired.
+func (c *Client) Refresh(ctx context.Context) error {
+	body := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{c.Tokens().RefreshToken}
+
+	tokens := Tokens{}
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: "/api/user/refresh", body: body}, &tokens); err != nil {
+		return err
+	}
+	c.SetTokens(tokens)
+	return nil
+}
+
+// Logout revokes the session and forgets its tokens.
+func (c *Client) Logout(ctx context.Context) error {
+	if _, err := c.do(ctx, request{method: http.MethodPost, path: "/api/user/logout", auth: true}, nil); err != nil {
+		return err
+	}
+	c.SetTokens(Tokens{})
+	return nil
+}
+
+// DeleteAccount deletes the user with all its data and forgets its tokens.
+func (c *Client) DeleteAccount(ctx context.Context) error {
+	if _, err := c.do(ctx, request{method: http.MethodDelete, path: "/api/user", auth: true, idempotent: true}, nil); err != nil {
+		return err
+	}
+	c.SetTokens(Tokens{})
+	return nil
+}
+
+func (c *Client) Export(ctx context.Context) (*Export, error) {
+	export := &Export{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/export", auth: true, idempotent: true}, export); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+func (c *Client) Profile(ctx context.Context) (*Profile, error) {
+	profile := &Profile{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/profile", auth: true, idempotent: true}, profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// UpdateProfile applies update and returns the new profile. A wrong current
+// password is ErrForbidden. After a password change the client keeps the new
+// token pair, as the old tokens are revoked.
+func (c *Client) UpdateProfile(ctx context.Context, update ProfileUpdate) (*Profile, error) {
+	var resp struct {
+		Profile
+		Tokens
+	}
+	if _, err := c.do(ctx, request{method: http.MethodPatch, path: "/api/user/profile", body: update, auth: true}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Token) != 0 {
+		c.SetTokens(resp.Tokens)
+	}
+	return &resp.Profile, nil
+}
+
+func (c *Client) Sessions(ctx context.Context) ([]Session, error) {
+	sessions := make([]Session, 0)
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/sessions", auth: true, idempotent: true}, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (c *Client) RevokeSession(ctx context.Context, id string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/api/user/sessions/" + url.PathEscape(id), auth: true, idempotent: true}, nil)
+	return err
+}
+
+// NotificationPreferences returns empty preferences when none are set.
+func (c *Client) NotificationPreferences(ctx context.Context) (*NotificationPreferences, error) {
+	prefs := &NotificationPreferences{}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/notifications", auth: true, idempotent: true}, prefs); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func (c *Client) SetNotificationPreferences(ctx context.Context, prefs NotificationPreferences) error {
+	_, err := c.do(ctx, request{method: http.MethodPut, path: "/api/user/notifications", body: prefs, auth: true, idempotent: true}, nil)
+	return err
+}
+
+func (c *Client) DeleteNotificationPreferences(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: "/api/user/notifications", auth: true, idempotent: true}, nil)
+	return err
+}
@@ -0,0 +1,96 @@
+package validate
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password rules reported in PasswordError.
+const (
+	RuleMinLength = "min_length"
+	RuleLower     = "lowercase"
+	RuleUpper     = "uppercase"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleCommon    = "common_password"
+)
+
+// commonPasswords is a short deny-list of the most frequently leaked
+// passwords; deployments can extend it through PasswordPolicy.DenyList.
+var commonPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "password", "password1",
+	"qwerty", "qwerty123", "qwertyuiop", "111111", "123123", "abc123",
+	"iloveyou", "admin", "welcome", "letmein", "monkey", "dragon",
+	"sunshine", "princess", "football", "baseball", "passw0rd", "000000",
+}
+
+// PasswordPolicy describes the rules a new password must satisfy.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	DenyList      []string
+}
+
+// PasswordError names the first rule a password failed.
+type PasswordError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *PasswordError) Error() string {
+	return e.Message
+}
+
+// DefaultPasswordPolicy requires eight characters and rejects common
+// passwords without imposing character classes.
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8}
+}
+
+// Check returns a *PasswordError describing the first violated rule, or nil.
+func (p PasswordPolicy) Check(password string) error {
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		return &PasswordError{Rule: RuleMinLength, Message: fmt.Sprintf("password must be at least %d characters long", p.MinLength)}
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	switch {
+	case p.RequireLower && !lower:
+		return &PasswordError{Rule: RuleLower, Message: "password must contain a lowercase letter"}
+	case p.RequireUpper && !upper:
+		return &PasswordError{Rule: RuleUpper, Message: "password must contain an uppercase letter"}
+	case p.RequireDigit && !digit:
+		return &PasswordError{Rule: RuleDigit, Message: "password must contain a digit"}
+	case p.RequireSymbol && !symbol:
+		return &PasswordError{Rule: RuleSymbol, Message: "password must contain a symbol"}
+	}
+
+	normalized := strings.ToLower(password)
+	for _, list := range [][]string{commonPasswords, p.DenyList} {
+		for _, common := range list {
+			if normalized == strings.ToLower(common) {
+				return &PasswordError{Rule: RuleCommon, Message: "password is too common"}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+// Package validate holds the request validation rules shared by the server
+// and its clients.
+package validate
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Order numbers are at least a payload digit and a check digit long, and no
+// longer than any card or receipt number seen in practice.
+const (
+	MinOrderNumberLength = 2
+	MaxOrderNumberLength = 32
+)
+
+// Luhn reports whether number is a non-empty string of ASCII digits that
+// passes the Luhn checksum.
+func Luhn(number string) bool {
+	if len(number) == 0 {
+		return false
+	}
+
+	sum, ok := luhnSum(number, false)
+	return ok && sum%10 == 0
+}
+
+// LuhnCheckDigit returns the digit that makes payload followed by it pass the
+// Luhn checksum. It reports false if payload is not a string of ASCII digits.
+func LuhnCheckDigit(payload string) (byte, bool) {
+	sum, ok := luhnSum(payload, true)
+	if !ok {
+		return 0, false
+	}
+	return byte('0' + (10-sum%10)%10), true
+}
+
+// luhnSum sums the digits of number from the right, doubling every second
+// one. With doubleFirst the rightmost digit is doubled, as it is when a check
+// digit is still to be appended.
+func luhnSum(number string, doubleFirst bool) (int, bool) {
+	sum := 0
+	double := doubleFirst
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+
+		d := int(c - '0')
+		if double {
+			d *= 2
+		}
+		sum += d/10 + d%10
+
+		double = !double
+	}
+	return sum, true
+}
+
+// Order number rules reported in OrderNumberError.
+const (
+	RuleOrderLength   = "length"
+	RuleOrderDigits   = "digits"
+	RuleOrderZero     = "zero"
+	RuleOrderChecksum = "checksum"
+)
+
+// OrderNumberError names the first rule an order number failed.
+type OrderNumberError struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (e *OrderNumberError) Error() string {
+	return e.Message
+}
+
+// OrderNumber reports whether number is acceptable as an order number.
+func OrderNumber(number string) bool {
+	return CheckOrderNumber(number) == nil
+}
+
+// CheckOrderNumber returns an *OrderNumberError describing the first violated
+// rule, or nil. Surrounding whitespace is not trimmed: it is not a digit.
+func CheckOrderNumber(number string) error {
+	if len(number) < MinOrderNumberLength || len(number) > MaxOrderNumberLength {
+		return &OrderNumberError{Rule: RuleOrderLength, Message: fmt.Sprintf("order number must be %d to %d digits long", MinOrderNumberLength, MaxOrderNumberLength)}
+	}
+
+	sum, ok := luhnSum(number, false)
+	if !ok {
+		return &OrderNumberError{Rule: RuleOrderDigits, Message: "order number must contain only the digits 0-9"}
+	}
+	// All zeros pass the checksum but are never issued.
+	if strings.Trim(number, "0") == "" {
+		return &OrderNumberError{Rule: RuleOrderZero, Message: "order number must not be all zeros"}
+	}
+	if sum%10 != 0 {
+		return &OrderNumberError{Rule: RuleOrderChecksum, Message: "order number fails the Luhn check"}
+	}
+	return nil
+}
+
+// Amount reports whether sum is a valid positive monetary amount.
+func Amount(sum float64) bool {
+	return sum > 0 && !math.IsInf(sum, 0) && !math.IsNaN(sum)
+}
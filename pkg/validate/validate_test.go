@@ -0,0 +1,204 @@
+package validate
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// digits is a random string of ASCII digits for testing/quick.
+type digits string
+
+func (digits) Generate(r *rand.Rand, size int) reflect.Value {
+	b := make([]byte, 1+r.Intn(MaxOrderNumberLength))
+	for i := range b {
+		b[i] = byte('0' + r.Intn(10))
+	}
+	return reflect.ValueOf(digits(b))
+}
+
+// referenceLuhn is the checksum as it is usually written down: double every
+// second digit from the right and subtract 9 from doubles above 9.
+func referenceLuhn(number string) bool {
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func check(t *testing.T, property interface{}) {
+	t.Helper()
+	if err := quick.Check(property, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLuhn(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"79927398713", true},
+		{"4561261212345467", true},
+		{"0", true},
+		{"79927398710", false},
+		{"4561261212345464", false},
+		{"", false},
+		{"7992 7398 713", false},
+		{"７９９２７３９８７１３", false},
+	}
+	for _, tt := range tests {
+		if got := Luhn(tt.number); got != tt.want {
+			t.Errorf("Luhn(%q) = %t, want %t", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestLuhnMatchesReference(t *testing.T) {
+	check(t, func(n digits) bool {
+		return Luhn(string(n)) == referenceLuhn(string(n))
+	})
+}
+
+func TestLuhnCheckDigitCompletesNumber(t *testing.T) {
+	check(t, func(payload digits) bool {
+		d, ok := LuhnCheckDigit(string(payload))
+		return ok && d >= '0' && d <= '9' && Luhn(string(payload)+string(d))
+	})
+}
+
+// The check digit is the only one that completes the payload.
+func TestLuhnCheckDigitIsUnique(t *testing.T) {
+	check(t, func(payload digits) bool {
+		want, _ := LuhnCheckDigit(string(payload))
+		for d := byte('0'); d <= '9'; d++ {
+			if Luhn(string(payload)+string(d)) != (d == want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestLuhnCatchesOneWrongDigit(t *testing.T) {
+	check(t, func(payload digits, pos uint8, delta uint8) bool {
+		d, _ := LuhnCheckDigit(string(payload))
+		number := []byte(string(payload) + string(d))
+		i := int(pos) % len(number)
+		number[i] = '0' + (number[i]-'0'+1+delta%9)%10
+		return !Luhn(string(number))
+	})
+}
+
+// Swapping two adjacent digits is caught unless they are 0 and 9.
+func TestLuhnCatchesAdjacentSwaps(t *testing.T) {
+	check(t, func(payload digits, pos uint8) bool {
+		d, _ := LuhnCheckDigit(string(payload))
+		number := []byte(string(payload) + string(d))
+		i := int(pos) % (len(number) - 1)
+		a, b := number[i], number[i+1]
+		if a == b || a+b == '0'+'9' {
+			return true
+		}
+		number[i], number[i+1] = b, a
+		return !Luhn(string(number))
+	})
+}
+
+func TestLuhnIgnoresLeadingZeros(t *testing.T) {
+	check(t, func(n digits, zeros uint8) bool {
+		return Luhn(strings.Repeat("0", int(zeros%8))+string(n)) == Luhn(string(n))
+	})
+}
+
+func TestLuhnRejectsNonDigits(t *testing.T) {
+	check(t, func(n digits, pos uint8, c byte) bool {
+		if c >= '0' && c <= '9' {
+			return true
+		}
+		i := int(pos) % (len(n) + 1)
+		number := string(n[:i]) + string(c) + string(n[i:])
+		_, ok := LuhnCheckDigit(number)
+		return !Luhn(number) && !ok && !OrderNumber(number)
+	})
+}
+
+func TestOrderNumberAgreesWithLuhn(t *testing.T) {
+	check(t, func(n digits) bool {
+		number := string(n)
+		want := len(number) >= MinOrderNumberLength && strings.Trim(number, "0") != "" && Luhn(number)
+		return OrderNumber(number) == want
+	})
+}
+
+func TestCheckOrderNumber(t *testing.T) {
+	tests := []struct {
+		number   string
+		wantRule string
+	}{
+		{"79927398713", ""},
+		{"7", RuleOrderLength},
+		{strings.Repeat("0", MaxOrderNumberLength) + "0", RuleOrderLength},
+		{"7992739871x", RuleOrderDigits},
+		{" 79927398713", RuleOrderDigits},
+		{"0000", RuleOrderZero},
+		{"79927398710", RuleOrderChecksum},
+	}
+	for _, tt := range tests {
+		err := CheckOrderNumber(tt.number)
+		rule := ""
+		if err != nil {
+			rule = err.(*OrderNumberError).Rule
+		}
+		if rule != tt.wantRule {
+			t.Errorf("CheckOrderNumber(%q) rule = %q, want %q", tt.number, rule, tt.wantRule)
+		}
+	}
+}
+
+func FuzzCheckOrderNumber(f *testing.F) {
+	for _, seed := range []string{
+		"79927398713", "79927398710", "0", "00", "0000000000000000000000000000000000",
+		"0079927398713", " 79927398713", "79927398713\n", "+79927398713", "-79927398713",
+		"7992739871a", "７９９２７３９８７１３", "٧٩٩٢٧٣٩٨٧١٣", "\x00", "",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, number string) {
+		err := CheckOrderNumber(number)
+		if OrderNumber(number) != (err == nil) {
+			t.Fatalf("OrderNumber(%q) disagrees with CheckOrderNumber() = %v", number, err)
+		}
+		if err != nil {
+			if _, ok := err.(*OrderNumberError); !ok {
+				t.Fatalf("CheckOrderNumber(%q) error is %T, want *OrderNumberError", number, err)
+			}
+			return
+		}
+
+		if len(number) < MinOrderNumberLength || len(number) > MaxOrderNumberLength {
+			t.Fatalf("CheckOrderNumber(%q) accepted %d digits", number, len(number))
+		}
+		for i := 0; i < len(number); i++ {
+			if number[i] < '0' || number[i] > '9' {
+				t.Fatalf("CheckOrderNumber(%q) accepted %q", number, number[i])
+			}
+		}
+		if strings.Trim(number, "0") == "" {
+			t.Fatalf("CheckOrderNumber(%q) accepted all zeros", number)
+		}
+		if !referenceLuhn(number) {
+			t.Fatalf("CheckOrderNumber(%q) accepted a bad checksum", number)
+		}
+	})
+}